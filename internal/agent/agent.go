@@ -25,6 +25,7 @@ type Agent struct {
 	UpdatedAt        time.Time          `bson:"updatedAt"json:"updatedAt"` // used for heart beat
 	PublicIPOverride string             `bson:"public_ip_override"json:"public_ip_override"`
 	Version          string             `bson:"version" json:"version"`
+	Online           bool               `bson:"online" json:"online"` // set by the watchdog when the heart beat lapses
 	// pin will be used for "auth" as the password, the ID will stay the same
 }
 
@@ -72,20 +73,20 @@ func UpdateProbeTarget(db *mongo.Database, probeID primitive.ObjectID, newTarget
 	return nil
 }
 
-func (a *Agent) UpdateTimestamp(db *mongo.Database) error {
+func (a *Agent) UpdateTimestamp(ctx context.Context, db *mongo.Database) error {
 	ee := internal.ErrorFormat{Package: "internal.agent", Function: "agent.UpdateTimestamp", Level: log.ErrorLevel, ObjectID: a.ID}
 
 	var filter = bson.D{{"_id", a.ID}}
 
 	update := bson.D{{"$set", bson.D{{"updatedAt", time.Now()}}}}
 
-	_, err := db.Collection("agents").UpdateOne(context.TODO(), filter, update)
+	_, err := db.Collection("agents").UpdateOne(ctx, filter, update)
 	if err != nil {
 		ee.Error = err
 		return ee.ToError()
 	}
 
-	err = a.Get(db)
+	err = a.GetContext(ctx, db)
 	if err != nil {
 		ee.Error = err
 		return ee.ToError()
@@ -124,7 +125,7 @@ func (a *Agent) UpdateTimestamp(db *mongo.Database) error {
 
 			if splitVer[0] >= 1 && splitVer[1] >= 2 && splitVer[2] >= 1 {
 				probe := Probe{Agent: a.ID}
-				pps, err2 := probe.GetAllProbesForAgent(db)
+				pps, err2 := probe.GetAllProbesForAgent(ctx, db)
 				if err2 != nil {
 					ee.Error = err2
 					ee.Message = "unable to get all probes for agent"
@@ -284,18 +285,23 @@ func GeneratePin(max int) string {
 }
 
 func (a *Agent) Get(db *mongo.Database) error {
+	return a.GetContext(context.TODO(), db)
+}
+
+// GetContext is Get running the query with ctx, so it's part of the trace of the caller
+func (a *Agent) GetContext(ctx context.Context, db *mongo.Database) error {
 	ee := internal.ErrorFormat{Package: "internal.agent", Function: "agent.Get", Level: log.ErrorLevel, ObjectID: a.ID}
 
 	var filter = bson.D{{"_id", a.ID}}
 
-	cursor, err := db.Collection("agents").Find(context.TODO(), filter)
+	cursor, err := db.Collection("agents").Find(ctx, filter)
 	if err != nil {
 		ee.Message = "unable to search for agent by id"
 		ee.Error = err
 		return ee.ToError()
 	}
 	var results []bson.D
-	if err = cursor.All(context.TODO(), &results); err != nil {
+	if err = cursor.All(ctx, &results); err != nil {
 		ee.Message = "error cursoring through agents"
 		ee.Error = err
 		return ee.ToError()
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sync"
+	"time"
+)
+
+type cachedAgent struct {
+	agent   *Agent
+	expires time.Time
+}
+
+// AgentCache keeps the agents that report data in memory, for the consumers of the ingestion that need their name & site
+type AgentCache struct {
+	TTL time.Duration
+
+	mu     sync.RWMutex
+	agents map[primitive.ObjectID]cachedAgent
+}
+
+func NewAgentCache(ttl time.Duration) *AgentCache {
+	if ttl <= 0 {
+		ttl = defaultProbeCacheTTL
+	}
+	return &AgentCache{TTL: ttl, agents: make(map[primitive.ObjectID]cachedAgent)}
+}
+
+// Get returns the agent, looking it up when it isn't cached or expired. The agent is shared, it must not be modified.
+func (c *AgentCache) Get(db *mongo.Database, id primitive.ObjectID) (*Agent, error) {
+	c.mu.RLock()
+	cached, ok := c.agents[id]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.agent, nil
+	}
+
+	a := &Agent{ID: id}
+	err := a.Get(db)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.agents[id] = cachedAgent{agent: a, expires: time.Now().Add(c.TTL)}
+	c.mu.Unlock()
+
+	return a, nil
+}
+
+// Prune drops the expired agents
+func (c *AgentCache) Prune() {
+	now := time.Now()
+	c.mu.Lock()
+	for id, cached := range c.agents {
+		if now.After(cached.expires) {
+			delete(c.agents, id)
+		}
+	}
+	c.mu.Unlock()
+}
@@ -0,0 +1,148 @@
+package agent
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"nw-guardian/internal"
+	"time"
+)
+
+type AgentEventType string
+
+const (
+	AgentEvent_ONLINE  AgentEventType = "ONLINE"
+	AgentEvent_OFFLINE AgentEventType = "OFFLINE"
+)
+
+// AgentEvent records an online / offline transition of an agent
+type AgentEvent struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Agent     primitive.ObjectID `json:"agent" bson:"agent"`
+	Site      primitive.ObjectID `json:"site" bson:"site"`
+	Type      AgentEventType     `json:"type" bson:"type"`
+	LastSeen  time.Time          `json:"lastSeen" bson:"lastSeen"` // heart beat of the agent at the time of the transition
+	Timestamp time.Time          `json:"timestamp" bson:"timestamp"`
+}
+
+func (ae *AgentEvent) Create(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "agent_events.Create", ObjectID: ae.Agent}
+
+	ae.ID = primitive.NewObjectID()
+	if (ae.Timestamp == time.Time{}) {
+		ae.Timestamp = time.Now()
+	}
+
+	_, err := db.Collection("agent_events").InsertOne(context.TODO(), ae)
+	if err != nil {
+		ee.Message = "error inserting agent event"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// GetAgentEvents returns the latest transitions of the agent, newest first
+func GetAgentEvents(db *mongo.Database, agentID primitive.ObjectID, limit int64) ([]AgentEvent, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "agent_events.GetAgentEvents", ObjectID: agentID}
+
+	opts := options.Find().SetSort(bson.M{"timestamp": -1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := db.Collection("agent_events").Find(context.TODO(), bson.M{"agent": agentID}, opts)
+	if err != nil {
+		ee.Message = "unable to find agent events"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var events []AgentEvent
+	if err = cursor.All(context.TODO(), &events); err != nil {
+		ee.Message = "unable to decode agent events"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return events, nil
+}
+
+// SetOnline updates the online status of the agent and records the transition
+func (a *Agent) SetOnline(db *mongo.Database, online bool) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "agent_events.SetOnline", ObjectID: a.ID}
+
+	_, err := db.Collection("agents").UpdateOne(context.TODO(), bson.M{"_id": a.ID}, bson.M{"$set": bson.M{"online": online}})
+	if err != nil {
+		ee.Message = "unable to update agent online status"
+		ee.Error = err
+		return ee.ToError()
+	}
+	a.Online = online
+
+	event := AgentEvent{Agent: a.ID, Site: a.Site, Type: AgentEvent_OFFLINE, LastSeen: a.UpdatedAt}
+	if online {
+		event.Type = AgentEvent_ONLINE
+	}
+
+	return event.Create(db)
+}
+
+// GetInitializedAgents returns every initialized agent
+func GetInitializedAgents(db *mongo.Database) ([]Agent, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "agent_events.GetInitializedAgents"}
+
+	cursor, err := db.Collection("agents").Find(context.TODO(), bson.M{"initialized": true})
+	if err != nil {
+		ee.Message = "unable to find agents"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var agents []Agent
+	if err = cursor.All(context.TODO(), &agents); err != nil {
+		ee.Message = "unable to decode agents"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return agents, nil
+}
+
+// GetAgentsByHeartbeat returns initialized agents that are marked (or not yet marked) with the provided
+// online status, and whose heart beat is either before or after the cutoff
+func GetAgentsByHeartbeat(db *mongo.Database, online bool, before bool, cutoff time.Time) ([]Agent, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "agent_events.GetAgentsByHeartbeat"}
+
+	updatedAt := bson.M{"$gte": cutoff}
+	if before {
+		updatedAt = bson.M{"$lt": cutoff}
+	}
+
+	// agents created before the status existed don't have the field, so match on $ne
+	filter := bson.M{
+		"initialized": true,
+		"online":      bson.M{"$ne": !online},
+		"updatedAt":   updatedAt,
+	}
+
+	cursor, err := db.Collection("agents").Find(context.TODO(), filter)
+	if err != nil {
+		ee.Message = "unable to find agents"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var agents []Agent
+	if err = cursor.All(context.TODO(), &agents); err != nil {
+		ee.Message = "unable to decode agents"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return agents, nil
+}
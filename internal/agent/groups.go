@@ -74,6 +74,25 @@ func (c *Group) GetAll(db *mongo.Database) ([]*Group, error) {
 	return agentCheck, nil
 }
 
+// GetGroupIDsForAgent returns the ids of the groups the agent is a part of
+func GetGroupIDsForAgent(db *mongo.Database, agentID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	cursor, err := db.Collection("agent_groups").Find(context.TODO(), bson.M{"agents": agentID})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []Group
+	if err = cursor.All(context.TODO(), &groups); err != nil {
+		return nil, err
+	}
+
+	var ids []primitive.ObjectID
+	for _, g := range groups {
+		ids = append(ids, g.ID)
+	}
+	return ids, nil
+}
+
 /**
 
 By default, agents are not apart of groups. These will likely be used to automagically select targets of agents.
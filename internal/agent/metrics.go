@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricKeys lists every metric that can be extracted from parsed probe data,
+// these are the names alert rules (and anything else consuming probe data) use
+// to reference a value. Durations are always reported in milliseconds.
+var MetricKeys = []string{
+	"PingResult.PacketLoss",
+	"PingResult.PacketsSent",
+	"PingResult.PacketsRecv",
+	"PingResult.MinRtt",
+	"PingResult.AvgRtt",
+	"PingResult.MaxRtt",
+	"PingResult.StdDevRtt",
+	"MtrResult.HopCount",
+	"MtrResult.FinalHopLoss",
+	"MtrResult.FinalHopAvg",
+	"MtrResult.FinalHopWorst",
+	"MtrResult.MaxHopLoss",
+	"TrafficSimClientStats.AverageRTT",
+	"TrafficSimClientStats.MinRTT",
+	"TrafficSimClientStats.MaxRTT",
+	"TrafficSimClientStats.StdDevRTT",
+	"TrafficSimClientStats.P95RTT",
+	"TrafficSimClientStats.LossPercentage",
+	"TrafficSimClientStats.LostPackets",
+	"TrafficSimClientStats.OutOfSequence",
+	"TrafficSimClientStats.DuplicatePackets",
+	"RPerfResults.PacketsLost",
+	"RPerfResults.PacketLoss",
+	"RPerfResults.JitterAverage",
+	"RPerfResults.PacketsOutOfOrder",
+	"RPerfResults.Throughput",
+	"SpeedTestResult.DLSpeed",
+	"SpeedTestResult.ULSpeed",
+	"SpeedTestResult.Latency",
+	"SpeedTestResult.Jitter",
+	"CompleteSystemInfo.MemoryUsedPct",
+	"CompleteSystemInfo.MemoryAvailable",
+}
+
+// IsMetricKey reports if the provided key is a known metric
+func IsMetricKey(key string) bool {
+	for _, k := range MetricKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics flattens the parsed data of the probe data into named numeric values,
+// the data needs to have been parsed first (eg. by Create), raw bson documents return nil
+func (pd *ProbeData) Metrics() map[string]float64 {
+	switch d := pd.Data.(type) {
+	case PingResult:
+		return d.Metrics()
+	case MtrResult:
+		return d.Metrics()
+	case TrafficSimClientStats:
+		return d.Metrics()
+	case RPerfResults:
+		return d.Metrics()
+	case SpeedTestResult:
+		return d.Metrics()
+	case CompleteSystemInfo:
+		return d.Metrics()
+	default:
+		return nil
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (p PingResult) Metrics() map[string]float64 {
+	return map[string]float64{
+		"PingResult.PacketLoss":  p.PacketLoss,
+		"PingResult.PacketsSent": float64(p.PacketsSent),
+		"PingResult.PacketsRecv": float64(p.PacketsRecv),
+		"PingResult.MinRtt":      durationMs(p.MinRtt),
+		"PingResult.AvgRtt":      durationMs(p.AvgRtt),
+		"PingResult.MaxRtt":      durationMs(p.MaxRtt),
+		"PingResult.StdDevRtt":   durationMs(p.StdDevRtt),
+	}
+}
+
+// parseMtrValue parses the string values reported by mtr (eg. "12.5" or "0.0%")
+func parseMtrValue(s string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%")), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func (m MtrResult) Metrics() map[string]float64 {
+	metrics := map[string]float64{
+		"MtrResult.HopCount": float64(len(m.Report.Hops)),
+	}
+
+	if len(m.Report.Hops) == 0 {
+		return metrics
+	}
+
+	var maxLoss float64
+	for _, hop := range m.Report.Hops {
+		loss := parseMtrValue(hop.LossPct)
+		if loss > maxLoss {
+			maxLoss = loss
+		}
+	}
+
+	final := m.Report.Hops[len(m.Report.Hops)-1]
+	metrics["MtrResult.FinalHopLoss"] = parseMtrValue(final.LossPct)
+	metrics["MtrResult.FinalHopAvg"] = parseMtrValue(final.Avg)
+	metrics["MtrResult.FinalHopWorst"] = parseMtrValue(final.Worst)
+	metrics["MtrResult.MaxHopLoss"] = maxLoss
+
+	return metrics
+}
+
+// LossHop is a hop of an mtr path that lost packets, the address is empty if the hop didn't respond
+type LossHop struct {
+	TTL      int
+	IP       string
+	Hostname string
+	Loss     float64
+}
+
+// LastLossHop returns the furthest hop of the path that lost packets, ok is false when none did
+func (m MtrResult) LastLossHop() (hop LossHop, ok bool) {
+	for _, h := range m.Report.Hops {
+		loss := parseMtrValue(h.LossPct)
+		if loss <= 0 {
+			continue
+		}
+
+		hop, ok = LossHop{TTL: h.TTL, Loss: loss}, true
+		if len(h.Hosts) > 0 {
+			hop.IP = h.Hosts[0].IP
+			hop.Hostname = h.Hosts[0].Hostname
+		}
+	}
+	return hop, ok
+}
+
+func (t TrafficSimClientStats) Metrics() map[string]float64 {
+	metrics := map[string]float64{
+		"TrafficSimClientStats.AverageRTT":       t.AverageRTT,
+		"TrafficSimClientStats.MinRTT":           float64(t.MinRTT),
+		"TrafficSimClientStats.MaxRTT":           float64(t.MaxRTT),
+		"TrafficSimClientStats.StdDevRTT":        t.StdDevRTT,
+		"TrafficSimClientStats.LossPercentage":   float64(t.LossPercentage),
+		"TrafficSimClientStats.LostPackets":      float64(t.LostPackets),
+		"TrafficSimClientStats.OutOfSequence":    float64(t.OutOfSequence),
+		"TrafficSimClientStats.DuplicatePackets": float64(t.DuplicatePackets),
+	}
+
+	// worst p95 across all the flows in the report
+	var p95 int
+	for _, flow := range t.Flows {
+		if flow.RttStats.P95 > p95 {
+			p95 = flow.RttStats.P95
+		}
+	}
+	if len(t.Flows) > 0 {
+		metrics["TrafficSimClientStats.P95RTT"] = float64(p95)
+	}
+
+	return metrics
+}
+
+func (r RPerfResults) Metrics() map[string]float64 {
+	metrics := map[string]float64{
+		"RPerfResults.PacketsLost":       float64(r.Summary.PacketsLost),
+		"RPerfResults.JitterAverage":     r.Summary.JitterAverage * 1000,
+		"RPerfResults.PacketsOutOfOrder": float64(r.Summary.PacketsOutOfOrder),
+	}
+
+	if r.Summary.PacketsSent > 0 {
+		metrics["RPerfResults.PacketLoss"] = float64(r.Summary.PacketsLost) / float64(r.Summary.PacketsSent) * 100
+	}
+	if r.Summary.DurationReceive > 0 {
+		// bits per second
+		metrics["RPerfResults.Throughput"] = float64(r.Summary.BytesReceived) * 8 / r.Summary.DurationReceive
+	}
+
+	return metrics
+}
+
+func (s SpeedTestResult) Metrics() map[string]float64 {
+	if len(s.TestData) == 0 {
+		return nil
+	}
+
+	// speedtests only ever run against the single best server
+	server := s.TestData[0]
+	return map[string]float64{
+		"SpeedTestResult.DLSpeed": float64(server.DLSpeed),
+		"SpeedTestResult.ULSpeed": float64(server.ULSpeed),
+		"SpeedTestResult.Latency": durationMs(server.Latency),
+		"SpeedTestResult.Jitter":  durationMs(server.Jitter),
+	}
+}
+
+func (c CompleteSystemInfo) Metrics() map[string]float64 {
+	if c.MemoryInfo.Total == 0 {
+		return nil
+	}
+
+	return map[string]float64{
+		"CompleteSystemInfo.MemoryUsedPct":   float64(c.MemoryInfo.Used) / float64(c.MemoryInfo.Total) * 100,
+		"CompleteSystemInfo.MemoryAvailable": float64(c.MemoryInfo.Available),
+	}
+}
@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"nw-guardian/internal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RouteHop is a single TTL of a traceroute path, hops that didn't respond have no hosts
+type RouteHop struct {
+	TTL   int      `json:"ttl" bson:"ttl"`
+	Hosts []string `json:"hosts" bson:"hosts"` // sorted, more than one when the path is load balanced
+}
+
+// RouteVersion is a distinct path seen for a probe & target, a new version is recorded every time the path changes
+type RouteVersion struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Probe       primitive.ObjectID `json:"probe" bson:"probe"`
+	Target      ProbeTarget        `json:"target" bson:"target"`
+	Version     int                `json:"version" bson:"version"`
+	Fingerprint string             `json:"fingerprint" bson:"fingerprint"`
+	Hops        []RouteHop         `json:"hops" bson:"hops"`
+	ProbeData   primitive.ObjectID `json:"probeData" bson:"probeData"` // first probe data with the path
+	Samples     int64              `json:"samples" bson:"samples"`
+	FirstSeen   time.Time          `json:"firstSeen" bson:"firstSeen"`
+	LastSeen    time.Time          `json:"lastSeen" bson:"lastSeen"`
+}
+
+type HopChange string
+
+const (
+	HopChange_SAME    HopChange = "SAME"
+	HopChange_CHANGED HopChange = "CHANGED"
+	HopChange_ADDED   HopChange = "ADDED"
+	HopChange_REMOVED HopChange = "REMOVED"
+)
+
+// HopDiff compares the hosts of a TTL between two versions of a path
+type HopDiff struct {
+	TTL      int       `json:"ttl"`
+	Change   HopChange `json:"change"`
+	Previous []string  `json:"previous,omitempty"`
+	Current  []string  `json:"current,omitempty"`
+}
+
+// RouteChange is the move from one version of a path to the next
+type RouteChange struct {
+	Timestamp time.Time     `json:"timestamp"`
+	From      *RouteVersion `json:"from,omitempty"` // unset for the first path seen
+	To        RouteVersion  `json:"to"`
+	Diff      []HopDiff     `json:"diff"`
+}
+
+// Path returns the hops of the report ordered by TTL, trailing hops that didn't respond are dropped
+// as the amount mtr reports varies between runs when the target doesn't answer
+func (m MtrResult) Path() []RouteHop {
+	var hops []RouteHop
+	for _, hop := range m.Report.Hops {
+		h := RouteHop{TTL: hop.TTL, Hosts: []string{}}
+		for _, host := range hop.Hosts {
+			ip := strings.TrimSpace(host.IP)
+			if ip != "" {
+				h.Hosts = append(h.Hosts, ip)
+			}
+		}
+		sort.Strings(h.Hosts)
+		hops = append(hops, h)
+	}
+
+	sort.SliceStable(hops, func(i, j int) bool {
+		return hops[i].TTL < hops[j].TTL
+	})
+
+	for len(hops) > 0 && len(hops[len(hops)-1].Hosts) == 0 {
+		hops = hops[:len(hops)-1]
+	}
+
+	return hops
+}
+
+// RouteFingerprint hashes the ordered hop hosts of a path
+func RouteFingerprint(hops []RouteHop) string {
+	var sb strings.Builder
+	for _, hop := range hops {
+		sb.WriteString(strconv.Itoa(hop.TTL))
+		sb.WriteString(":")
+		if len(hop.Hosts) == 0 {
+			sb.WriteString("*")
+		}
+		sb.WriteString(strings.Join(hop.Hosts, ","))
+		sb.WriteString("|")
+	}
+
+	sum := sha1.Sum([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// DiffRoutes compares two paths hop by hop
+func DiffRoutes(previous []RouteHop, current []RouteHop) []HopDiff {
+	prev := make(map[int][]string)
+	cur := make(map[int][]string)
+	var ttls []int
+
+	for _, hop := range previous {
+		prev[hop.TTL] = hop.Hosts
+		ttls = append(ttls, hop.TTL)
+	}
+	for _, hop := range current {
+		cur[hop.TTL] = hop.Hosts
+		if _, ok := prev[hop.TTL]; !ok {
+			ttls = append(ttls, hop.TTL)
+		}
+	}
+	sort.Ints(ttls)
+
+	var diff []HopDiff
+	for _, ttl := range ttls {
+		p, inPrev := prev[ttl]
+		c, inCur := cur[ttl]
+
+		d := HopDiff{TTL: ttl, Previous: p, Current: c}
+		switch {
+		case !inPrev:
+			d.Change = HopChange_ADDED
+		case !inCur:
+			d.Change = HopChange_REMOVED
+		case strings.Join(p, ",") != strings.Join(c, ","):
+			d.Change = HopChange_CHANGED
+		default:
+			d.Change = HopChange_SAME
+		}
+		diff = append(diff, d)
+	}
+
+	return diff
+}
+
+func latestRouteVersion(db *mongo.Database, probe primitive.ObjectID, target ProbeTarget) (*RouteVersion, error) {
+	filter := bson.M{
+		"probe":         probe,
+		"target.target": target.Target,
+		"target.agent":  target.Agent,
+	}
+
+	var latest RouteVersion
+	err := db.Collection("mtr_routes").FindOne(context.TODO(), filter, options.FindOne().SetSort(bson.M{"version": -1})).Decode(&latest)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &latest, nil
+}
+
+// TrackRoute records the path of mtr probe data, creating a new route version when it differs from the
+// previous one. The version the path belongs to is returned, along with whether the path changed.
+func TrackRoute(db *mongo.Database, pd *ProbeData) (*RouteVersion, bool, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "mtr_routes.TrackRoute", ObjectID: pd.ProbeID}
+
+	mtr, ok := pd.Data.(MtrResult)
+	if !ok {
+		return nil, false, nil
+	}
+
+	hops := mtr.Path()
+	if len(hops) == 0 {
+		return nil, false, nil
+	}
+	fingerprint := RouteFingerprint(hops)
+
+	seen := pd.CreatedAt
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+
+	latest, err := latestRouteVersion(db, pd.ProbeID, pd.Target)
+	if err != nil {
+		ee.Message = "unable to get latest route version"
+		ee.Error = err
+		return nil, false, ee.ToError()
+	}
+
+	if latest != nil && latest.Fingerprint == fingerprint {
+		_, err = db.Collection("mtr_routes").UpdateOne(context.TODO(), bson.M{"_id": latest.ID},
+			bson.M{"$set": bson.M{"lastSeen": seen}, "$inc": bson.M{"samples": 1}})
+		if err != nil {
+			ee.Message = "unable to update route version"
+			ee.Error = err
+			return nil, false, ee.ToError()
+		}
+		latest.LastSeen = seen
+		latest.Samples++
+		return latest, false, nil
+	}
+
+	version := RouteVersion{
+		ID:          primitive.NewObjectID(),
+		Probe:       pd.ProbeID,
+		Target:      pd.Target,
+		Version:     1,
+		Fingerprint: fingerprint,
+		Hops:        hops,
+		ProbeData:   pd.ID,
+		Samples:     1,
+		FirstSeen:   seen,
+		LastSeen:    seen,
+	}
+	if latest != nil {
+		version.Version = latest.Version + 1
+	}
+
+	_, err = db.Collection("mtr_routes").InsertOne(context.TODO(), version)
+	if err != nil {
+		ee.Message = "unable to insert route version"
+		ee.Error = err
+		return nil, false, ee.ToError()
+	}
+
+	return &version, latest != nil, nil
+}
+
+// GetRouteVersions returns the route versions of a probe, newest first. The target is optional.
+func GetRouteVersions(db *mongo.Database, probe primitive.ObjectID, target string, limit int64) ([]RouteVersion, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "mtr_routes.GetRouteVersions", ObjectID: probe}
+
+	filter := bson.M{"probe": probe}
+	if target != "" {
+		filter["target.target"] = target
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "firstSeen", Value: -1}, {Key: "version", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := db.Collection("mtr_routes").Find(context.TODO(), filter, opts)
+	if err != nil {
+		ee.Message = "unable to find route versions"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var versions []RouteVersion
+	if err = cursor.All(context.TODO(), &versions); err != nil {
+		ee.Message = "unable to decode route versions"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return versions, nil
+}
+
+// GetRouteChanges returns the path changes of a probe over time, newest first, with the hop by hop
+// diff against the version it replaced
+func GetRouteChanges(db *mongo.Database, probe primitive.ObjectID, target string, limit int64) ([]RouteChange, error) {
+	// one extra version is needed to diff the oldest change returned
+	fetch := limit
+	if fetch > 0 {
+		fetch++
+	}
+
+	versions, err := GetRouteVersions(db, probe, target, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	// versions are per target, so the previous version is looked up by target
+	type targetKey struct {
+		agent  primitive.ObjectID
+		target string
+	}
+	byTarget := make(map[targetKey][]RouteVersion)
+	for _, v := range versions {
+		k := targetKey{v.Target.Agent, v.Target.Target}
+		byTarget[k] = append(byTarget[k], v)
+	}
+
+	var changes []RouteChange
+	for _, v := range versions {
+		k := targetKey{v.Target.Agent, v.Target.Target}
+		list := byTarget[k]
+
+		var prev *RouteVersion
+		for i := range list {
+			if list[i].Version == v.Version-1 {
+				prev = &list[i]
+				break
+			}
+		}
+
+		if prev == nil && v.Version > 1 {
+			// the previous version fell outside of the limit
+			continue
+		}
+
+		change := RouteChange{Timestamp: v.FirstSeen, From: prev, To: v}
+		if prev != nil {
+			change.Diff = DiffRoutes(prev.Hops, v.Hops)
+		} else {
+			change.Diff = DiffRoutes(nil, v.Hops)
+		}
+		changes = append(changes, change)
+	}
+
+	if limit > 0 && int64(len(changes)) > limit {
+		changes = changes[:limit]
+	}
+
+	return changes, nil
+}
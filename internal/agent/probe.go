@@ -73,12 +73,87 @@ type ProbeTarget struct {
 }
 
 type ProbeAlert struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
 	Agent     primitive.ObjectID `json:"agent,omitempty" bson:"agent" bson:"agent"`
+	Site      primitive.ObjectID `json:"site" bson:"site"`
+	Signal    AlertSignal        `json:"signal" bson:"signal"`
+	Severity  AlertSeverity      `json:"severity" bson:"severity"`
+	Rule      primitive.ObjectID `json:"rule,omitempty" bson:"rule"` // alert rule that fired
+	Target    ProbeTarget        `json:"target" bson:"target"`
+	Metric    string             `json:"metric" bson:"metric"`
+	Value     float64            `json:"value" bson:"value"`         // value of the metric that fired the alert
+	Threshold float64            `json:"threshold" bson:"threshold"` // threshold of the rule at the time of firing
+	Message   string             `json:"message" bson:"message"`
 	Timestamp time.Time          `json:"timestamp" bson:"timestamp"`
 	Probe     Probe              `bson:"probe" json:"probe"`
 	ProbeData ProbeData          `json:"probe_data" bson:"probeData"`
+
+	Status         AlertStatus        `json:"status" bson:"status"`
+	AcknowledgedBy primitive.ObjectID `json:"acknowledgedBy,omitempty" bson:"acknowledgedBy,omitempty"` // user that acknowledged the alert
+	AcknowledgedAt time.Time          `json:"acknowledgedAt,omitempty" bson:"acknowledgedAt,omitempty"`
+	ResolvedBy     primitive.ObjectID `json:"resolvedBy,omitempty" bson:"resolvedBy,omitempty"` // not set when auto resolved
+	ResolvedAt     time.Time          `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+
+	Policy         primitive.ObjectID `json:"policy,omitempty" bson:"policy,omitempty"` // escalation policy routing the alert
+	EscalationStep int                `json:"escalationStep" bson:"escalationStep"`     // steps of the policy that have been notified
+
+	DedupKey string `json:"dedupKey" bson:"dedupKey"` // shared by the alerts of a probe & target, used as the incident key by pagerduty & opsgenie
+
+	Incident primitive.ObjectID `json:"incident,omitempty" bson:"incident,omitempty"` // correlated incident the alert belongs to
+	Grouped  bool               `json:"grouped" bson:"grouped"`                       // notified through its incident rather than on its own
 }
 
+// AlertSignal is what raised the alert
+type AlertSignal string
+
+const (
+	AlertSignal_THRESHOLD     AlertSignal = "THRESHOLD"
+	AlertSignal_AGENT_OFFLINE AlertSignal = "AGENT_OFFLINE"
+	AlertSignal_ANOMALY       AlertSignal = "ANOMALY"
+)
+
+// AlertSeverity ranks alerts, chat channels filter on it
+type AlertSeverity string
+
+const (
+	AlertSeverity_INFO     AlertSeverity = "INFO"
+	AlertSeverity_WARNING  AlertSeverity = "WARNING"
+	AlertSeverity_CRITICAL AlertSeverity = "CRITICAL"
+)
+
+// Rank orders the severities, alerts created before severities existed are critical
+func (s AlertSeverity) Rank() int {
+	switch s {
+	case AlertSeverity_INFO:
+		return 0
+	case AlertSeverity_WARNING:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// ValidSeverity reports if the severity is known, empty is allowed and defaults to critical
+func ValidSeverity(s AlertSeverity) bool {
+	switch s {
+	case "", AlertSeverity_INFO, AlertSeverity_WARNING, AlertSeverity_CRITICAL:
+		return true
+	}
+	return false
+}
+
+type AlertStatus string
+
+const (
+	AlertStatus_FIRING       AlertStatus = "FIRING"
+	AlertStatus_ACKNOWLEDGED AlertStatus = "ACKNOWLEDGED"
+	AlertStatus_FLAPPING     AlertStatus = "FLAPPING" // oscillating around the threshold, notifications are held
+	AlertStatus_RESOLVED     AlertStatus = "RESOLVED"
+)
+
+// OpenAlertStatuses are the statuses of alerts that haven't been resolved
+var OpenAlertStatuses = []AlertStatus{AlertStatus_FIRING, AlertStatus_ACKNOWLEDGED, AlertStatus_FLAPPING}
+
 func DeleteProbesByAgentID(db *mongo.Database, agentID primitive.ObjectID) error {
 	// todo if probe is deleted, delete associated data
 	// todo if agent is delete, delete all probes, and data
@@ -137,6 +212,9 @@ type ProbeDataRequest struct {
 	EndTimestamp   time.Time `json:"endTimestamp"`
 	Recent         bool      `json:"recent"`
 	Option         string    `json:"option"`
+	Cursor         string    `json:"cursor"`   // nextCursor of the previous page
+	Order          string    `json:"order"`    // asc or desc (default), by measurement time
+	Paginate       bool      `json:"paginate"` // return the data with the cursor of the next page
 }
 
 func (probe *Probe) FindSimilarProbes(db *mongo.Database) ([]*Probe, error) {
@@ -339,7 +417,8 @@ func (probe *Probe) GetAll(db *mongo.Database) ([]*Probe, error) {
 	return agentCheck, nil
 }
 
-func (probe *Probe) GetAllProbesForAgent(db *mongo.Database) ([]*Probe, error) {
+// GetAllProbesForAgent runs the probe queries with ctx, the targets of the probes are still resolved without it
+func (probe *Probe) GetAllProbesForAgent(ctx context.Context, db *mongo.Database) ([]*Probe, error) {
 	ee := internal.ErrorFormat{
 		Package:  "internal.agent",
 		Level:    log.ErrorLevel,
@@ -354,7 +433,7 @@ func (probe *Probe) GetAllProbesForAgent(db *mongo.Database) ([]*Probe, error) {
 	}
 
 	// Execute database query
-	cursor, err := db.Collection("probes").Find(context.TODO(), filter)
+	cursor, err := db.Collection("probes").Find(ctx, filter)
 	if err != nil {
 		ee.Error = err
 		ee.Message = "unable to get probes for agent"
@@ -362,7 +441,7 @@ func (probe *Probe) GetAllProbesForAgent(db *mongo.Database) ([]*Probe, error) {
 	}
 
 	var results []bson.D
-	if err = cursor.All(context.TODO(), &results); err != nil {
+	if err = cursor.All(ctx, &results); err != nil {
 		ee.Error = err
 		ee.Message = "error retrieving cursor results"
 		return nil, ee.ToError()
@@ -380,7 +459,7 @@ func (probe *Probe) GetAllProbesForAgent(db *mongo.Database) ([]*Probe, error) {
 	}
 
 	// NEW: Find reverse probes - where other agents have AGENT probes targeting this agent
-	reverseProbes, err := probe.findReverseProbes(db)
+	reverseProbes, err := probe.findReverseProbes(ctx, db)
 	if err != nil {
 		log.WithError(err).Error("Failed to find reverse probes")
 		// Don't fail the entire operation, just log the error
@@ -393,7 +472,7 @@ func (probe *Probe) GetAllProbesForAgent(db *mongo.Database) ([]*Probe, error) {
 
 // findReverseProbes finds all AGENT probes from other agents that target this agent
 // and generates reverse probe entries for bidirectional visibility
-func (p *Probe) findReverseProbes(db *mongo.Database) ([]*Probe, error) {
+func (p *Probe) findReverseProbes(ctx context.Context, db *mongo.Database) ([]*Probe, error) {
 	ee := internal.ErrorFormat{
 		Package:  "internal.agent",
 		Level:    log.ErrorLevel,
@@ -408,7 +487,7 @@ func (p *Probe) findReverseProbes(db *mongo.Database) ([]*Probe, error) {
 		{"agent", bson.M{"$ne": p.Agent}}, // Exclude self-targeting probes
 	}
 
-	cursor, err := db.Collection("probes").Find(context.TODO(), filter)
+	cursor, err := db.Collection("probes").Find(ctx, filter)
 	if err != nil {
 		ee.Error = err
 		ee.Message = "unable to find reverse AGENT probes"
@@ -416,7 +495,7 @@ func (p *Probe) findReverseProbes(db *mongo.Database) ([]*Probe, error) {
 	}
 
 	var sourceProbes []Probe
-	if err := cursor.All(context.TODO(), &sourceProbes); err != nil {
+	if err := cursor.All(ctx, &sourceProbes); err != nil {
 		ee.Error = err
 		ee.Message = "unable to decode reverse AGENT probes"
 		return nil, ee.ToError()
@@ -544,9 +623,9 @@ func (p *Probe) createReverseTrafficSimProbe(sourceProbe *Probe, sourceAgent Age
 			if probe.Config.Target == nil {
 				jM, err := json.Marshal(probe)
 				if err != nil {
-					log.Error("error marshal target agent conf (%s) - %s ", err, string(jM))
+					log.Errorf("error marshal target agent conf (%s) - %s ", err, string(jM))
 				}
-				log.Warn("12 Failed to get target from server - %s", string(jM))
+				log.Warnf("12 Failed to get target from server - %s", string(jM))
 
 				continue
 			}
@@ -576,9 +655,9 @@ func (p *Probe) createReverseTrafficSimProbe(sourceProbe *Probe, sourceAgent Age
 
 				jM, err := json.Marshal(probe)
 				if err != nil {
-					log.Error("error marshal target agent conf (%s) - %s ", err, string(jM))
+					log.Errorf("error marshal target agent conf (%s) - %s ", err, string(jM))
 				}
-				log.Warn("Failed to get target from server - %s", string(jM))
+				log.Warnf("Failed to get target from server - %s", string(jM))
 
 				continue
 			}
@@ -835,9 +914,9 @@ func (p *Probe) createTrafficSimFakeProbe(originalProbe *Probe, target ProbeTarg
 
 				jM, err := json.Marshal(agentProbe)
 				if err != nil {
-					log.Error("error marshal target agent conf (%s) - %s ", err, string(jM))
+					log.Errorf("error marshal target agent conf (%s) - %s ", err, string(jM))
 				}
-				log.Warn("11 Failed to get target from server - %s", string(jM))
+				log.Warnf("11 Failed to get target from server - %s", string(jM))
 
 				continue
 			}
@@ -984,6 +1063,34 @@ func (p *Probe) extractNetResult(data interface{}) (NetResult, error) {
 	}
 }
 
+// GetAgentNetInfo returns the most recent network info reported by the agent, nil when it hasn't reported any
+func GetAgentNetInfo(db *mongo.Database, agentID primitive.ObjectID) (*NetResult, error) {
+	networkProbe := Probe{Agent: agentID, Type: ProbeType_NETWORKINFO}
+	probes, err := networkProbe.Get(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(probes) == 0 {
+		return nil, nil
+	}
+
+	probes[0].Agent = primitive.ObjectID{}
+	data, err := probes[0].GetData(&ProbeDataRequest{Recent: true, Limit: 1}, db)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+
+	if netResult, ok := data[len(data)-1].Data.(NetResult); ok {
+		return &netResult, nil
+	}
+	netResult, err := probes[0].extractNetResult(data[len(data)-1].Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &netResult, nil
+}
+
 // configureRPerfTarget configures the target for RPerf and TrafficSim probes
 func (p *Probe) configureRPerfTarget(probe *Probe, publicIP string, db *mongo.Database) error {
 	// Find the corresponding server probe for this agent
@@ -0,0 +1,478 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"nw-guardian/internal"
+	"time"
+)
+
+// IncidentKey is the stable key identifying incidents of a probe & target in external incident tools,
+// every alert of the same probe & target maps to the same incident
+func IncidentKey(probe primitive.ObjectID, target ProbeTarget) string {
+	sum := sha256.Sum256([]byte(probe.Hex() + "|" + target.Agent.Hex() + "|" + target.Group.Hex() + "|" + target.Target))
+	return "guardian-" + hex.EncodeToString(sum[:16])
+}
+
+func (pa *ProbeAlert) Create(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.Create", ObjectID: pa.Probe.ID}
+
+	if pa.ID.IsZero() {
+		pa.ID = primitive.NewObjectID()
+	}
+	if pa.Status == "" {
+		pa.Status = AlertStatus_FIRING
+	}
+	if pa.Severity == "" {
+		pa.Severity = AlertSeverity_CRITICAL
+	}
+	if (pa.Timestamp == time.Time{}) {
+		pa.Timestamp = time.Now()
+	}
+	if pa.DedupKey == "" {
+		// alerts raised for the agent itself have no probe
+		source := pa.Probe.ID
+		if source == primitive.NilObjectID {
+			source = pa.Agent
+		}
+		pa.DedupKey = IncidentKey(source, pa.Target)
+	}
+
+	mar, err := bson.Marshal(pa)
+	if err != nil {
+		ee.Message = "unable to marshal probe alert"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	var b *bson.D
+	err = bson.Unmarshal(mar, &b)
+	if err != nil {
+		ee.Message = "unable to unmarshal probe alert"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	_, err = db.Collection("probe_alerts").InsertOne(context.TODO(), b)
+	if err != nil {
+		ee.Message = "error inserting probe alert"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (pa *ProbeAlert) Get(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.Get", ObjectID: pa.ID}
+
+	err := db.Collection("probe_alerts").FindOne(context.TODO(), bson.M{"_id": pa.ID}).Decode(pa)
+	if err != nil {
+		ee.Message = "unable to find probe alert"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// Acknowledge moves a firing alert to acknowledged, recording who acknowledged it
+func (pa *ProbeAlert) Acknowledge(db *mongo.Database, user primitive.ObjectID) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.Acknowledge", ObjectID: pa.ID}
+
+	err := pa.Get(db)
+	if err != nil {
+		return err
+	}
+
+	if pa.Status != AlertStatus_FIRING && pa.Status != AlertStatus_FLAPPING {
+		ee.Message = "only firing or flapping alerts can be acknowledged, alert is " + string(pa.Status)
+		return ee.ToError()
+	}
+	previous := pa.Status
+
+	pa.Status = AlertStatus_ACKNOWLEDGED
+	pa.AcknowledgedBy = user
+	pa.AcknowledgedAt = time.Now()
+
+	update := bson.M{"$set": bson.M{
+		"status":         pa.Status,
+		"acknowledgedBy": pa.AcknowledgedBy,
+		"acknowledgedAt": pa.AcknowledgedAt,
+	}}
+
+	res, err := db.Collection("probe_alerts").UpdateOne(context.TODO(), bson.M{"_id": pa.ID, "status": previous}, update)
+	if err != nil {
+		ee.Message = "unable to acknowledge probe alert"
+		ee.Error = err
+		return ee.ToError()
+	}
+	if res.MatchedCount == 0 {
+		// resolved or moved between firing & flapping since it was read
+		ee.Message = "alert is no longer " + string(previous)
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// Resolve resolves an open alert, user is left empty when the alert auto resolves
+func (pa *ProbeAlert) Resolve(db *mongo.Database, user primitive.ObjectID) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.Resolve", ObjectID: pa.ID}
+
+	err := pa.Get(db)
+	if err != nil {
+		return err
+	}
+
+	if pa.Status == AlertStatus_RESOLVED {
+		ee.Message = "alert is already resolved"
+		return ee.ToError()
+	}
+
+	pa.Status = AlertStatus_RESOLVED
+	pa.ResolvedBy = user
+	pa.ResolvedAt = time.Now()
+
+	set := bson.M{
+		"status":     pa.Status,
+		"resolvedAt": pa.ResolvedAt,
+	}
+	if user != primitive.NilObjectID {
+		set["resolvedBy"] = user
+	}
+
+	filter := bson.M{"_id": pa.ID, "status": bson.M{"$ne": AlertStatus_RESOLVED}}
+	res, err := db.Collection("probe_alerts").UpdateOne(context.TODO(), filter, bson.M{"$set": set})
+	if err != nil {
+		ee.Message = "unable to resolve probe alert"
+		ee.Error = err
+		return ee.ToError()
+	}
+	if res.MatchedCount == 0 {
+		// resolved by someone else since it was read
+		ee.Message = "alert is already resolved"
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// SetStatus moves an open alert between the firing and flapping statuses. Acknowledged alerts are left as they
+// are, false is returned when the alert wasn't firing or flapping.
+func (pa *ProbeAlert) SetStatus(db *mongo.Database, status AlertStatus) (bool, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.SetStatus", ObjectID: pa.ID}
+
+	filter := bson.M{"_id": pa.ID, "status": bson.M{"$in": []AlertStatus{AlertStatus_FIRING, AlertStatus_FLAPPING}}}
+	res, err := db.Collection("probe_alerts").UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{"status": status}})
+	if err != nil {
+		ee.Message = "unable to update probe alert status"
+		ee.Error = err
+		return false, ee.ToError()
+	}
+
+	err = pa.Get(db)
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 0 && pa.Status == AlertStatus_RESOLVED {
+		ee.Message = "alert is already resolved"
+		return false, ee.ToError()
+	}
+
+	return res.MatchedCount > 0, nil
+}
+
+// SetPolicy assigns the escalation policy that routes the notifications of the alert
+func (pa *ProbeAlert) SetPolicy(db *mongo.Database, policy primitive.ObjectID) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.SetPolicy", ObjectID: pa.ID}
+
+	_, err := db.Collection("probe_alerts").UpdateOne(context.TODO(), bson.M{"_id": pa.ID}, bson.M{"$set": bson.M{"policy": policy, "escalationStep": 0}})
+	if err != nil {
+		ee.Message = "unable to set escalation policy of probe alert"
+		ee.Error = err
+		return ee.ToError()
+	}
+	pa.Policy = policy
+	pa.EscalationStep = 0
+
+	return nil
+}
+
+// AdvanceEscalation moves the alert past the escalation step, false is returned when the step was
+// already taken (eg. by another worker) so it is only ever notified once
+func (pa *ProbeAlert) AdvanceEscalation(db *mongo.Database, step int) (bool, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.AdvanceEscalation", ObjectID: pa.ID}
+
+	res, err := db.Collection("probe_alerts").UpdateOne(context.TODO(), bson.M{"_id": pa.ID, "escalationStep": step}, bson.M{"$set": bson.M{"escalationStep": step + 1}})
+	if err != nil {
+		ee.Message = "unable to advance escalation of probe alert"
+		ee.Error = err
+		return false, ee.ToError()
+	}
+	if res.ModifiedCount == 0 {
+		return false, nil
+	}
+	pa.EscalationStep = step + 1
+
+	return true, nil
+}
+
+// GetEscalatingAlerts returns the unacknowledged open alerts that are routed by an escalation policy
+func GetEscalatingAlerts(db *mongo.Database) ([]ProbeAlert, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.GetEscalatingAlerts"}
+
+	filter := bson.M{
+		"status": bson.M{"$in": []AlertStatus{AlertStatus_FIRING, AlertStatus_FLAPPING}},
+		"policy": bson.M{"$exists": true},
+	}
+
+	cursor, err := db.Collection("probe_alerts").Find(context.TODO(), filter)
+	if err != nil {
+		ee.Message = "unable to find escalating probe alerts"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var alerts []ProbeAlert
+	if err = cursor.All(context.TODO(), &alerts); err != nil {
+		ee.Message = "unable to decode escalating probe alerts"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return alerts, nil
+}
+
+// FindOpenAlert returns the alert that is still firing or acknowledged for the rule, probe and target.
+// A nil alert is returned if there is none open
+func FindOpenAlert(db *mongo.Database, rule primitive.ObjectID, probe primitive.ObjectID, target ProbeTarget) (*ProbeAlert, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.FindOpenAlert", ObjectID: probe}
+
+	filter := bson.M{
+		"rule":          rule,
+		"probe._id":     probe,
+		"target.target": target.Target,
+		"target.agent":  target.Agent,
+		"status":        bson.M{"$in": OpenAlertStatuses},
+	}
+
+	var alert ProbeAlert
+	err := db.Collection("probe_alerts").FindOne(context.TODO(), filter).Decode(&alert)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		ee.Message = "unable to find open probe alert"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return &alert, nil
+}
+
+// FindOpenMetricAlert returns the open alert raised by a signal without a rule (eg. ANOMALY) for the metric
+// of the probe and target, a nil alert is returned if there is none open
+func FindOpenMetricAlert(db *mongo.Database, signal AlertSignal, probe primitive.ObjectID, target ProbeTarget, metric string) (*ProbeAlert, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.FindOpenMetricAlert", ObjectID: probe}
+
+	filter := bson.M{
+		"signal":        signal,
+		"metric":        metric,
+		"probe._id":     probe,
+		"target.target": target.Target,
+		"target.agent":  target.Agent,
+		"status":        bson.M{"$in": OpenAlertStatuses},
+	}
+
+	var alert ProbeAlert
+	err := db.Collection("probe_alerts").FindOne(context.TODO(), filter).Decode(&alert)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		ee.Message = "unable to find open probe alert"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return &alert, nil
+}
+
+// FindOpenAgentAlert returns the open alert raised for the agent itself by the signal (eg. AGENT_OFFLINE),
+// a nil alert is returned if there is none open
+func FindOpenAgentAlert(db *mongo.Database, agentID primitive.ObjectID, signal AlertSignal) (*ProbeAlert, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.FindOpenAgentAlert", ObjectID: agentID}
+
+	filter := bson.M{
+		"agent":  agentID,
+		"signal": signal,
+		"status": bson.M{"$in": OpenAlertStatuses},
+	}
+
+	var alert ProbeAlert
+	err := db.Collection("probe_alerts").FindOne(context.TODO(), filter).Decode(&alert)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		ee.Message = "unable to find open agent alert"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return &alert, nil
+}
+
+// AlertFilter narrows down the alerts returned when listing them
+type AlertFilter struct {
+	Status []AlertStatus      `json:"status"`
+	Probe  primitive.ObjectID `json:"probe"`
+	Agent  primitive.ObjectID `json:"agent"`
+	Limit  int64              `json:"limit"`
+}
+
+// GetAlerts lists alerts for a site, newest first
+func GetAlerts(db *mongo.Database, site primitive.ObjectID, f AlertFilter) ([]ProbeAlert, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.GetAlerts", ObjectID: site}
+
+	filter := bson.M{}
+	if site != primitive.NilObjectID {
+		filter["site"] = site
+	}
+	if f.Agent != primitive.NilObjectID {
+		filter["agent"] = f.Agent
+	}
+	if f.Probe != primitive.NilObjectID {
+		filter["probe._id"] = f.Probe
+	}
+	if len(f.Status) > 0 {
+		filter["status"] = bson.M{"$in": f.Status}
+	}
+
+	opts := options.Find().SetSort(bson.M{"timestamp": -1})
+	if f.Limit > 0 {
+		opts.SetLimit(f.Limit)
+	}
+
+	cursor, err := db.Collection("probe_alerts").Find(context.TODO(), filter, opts)
+	if err != nil {
+		ee.Message = "unable to find probe alerts"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var alerts []ProbeAlert
+	if err = cursor.All(context.TODO(), &alerts); err != nil {
+		ee.Message = "unable to decode probe alerts"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return alerts, nil
+}
+
+// GetOpenAlertsByDedupKey returns the open alerts of the site sharing the dedup key
+func GetOpenAlertsByDedupKey(db *mongo.Database, site primitive.ObjectID, key string) ([]ProbeAlert, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.GetOpenAlertsByDedupKey", ObjectID: site}
+
+	filter := bson.M{
+		"site":     site,
+		"dedupKey": key,
+		"status":   bson.M{"$in": OpenAlertStatuses},
+	}
+
+	cursor, err := db.Collection("probe_alerts").Find(context.TODO(), filter)
+	if err != nil {
+		ee.Message = "unable to find alerts by dedup key"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var alerts []ProbeAlert
+	if err = cursor.All(context.TODO(), &alerts); err != nil {
+		ee.Message = "unable to decode alerts"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return alerts, nil
+}
+
+// SetIncident attaches the alert to a correlated incident
+func (pa *ProbeAlert) SetIncident(db *mongo.Database, incident primitive.ObjectID, grouped bool) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.SetIncident", ObjectID: pa.ID}
+
+	_, err := db.Collection("probe_alerts").UpdateOne(context.TODO(), bson.M{"_id": pa.ID}, bson.M{"$set": bson.M{"incident": incident, "grouped": grouped}})
+	if err != nil {
+		ee.Message = "unable to set incident of probe alert"
+		ee.Error = err
+		return ee.ToError()
+	}
+	pa.Incident = incident
+	pa.Grouped = grouped
+
+	return nil
+}
+
+func findAlerts(db *mongo.Database, filter bson.M, opts *options.FindOptions) ([]ProbeAlert, error) {
+	cursor, err := db.Collection("probe_alerts").Find(context.TODO(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts []ProbeAlert
+	if err = cursor.All(context.TODO(), &alerts); err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
+
+// GetIncidentAlerts returns the alerts of a correlated incident, oldest first
+func GetIncidentAlerts(db *mongo.Database, incident primitive.ObjectID, openOnly bool) ([]ProbeAlert, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.GetIncidentAlerts", ObjectID: incident}
+
+	filter := bson.M{"incident": incident}
+	if openOnly {
+		filter["status"] = bson.M{"$in": OpenAlertStatuses}
+	}
+
+	alerts, err := findAlerts(db, filter, options.Find().SetSort(bson.M{"timestamp": 1}))
+	if err != nil {
+		ee.Message = "unable to find incident alerts"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return alerts, nil
+}
+
+// GetUncorrelatedAlerts returns the firing alerts of the site raised since the time by other agents
+// that don't belong to an incident yet
+func GetUncorrelatedAlerts(db *mongo.Database, site primitive.ObjectID, since time.Time, excludeAgent primitive.ObjectID) ([]ProbeAlert, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_alert.GetUncorrelatedAlerts", ObjectID: site}
+
+	filter := bson.M{
+		"site":      site,
+		"agent":     bson.M{"$ne": excludeAgent},
+		"status":    bson.M{"$in": []AlertStatus{AlertStatus_FIRING, AlertStatus_FLAPPING}},
+		"timestamp": bson.M{"$gte": since},
+		"incident":  bson.M{"$exists": false},
+	}
+
+	alerts, err := findAlerts(db, filter, options.Find().SetSort(bson.M{"timestamp": 1}))
+	if err != nil {
+		ee.Message = "unable to find uncorrelated alerts"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return alerts, nil
+}
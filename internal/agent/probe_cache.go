@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sync"
+	"time"
+)
+
+// ErrProbeNotFound is returned for data of probes that don't exist
+var ErrProbeNotFound = errors.New("no matching probe found")
+
+// defaultProbeCacheTTL is how long a probe is served from the cache, edits to a probe reach the ingestion within it
+const defaultProbeCacheTTL = 30 * time.Second
+
+type cachedProbe struct {
+	probe   *Probe
+	expires time.Time
+}
+
+// ProbeCache keeps the probes that report data in memory so ingesting their data doesn't look them up every time
+type ProbeCache struct {
+	TTL time.Duration
+
+	mu     sync.RWMutex
+	probes map[primitive.ObjectID]cachedProbe
+}
+
+func NewProbeCache(ttl time.Duration) *ProbeCache {
+	if ttl <= 0 {
+		ttl = defaultProbeCacheTTL
+	}
+	return &ProbeCache{TTL: ttl, probes: make(map[primitive.ObjectID]cachedProbe)}
+}
+
+// Get returns the probe, looking it up when it isn't cached or expired. The probe is shared, it must not be modified.
+func (c *ProbeCache) Get(db *mongo.Database, id primitive.ObjectID) (*Probe, error) {
+	c.mu.RLock()
+	cached, ok := c.probes[id]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.probe, nil
+	}
+
+	p := Probe{ID: id}
+	probes, err := p.Get(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(probes) == 0 {
+		return nil, ErrProbeNotFound
+	}
+
+	c.mu.Lock()
+	c.probes[id] = cachedProbe{probe: probes[0], expires: time.Now().Add(c.TTL)}
+	c.mu.Unlock()
+
+	return probes[0], nil
+}
+
+// Invalidate drops the probe from the cache
+func (c *ProbeCache) Invalidate(id primitive.ObjectID) {
+	c.mu.Lock()
+	delete(c.probes, id)
+	c.mu.Unlock()
+}
+
+// Prune drops the expired probes, deleted probes would otherwise stay in the cache
+func (c *ProbeCache) Prune() {
+	now := time.Now()
+	c.mu.Lock()
+	for id, cached := range c.probes {
+		if now.After(cached.expires) {
+			delete(c.probes, id)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// Len returns the amount of cached probes
+func (c *ProbeCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.probes)
+}
@@ -2,7 +2,6 @@ package agent
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -24,17 +23,66 @@ storing the agent probe types will be more complicated
 */
 
 type ProbeData struct {
-	ID        primitive.ObjectID `json:"id" bson:"_id"`
-	ProbeID   primitive.ObjectID `json:"probe" bson:"probe"`
-	Triggered bool               `json:"triggered" bson:"triggered"`
-	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
-	UpdatedAt time.Time          `bson:"updatedAt" json:"updatedAt"`
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	ProbeID     primitive.ObjectID `json:"probe" bson:"probe"`
+	Triggered   bool               `json:"triggered" bson:"triggered"`
+	Maintenance bool               `json:"maintenance" bson:"maintenance"` // collected during a maintenance window, excluded from alerting
+	Anomalous   bool               `json:"anomalous" bson:"anomalous"`     // deviates from the baseline of the probe
+	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt   time.Time          `bson:"updatedAt" json:"updatedAt"`
 	/*
 		when we are storing agent probe data we will use the agent as the one reporting,
 		and the target will be the targeted agent / host
 	*/
 	Target ProbeTarget `bson:"target" json:"target"`
 	Data   interface{} `json:"data,omitempty" bson:"data,omitempty"`
+
+	Timestamp time.Time     `bson:"timestamp" json:"timestamp"` // when the data was measured, the time field of the collection
+	Meta      ProbeDataMeta `bson:"meta" json:"-"`              // the meta field of the collection
+}
+
+// ProbeDataMeta identifies the series the probe data belongs to, measurements sharing it are bucketed together
+type ProbeDataMeta struct {
+	Probe  primitive.ObjectID `bson:"probe"`
+	Agent  primitive.ObjectID `bson:"agent"` // agent of the probe
+	Type   ProbeType          `bson:"type"`  // type of the data, the actual type for AGENT probes
+	Target ProbeTarget        `bson:"target"`
+}
+
+// probeDataType returns the type of the data reported for the probe, AGENT probes prefix the target with it
+func probeDataType(t ProbeType, target string) ProbeType {
+	if t == ProbeType_AGENT {
+		parts := strings.Split(target, "%%%")
+		if len(parts) >= 1 {
+			return ProbeType(parts[0])
+		}
+	}
+	return t
+}
+
+// measuredAt returns the time reported in the data, falling back to when it was received
+func (pd *ProbeData) measuredAt() time.Time {
+	var t time.Time
+	switch d := pd.Data.(type) {
+	case PingResult:
+		t = d.StopTimestamp
+	case MtrResult:
+		t = d.StopTimestamp
+	case RPerfResults:
+		t = d.StopTimestamp
+	case TrafficSimClientStats:
+		t = d.ReportTime
+	case NetResult:
+		t = d.Timestamp
+	case SpeedTestResult:
+		t = d.Timestamp
+	case CompleteSystemInfo:
+		t = d.Timestamp
+	}
+	if t.IsZero() {
+		return pd.CreatedAt
+	}
+	return t
 }
 
 func DeleteProbeDataByProbeID(db *mongo.Database, probeID primitive.ObjectID) error {
@@ -42,7 +90,7 @@ func DeleteProbeDataByProbeID(db *mongo.Database, probeID primitive.ObjectID) er
 
 	// Convert the string ID to an ObjectID
 	// Create a filter to match the document by ID
-	filter := bson.M{"probe": probeID}
+	filter := bson.M{"meta.probe": probeID}
 
 	// Perform the deletion
 	_, err := db.Collection("probe_data").DeleteMany(context.TODO(), filter)
@@ -59,8 +107,6 @@ func (pd *ProbeData) Create(db *mongo.Database) error {
 	// todo handle to check if agent id is set and all that... or should it be in the api section??
 	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data.Create", ObjectID: pd.ProbeID}
 
-	pd.ID = primitive.NewObjectID()
-
 	pp := Probe{ID: pd.ProbeID}
 	pp2, err := pp.Get(db)
 	if err != nil {
@@ -70,13 +116,11 @@ func (pd *ProbeData) Create(db *mongo.Database) error {
 	}
 
 	if len(pp2) < 1 {
-		log.Printf("pp: %v", pp)
-		log.Printf("pp2: %v", pp2)
 		return errors.New("no matching probe found")
 	}
 
 	a := Agent{ID: pp2[0].Agent}
-	err = a.UpdateTimestamp(db)
+	err = a.UpdateTimestamp(context.TODO(), db)
 	if err != nil {
 		ee.Message = "couldnt update timestamp on agent"
 		ee.Error = err
@@ -84,34 +128,15 @@ func (pd *ProbeData) Create(db *mongo.Database) error {
 		ee.Print()
 	}
 
-	// load types
-
-	pd.Data, _ = pd.parse(db)
-
-	if (pd.CreatedAt == time.Time{}) {
-		pd.CreatedAt = time.Now()
-		// don't return??!??
-		ee.Message = "timestamp not included in probe data"
-		ee.Error = err
-		ee.Level = log.WarnLevel
-		ee.Print()
-	}
-
-	mar, err := bson.Marshal(pd)
+	err = pd.Decode(pp2[0])
 	if err != nil {
-		ee.Message = "unable to marshal"
+		ee.Message = "invalid probe data"
 		ee.Error = err
 		return ee.ToError()
 	}
+	pd.Prepare(db, pp2[0])
 
-	var b *bson.D
-	err = bson.Unmarshal(mar, &b)
-	if err != nil {
-		ee.Message = "unable to unmarshal"
-		ee.Error = err
-		return ee.ToError()
-	}
-	_, err = db.Collection("probe_data").InsertOne(context.TODO(), b)
+	_, err = db.Collection("probe_data").InsertOne(context.TODO(), pd)
 	if err != nil {
 		ee.Message = "error inserting doc"
 		ee.Error = err
@@ -120,83 +145,71 @@ func (pd *ProbeData) Create(db *mongo.Database) error {
 	return nil
 }
 
-func (pd *ProbeData) parse(db *mongo.Database) (interface{}, error) {
-	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.WarnLevel, Function: "probe_data.parse", ObjectID: pd.ProbeID}
+// Prepare sets the fields derived from the decoded data of the probe it was reported by, ready to be inserted
+func (pd *ProbeData) Prepare(db *mongo.Database, probe *Probe) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.WarnLevel, Function: "probe_data.Prepare", ObjectID: pd.ProbeID}
 
-	pp := Probe{ID: pd.ProbeID}
-	probes, err := pp.Get(db)
-	if err != nil || len(probes) == 0 {
-		ee.Message = "unable to get probe from id or no probes found"
-		ee.Error = err
-		return nil, ee.ToError()
+	pd.ID = primitive.NewObjectID()
+
+	if _, ok := pd.Data.(SpeedTestResult); ok {
+		pp := Probe{ID: pd.ProbeID}
+		_ = pp.UpdateFirstProbeTarget(db, "ok")
 	}
 
-	probe := probes[0]
-	probeType := probe.Type
+	if (pd.CreatedAt == time.Time{}) {
+		pd.CreatedAt = time.Now()
+		ee.Message = "timestamp not included in probe data"
+		ee.Print()
+	}
 
-	// If it's an AGENT type, try parsing actual type from ProbeTarget
-	if probeType == ProbeType_AGENT {
-		parts := strings.Split(pd.Target.Target, "%%%")
-		if len(parts) >= 1 {
-			probeType = ProbeType(parts[0])
-		}
+	pd.Timestamp = pd.measuredAt()
+	pd.Meta = ProbeDataMeta{
+		Probe:  pd.ProbeID,
+		Agent:  probe.Agent,
+		Type:   probeDataType(probe.Type, pd.Target.Target),
+		Target: pd.Target,
 	}
+}
 
-	jsonData, err := json.Marshal(pd.Data)
-	if err != nil {
-		ee.Message = "cannot marshal"
-		ee.Error = err
-		return nil, ee.ToError()
+// InsertProbeData inserts prepared probe data in one round trip and returns the data that was stored,
+// the rest of the batch is still inserted when some of it fails
+func InsertProbeData(ctx context.Context, db *mongo.Database, data []*ProbeData) ([]*ProbeData, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data.InsertProbeData"}
+
+	if len(data) == 0 {
+		return nil, nil
 	}
 
-	switch probeType {
-	case ProbeType_TRAFFICSIM:
-		var stats TrafficSimClientStats
-		err = json.Unmarshal(jsonData, &stats)
-		return stats, err
-
-	case ProbeType_RPERF:
-		var rperf RPerfResults
-		err = json.Unmarshal(jsonData, &rperf)
-		return rperf, err
-
-	case ProbeType_MTR:
-		var mtr MtrResult
-		err = json.Unmarshal(jsonData, &mtr)
-		return mtr, err
-
-	case ProbeType_NETWORKINFO:
-		var netinfo NetResult
-		err = json.Unmarshal(jsonData, &netinfo)
-		return netinfo, err
-
-	case ProbeType_PING:
-		var ping PingResult
-		err = json.Unmarshal(jsonData, &ping)
-		return ping, err
-
-	case ProbeType_SPEEDTEST:
-		var result SpeedTestResult
-		err = json.Unmarshal(jsonData, &result)
-		if err == nil {
-			_ = pp.UpdateFirstProbeTarget(db, "ok")
-		}
-		return result, err
+	docs := make([]interface{}, 0, len(data))
+	for _, pd := range data {
+		docs = append(docs, pd)
+	}
 
-	case ProbeType_SPEEDTEST_SERVERS:
-		var servers []SpeedTestServer
-		err = json.Unmarshal(jsonData, &servers)
-		return servers, err
+	_, err := db.Collection("probe_data").InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return data, nil
+	}
 
-	case ProbeType_SYSTEMINFO:
-		var sysinfo CompleteSystemInfo
-		err = json.Unmarshal(jsonData, &sysinfo)
-		return sysinfo, err
+	ee.Message = fmt.Sprintf("error inserting %d docs", len(docs))
+	ee.Error = err
 
-	default:
-		ee.Message = fmt.Sprintf("unsupported probe type: %s", probeType)
+	bwe, ok := err.(mongo.BulkWriteException)
+	if !ok || bwe.WriteConcernError != nil {
 		return nil, ee.ToError()
 	}
+
+	failed := make(map[int]bool)
+	for _, we := range bwe.WriteErrors {
+		failed[we.Index] = true
+	}
+	stored := make([]*ProbeData, 0, len(data))
+	for i, pd := range data {
+		if !failed[i] {
+			stored = append(stored, pd)
+		}
+	}
+
+	return stored, ee.ToError()
 }
 
 // GroupedProbeData represents probe data grouped by reporting agent, target agent, and type
@@ -217,6 +230,9 @@ type AgentGroupedData struct {
 
 	// Summary information
 	Summary GroupingSummary `json:"summary"`
+
+	// cursor of the next page, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
 }
 
 // GroupingSummary provides summary statistics
@@ -243,31 +259,29 @@ func (probe *Probe) GetAgentProbeDataGrouped(req *ProbeDataRequest, db *mongo.Da
 
 	// Build base filter
 	filter := bson.M{
-		"probe": probe.ID,
+		"meta.probe": probe.ID,
 	}
 
 	// Add agent filter if specified
 	if probe.Agent != primitive.NilObjectID {
-		filter["agent"] = probe.Agent
+		filter["meta.agent"] = probe.Agent
 	}
 
-	// For time filtering, we'll need to handle different timestamp fields
-	// We'll use a general approach and let MongoDB handle non-existent fields
 	if !req.Recent {
-		timeFilter := bson.M{
-			"$or": []bson.M{
-				{"data.stop_timestamp": bson.M{"$gt": req.StartTimestamp, "$lt": req.EndTimestamp}},
-				{"data.timestamp": bson.M{"$gt": req.StartTimestamp, "$lt": req.EndTimestamp}},
-				{"data.reportTime": bson.M{"$gt": req.StartTimestamp, "$lt": req.EndTimestamp}},
-			},
-		}
-		filter["$and"] = []bson.M{timeFilter}
+		filter["timestamp"] = bson.M{"$gt": req.StartTimestamp, "$lt": req.EndTimestamp}
 	}
 
-	// Set query options - we'll sort by _id descending as a general approach
+	sort, err := req.page(filter)
+	if err != nil {
+		ee.Message = "invalid page"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	// Set query options
 	opts := options.Find().
 		SetLimit(req.Limit).
-		SetSort(bson.D{{"_id", -1}})
+		SetSort(sort)
 
 	// Execute query
 	cursor, err := db.Collection("probe_data").Find(context.TODO(), filter, opts)
@@ -302,6 +316,7 @@ func (probe *Probe) GetAgentProbeDataGrouped(req *ProbeDataRequest, db *mongo.Da
 		ee.Error = err
 		return nil, ee.ToError()
 	}
+	result.NextCursor = req.nextCursor(probeDataList)
 
 	// Group the data
 	for _, data := range probeDataList {
@@ -359,7 +374,8 @@ func (probe *Probe) GetAgentProbeDataGrouped(req *ProbeDataRequest, db *mongo.Da
 		result.Summary.ProbeTypes = append(result.Summary.ProbeTypes, probeType)
 	}
 
-	if result.Summary.TotalDataPoints == 0 {
+	// paging past the last data returns an empty page
+	if result.Summary.TotalDataPoints == 0 && req.Cursor == "" {
 		ee.Error = errors.New("no data found for this probe")
 		return nil, ee.ToError()
 	}
@@ -390,10 +406,14 @@ func (probe *Probe) GetAgentProbeDataFlat(req *ProbeDataRequest, db *mongo.Datab
 		return nil, err
 	}
 
-	// Flatten the nested structure
+	return groupedData.Flat(), nil
+}
+
+// Flat flattens the nested groups
+func (g *AgentGroupedData) Flat() []GroupedProbeData {
 	var flatData []GroupedProbeData
 
-	for reportingAgentHex, targetMap := range groupedData.Groups {
+	for reportingAgentHex, targetMap := range g.Groups {
 		reportingAgent, _ := primitive.ObjectIDFromHex(reportingAgentHex)
 
 		for targetAgentHex, typeMap := range targetMap {
@@ -410,19 +430,7 @@ func (probe *Probe) GetAgentProbeDataFlat(req *ProbeDataRequest, db *mongo.Datab
 		}
 	}
 
-	return flatData, nil
-}
-
-// Helper function to get timestamp field based on probe type
-func getTimestampField(probeType string) string {
-	switch probeType {
-	case "NETWORKINFO", "NETINFO", "SPEEDTEST", "SYSTEMINFO", "SYSINFO":
-		return "data.timestamp"
-	case "TRAFFICSIM":
-		return "data.reportTime"
-	default:
-		return "data.stop_timestamp"
-	}
+	return flatData
 }
 
 // GetProbeTargetPairs extracts all unique reporting-target agent pairs from probe data
@@ -430,7 +438,7 @@ func GetProbeTargetPairs(probeID primitive.ObjectID, db *mongo.Database) ([]Agen
 	pipeline := []bson.M{
 		{
 			"$match": bson.M{
-				"probe": probeID,
+				"meta.probe": probeID,
 			},
 		},
 		{
@@ -467,7 +475,7 @@ func GetProbeTargetPairs(probeID primitive.ObjectID, db *mongo.Database) ([]Agen
 // GetProbeTypesFromData extracts all unique probe types from probe data
 func GetProbeTypesFromData(probeID primitive.ObjectID, db *mongo.Database) ([]string, error) {
 	// First get sample documents to extract probe types
-	filter := bson.M{"probe": probeID}
+	filter := bson.M{"meta.probe": probeID}
 	opts := options.Find().SetLimit(100) // Sample size
 
 	cursor, err := db.Collection("probe_data").Find(context.TODO(), filter, opts)
@@ -513,10 +521,14 @@ func (probe *Probe) GetAgentProbeData(req *ProbeDataRequest, db *mongo.Database)
 		return nil, err
 	}
 
-	// Convert to simple map format if needed
+	return groupedData.ByType(), nil
+}
+
+// ByType merges the groups into a map of probe type -> data
+func (g *AgentGroupedData) ByType() map[string][]ProbeData {
 	result := make(map[string][]ProbeData)
 
-	for _, targetMap := range groupedData.Groups {
+	for _, targetMap := range g.Groups {
 		for _, typeMap := range targetMap {
 			for probeType, dataList := range typeMap {
 				if existing, ok := result[probeType]; ok {
@@ -528,7 +540,7 @@ func (probe *Probe) GetAgentProbeData(req *ProbeDataRequest, db *mongo.Database)
 		}
 	}
 
-	return result, nil
+	return result
 }
 
 // Example routes:
@@ -564,41 +576,51 @@ tempRoutes = append(tempRoutes, &Route{
 // it will require the type to be sent in check, otherwise
 // the check id will be used
 func (probe *Probe) GetData(req *ProbeDataRequest, db *mongo.Database) ([]ProbeData, error) {
-	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data.GetData"}
+	page, err := probe.GetDataPage(req, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.Data) == 0 {
+		ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data.GetData", ObjectID: probe.ID}
+		ee.Error = errors.New("no data matches the provided check id")
+		return nil, ee.ToError()
+	}
+
+	return page.Data, nil
+}
+
+// GetDataPage returns a page of the probe data along with the cursor of the next page, paging past the
+// last data returns an empty page
+func (probe *Probe) GetDataPage(req *ProbeDataRequest, db *mongo.Database) (*ProbeDataPage, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data.GetDataPage"}
 
 	opts := options.Find().SetLimit(req.Limit)
 
 	// Combined filter
-	var combinedFilter = bson.M{"probe": probe.ID}
+	var combinedFilter = bson.M{"meta.probe": probe.ID}
 	if probe.Agent != (primitive.ObjectID{0}) {
-		combinedFilter["agent"] = probe.Agent
+		combinedFilter["meta.agent"] = probe.Agent
 		//combinedFilter["type"] = c.Type
 		ee.ObjectID = probe.Agent
 	}
 
-	var timestampField = "data.stop_timestamp"
-
-	if probe.Type == ProbeType_NETWORKINFO || probe.Type == ProbeType_SPEEDTEST || probe.Type == ProbeType_SYSTEMINFO {
-		timestampField = "data.timestamp"
-	} else if probe.Type == ProbeType_TRAFFICSIM {
-		timestampField = "data.reportTime"
-	}
-
+	// every probe type stores when it was measured in the normalized timestamp
 	if !req.Recent {
-		opts.SetSort(bson.D{{timestampField, -1}})
-		timeFilter := bson.M{
-			timestampField: bson.M{
-				"$gt": req.StartTimestamp,
-				"$lt": req.EndTimestamp,
-			},
-		}
-		for k, v := range timeFilter {
-			combinedFilter[k] = v
+		combinedFilter["timestamp"] = bson.M{
+			"$gt": req.StartTimestamp,
+			"$lt": req.EndTimestamp,
 		}
-	} else {
-		opts = opts.SetSort(bson.D{{timestampField, -1}})
 	}
 
+	sort, err := req.page(combinedFilter)
+	if err != nil {
+		ee.Message = "invalid page"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+	opts.SetSort(sort)
+
 	cursor, err := db.Collection("probe_data").Find(context.TODO(), combinedFilter, opts)
 	if err != nil {
 		ee.Message = "cannot find probed data"
@@ -613,12 +635,7 @@ func (probe *Probe) GetData(req *ProbeDataRequest, db *mongo.Database) ([]ProbeD
 		return nil, ee.ToError()
 	}
 
-	if len(results) == 0 {
-		ee.Error = errors.New("no data matches the provided check id")
-		return nil, ee.ToError()
-	}
-
-	var checkData []ProbeData
+	checkData := make([]ProbeData, 0, len(results))
 
 	for _, r := range results {
 		var cData ProbeData
@@ -637,7 +654,7 @@ func (probe *Probe) GetData(req *ProbeDataRequest, db *mongo.Database) ([]ProbeD
 		checkData = append(checkData, cData)
 	}
 
-	return checkData, nil
+	return &ProbeDataPage{Data: checkData, NextCursor: req.nextCursor(checkData)}, nil
 }
 
 /*type MtrResult struct {
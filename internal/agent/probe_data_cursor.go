@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"encoding/base64"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProbeDataOrder_DESC = "desc"
+	ProbeDataOrder_ASC  = "asc"
+)
+
+// ProbeDataPage is a page of probe data, NextCursor is empty on the last page
+type ProbeDataPage struct {
+	Data       []ProbeData `json:"data"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// AgentProbeDataFlatPage is a page of the flat format of AGENT probe data
+type AgentProbeDataFlatPage struct {
+	Data       []GroupedProbeData `json:"data"`
+	NextCursor string             `json:"nextCursor,omitempty"`
+}
+
+// AgentProbeDataSimplePage is a page of the simple format (type -> data) of AGENT probe data
+type AgentProbeDataSimplePage struct {
+	Data       map[string][]ProbeData `json:"data"`
+	NextCursor string                 `json:"nextCursor,omitempty"`
+}
+
+// probeDataCursor is the position after the last probe data of a page, probe data measured at the
+// same time is ordered by id
+type probeDataCursor struct {
+	Timestamp time.Time
+	ID        primitive.ObjectID
+}
+
+// encodeProbeDataCursor returns the opaque cursor of the page ending with the probe data
+func encodeProbeDataCursor(pd ProbeData) string {
+	raw := strconv.FormatInt(pd.Timestamp.UnixMilli(), 10) + ":" + pd.ID.Hex()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeProbeDataCursor(cursor string) (probeDataCursor, error) {
+	var c probeDataCursor
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return c, errors.New("invalid cursor")
+	}
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	c.ID, err = primitive.ObjectIDFromHex(parts[1])
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	c.Timestamp = time.UnixMilli(ms)
+
+	return c, nil
+}
+
+// page adds the cursor of the request to the filter and returns the sort of its order
+func (req *ProbeDataRequest) page(filter bson.M) (bson.D, error) {
+	dir := -1
+	op := "$lt"
+	switch strings.ToLower(req.Order) {
+	case "", ProbeDataOrder_DESC:
+	case ProbeDataOrder_ASC:
+		dir = 1
+		op = "$gt"
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+
+	if req.Cursor != "" {
+		c, err := decodeProbeDataCursor(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after := bson.M{"$or": []bson.M{
+			{"timestamp": bson.M{op: c.Timestamp}},
+			{"timestamp": c.Timestamp, "_id": bson.M{op: c.ID}},
+		}}
+		if and, ok := filter["$and"].([]bson.M); ok {
+			filter["$and"] = append(and, after)
+		} else {
+			filter["$and"] = []bson.M{after}
+		}
+	}
+
+	return bson.D{{Key: "timestamp", Value: dir}, {Key: "_id", Value: dir}}, nil
+}
+
+// nextCursor returns the cursor of the page following the results, empty when the results didn't fill the page
+func (req *ProbeDataRequest) nextCursor(results []ProbeData) string {
+	if req.Limit <= 0 || int64(len(results)) < req.Limit {
+		return ""
+	}
+	return encodeProbeDataCursor(results[len(results)-1])
+}
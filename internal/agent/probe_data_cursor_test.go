@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"encoding/base64"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestProbeDataCursor(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	tests := []struct {
+		name      string
+		timestamp time.Time
+	}{
+		{"now", time.Now()},
+		{"epoch", time.UnixMilli(0)},
+		{"before epoch", time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC)},
+		{"sub millisecond", time.Date(2024, 1, 1, 0, 0, 0, 123456789, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		cursor := encodeProbeDataCursor(ProbeData{ID: id, Timestamp: tt.timestamp})
+
+		c, err := decodeProbeDataCursor(cursor)
+		if err != nil {
+			t.Errorf("%s: decode(%q) error = %v", tt.name, cursor, err)
+			continue
+		}
+		if c.ID != id {
+			t.Errorf("%s: id = %s, want %s", tt.name, c.ID.Hex(), id.Hex())
+		}
+		if want := tt.timestamp.Truncate(time.Millisecond); !c.Timestamp.Equal(want) {
+			t.Errorf("%s: timestamp = %s, want %s", tt.name, c.Timestamp, want)
+		}
+	}
+}
+
+func TestDecodeProbeDataCursorInvalid(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "***"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("1:" + primitive.NewObjectID().Hex()))},
+		{"no separator", encode("1700000000000")},
+		{"bad timestamp", encode("abc:" + primitive.NewObjectID().Hex())},
+		{"bad id", encode("1700000000000:xyz")},
+		{"empty id", encode("1700000000000:")},
+	}
+
+	for _, tt := range tests {
+		if _, err := decodeProbeDataCursor(tt.cursor); err == nil {
+			t.Errorf("%s: decode(%q) succeeded, want an error", tt.name, tt.cursor)
+		}
+	}
+}
+
+func TestProbeDataRequestPage(t *testing.T) {
+	cursor := encodeProbeDataCursor(ProbeData{ID: primitive.NewObjectID(), Timestamp: time.Now()})
+
+	tests := []struct {
+		name    string
+		req     ProbeDataRequest
+		dir     int
+		op      string // comparison added for the cursor, empty when none
+		wantErr bool
+	}{
+		{"default", ProbeDataRequest{}, -1, "", false},
+		{"asc", ProbeDataRequest{Order: "ASC"}, 1, "", false},
+		{"desc cursor", ProbeDataRequest{Cursor: cursor}, -1, "$lt", false},
+		{"asc cursor", ProbeDataRequest{Order: "asc", Cursor: cursor}, 1, "$gt", false},
+		{"bad order", ProbeDataRequest{Order: "up"}, 0, "", true},
+		{"bad cursor", ProbeDataRequest{Cursor: "***"}, 0, "", true},
+	}
+
+	for _, tt := range tests {
+		filter := bson.M{"meta.probe": primitive.NewObjectID()}
+		sort, err := tt.req.page(filter)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+
+		if sort[0].Value != tt.dir || sort[1].Value != tt.dir {
+			t.Errorf("%s: sort = %v, want direction %d", tt.name, sort, tt.dir)
+		}
+
+		and, ok := filter["$and"].([]bson.M)
+		if tt.op == "" {
+			if ok {
+				t.Errorf("%s: cursor filter added without a cursor", tt.name)
+			}
+			continue
+		}
+		if !ok || len(and) != 1 {
+			t.Errorf("%s: filter = %v, want the cursor in $and", tt.name, filter)
+			continue
+		}
+		or := and[0]["$or"].([]bson.M)
+		if _, ok := or[0]["timestamp"].(bson.M)[tt.op]; !ok {
+			t.Errorf("%s: cursor filter = %v, want %s", tt.name, or, tt.op)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package agent
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"nw-guardian/internal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ExportFormat string
+
+const (
+	ExportFormat_CSV    ExportFormat = "csv"
+	ExportFormat_NDJSON ExportFormat = "ndjson"
+)
+
+// exportBatchSize is how many documents are fetched from the cursor at once, and written between flushes
+const exportBatchSize = 500
+
+// ProbeDataExport selects the probe data of a probe, agent or workspace to export, one of them is required
+type ProbeDataExport struct {
+	Probe  primitive.ObjectID
+	Agent  primitive.ObjectID
+	Site   primitive.ObjectID
+	From   time.Time
+	To     time.Time
+	Types  []ProbeType // empty exports every type, csv exports require exactly one
+	Format ExportFormat
+}
+
+// Validate checks the export can be written, it is called before anything is sent
+func (e *ProbeDataExport) Validate() error {
+	if e.Probe.IsZero() && e.Agent.IsZero() && e.Site.IsZero() {
+		return errors.New("a probe, agent or workspace is required")
+	}
+	if !e.To.IsZero() && e.To.Before(e.From) {
+		return errors.New("to is before from")
+	}
+
+	switch e.Format {
+	case ExportFormat_NDJSON:
+	case ExportFormat_CSV:
+		if len(e.Types) != 1 {
+			return errors.New("csv exports require a single type")
+		}
+		if _, ok := csvExporters[e.Types[0]]; !ok {
+			return fmt.Errorf("csv exports aren't supported for %s, use ndjson", e.Types[0])
+		}
+	case "parquet", "arrow":
+		// there's no columnar writer in the module, csv converts losslessly (eg. duckdb's COPY ... TO 'x.parquet')
+		return fmt.Errorf("%s exports aren't supported, export csv and convert it", e.Format)
+	default:
+		return fmt.Errorf("unsupported format %q", e.Format)
+	}
+
+	return nil
+}
+
+func (e *ProbeDataExport) filter(db *mongo.Database) (bson.M, error) {
+	filter := bson.M{}
+
+	switch {
+	case !e.Probe.IsZero():
+		filter["meta.probe"] = e.Probe
+	case !e.Agent.IsZero():
+		filter["meta.agent"] = e.Agent
+	default:
+		cursor, err := db.Collection("agents").Find(context.TODO(), bson.M{"site": e.Site}, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return nil, err
+		}
+		var agents []struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err = cursor.All(context.TODO(), &agents); err != nil {
+			return nil, err
+		}
+		ids := make([]primitive.ObjectID, 0, len(agents))
+		for _, a := range agents {
+			ids = append(ids, a.ID)
+		}
+		filter["meta.agent"] = bson.M{"$in": ids}
+	}
+
+	if len(e.Types) > 0 {
+		filter["meta.type"] = bson.M{"$in": e.Types}
+	}
+
+	timestamp := bson.M{"$gte": e.From}
+	if !e.To.IsZero() {
+		timestamp["$lt"] = e.To
+	}
+	filter["timestamp"] = timestamp
+
+	return filter, nil
+}
+
+// decodeExportData decodes the stored data into the result type of the probe data
+func decodeExportData(t ProbeType, raw bson.RawValue) (interface{}, error) {
+	var v interface{}
+	switch t {
+	case ProbeType_PING:
+		v = &PingResult{}
+	case ProbeType_MTR:
+		v = &MtrResult{}
+	case ProbeType_RPERF:
+		v = &RPerfResults{}
+	case ProbeType_TRAFFICSIM:
+		v = &TrafficSimClientStats{}
+	case ProbeType_NETWORKINFO:
+		v = &NetResult{}
+	case ProbeType_SPEEDTEST:
+		v = &SpeedTestResult{}
+	case ProbeType_SPEEDTEST_SERVERS:
+		v = &[]SpeedTestServer{}
+	case ProbeType_SYSTEMINFO:
+		v = &CompleteSystemInfo{}
+	default:
+		var d bson.D
+		err := raw.Unmarshal(&d)
+		return d, err
+	}
+	err := raw.Unmarshal(v)
+	return v, err
+}
+
+// exportRecord is a line of a ndjson export
+type exportRecord struct {
+	ID        primitive.ObjectID `json:"id"`
+	Timestamp time.Time          `json:"timestamp"`
+	Probe     primitive.ObjectID `json:"probe"`
+	Agent     primitive.ObjectID `json:"agent"`
+	Type      ProbeType          `json:"type"`
+	Target    ProbeTarget        `json:"target"`
+	Data      interface{}        `json:"data"`
+}
+
+// Write streams the probe data to w from a cursor, oldest first, without holding it in memory.
+// w is flushed every exportBatchSize records when it implements Flush().
+func (e *ProbeDataExport) Write(db *mongo.Database, w io.Writer) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data_export.Write"}
+
+	if err := e.Validate(); err != nil {
+		ee.Message = "invalid export"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	filter, err := e.filter(db)
+	if err != nil {
+		ee.Message = "unable to find agents of workspace"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+		SetBatchSize(exportBatchSize)
+
+	cursor, err := db.Collection("probe_data").Find(context.TODO(), filter, opts)
+	if err != nil {
+		ee.Message = "cannot find probe data"
+		ee.Error = err
+		return ee.ToError()
+	}
+	defer cursor.Close(context.TODO())
+
+	flush := func() error { return nil }
+	if f, ok := w.(interface{ Flush() }); ok {
+		flush = func() error { f.Flush(); return nil }
+	}
+
+	var encode func(pd *ProbeData, data interface{}) error
+	switch e.Format {
+	case ExportFormat_CSV:
+		exporter := csvExporters[e.Types[0]]
+		cw := csv.NewWriter(w)
+		if err = cw.Write(append(csvCommonHeader, exporter.header...)); err != nil {
+			ee.Message = "unable to write export"
+			ee.Error = err
+			return ee.ToError()
+		}
+		encode = func(pd *ProbeData, data interface{}) error {
+			for _, row := range exporter.rows(data) {
+				if err := cw.Write(append(csvCommon(pd), row...)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		inner := flush
+		flush = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			return inner()
+		}
+	default:
+		enc := json.NewEncoder(w)
+		encode = func(pd *ProbeData, data interface{}) error {
+			return enc.Encode(exportRecord{
+				ID:        pd.ID,
+				Timestamp: pd.Timestamp,
+				Probe:     pd.Meta.Probe,
+				Agent:     pd.Meta.Agent,
+				Type:      pd.Meta.Type,
+				Target:    pd.Target,
+				Data:      data,
+			})
+		}
+	}
+
+	written := 0
+	for cursor.Next(context.TODO()) {
+		var pd ProbeData
+		if err = bson.Unmarshal(cursor.Current, &pd); err != nil {
+			ee.Message = "error unmarshalling probe data"
+			ee.Error = err
+			return ee.ToError()
+		}
+
+		data, err := decodeExportData(pd.Meta.Type, cursor.Current.Lookup("data"))
+		if err != nil {
+			// a single malformed document shouldn't abort a long export
+			log.Warnf("skipping probe data %s of export: %v", pd.ID.Hex(), err)
+			continue
+		}
+
+		if err = encode(&pd, data); err != nil {
+			ee.Message = "unable to write export"
+			ee.Error = err
+			return ee.ToError()
+		}
+
+		written++
+		if written%exportBatchSize == 0 {
+			if err = flush(); err != nil {
+				ee.Message = "unable to write export"
+				ee.Error = err
+				return ee.ToError()
+			}
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		ee.Message = "error cursoring probe data"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	if err = flush(); err != nil {
+		ee.Message = "unable to write export"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+var csvCommonHeader = []string{"timestamp", "id", "probe", "agent", "type", "target", "target_agent"}
+
+func csvCommon(pd *ProbeData) []string {
+	targetAgent := ""
+	if !pd.Target.Agent.IsZero() {
+		targetAgent = pd.Target.Agent.Hex()
+	}
+	return []string{
+		pd.Timestamp.UTC().Format(time.RFC3339Nano),
+		pd.ID.Hex(),
+		pd.Meta.Probe.Hex(),
+		pd.Meta.Agent.Hex(),
+		string(pd.Meta.Type),
+		pd.Target.Target,
+		targetAgent,
+	}
+}
+
+// csvExporter flattens the data of a type into rows, some types have a row per hop or flow
+type csvExporter struct {
+	header []string
+	rows   func(data interface{}) [][]string
+}
+
+var csvExporters = map[ProbeType]csvExporter{
+	ProbeType_PING: {
+		header: []string{"start_timestamp", "stop_timestamp", "addr", "packets_sent", "packets_recv", "packets_recv_duplicates",
+			"packet_loss", "min_rtt_ms", "avg_rtt_ms", "max_rtt_ms", "std_dev_rtt_ms"},
+		rows: func(data interface{}) [][]string {
+			p := data.(*PingResult)
+			return [][]string{{
+				csvTime(p.StartTimestamp), csvTime(p.StopTimestamp), p.Addr,
+				strconv.Itoa(p.PacketsSent), strconv.Itoa(p.PacketsRecv), strconv.Itoa(p.PacketsRecvDuplicates),
+				csvFloat(p.PacketLoss), csvMs(p.MinRtt), csvMs(p.AvgRtt), csvMs(p.MaxRtt), csvMs(p.StdDevRtt),
+			}}
+		},
+	},
+	ProbeType_MTR: {
+		header: []string{"start_timestamp", "stop_timestamp", "destination_ip", "destination_hostname", "ttl", "hop_ips",
+			"hop_hostnames", "loss_pct", "sent", "recv", "last", "avg", "best", "worst", "stddev"},
+		rows: func(data interface{}) [][]string {
+			m := data.(*MtrResult)
+			var rows [][]string
+			for _, hop := range m.Report.Hops {
+				var ips, hostnames []string
+				for _, h := range hop.Hosts {
+					ips = append(ips, h.IP)
+					hostnames = append(hostnames, h.Hostname)
+				}
+				rows = append(rows, []string{
+					csvTime(m.StartTimestamp), csvTime(m.StopTimestamp),
+					m.Report.Info.Target.IP, m.Report.Info.Target.Hostname,
+					strconv.Itoa(hop.TTL), strings.Join(ips, "|"), strings.Join(hostnames, "|"),
+					strings.TrimSuffix(hop.LossPct, "%"), strconv.Itoa(hop.Sent), strconv.Itoa(hop.Recv),
+					hop.Last, hop.Avg, hop.Best, hop.Worst, hop.StdDev,
+				})
+			}
+			return rows
+		},
+	},
+	ProbeType_RPERF: {
+		header: []string{"start_timestamp", "stop_timestamp", "success", "bytes_sent", "bytes_received", "duration_send",
+			"duration_receive", "framed_packet_size", "jitter_average", "jitter_packets_consecutive", "packets_sent",
+			"packets_received", "packets_lost", "packets_duplicated", "packets_out_of_order"},
+		rows: func(data interface{}) [][]string {
+			r := data.(*RPerfResults)
+			s := r.Summary
+			return [][]string{{
+				csvTime(r.StartTimestamp), csvTime(r.StopTimestamp), strconv.FormatBool(r.Success),
+				strconv.Itoa(s.BytesSent), strconv.Itoa(s.BytesReceived), csvFloat(s.DurationSend),
+				csvFloat(s.DurationReceive), strconv.Itoa(s.FramedPacketSize), csvFloat(s.JitterAverage),
+				strconv.Itoa(s.JitterPacketsConsecutive), strconv.Itoa(s.PacketsSent),
+				strconv.Itoa(s.PacketsReceived), strconv.Itoa(s.PacketsLost), strconv.Itoa(s.PacketsDuplicated),
+				strconv.Itoa(s.PacketsOutOfOrder),
+			}}
+		},
+	},
+	ProbeType_TRAFFICSIM: {
+		header: []string{"report_time", "average_rtt", "min_rtt", "max_rtt", "loss_percentage", "lost_packets",
+			"duplicate_packets", "out_of_sequence", "flow", "direction", "duration", "bytes_sent", "bytes_received",
+			"packets_sent", "packets_received", "packets_lost", "flow_loss_percentage", "rtt_min", "rtt_avg", "rtt_max",
+			"rtt_p50", "rtt_p95", "rtt_p99", "jitter_min", "jitter_avg", "jitter_max", "throughput_send",
+			"throughput_recv"},
+		rows: func(data interface{}) [][]string {
+			t := data.(*TrafficSimClientStats)
+			stats := []string{
+				csvTime(t.ReportTime), csvFloat(t.AverageRTT), strconv.Itoa(t.MinRTT), strconv.Itoa(t.MaxRTT),
+				strconv.Itoa(t.LossPercentage), strconv.Itoa(t.LostPackets), strconv.Itoa(t.DuplicatePackets),
+				strconv.Itoa(t.OutOfSequence),
+			}
+			if len(t.Flows) == 0 {
+				return [][]string{append(stats, make([]string, 20)...)}
+			}
+
+			// flows are keyed by id, sort them so exports are stable
+			ids := make([]string, 0, len(t.Flows))
+			for id := range t.Flows {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+
+			rows := make([][]string, 0, len(ids))
+			for _, id := range ids {
+				f := t.Flows[id]
+				row := append(append([]string{}, stats...),
+					id, f.Direction, csvFloat(f.Duration), strconv.Itoa(f.BytesSent), strconv.Itoa(f.BytesReceived),
+					strconv.Itoa(f.PacketsSent), strconv.Itoa(f.PacketsReceived), strconv.Itoa(f.PacketsLost),
+					strconv.Itoa(f.LossPercentage), strconv.Itoa(f.RttStats.Min), strconv.Itoa(f.RttStats.Avg),
+					strconv.Itoa(f.RttStats.Max), strconv.Itoa(f.RttStats.P50), strconv.Itoa(f.RttStats.P95),
+					strconv.Itoa(f.RttStats.P99), strconv.Itoa(f.JitterStats.Min), strconv.Itoa(f.JitterStats.Avg),
+					strconv.Itoa(f.JitterStats.Max), csvFloat(f.ThroughputSend), csvFloat(f.ThroughputRecv),
+				)
+				rows = append(rows, row)
+			}
+			return rows
+		},
+	},
+}
+
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func csvFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// csvMs formats durations in milliseconds, the unit used across the ui
+func csvMs(d time.Duration) string {
+	return csvFloat(float64(d) / float64(time.Millisecond))
+}
@@ -0,0 +1,306 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"nw-guardian/internal"
+	"time"
+)
+
+const (
+	probeDataCollection       = "probe_data"
+	legacyProbeDataCollection = "probe_data_legacy" // the regular collection, kept after migrating until dropped by hand
+	probeDataMigration        = "probe_data_timeseries"
+)
+
+// migrateBatch is the amount of legacy documents rewritten per insert
+const migrateBatch = 1000
+
+// legacyTimestampFields are where the probe types stored when the data was measured before it was normalized
+var legacyTimestampFields = [][]string{
+	{"data", "stop_timestamp"},
+	{"data", "reportTime"},
+	{"data", "timestamp"},
+	{"createdAt"},
+}
+
+// migration tracks the progress of a data migration so it can resume where it stopped
+type migration struct {
+	ID         string             `bson:"_id"`
+	Last       primitive.ObjectID `bson:"last"` // last legacy document migrated
+	Migrated   int64              `bson:"migrated"`
+	Skipped    int64              `bson:"skipped"`
+	Done       bool               `bson:"done"`
+	StartedAt  time.Time          `bson:"startedAt"`
+	FinishedAt time.Time          `bson:"finishedAt,omitempty"`
+}
+
+// collectionType returns the type of the collection (collection, timeseries or view), empty when it doesn't exist
+func collectionType(db *mongo.Database, name string) (string, error) {
+	specs, err := db.ListCollectionSpecifications(context.TODO(), bson.M{"name": name})
+	if err != nil {
+		return "", err
+	}
+	if len(specs) == 0 {
+		return "", nil
+	}
+	return specs[0].Type, nil
+}
+
+func createProbeDataCollection(db *mongo.Database) error {
+	ts := options.TimeSeries().SetTimeField("timestamp").SetMetaField("meta").SetGranularity("minutes")
+	return db.CreateCollection(context.TODO(), probeDataCollection, options.CreateCollection().SetTimeSeriesOptions(ts))
+}
+
+// EnsureProbeDataCollection creates probe_data as a time-series collection when it doesn't exist yet, a regular
+// probe_data collection is left as is until it is migrated
+func EnsureProbeDataCollection(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data_migration.EnsureProbeDataCollection"}
+
+	t, err := collectionType(db, probeDataCollection)
+	if err != nil {
+		ee.Message = "unable to list collections"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	switch t {
+	case "":
+		err = createProbeDataCollection(db)
+		if err != nil {
+			ee.Message = "unable to create probe data time-series collection"
+			ee.Error = err
+			return ee.ToError()
+		}
+		log.Info("created probe_data time-series collection")
+	case "timeseries":
+	default:
+		log.Warn("probe_data is a regular collection, data stored before the time-series layout won't be queried until it is migrated with -migrate-probe-data")
+	}
+
+	return nil
+}
+
+// legacyTimestamp returns when the legacy document was measured
+func legacyTimestamp(doc bson.Raw, id primitive.ObjectID) time.Time {
+	for _, path := range legacyTimestampFields {
+		v, err := doc.LookupErr(path...)
+		if err != nil {
+			continue
+		}
+		if ms, ok := v.DateTimeOK(); ok && ms > 0 {
+			return time.UnixMilli(ms)
+		}
+	}
+	return id.Timestamp()
+}
+
+// MigrateProbeData rewrites the probe data of the regular probe_data collection into a time-series collection.
+// The regular collection is renamed to probe_data_legacy and kept, the progress is stored so an interrupted
+// migration continues where it stopped. Data of probes that no longer exist is skipped. Guardian shouldn't be
+// receiving probe data while it runs.
+func MigrateProbeData(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data_migration.MigrateProbeData"}
+
+	t, err := collectionType(db, probeDataCollection)
+	if err != nil {
+		ee.Message = "unable to list collections"
+		ee.Error = err
+		return ee.ToError()
+	}
+	legacy, err := collectionType(db, legacyProbeDataCollection)
+	if err != nil {
+		ee.Message = "unable to list collections"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	if t == "collection" {
+		if legacy != "" {
+			ee.Error = errors.New("probe_data is a regular collection but " + legacyProbeDataCollection + " already exists")
+			return ee.ToError()
+		}
+		rename := bson.D{
+			{Key: "renameCollection", Value: db.Name() + "." + probeDataCollection},
+			{Key: "to", Value: db.Name() + "." + legacyProbeDataCollection},
+		}
+		err = db.Client().Database("admin").RunCommand(context.TODO(), rename).Err()
+		if err != nil {
+			ee.Message = "unable to rename probe_data to " + legacyProbeDataCollection
+			ee.Error = err
+			return ee.ToError()
+		}
+		legacy = "collection"
+		t = ""
+		log.Info("renamed probe_data to " + legacyProbeDataCollection)
+	}
+
+	if t == "" {
+		err = createProbeDataCollection(db)
+		if err != nil {
+			ee.Message = "unable to create probe data time-series collection"
+			ee.Error = err
+			return ee.ToError()
+		}
+		log.Info("created probe_data time-series collection")
+	}
+
+	if legacy == "" {
+		log.Info("no legacy probe data to migrate")
+		return nil
+	}
+
+	progress := migration{ID: probeDataMigration, StartedAt: time.Now()}
+	err = db.Collection("migrations").FindOne(context.TODO(), bson.M{"_id": probeDataMigration}).Decode(&progress)
+	if err != nil && err != mongo.ErrNoDocuments {
+		ee.Message = "unable to get migration progress"
+		ee.Error = err
+		return ee.ToError()
+	}
+	if progress.Done {
+		log.Info("probe data was already migrated")
+		return nil
+	}
+	if !progress.Last.IsZero() {
+		log.Infof("resuming probe data migration after %s (%d migrated)", progress.Last.Hex(), progress.Migrated)
+
+		// the batch being inserted when the migration stopped may have been written without its progress
+		var newest struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		err = db.Collection(legacyProbeDataCollection).FindOne(context.TODO(), bson.M{}, options.FindOne().SetSort(bson.M{"_id": -1})).Decode(&newest)
+		if err == nil {
+			_, err = db.Collection(probeDataCollection).DeleteMany(context.TODO(), bson.M{"_id": bson.M{"$gt": progress.Last, "$lte": newest.ID}})
+		}
+		if err != nil && err != mongo.ErrNoDocuments {
+			// resuming would duplicate the partially migrated batch
+			ee.Message = "unable to remove the partially migrated batch"
+			ee.Error = err
+			return ee.ToError()
+		}
+	}
+
+	// agent & type of every probe seen, nil when the probe was deleted
+	probes := make(map[primitive.ObjectID]*Probe)
+	lookup := func(id primitive.ObjectID) (*Probe, error) {
+		if p, ok := probes[id]; ok {
+			return p, nil
+		}
+		var p Probe
+		err := db.Collection("probes").FindOne(context.TODO(), bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"agent": 1, "type": 1})).Decode(&p)
+		if err == mongo.ErrNoDocuments {
+			probes[id] = nil
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		probes[id] = &p
+		return &p, nil
+	}
+
+	for {
+		filter := bson.M{}
+		if !progress.Last.IsZero() {
+			filter["_id"] = bson.M{"$gt": progress.Last}
+		}
+		opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(migrateBatch)
+
+		cursor, err := db.Collection(legacyProbeDataCollection).Find(context.TODO(), filter, opts)
+		if err != nil {
+			ee.Message = "unable to read legacy probe data"
+			ee.Error = err
+			return ee.ToError()
+		}
+		var docs []bson.Raw
+		if err = cursor.All(context.TODO(), &docs); err != nil {
+			ee.Message = "unable to decode legacy probe data"
+			ee.Error = err
+			return ee.ToError()
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		var batch []interface{}
+		for _, raw := range docs {
+			id, ok := raw.Lookup("_id").ObjectIDOK()
+			if !ok {
+				ee.Error = errors.New("legacy probe data without an object id")
+				return ee.ToError()
+			}
+			progress.Last = id
+
+			probeID, _ := raw.Lookup("probe").ObjectIDOK()
+			probe, err := lookup(probeID)
+			if err != nil {
+				ee.Message = "unable to get probe of probe data"
+				ee.Error = err
+				return ee.ToError()
+			}
+			if probe == nil {
+				progress.Skipped++
+				continue
+			}
+
+			var target ProbeTarget
+			if v, err := raw.LookupErr("target"); err == nil {
+				_ = v.Unmarshal(&target)
+			}
+
+			var doc bson.D
+			if err = bson.Unmarshal(raw, &doc); err != nil {
+				ee.Message = "unable to decode legacy probe data"
+				ee.Error = err
+				return ee.ToError()
+			}
+			doc = append(doc,
+				bson.E{Key: "timestamp", Value: legacyTimestamp(raw, id)},
+				bson.E{Key: "meta", Value: ProbeDataMeta{
+					Probe:  probeID,
+					Agent:  probe.Agent,
+					Type:   probeDataType(probe.Type, target.Target),
+					Target: target,
+				}},
+			)
+			batch = append(batch, doc)
+		}
+
+		if len(batch) > 0 {
+			_, err = db.Collection(probeDataCollection).InsertMany(context.TODO(), batch, options.InsertMany().SetOrdered(false))
+			if err != nil {
+				ee.Message = "unable to insert migrated probe data"
+				ee.Error = err
+				return ee.ToError()
+			}
+			progress.Migrated += int64(len(batch))
+		}
+
+		_, err = db.Collection("migrations").ReplaceOne(context.TODO(), bson.M{"_id": probeDataMigration}, progress, options.Replace().SetUpsert(true))
+		if err != nil {
+			ee.Message = "unable to save migration progress"
+			ee.Error = err
+			return ee.ToError()
+		}
+		log.Infof("migrated %d probe data documents (%d skipped)", progress.Migrated, progress.Skipped)
+	}
+
+	progress.Done = true
+	progress.FinishedAt = time.Now()
+	_, err = db.Collection("migrations").ReplaceOne(context.TODO(), bson.M{"_id": probeDataMigration}, progress, options.Replace().SetUpsert(true))
+	if err != nil {
+		ee.Message = "unable to save migration progress"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	log.Infof("probe data migration finished, %d documents migrated & %d of deleted probes skipped, %s can be dropped once verified",
+		progress.Migrated, progress.Skipped, legacyProbeDataCollection)
+
+	return nil
+}
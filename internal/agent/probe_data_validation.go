@@ -0,0 +1,321 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"nw-guardian/internal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxClockSkew is how far in the future a measurement can be before it is rejected
+const maxClockSkew = 5 * time.Minute
+
+// quarantineRetention is how long rejected probe data is kept
+const quarantineRetention = 30 * 24 * time.Hour
+
+// oldestMeasurement rejects timestamps of agents with an unset clock
+var oldestMeasurement = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ProbeDataError is why probe data was rejected, it is sent back to the agent
+type ProbeDataError struct {
+	Probe  primitive.ObjectID `json:"probe"`
+	Target string             `json:"target,omitempty"`
+	Type   ProbeType          `json:"type,omitempty"`
+	Field  string             `json:"field,omitempty"` // json field of the data, empty when the data as a whole is invalid
+	Reason string             `json:"reason"`
+}
+
+func (e *ProbeDataError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("invalid %s probe data for probe %s: %s %s", e.Type, e.Probe.Hex(), e.Field, e.Reason)
+	}
+	return fmt.Sprintf("invalid %s probe data for probe %s: %s", e.Type, e.Probe.Hex(), e.Reason)
+}
+
+func invalidField(field string, reason string, args ...interface{}) *ProbeDataError {
+	return &ProbeDataError{Field: field, Reason: fmt.Sprintf(reason, args...)}
+}
+
+func checkTimestamp(field string, t time.Time) *ProbeDataError {
+	switch {
+	case t.IsZero():
+		return invalidField(field, "is required")
+	case t.After(time.Now().Add(maxClockSkew)):
+		return invalidField(field, "is in the future (%s)", t.UTC().Format(time.RFC3339))
+	case t.Before(oldestMeasurement):
+		return invalidField(field, "is too old (%s)", t.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func checkPercent(field string, v float64) *ProbeDataError {
+	if v < 0 || v > 100 {
+		return invalidField(field, "must be between 0 and 100, got %v", v)
+	}
+	return nil
+}
+
+func checkPositive(field string, v float64) *ProbeDataError {
+	if v < 0 {
+		return invalidField(field, "cannot be negative, got %v", v)
+	}
+	return nil
+}
+
+// firstInvalid returns the first failed check
+func firstInvalid(checks ...*ProbeDataError) *ProbeDataError {
+	for _, c := range checks {
+		if c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+func (p PingResult) validate() *ProbeDataError {
+	err := firstInvalid(
+		checkTimestamp("stop_timestamp", p.StopTimestamp),
+		checkPositive("packets_sent", float64(p.PacketsSent)),
+		checkPositive("packets_recv", float64(p.PacketsRecv)),
+		checkPercent("packet_loss", p.PacketLoss),
+		checkPositive("min_rtt", float64(p.MinRtt)),
+		checkPositive("avg_rtt", float64(p.AvgRtt)),
+		checkPositive("max_rtt", float64(p.MaxRtt)),
+	)
+	if err != nil {
+		return err
+	}
+	if p.MinRtt > p.MaxRtt {
+		return invalidField("min_rtt", "is above max_rtt")
+	}
+	return nil
+}
+
+func (m MtrResult) validate() *ProbeDataError {
+	if err := checkTimestamp("stop_timestamp", m.StopTimestamp); err != nil {
+		return err
+	}
+	if len(m.Report.Hops) == 0 {
+		return invalidField("report.hops", "is required")
+	}
+	for i, hop := range m.Report.Hops {
+		if hop.TTL <= 0 {
+			return invalidField(fmt.Sprintf("report.hops[%d].ttl", i), "must be positive, got %d", hop.TTL)
+		}
+		loss := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(hop.LossPct), "%"))
+		if loss == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(loss, 64)
+		if err != nil {
+			return invalidField(fmt.Sprintf("report.hops[%d].loss_pct", i), "is not a number (%q)", hop.LossPct)
+		}
+		if err := checkPercent(fmt.Sprintf("report.hops[%d].loss_pct", i), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r RPerfResults) validate() *ProbeDataError {
+	return firstInvalid(
+		checkTimestamp("stop_timestamp", r.StopTimestamp),
+		checkPositive("summary.bytes_received", float64(r.Summary.BytesReceived)),
+		checkPositive("summary.bytes_sent", float64(r.Summary.BytesSent)),
+		checkPositive("summary.duration_receive", r.Summary.DurationReceive),
+		checkPositive("summary.packets_lost", float64(r.Summary.PacketsLost)),
+		checkPositive("summary.packets_sent", float64(r.Summary.PacketsSent)),
+		checkPositive("summary.jitter_average", r.Summary.JitterAverage),
+	)
+}
+
+func (t TrafficSimClientStats) validate() *ProbeDataError {
+	return firstInvalid(
+		checkTimestamp("reportTime", t.ReportTime),
+		checkPercent("lossPercentage", float64(t.LossPercentage)),
+		checkPositive("averageRTT", t.AverageRTT),
+	)
+}
+
+func (n NetResult) validate() *ProbeDataError {
+	return checkTimestamp("timestamp", n.Timestamp)
+}
+
+func (s SpeedTestResult) validate() *ProbeDataError {
+	if err := checkTimestamp("timestamp", s.Timestamp); err != nil {
+		return err
+	}
+	if len(s.TestData) == 0 {
+		return invalidField("test_data", "is required")
+	}
+	return nil
+}
+
+func (c CompleteSystemInfo) validate() *ProbeDataError {
+	return checkTimestamp("timestamp", c.Timestamp)
+}
+
+// Decode parses the raw data of the probe data into the result type of the probe and validates it.
+// A *ProbeDataError is returned when the data is malformed or out of range.
+func (pd *ProbeData) Decode(probe *Probe) error {
+	probeType := probeDataType(probe.Type, pd.Target.Target)
+	reject := func(e *ProbeDataError) error {
+		e.Probe = pd.ProbeID
+		e.Target = pd.Target.Target
+		e.Type = probeType
+		return e
+	}
+
+	if pd.Data == nil {
+		return reject(invalidField("data", "is required"))
+	}
+
+	raw, err := json.Marshal(pd.Data)
+	if err != nil {
+		return reject(invalidField("data", "cannot be encoded: %v", err))
+	}
+
+	var decoded interface{}
+	var invalid *ProbeDataError
+	switch probeType {
+	case ProbeType_TRAFFICSIM:
+		var stats TrafficSimClientStats
+		err = json.Unmarshal(raw, &stats)
+		decoded, invalid = stats, stats.validate()
+	case ProbeType_RPERF:
+		var rperf RPerfResults
+		err = json.Unmarshal(raw, &rperf)
+		decoded, invalid = rperf, rperf.validate()
+	case ProbeType_MTR:
+		var mtr MtrResult
+		err = json.Unmarshal(raw, &mtr)
+		decoded, invalid = mtr, mtr.validate()
+	case ProbeType_NETWORKINFO:
+		var netinfo NetResult
+		err = json.Unmarshal(raw, &netinfo)
+		decoded, invalid = netinfo, netinfo.validate()
+	case ProbeType_PING:
+		var ping PingResult
+		err = json.Unmarshal(raw, &ping)
+		decoded, invalid = ping, ping.validate()
+	case ProbeType_SPEEDTEST:
+		var result SpeedTestResult
+		err = json.Unmarshal(raw, &result)
+		decoded, invalid = result, result.validate()
+	case ProbeType_SPEEDTEST_SERVERS:
+		var servers []SpeedTestServer
+		err = json.Unmarshal(raw, &servers)
+		decoded = servers
+	case ProbeType_SYSTEMINFO:
+		var sysinfo CompleteSystemInfo
+		err = json.Unmarshal(raw, &sysinfo)
+		decoded, invalid = sysinfo, sysinfo.validate()
+	default:
+		return reject(&ProbeDataError{Reason: fmt.Sprintf("unsupported probe type %s", probeType)})
+	}
+
+	if err != nil {
+		if te, ok := err.(*json.UnmarshalTypeError); ok {
+			// the field is empty when the data as a whole has the wrong type
+			field := te.Field
+			if field == "" {
+				field = "data"
+			}
+			return reject(invalidField(field, "must be a %s, got a %s", te.Type, te.Value))
+		}
+		return reject(invalidField("data", "is malformed: %v", err))
+	}
+	if invalid != nil {
+		return reject(invalid)
+	}
+
+	pd.Data = decoded
+	return nil
+}
+
+// QuarantinedProbeData is probe data that was rejected, kept with the reason for quarantineRetention
+type QuarantinedProbeData struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	Probe      primitive.ObjectID `json:"probe" bson:"probe"`
+	Agent      primitive.ObjectID `json:"agent" bson:"agent"` // agent that sent the data
+	Target     ProbeTarget        `json:"target" bson:"target"`
+	Type       ProbeType          `json:"type" bson:"type"`
+	Field      string             `json:"field,omitempty" bson:"field,omitempty"`
+	Reason     string             `json:"reason" bson:"reason"`
+	Payload    interface{}        `json:"payload" bson:"payload"` // the data as it was received
+	ReceivedAt time.Time          `json:"receivedAt" bson:"receivedAt"`
+}
+
+// Quarantine stores the rejected probe data with the reason it was rejected
+func (pd *ProbeData) Quarantine(db *mongo.Database, agentID primitive.ObjectID, reason *ProbeDataError) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data_validation.Quarantine", ObjectID: pd.ProbeID}
+
+	q := QuarantinedProbeData{
+		ID:         primitive.NewObjectID(),
+		Probe:      pd.ProbeID,
+		Agent:      agentID,
+		Target:     pd.Target,
+		Type:       reason.Type,
+		Field:      reason.Field,
+		Reason:     reason.Reason,
+		Payload:    pd.Data,
+		ReceivedAt: time.Now(),
+	}
+
+	_, err := db.Collection("probe_data_quarantine").InsertOne(context.TODO(), q)
+	if err != nil {
+		ee.Message = "unable to quarantine probe data"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// GetQuarantinedProbeData returns the latest rejected probe data of the probe
+func GetQuarantinedProbeData(db *mongo.Database, probe primitive.ObjectID, limit int64) ([]QuarantinedProbeData, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data_validation.GetQuarantinedProbeData", ObjectID: probe}
+
+	opts := options.Find().SetSort(bson.M{"receivedAt": -1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := db.Collection("probe_data_quarantine").Find(context.TODO(), bson.M{"probe": probe}, opts)
+	if err != nil {
+		ee.Message = "unable to find quarantined probe data"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var quarantined []QuarantinedProbeData
+	if err = cursor.All(context.TODO(), &quarantined); err != nil {
+		ee.Message = "unable to decode quarantined probe data"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return quarantined, nil
+}
+
+// PruneQuarantine deletes the rejected probe data past quarantineRetention
+func PruneQuarantine(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "probe_data_validation.PruneQuarantine"}
+
+	_, err := db.Collection("probe_data_quarantine").DeleteMany(context.TODO(), bson.M{"receivedAt": bson.M{"$lt": time.Now().Add(-quarantineRetention)}})
+	if err != nil {
+		ee.Message = "unable to prune quarantined probe data"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
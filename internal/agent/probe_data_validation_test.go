@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestProbeDataDecode(t *testing.T) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	ping := func(fields map[string]interface{}) map[string]interface{} {
+		data := map[string]interface{}{
+			"stop_timestamp": now,
+			"packets_sent":   10,
+			"packets_recv":   9,
+			"packet_loss":    10.0,
+			"min_rtt":        1000000,
+			"avg_rtt":        2000000,
+			"max_rtt":        3000000,
+		}
+		for k, v := range fields {
+			data[k] = v
+		}
+		return data
+	}
+
+	tests := []struct {
+		name      string
+		probeType ProbeType
+		target    string
+		data      interface{}
+		field     string // field of the ProbeDataError, "-" when the data is valid
+	}{
+		{"valid ping", ProbeType_PING, "1.1.1.1", ping(nil), "-"},
+		{"missing data", ProbeType_PING, "1.1.1.1", nil, "data"},
+		{"wrong type", ProbeType_PING, "1.1.1.1", ping(map[string]interface{}{"packets_sent": "ten"}), "packets_sent"},
+		{"loss out of range", ProbeType_PING, "1.1.1.1", ping(map[string]interface{}{"packet_loss": 101.0}), "packet_loss"},
+		{"negative rtt", ProbeType_PING, "1.1.1.1", ping(map[string]interface{}{"avg_rtt": -1}), "avg_rtt"},
+		{"min above max", ProbeType_PING, "1.1.1.1", ping(map[string]interface{}{"min_rtt": 4000000}), "min_rtt"},
+		{"missing timestamp", ProbeType_PING, "1.1.1.1", ping(map[string]interface{}{"stop_timestamp": "0001-01-01T00:00:00Z"}), "stop_timestamp"},
+		{"future timestamp", ProbeType_PING, "1.1.1.1", ping(map[string]interface{}{"stop_timestamp": future}), "stop_timestamp"},
+		{"old timestamp", ProbeType_PING, "1.1.1.1", ping(map[string]interface{}{"stop_timestamp": "2001-01-01T00:00:00Z"}), "stop_timestamp"},
+		{"malformed", ProbeType_PING, "1.1.1.1", "not an object", "data"},
+		{
+			"valid mtr", ProbeType_MTR, "1.1.1.1",
+			map[string]interface{}{"stop_timestamp": now, "report": map[string]interface{}{"hops": []interface{}{
+				map[string]interface{}{"ttl": 1, "loss_pct": "0.0%"},
+			}}},
+			"-",
+		},
+		{"mtr without hops", ProbeType_MTR, "1.1.1.1", map[string]interface{}{"stop_timestamp": now}, "report.hops"},
+		{
+			"mtr bad loss", ProbeType_MTR, "1.1.1.1",
+			map[string]interface{}{"stop_timestamp": now, "report": map[string]interface{}{"hops": []interface{}{
+				map[string]interface{}{"ttl": 1, "loss_pct": "lots"},
+			}}},
+			"report.hops[0].loss_pct",
+		},
+		{"agent probe typed by target", ProbeType_AGENT, "PING%%%1.1.1.1", ping(map[string]interface{}{"packet_loss": -1.0}), "packet_loss"},
+		{"unsupported type", ProbeType("NOPE"), "", map[string]interface{}{}, ""},
+	}
+
+	for _, tt := range tests {
+		pd := ProbeData{ProbeID: primitive.NewObjectID(), Target: ProbeTarget{Target: tt.target}, Data: tt.data}
+		err := pd.Decode(&Probe{Type: tt.probeType})
+
+		if tt.field == "-" {
+			if err != nil {
+				t.Errorf("%s: Decode() error = %v", tt.name, err)
+			}
+			continue
+		}
+
+		var invalid *ProbeDataError
+		if !errors.As(err, &invalid) {
+			t.Errorf("%s: Decode() error = %v, want a *ProbeDataError", tt.name, err)
+			continue
+		}
+		if invalid.Field != tt.field {
+			t.Errorf("%s: invalid field = %q (%s), want %q", tt.name, invalid.Field, invalid.Reason, tt.field)
+		}
+		if invalid.Probe != pd.ProbeID {
+			t.Errorf("%s: error probe = %s, want %s", tt.name, invalid.Probe.Hex(), pd.ProbeID.Hex())
+		}
+	}
+}
+
+func TestProbeDataDecodeTyped(t *testing.T) {
+	pd := ProbeData{Data: map[string]interface{}{"stop_timestamp": time.Now().UTC().Format(time.RFC3339), "packet_loss": 5.0}}
+	if err := pd.Decode(&Probe{Type: ProbeType_PING}); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+
+	ping, ok := pd.Data.(PingResult)
+	if !ok {
+		t.Fatalf("data is a %T, want a PingResult", pd.Data)
+	}
+	if ping.PacketLoss != 5 {
+		t.Errorf("packet loss = %v, want 5", ping.PacketLoss)
+	}
+}
@@ -0,0 +1,281 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"nw-guardian/internal"
+	"time"
+)
+
+// RetentionProbeTypes are the probe types that store probe data and can have a retention
+var RetentionProbeTypes = []ProbeType{
+	ProbeType_PING,
+	ProbeType_MTR,
+	ProbeType_RPERF,
+	ProbeType_SPEEDTEST,
+	ProbeType_NETWORKINFO,
+	ProbeType_SYSTEMINFO,
+	ProbeType_TRAFFICSIM,
+}
+
+// SuggestedRetention is returned for workspaces that haven't configured a retention policy yet, nothing is
+// pruned until a policy is saved
+var SuggestedRetention = map[ProbeType]int{
+	ProbeType_PING:        30,
+	ProbeType_MTR:         14,
+	ProbeType_TRAFFICSIM:  30,
+	ProbeType_RPERF:       90,
+	ProbeType_SPEEDTEST:   365,
+	ProbeType_NETWORKINFO: 90,
+	ProbeType_SYSTEMINFO:  30,
+}
+
+// pruneBatch is the amount of agents deleted from at once, keeping the $in of the delete small
+const pruneBatch = 500
+
+// minServerVersion is the first MongoDB major version able to delete from time-series collections by time
+const minServerVersion = 7
+
+// RetentionPolicy is how long the probe data of a workspace is kept, per probe type, in days
+type RetentionPolicy struct {
+	ID      primitive.ObjectID `json:"id" bson:"_id"`
+	Site    primitive.ObjectID `json:"site" bson:"site"`
+	Types   map[ProbeType]int  `json:"types" bson:"types"`     // days kept per probe type
+	Default int                `json:"default" bson:"default"` // days kept for types without their own retention, 0 keeps them forever
+
+	UpdatedAt    time.Time `json:"updatedAt" bson:"updatedAt"`
+	LastPrunedAt time.Time `json:"lastPrunedAt,omitempty" bson:"lastPrunedAt,omitempty"`
+	LastPruned   int64     `json:"lastPruned" bson:"lastPruned"` // probe data deleted by the last run
+	Configured   bool      `json:"configured" bson:"-"`          // false when the policy is the suggested one
+}
+
+func (p *RetentionPolicy) Validate() error {
+	if p.Default < 0 {
+		return errors.New("retention cannot be negative")
+	}
+
+	for t, days := range p.Types {
+		known := false
+		for _, rt := range RetentionProbeTypes {
+			if rt == t {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("probe type %s doesn't store probe data", t)
+		}
+		if days < 0 {
+			return errors.New("retention cannot be negative")
+		}
+	}
+
+	return nil
+}
+
+// Days returns the retention of the probe type, 0 when its data is kept forever
+func (p *RetentionPolicy) Days(t ProbeType) int {
+	if days, ok := p.Types[t]; ok {
+		return days
+	}
+	return p.Default
+}
+
+// GetRetentionPolicy returns the retention policy of the site, the suggested policy is returned
+// (without being saved) when the site hasn't configured one
+func GetRetentionPolicy(db *mongo.Database, site primitive.ObjectID) (*RetentionPolicy, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "retention.GetRetentionPolicy", ObjectID: site}
+
+	var policy RetentionPolicy
+	err := db.Collection("retention_policies").FindOne(context.TODO(), bson.M{"site": site}).Decode(&policy)
+	if err == mongo.ErrNoDocuments {
+		types := make(map[ProbeType]int)
+		for t, days := range SuggestedRetention {
+			types[t] = days
+		}
+		return &RetentionPolicy{Site: site, Types: types}, nil
+	}
+	if err != nil {
+		ee.Message = "unable to find retention policy"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	policy.Configured = true
+	return &policy, nil
+}
+
+// Save creates or replaces the retention policy of the site
+func (p *RetentionPolicy) Save(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "retention.Save", ObjectID: p.Site}
+
+	err := p.Validate()
+	if err != nil {
+		ee.Message = "invalid retention policy"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	if p.Types == nil {
+		p.Types = make(map[ProbeType]int)
+	}
+	p.UpdatedAt = time.Now()
+
+	update := bson.M{
+		"$set": bson.M{
+			"types":     p.Types,
+			"default":   p.Default,
+			"updatedAt": p.UpdatedAt,
+		},
+		"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+	}
+
+	_, err = db.Collection("retention_policies").UpdateOne(context.TODO(), bson.M{"site": p.Site}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		ee.Message = "unable to save retention policy"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	p.Configured = true
+	return nil
+}
+
+// GetRetentionPolicies returns every configured retention policy
+func GetRetentionPolicies(db *mongo.Database) ([]RetentionPolicy, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "retention.GetRetentionPolicies"}
+
+	cursor, err := db.Collection("retention_policies").Find(context.TODO(), bson.M{})
+	if err != nil {
+		ee.Message = "unable to find retention policies"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var policies []RetentionPolicy
+	if err = cursor.All(context.TODO(), &policies); err != nil {
+		ee.Message = "unable to decode retention policies"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	for i := range policies {
+		policies[i].Configured = true
+	}
+
+	return policies, nil
+}
+
+// CheckServerVersion returns an error when the MongoDB server is older than minServerVersion, the pruning would
+// fail on every run against it
+func CheckServerVersion(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "retention.CheckServerVersion"}
+
+	var info struct {
+		Version      string  `bson:"version"`
+		VersionArray []int32 `bson:"versionArray"`
+	}
+	err := db.RunCommand(context.TODO(), bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info)
+	if err != nil {
+		ee.Message = "unable to get the mongodb server version"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	if len(info.VersionArray) == 0 || info.VersionArray[0] < minServerVersion {
+		ee.Error = fmt.Errorf("mongodb %s is not supported, probe data retention needs %d.0 or newer", info.Version, minServerVersion)
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// siteAgents returns the ids of the agents of the site
+func siteAgents(db *mongo.Database, site primitive.ObjectID) ([]interface{}, error) {
+	return db.Collection("agents").Distinct(context.TODO(), "_id", bson.M{"site": site})
+}
+
+// Prune deletes the probe data of the site that is older than the retention of its type, returning the amount
+// deleted per type. The type is the one of the data (meta.type), so the data of AGENT probes follows the retention
+// of the ping, mtr or trafficsim data they report.
+func (p *RetentionPolicy) Prune(db *mongo.Database) (map[ProbeType]int64, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "retention.Prune", ObjectID: p.Site}
+
+	agents, err := siteAgents(db, p.Site)
+	if err != nil {
+		ee.Message = "unable to find agents of site"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	deleted := make(map[ProbeType]int64)
+	var total int64
+
+	for _, t := range RetentionProbeTypes {
+		days := p.Days(t)
+		if days <= 0 {
+			continue
+		}
+		cutoff := time.Now().AddDate(0, 0, -days)
+
+		for start := 0; start < len(agents); start += pruneBatch {
+			end := start + pruneBatch
+			if end > len(agents) {
+				end = len(agents)
+			}
+
+			filter := bson.M{
+				"meta.agent": bson.M{"$in": agents[start:end]},
+				"meta.type":  t,
+				"timestamp":  bson.M{"$lt": cutoff},
+			}
+			result, err := db.Collection("probe_data").DeleteMany(context.TODO(), filter)
+			if err != nil {
+				ee.Message = "unable to prune probe data"
+				ee.Error = err
+				return deleted, ee.ToError()
+			}
+			deleted[t] += result.DeletedCount
+			total += result.DeletedCount
+		}
+	}
+
+	p.LastPrunedAt = time.Now()
+	p.LastPruned = total
+	if p.Configured {
+		_, err = db.Collection("retention_policies").UpdateOne(context.TODO(), bson.M{"site": p.Site},
+			bson.M{"$set": bson.M{"lastPrunedAt": p.LastPrunedAt, "lastPruned": p.LastPruned}})
+		if err != nil {
+			log.Error(err)
+		}
+	}
+
+	return deleted, nil
+}
+
+// PruneProbeData enforces every configured retention policy
+func PruneProbeData(db *mongo.Database) error {
+	policies, err := GetRetentionPolicies(db)
+	if err != nil {
+		return err
+	}
+
+	for i := range policies {
+		deleted, err := policies[i].Prune(db)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if policies[i].LastPruned > 0 {
+			log.Infof("pruned %d probe data documents of site %s %v", policies[i].LastPruned, policies[i].Site.Hex(), deleted)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"nw-guardian/internal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RollupResolution is the width of the buckets of a rollup
+type RollupResolution string
+
+const (
+	RollupResolution_MINUTE RollupResolution = "1m"
+	RollupResolution_HOUR   RollupResolution = "1h"
+	RollupResolution_DAY    RollupResolution = "1d"
+)
+
+// RollupResolutions are kept for every probe & target, ordered from the finest
+var RollupResolutions = []RollupResolution{RollupResolution_MINUTE, RollupResolution_HOUR, RollupResolution_DAY}
+
+// rollupRetention is how long the buckets of a resolution are kept, daily buckets are kept forever
+var rollupRetention = map[RollupResolution]time.Duration{
+	RollupResolution_MINUTE: 14 * 24 * time.Hour,
+	RollupResolution_HOUR:   365 * 24 * time.Hour,
+}
+
+// the histogram bins grow by 10%, percentiles are accurate to about 5%
+const rollupBinGrowth = 1.1
+
+// maxRollupPoints is the amount of buckets the automatic resolution aims to stay under
+const maxRollupPoints = 1500
+
+func (r RollupResolution) Duration() time.Duration {
+	switch r {
+	case RollupResolution_MINUTE:
+		return time.Minute
+	case RollupResolution_HOUR:
+		return time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
+
+// Bucket returns the start of the bucket the time falls in (UTC)
+func (r RollupResolution) Bucket(t time.Time) time.Time {
+	return t.UTC().Truncate(r.Duration())
+}
+
+// ResolutionFor picks the finest resolution that keeps the range under maxRollupPoints buckets and is still kept
+// at the start of the range
+func ResolutionFor(from time.Time, to time.Time) RollupResolution {
+	return resolutionFor(from, to, time.Now())
+}
+
+func resolutionFor(from time.Time, to time.Time, now time.Time) RollupResolution {
+	span := to.Sub(from)
+	for _, r := range RollupResolutions {
+		if keep, ok := rollupRetention[r]; ok && from.Before(now.Add(-keep)) {
+			continue
+		}
+		if span/r.Duration() <= maxRollupPoints {
+			return r
+		}
+	}
+	return RollupResolution_DAY
+}
+
+func rollupBin(v float64) int {
+	if v <= 0 {
+		return 0
+	}
+	return int(math.Floor(math.Log1p(v) / math.Log(rollupBinGrowth)))
+}
+
+// rollupBinValue is the value in the middle of the bin
+func rollupBinValue(bin int) float64 {
+	return math.Expm1((float64(bin) + 0.5) * math.Log(rollupBinGrowth))
+}
+
+// rollupField converts a metric key to a document field, mongo doesn't allow dots in field names
+func rollupField(metric string) string {
+	return strings.ReplaceAll(metric, ".", "_")
+}
+
+func rollupMetric(field string) string {
+	return strings.Replace(field, "_", ".", 1)
+}
+
+// rollupStats is how a metric is stored in a bucket
+type rollupStats struct {
+	Count int64            `bson:"count"`
+	Sum   float64          `bson:"sum"`
+	Min   float64          `bson:"min"`
+	Max   float64          `bson:"max"`
+	Hist  map[string]int64 `bson:"hist"` // samples per bin
+}
+
+// percentile estimates the percentile from the histogram, clamped to the min & max seen
+func (s rollupStats) percentile(p float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+
+	bins := make([]int, 0, len(s.Hist))
+	for k := range s.Hist {
+		b, err := strconv.Atoi(k)
+		if err == nil {
+			bins = append(bins, b)
+		}
+	}
+	sort.Ints(bins)
+
+	rank := int64(math.Ceil(p * float64(s.Count)))
+	var seen int64
+	value := s.Max
+	for _, b := range bins {
+		seen += s.Hist[strconv.Itoa(b)]
+		if seen >= rank {
+			value = rollupBinValue(b)
+			break
+		}
+	}
+
+	return math.Min(math.Max(value, s.Min), s.Max)
+}
+
+// RollupStats summarizes a metric over a bucket
+type RollupStats struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min"`
+	Avg   float64 `json:"avg"`
+	Max   float64 `json:"max"`
+	P95   float64 `json:"p95"`
+}
+
+// Rollup is a bucket of the metrics of a probe & target
+type Rollup struct {
+	Probe      primitive.ObjectID     `json:"probe"`
+	Target     ProbeTarget            `json:"target"`
+	Resolution RollupResolution       `json:"resolution"`
+	Bucket     time.Time              `json:"bucket"`
+	Samples    int64                  `json:"samples"`
+	Metrics    map[string]RollupStats `json:"metrics"`
+}
+
+type rollupDoc struct {
+	Probe      primitive.ObjectID     `bson:"probe"`
+	Target     ProbeTarget            `bson:"target"`
+	Resolution RollupResolution       `bson:"resolution"`
+	Bucket     time.Time              `bson:"bucket"`
+	Samples    int64                  `bson:"samples"`
+	Metrics    map[string]rollupStats `bson:"metrics"`
+}
+
+func (d rollupDoc) rollup(metrics map[string]bool) Rollup {
+	r := Rollup{
+		Probe:      d.Probe,
+		Target:     d.Target,
+		Resolution: d.Resolution,
+		Bucket:     d.Bucket,
+		Samples:    d.Samples,
+		Metrics:    make(map[string]RollupStats),
+	}
+
+	for field, s := range d.Metrics {
+		metric := rollupMetric(field)
+		if len(metrics) > 0 && !metrics[metric] {
+			continue
+		}
+		stats := RollupStats{Count: s.Count, Min: s.Min, Max: s.Max, P95: s.percentile(0.95)}
+		if s.Count > 0 {
+			stats.Avg = s.Sum / float64(s.Count)
+		}
+		r.Metrics[metric] = stats
+	}
+
+	return r
+}
+
+// rollupUpdates returns the upserts folding the metrics of the probe data into its bucket of every resolution
+func rollupUpdates(pd *ProbeData) []mongo.WriteModel {
+	metrics := pd.Metrics()
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	// bucketed by when the data was measured, backfilled & late data lands in the bucket it belongs to
+	t := pd.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	inc := bson.M{"samples": 1}
+	mins := bson.M{}
+	maxs := bson.M{}
+	for metric, value := range metrics {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		field := "metrics." + rollupField(metric)
+		inc[field+".count"] = 1
+		inc[field+".sum"] = value
+		inc[field+".hist."+strconv.Itoa(rollupBin(value))] = 1
+		mins[field+".min"] = value
+		maxs[field+".max"] = value
+	}
+	if len(mins) == 0 {
+		return nil
+	}
+	update := bson.M{"$inc": inc, "$min": mins, "$max": maxs}
+
+	models := make([]mongo.WriteModel, 0, len(RollupResolutions))
+	for _, r := range RollupResolutions {
+		filter := bson.M{
+			"probe":         pd.ProbeID,
+			"target.target": pd.Target.Target,
+			"target.agent":  pd.Target.Agent,
+			"target.group":  pd.Target.Group,
+			"resolution":    r,
+			"bucket":        r.Bucket(t),
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+	}
+
+	return models
+}
+
+// RecordRollups folds the metrics of the probe data into its bucket of every resolution, in one round trip
+func RecordRollups(ctx context.Context, db *mongo.Database, data []*ProbeData) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "rollups.RecordRollups"}
+
+	var models []mongo.WriteModel
+	for _, pd := range data {
+		models = append(models, rollupUpdates(pd)...)
+	}
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := db.Collection("probe_rollups").BulkWrite(ctx, models)
+	if err != nil {
+		ee.Message = fmt.Sprintf("unable to record the rollups of %d probe data", len(data))
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// RollupRequest selects the buckets of a probe, the resolution is picked from the range when empty
+type RollupRequest struct {
+	From       time.Time
+	To         time.Time
+	Resolution RollupResolution
+	Target     string   // optional
+	Metrics    []string // optional, every metric when empty
+}
+
+// GetRollups returns the buckets of the probe over the range, oldest first, along with the resolution used
+func GetRollups(db *mongo.Database, probe primitive.ObjectID, req RollupRequest) ([]Rollup, RollupResolution, error) {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "rollups.GetRollups", ObjectID: probe}
+
+	if req.To.IsZero() {
+		req.To = time.Now()
+	}
+	if req.From.IsZero() {
+		req.From = req.To.Add(-24 * time.Hour)
+	}
+	if !req.From.Before(req.To) {
+		return nil, "", errors.New("the start of the range must be before its end")
+	}
+
+	resolution := req.Resolution
+	switch resolution {
+	case "", "auto":
+		resolution = ResolutionFor(req.From, req.To)
+	case RollupResolution_MINUTE, RollupResolution_HOUR, RollupResolution_DAY:
+	default:
+		return nil, "", errors.New("unknown resolution " + string(resolution))
+	}
+
+	filter := bson.M{
+		"probe":      probe,
+		"resolution": resolution,
+		"bucket":     bson.M{"$gte": resolution.Bucket(req.From), "$lte": req.To},
+	}
+	if req.Target != "" {
+		filter["target.target"] = req.Target
+	}
+
+	cursor, err := db.Collection("probe_rollups").Find(context.TODO(), filter, options.Find().SetSort(bson.M{"bucket": 1}))
+	if err != nil {
+		ee.Message = "unable to find rollups"
+		ee.Error = err
+		return nil, resolution, ee.ToError()
+	}
+
+	var docs []rollupDoc
+	if err = cursor.All(context.TODO(), &docs); err != nil {
+		ee.Message = "unable to decode rollups"
+		ee.Error = err
+		return nil, resolution, ee.ToError()
+	}
+
+	selected := make(map[string]bool)
+	for _, m := range req.Metrics {
+		selected[m] = true
+	}
+
+	rollups := make([]Rollup, 0, len(docs))
+	for _, d := range docs {
+		rollups = append(rollups, d.rollup(selected))
+	}
+
+	return rollups, resolution, nil
+}
+
+// PruneRollups deletes the minute & hour buckets past their retention
+func PruneRollups(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.agent", Level: log.ErrorLevel, Function: "rollups.PruneRollups"}
+
+	for resolution, keep := range rollupRetention {
+		filter := bson.M{"resolution": resolution, "bucket": bson.M{"$lt": time.Now().Add(-keep)}}
+		result, err := db.Collection("probe_rollups").DeleteMany(context.TODO(), filter)
+		if err != nil {
+			ee.Message = "unable to prune " + string(resolution) + " rollups"
+			ee.Error = err
+			return ee.ToError()
+		}
+		if result.DeletedCount > 0 {
+			log.Infof("pruned %d %s rollups", result.DeletedCount, resolution)
+		}
+	}
+
+	return nil
+}
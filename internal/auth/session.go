@@ -237,16 +237,16 @@ func (s *Session) UpdateConnWS(db *mongo.Database) error {
 	return nil
 }
 
-func GetSessionFromWSConn(wsConn string, db *mongo.Database) (*Session, error) {
+func GetSessionFromWSConn(ctx context.Context, wsConn string, db *mongo.Database) (*Session, error) {
 	ee := internal.ErrorFormat{Package: "internal.auth", Level: log.ErrorLevel, Function: "session.GetSessionFromWSConn"}
 
 	var filter = bson.D{{"ws_conn", wsConn}}
-	cursor, err := db.Collection("sessions").Find(context.TODO(), filter)
+	cursor, err := db.Collection("sessions").Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
 	var results []bson.D
-	if err = cursor.All(context.TODO(), &results); err != nil {
+	if err = cursor.All(ctx, &results); err != nil {
 		return nil, err
 	}
 
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -13,6 +14,7 @@ type DatabaseConnection struct {
 	MongoDB     *mongo.Database
 	MongoClient *mongo.Client
 	Logger      *logrus.Logger
+	Monitor     *event.CommandMonitor // optional, traces the commands when set
 }
 
 /*
@@ -31,6 +33,9 @@ func (d *DatabaseConnection) NewConnection() *DatabaseConnection {
 func (d *DatabaseConnection) Connect() {
 	var err error
 	session := options.Client().ApplyURI(d.URI)
+	if d.Monitor != nil {
+		session.SetMonitor(d.Monitor)
+	}
 	if err != nil {
 		d.Logger.Fatal(err)
 	}
@@ -1,3 +1,203 @@
 package handlers
 
-// todo process alerts for the various probe data
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/notifications"
+	"sync"
+	"time"
+)
+
+// AlertEngine evaluates the alert rules against probe data once it has been stored,
+// the state of every rule is tracked per rule, probe & target
+type AlertEngine struct {
+	DB        *mongo.Database
+	Notifier  *notifications.Dispatcher
+	Anomalies *AnomalyDetector
+	Flaps     *FlapDetector // shared with the anomaly detector & the agent watchdog
+
+	rulesMu sync.Mutex
+	rules   map[primitive.ObjectID]cachedRules // rules per site
+}
+
+// rulesTTL is how long the rules of a site are cached, edits to a rule apply within it
+const rulesTTL = 30 * time.Second
+
+type cachedRules struct {
+	rules   []AlertRule
+	expires time.Time
+}
+
+func NewAlertEngine(db *mongo.Database, notifier *notifications.Dispatcher) *AlertEngine {
+	flaps := NewFlapDetector()
+	return &AlertEngine{
+		DB:        db,
+		Notifier:  notifier,
+		Anomalies: NewAnomalyDetector(db, notifier, flaps),
+		Flaps:     flaps,
+		rules:     make(map[primitive.ObjectID]cachedRules),
+	}
+}
+
+// rulesFor returns the enabled rules of the site that apply to the probe, the rules of a site are cached for rulesTTL
+func (e *AlertEngine) rulesFor(site primitive.ObjectID, probe primitive.ObjectID) ([]AlertRule, error) {
+	e.rulesMu.Lock()
+	cached, ok := e.rules[site]
+	e.rulesMu.Unlock()
+
+	if !ok || time.Now().After(cached.expires) {
+		rules, err := GetRulesForSite(e.DB, site)
+		if err != nil {
+			return nil, err
+		}
+		cached = cachedRules{rules: rules, expires: time.Now().Add(rulesTTL)}
+
+		e.rulesMu.Lock()
+		e.rules[site] = cached
+		e.rulesMu.Unlock()
+	}
+
+	var rules []AlertRule
+	for _, rule := range cached.rules {
+		if rule.Enabled && (rule.Probe == primitive.NilObjectID || rule.Probe == probe) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func stateKey(rule *AlertRule, pd *agent.ProbeData) string {
+	return "rule|" + rule.ID.Hex() + "|" + pd.ProbeID.Hex() + "|" + pd.Target.Agent.Hex() + "|" + pd.Target.Target
+}
+
+// Prune drops the cached rules that expired and the alert & anomaly states of deleted rules and probes
+func (e *AlertEngine) Prune() error {
+	now := time.Now()
+	e.rulesMu.Lock()
+	for site, cached := range e.rules {
+		if now.After(cached.expires) {
+			delete(e.rules, site)
+		}
+	}
+	e.rulesMu.Unlock()
+
+	if err := e.Flaps.Prune(e.DB); err != nil {
+		return err
+	}
+	return e.Anomalies.Prune()
+}
+
+// Flush writes the baselines the anomaly detector updated
+func (e *AlertEngine) Flush(ctx context.Context) error {
+	if e.Anomalies == nil {
+		return nil
+	}
+	return e.Anomalies.Flush(ctx)
+}
+
+// state returns the state of the rule for the probe data, the first time it is seen the open alert is loaded from
+// the database, so alerts survive a restart
+func (e *AlertEngine) state(rule *AlertRule, pd *agent.ProbeData) *alertState {
+	return e.Flaps.state(stateKey(rule, pd), func(s *alertState) {
+		s.rule, s.probe = rule.ID, pd.ProbeID
+		open, err := agent.FindOpenAlert(e.DB, rule.ID, pd.ProbeID, pd.Target)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		s.restore(open, rule.RequiredSamples())
+	})
+}
+
+// Process evaluates every rule that applies to the probe data of the probe & its agent, flagging it as triggered
+// and opening a ProbeAlert when a rule fires. Open alerts are resolved automatically once the rule stops
+// breaching. The data is evaluated before it is stored, so the triggered & anomalous flags are part of the insert,
+// while the alert writes & notifications are returned to be run once the insert succeeded, nil when there are none.
+func (e *AlertEngine) Process(pd *agent.ProbeData, probe *agent.Probe, a *agent.Agent) (func(), error) {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "alerts.Process", ObjectID: pd.ProbeID}
+
+	// data collected during maintenance is stored but never evaluated
+	if pd.Maintenance {
+		return nil, nil
+	}
+
+	metrics := pd.Metrics()
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+
+	rules, err := e.rulesFor(a.Site, probe.ID)
+	if err != nil {
+		ee.Message = "unable to get alert rules"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	t := pd.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	triggered := false
+	var effects alertEffects
+
+	for i := range rules {
+		rule := &rules[i]
+
+		value, ok := metrics[rule.Metric]
+		if !ok {
+			continue
+		}
+
+		s := e.state(rule, pd)
+
+		breached := rule.Breached(value)
+		action := e.Flaps.dampen(s, rule.dampening(), breached, t)
+
+		// the samples are marked as triggered for as long as the rule breaches
+		if breached && s.breaches >= rule.RequiredSamples() {
+			triggered = true
+		}
+
+		effects.add(e.Flaps.apply(e.DB, e.Notifier, s, action, breached, func() *agent.ProbeAlert {
+			alert := e.alert(rule, probe, a, pd, value)
+			log.Warnf("alert for probe %s on agent %s - %s", probe.ID.Hex(), a.Name, alert.Message)
+			return alert
+		}))
+	}
+
+	pd.Triggered = triggered
+	if e.Anomalies != nil {
+		var anomalies func()
+		pd.Anomalous, anomalies = e.Anomalies.Evaluate(pd, probe, a, metrics)
+		effects.add(anomalies)
+	}
+
+	if len(effects) == 0 {
+		return nil, nil
+	}
+	return effects.run, nil
+}
+
+// alert is the alert raised when the rule fires for the probe data
+func (e *AlertEngine) alert(rule *AlertRule, probe *agent.Probe, a *agent.Agent, pd *agent.ProbeData, value float64) *agent.ProbeAlert {
+	return &agent.ProbeAlert{
+		Agent:     a.ID,
+		Site:      a.Site,
+		Signal:    agent.AlertSignal_THRESHOLD,
+		Severity:  rule.Severity,
+		Rule:      rule.ID,
+		Target:    pd.Target,
+		Metric:    rule.Metric,
+		Value:     value,
+		Threshold: rule.Threshold,
+		Message:   fmt.Sprintf("%s: %s %s %v (value: %v)", rule.Name, rule.Metric, rule.Operator, rule.Threshold, value),
+		Probe:     *probe,
+		ProbeData: *pd,
+	}
+}
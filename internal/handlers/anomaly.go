@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/notifications"
+	"sync"
+	"time"
+)
+
+// AnomalyMetrics are the metrics a baseline is kept for, with the smallest standard deviation used
+// when scoring so a perfectly flat baseline (eg. 0% loss) doesn't flag every tiny change
+var AnomalyMetrics = map[string]float64{
+	"PingResult.AvgRtt":                    1, // ms
+	"PingResult.PacketLoss":                1, // %
+	"TrafficSimClientStats.AverageRTT":     1,
+	"TrafficSimClientStats.P95RTT":         1,
+	"TrafficSimClientStats.LossPercentage": 1,
+}
+
+// Baseline is the EWMA mean and variance of a metric for a probe & target during one hour of the day (UTC)
+type Baseline struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Probe     primitive.ObjectID `json:"probe" bson:"probe"`
+	Target    agent.ProbeTarget  `json:"target" bson:"target"`
+	Metric    string             `json:"metric" bson:"metric"`
+	Hour      int                `json:"hour" bson:"hour"`
+	Mean      float64            `json:"mean" bson:"mean"`
+	Variance  float64            `json:"variance" bson:"variance"`
+	Samples   int64              `json:"samples" bson:"samples"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+func (b *Baseline) StdDev() float64 {
+	return math.Sqrt(b.Variance)
+}
+
+// update folds the value into the EWMA with the weight alpha
+func (b *Baseline) update(value float64, alpha float64) {
+	if b.Samples == 0 {
+		b.Mean = value
+		b.Variance = 0
+	} else {
+		diff := value - b.Mean
+		b.Mean += alpha * diff
+		b.Variance = (1 - alpha) * (b.Variance + alpha*diff*diff)
+	}
+	b.Samples++
+	b.UpdatedAt = time.Now()
+}
+
+// writeModel upserts the baseline, the caller holds the lock of the detector
+func (b *Baseline) writeModel() mongo.WriteModel {
+	filter := bson.M{
+		"probe":         b.Probe,
+		"target.target": b.Target.Target,
+		"target.agent":  b.Target.Agent,
+		"target.group":  b.Target.Group,
+		"metric":        b.Metric,
+		"hour":          b.Hour,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"mean":      b.Mean,
+			"variance":  b.Variance,
+			"samples":   b.Samples,
+			"updatedAt": b.UpdatedAt,
+		},
+		"$setOnInsert": bson.M{"_id": b.ID},
+	}
+
+	return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true)
+}
+
+// GetBaselines returns every baseline kept for the probe
+func GetBaselines(db *mongo.Database, probe primitive.ObjectID) ([]Baseline, error) {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "anomaly.GetBaselines", ObjectID: probe}
+
+	opts := options.Find().SetSort(bson.D{{Key: "metric", Value: 1}, {Key: "hour", Value: 1}})
+	cursor, err := db.Collection("probe_baselines").Find(context.TODO(), bson.M{"probe": probe}, opts)
+	if err != nil {
+		ee.Message = "unable to find probe baselines"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var baselines []Baseline
+	if err = cursor.All(context.TODO(), &baselines); err != nil {
+		ee.Message = "unable to decode probe baselines"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return baselines, nil
+}
+
+// AnomalyDetector scores samples against their baseline and raises ANOMALY alerts while a metric
+// stays more than Threshold standard deviations above normal
+type AnomalyDetector struct {
+	DB         *mongo.Database
+	Notifier   *notifications.Dispatcher
+	Flaps      *FlapDetector
+	Alpha      float64       // EWMA weight of a new sample
+	Threshold  float64       // z-score a sample needs to be flagged
+	MinSamples int64         // samples a baseline needs before it is used
+	MinResolve time.Duration // how long a metric needs to be back to normal before its alert resolves
+
+	mu        sync.Mutex
+	baselines map[string]*Baseline
+	dirty     map[string]bool // baselines updated since the last flush
+}
+
+func NewAnomalyDetector(db *mongo.Database, notifier *notifications.Dispatcher, flaps *FlapDetector) *AnomalyDetector {
+	return &AnomalyDetector{
+		DB:         db,
+		Notifier:   notifier,
+		Flaps:      flaps,
+		Alpha:      0.05,
+		Threshold:  3,
+		MinSamples: 30,
+		MinResolve: 5 * time.Minute,
+		baselines:  make(map[string]*Baseline),
+		dirty:      make(map[string]bool),
+	}
+}
+
+func baselineKey(pd *agent.ProbeData, metric string, hour int) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%d", pd.ProbeID.Hex(), pd.Target.Agent.Hex(), pd.Target.Target, metric, hour)
+}
+
+func anomalyKey(pd *agent.ProbeData, metric string) string {
+	return pd.ProbeID.Hex() + "|" + pd.Target.Agent.Hex() + "|" + pd.Target.Target + "|" + metric
+}
+
+// baseline returns the cached baseline, loading it from the database the first time
+func (d *AnomalyDetector) baseline(key string, pd *agent.ProbeData, metric string, hour int) *Baseline {
+	d.mu.Lock()
+	b, ok := d.baselines[key]
+	d.mu.Unlock()
+	if ok {
+		return b
+	}
+
+	b = &Baseline{}
+	filter := bson.M{
+		"probe":         pd.ProbeID,
+		"target.target": pd.Target.Target,
+		"target.agent":  pd.Target.Agent,
+		"target.group":  pd.Target.Group,
+		"metric":        metric,
+		"hour":          hour,
+	}
+	err := d.DB.Collection("probe_baselines").FindOne(context.TODO(), filter).Decode(b)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Error(err)
+		}
+		b = &Baseline{ID: primitive.NewObjectID(), Probe: pd.ProbeID, Target: pd.Target, Metric: metric, Hour: hour}
+	}
+
+	d.mu.Lock()
+	d.baselines[key] = b
+	d.mu.Unlock()
+
+	return b
+}
+
+// Prune drops the cached baselines of deleted probes
+func (d *AnomalyDetector) Prune() error {
+	probes := idSet{}
+
+	d.mu.Lock()
+	for _, b := range d.baselines {
+		probes.add(b.Probe)
+	}
+	d.mu.Unlock()
+
+	if err := probes.lookup(d.DB, "probes", nil); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	for key, b := range d.baselines {
+		if probes.gone(b.Probe) {
+			delete(d.baselines, key)
+			delete(d.dirty, key)
+		}
+	}
+	d.mu.Unlock()
+
+	return nil
+}
+
+// Flush writes the baselines updated since the last flush in a single bulk write, they are kept dirty when it fails
+func (d *AnomalyDetector) Flush(ctx context.Context) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "anomaly.Flush"}
+
+	d.mu.Lock()
+	keys := make([]string, 0, len(d.dirty))
+	models := make([]mongo.WriteModel, 0, len(d.dirty))
+	for key := range d.dirty {
+		keys = append(keys, key)
+		models = append(models, d.baselines[key].writeModel())
+	}
+	d.dirty = make(map[string]bool)
+	d.mu.Unlock()
+
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := d.DB.Collection("probe_baselines").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		d.mu.Lock()
+		for _, key := range keys {
+			if _, ok := d.baselines[key]; ok {
+				d.dirty[key] = true
+			}
+		}
+		d.mu.Unlock()
+
+		ee.Message = fmt.Sprintf("unable to save %d probe baselines", len(models))
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// state returns the flap detection state of the metric, the first time it is seen the open anomaly alert is
+// loaded from the database
+func (d *AnomalyDetector) state(pd *agent.ProbeData, metric string) *alertState {
+	return d.Flaps.state("anomaly|"+anomalyKey(pd, metric), func(s *alertState) {
+		s.probe = pd.ProbeID
+		alert, err := agent.FindOpenMetricAlert(d.DB, agent.AlertSignal_ANOMALY, pd.ProbeID, pd.Target, metric)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		s.restore(alert, 1)
+	})
+}
+
+// Evaluate scores the metrics of the probe data against their baselines before folding them in,
+// returning true if any of them were anomalous and the alert writes & notifications to run once the
+// probe data is stored. Only increases are flagged, lower latency or loss than usual isn't something
+// anyone gets paged for.
+func (d *AnomalyDetector) Evaluate(pd *agent.ProbeData, probe *agent.Probe, a *agent.Agent, metrics map[string]float64) (bool, func()) {
+	t := pd.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+	hour := t.UTC().Hour()
+
+	anomalous := false
+	var effects alertEffects
+
+	for metric, minStdDev := range AnomalyMetrics {
+		value, ok := metrics[metric]
+		if !ok {
+			continue
+		}
+
+		key := baselineKey(pd, metric, hour)
+		b := d.baseline(key, pd, metric, hour)
+
+		// the deviation is never scored tighter than 10% of the mean
+		stdDev := math.Max(b.StdDev(), math.Max(minStdDev, b.Mean*0.1))
+		z := (value - b.Mean) / stdDev
+		flagged := b.Samples >= d.MinSamples && z >= d.Threshold
+
+		// anomalous samples are folded in with less weight so a short spike doesn't skew the baseline,
+		// while a lasting shift still becomes the new normal eventually
+		alpha := d.Alpha
+		if flagged {
+			alpha = d.Alpha / 4
+		}
+		mean, dev := b.Mean, stdDev
+
+		// the baselines are written by Flush, once per batch
+		d.mu.Lock()
+		b.update(value, alpha)
+		d.dirty[key] = true
+		d.mu.Unlock()
+
+		if flagged {
+			anomalous = true
+		}
+
+		st := d.state(pd, metric)
+		action := d.Flaps.dampen(st, dampening{samples: 1, minResolve: d.MinResolve}, flagged, t)
+
+		effects.add(d.Flaps.apply(d.DB, d.Notifier, st, action, flagged, func() *agent.ProbeAlert {
+			alert := &agent.ProbeAlert{
+				Agent:     a.ID,
+				Site:      a.Site,
+				Signal:    agent.AlertSignal_ANOMALY,
+				Severity:  agent.AlertSeverity_WARNING,
+				Target:    pd.Target,
+				Metric:    metric,
+				Value:     value,
+				Threshold: mean + d.Threshold*dev,
+				Message:   fmt.Sprintf("%s is %.1f standard deviations above its baseline (value: %.2f, baseline: %.2f ± %.2f)", metric, z, value, mean, dev),
+				Probe:     *probe,
+				ProbeData: *pd,
+			}
+			log.Warnf("anomaly detected for probe %s on agent %s - %s", probe.ID.Hex(), a.Name, alert.Message)
+			return alert
+		}))
+	}
+
+	if len(effects) == 0 {
+		return anomalous, nil
+	}
+	return anomalous, effects.run
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed 5 field cron expression (minute hour day-of-month month day-of-week),
+// supporting *, lists, ranges and steps (eg. "0 2 * * 1-5" or "*/15 0-6 1,15 * *")
+type cronSchedule struct {
+	minute [60]bool
+	hour   [24]bool
+	dom    [32]bool
+	month  [13]bool
+	dow    [7]bool
+
+	domAny bool
+	dowAny bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression must have 5 fields")
+	}
+
+	c := &cronSchedule{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+
+	err := parseCronField(fields[0], 0, 59, c.minute[:])
+	if err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	err = parseCronField(fields[1], 0, 23, c.hour[:])
+	if err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	err = parseCronField(fields[2], 1, 31, c.dom[:])
+	if err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	err = parseCronField(fields[3], 1, 12, c.month[:])
+	if err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+
+	// sunday can be either 0 or 7
+	var dow [8]bool
+	err = parseCronField(fields[4], 0, 7, dow[:])
+	if err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	copy(c.dow[:], dow[:7])
+	c.dow[0] = c.dow[0] || dow[7]
+
+	return c, nil
+}
+
+func parseCronField(field string, min int, max int, out []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+			step = s
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			if i := strings.Index(part, "-"); i >= 0 {
+				var err1, err2 error
+				lo, err1 = strconv.Atoi(part[:i])
+				hi, err2 = strconv.Atoi(part[i+1:])
+				if err1 != nil || err2 != nil {
+					return fmt.Errorf("invalid range %q", part)
+				}
+			} else {
+				v, err := strconv.Atoi(part)
+				if err != nil {
+					return fmt.Errorf("invalid value %q", part)
+				}
+				lo, hi = v, v
+				if step > 1 {
+					// "5/15" means every 15 starting at 5
+					hi = max
+				}
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			out[v] = true
+		}
+	}
+
+	return nil
+}
+
+// matches reports if the schedule fires at the minute of t, like cron the day of month
+// and day of week match if either does when both are restricted
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minute[t.Minute()] && c.hour[t.Hour()] && c.dayMatches(t)
+}
+
+// dayMatches reports if the schedule fires on the day of t
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	if !c.month[int(t.Month())] {
+		return false
+	}
+
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// prev returns the latest minute at or before t the schedule fires at, false when it doesn't fire between
+// earliest and t. Only the days in between are walked, the hour & minute are picked from the fields directly.
+func (c *cronSchedule) prev(t time.Time, earliest time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	loc := t.Location()
+
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	for !day.Before(time.Date(earliest.Year(), earliest.Month(), earliest.Day(), 0, 0, 0, 0, loc)) {
+		if c.dayMatches(day) {
+			sameDay := day.Year() == t.Year() && day.YearDay() == t.YearDay()
+
+			maxHour := 23
+			if sameDay {
+				maxHour = t.Hour()
+			}
+			for h := maxHour; h >= 0; h-- {
+				if !c.hour[h] {
+					continue
+				}
+				maxMinute := 59
+				if sameDay && h == t.Hour() {
+					maxMinute = t.Minute()
+				}
+				for m := maxMinute; m >= 0; m-- {
+					if !c.minute[m] {
+						continue
+					}
+					fired := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, loc)
+					if fired.Before(earliest) {
+						return time.Time{}, false
+					}
+					return fired, true
+				}
+			}
+		}
+		day = time.Date(day.Year(), day.Month(), day.Day()-1, 0, 0, 0, 0, loc)
+	}
+
+	return time.Time{}, false
+}
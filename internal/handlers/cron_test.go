@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"0 2 * * 1-5", false},
+		{"*/15 0-6 1,15 * *", false},
+		{"5/20 * * * *", false},
+		{"0 0 * * 7", false},
+		{"0 0 * *", true},
+		{"0 0 * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"5-1 * * * *", true},
+		{"*/0 * * * *", true},
+		{"a * * * *", true},
+	}
+
+	for _, tt := range tests {
+		_, err := parseCron(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseCron(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// 2024-01-01 is a monday
+	tests := []struct {
+		expr string
+		at   time.Time
+		want bool
+	}{
+		{"0 2 * * 1-5", time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC), true},
+		{"0 2 * * 1-5", time.Date(2024, 1, 6, 2, 0, 0, 0, time.UTC), false},
+		{"0 2 * * 1-5", time.Date(2024, 1, 1, 2, 1, 0, 0, time.UTC), false},
+		{"*/15 * * * *", time.Date(2024, 1, 1, 5, 45, 0, 0, time.UTC), true},
+		{"*/15 * * * *", time.Date(2024, 1, 1, 5, 46, 0, 0, time.UTC), false},
+		{"5/20 * * * *", time.Date(2024, 1, 1, 5, 25, 0, 0, time.UTC), true},
+		{"5/20 * * * *", time.Date(2024, 1, 1, 5, 20, 0, 0, time.UTC), false},
+		{"0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 * * 0", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC), true},
+		// day of month and day of week match if either does
+		{"0 0 15 * 1", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 15 * 1", time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 15 * 1", time.Date(2024, 1, 9, 0, 0, 0, 0, time.UTC), false},
+		{"0 0 1 6 *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		if got := c.matches(tt.at); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.expr, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestCronPrev(t *testing.T) {
+	at := time.Date(2024, 1, 3, 10, 30, 0, 0, time.UTC) // wednesday
+
+	tests := []struct {
+		expr     string
+		earliest time.Time
+		want     time.Time
+		ok       bool
+	}{
+		{"30 10 * * *", at.Add(-time.Hour), at, true},
+		{"0 2 * * *", at.AddDate(0, 0, -1), time.Date(2024, 1, 3, 2, 0, 0, 0, time.UTC), true},
+		{"45 10 * * *", at.AddDate(0, 0, -1), time.Date(2024, 1, 2, 10, 45, 0, 0, time.UTC), true},
+		{"45 10 * * *", at.Add(-time.Hour), time.Time{}, false},
+		{"0 0 * * 1", at.AddDate(0, 0, -7), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"0 0 * * 1", at.AddDate(0, 0, -1), time.Time{}, false},
+		{"*/20 * * * *", at.Add(-time.Hour), time.Date(2024, 1, 3, 10, 20, 0, 0, time.UTC), true},
+		{"59 23 31 12 *", at.AddDate(0, 0, -7), time.Date(2023, 12, 31, 23, 59, 0, 0, time.UTC), true},
+	}
+
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.expr, err)
+		}
+		got, ok := c.prev(at, tt.earliest)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("%q prev = %s, %v, want %s, %v", tt.expr, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMaintenanceWindowActive(t *testing.T) {
+	at := time.Date(2024, 1, 3, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		window MaintenanceWindow
+		want   bool
+	}{
+		{"one-off covering", MaintenanceWindow{Enabled: true, StartsAt: at.Add(-time.Hour), EndsAt: at.Add(time.Hour)}, true},
+		{"one-off ended", MaintenanceWindow{Enabled: true, StartsAt: at.Add(-time.Hour), EndsAt: at}, false},
+		{"disabled", MaintenanceWindow{StartsAt: at.Add(-time.Hour), EndsAt: at.Add(time.Hour)}, false},
+		{"recurring started", MaintenanceWindow{Enabled: true, Cron: "0 10 * * *", Duration: 60}, true},
+		{"recurring over", MaintenanceWindow{Enabled: true, Cron: "0 10 * * *", Duration: 30}, false},
+		{"recurring from the day before", MaintenanceWindow{Enabled: true, Cron: "0 22 * * *", Duration: 13 * 60}, true},
+		{"recurring before its start", MaintenanceWindow{Enabled: true, Cron: "0 10 * * *", Duration: 60, StartsAt: at.Add(time.Hour)}, false},
+		{"recurring in its timezone", MaintenanceWindow{Enabled: true, Cron: "0 11 * * *", Duration: 60, Timezone: "Europe/Berlin"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.window.Active(at); got != tt.want {
+			t.Errorf("%s: Active = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package handlers
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/notifications"
+	"sync"
+	"time"
+)
+
+// dampenAction is what should happen to the alert of a signal after an evaluation
+type dampenAction int
+
+const (
+	dampenNone dampenAction = iota
+	dampenFire
+	dampenResolve
+	dampenFlapStart
+	dampenFlapStop
+)
+
+// alertState is the evaluation history of a signal (a rule, an anomaly metric or an agent heart beat) and its open alert.
+// It is only evaluated by the goroutine of the signal, the open alert is set under the lock of the detector so
+// Prune can read it.
+type alertState struct {
+	rule        primitive.ObjectID // rule, probe & agent the signal belongs to, when set the state is pruned once they are deleted
+	probe       primitive.ObjectID
+	agent       primitive.ObjectID
+	breaches    int                // breaching samples in a row
+	alert       primitive.ObjectID // open alert, if any
+	history     []bool             // latest evaluations, true when breached
+	flapping    bool
+	breachSince time.Time // start of the current breach
+	clearSince  time.Time // start of the current clear period
+}
+
+// dampening delays the state changes of a signal
+type dampening struct {
+	samples    int           // breaching samples in a row needed to fire
+	minFiring  time.Duration // how long the signal needs to breach before firing
+	minResolve time.Duration // how long the signal needs to be clear before resolving
+}
+
+// FlapDetector keeps the state of every alerting signal, every alert source goes through it before the dispatcher
+// so flapping signals are held with a single notification whatever raised them
+type FlapDetector struct {
+	Window int     // evaluations kept to detect flapping
+	High   float64 // percent state change at which a signal starts flapping
+	Low    float64 // percent state change below which a signal stops flapping
+
+	mu     sync.Mutex
+	states map[string]*alertState
+}
+
+func NewFlapDetector() *FlapDetector {
+	return &FlapDetector{
+		Window: 20,
+		High:   50,
+		Low:    25,
+		states: make(map[string]*alertState),
+	}
+}
+
+// state returns the state of the key, the first time a key is seen load restores it (eg. the open alert from the
+// database, so alerts survive a restart)
+func (f *FlapDetector) state(key string, load func(s *alertState)) *alertState {
+	f.mu.Lock()
+	s, ok := f.states[key]
+	f.mu.Unlock()
+	if ok {
+		return s
+	}
+
+	s = &alertState{}
+	if load != nil {
+		load(s)
+	}
+
+	f.mu.Lock()
+	f.states[key] = s
+	f.mu.Unlock()
+
+	return s
+}
+
+// forget drops the state of the key, it is restored from the database the next time the key is seen
+func (f *FlapDetector) forget(key string) {
+	f.mu.Lock()
+	delete(f.states, key)
+	f.mu.Unlock()
+}
+
+// Release drops the state holding the alert, called when a user resolves it so the signal has to breach again
+// before it fires a new alert
+func (f *FlapDetector) Release(alert primitive.ObjectID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, s := range f.states {
+		if s.alert == alert {
+			delete(f.states, key)
+		}
+	}
+}
+
+// Prune drops the states whose rule, probe or agent was deleted, and those whose alert was resolved outside of
+// the detector (eg. along with an incident)
+func (f *FlapDetector) Prune(db *mongo.Database) error {
+	rules, probes, agents, alerts := idSet{}, idSet{}, idSet{}, idSet{}
+
+	f.mu.Lock()
+	for _, s := range f.states {
+		rules.add(s.rule)
+		probes.add(s.probe)
+		agents.add(s.agent)
+		alerts.add(s.alert)
+	}
+	f.mu.Unlock()
+
+	if err := rules.lookup(db, "alert_rules", nil); err != nil {
+		return err
+	}
+	if err := probes.lookup(db, "probes", nil); err != nil {
+		return err
+	}
+	if err := agents.lookup(db, "agents", nil); err != nil {
+		return err
+	}
+	if err := alerts.lookup(db, "probe_alerts", bson.M{"status": bson.M{"$in": agent.OpenAlertStatuses}}); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, s := range f.states {
+		if rules.gone(s.rule) || probes.gone(s.probe) || agents.gone(s.agent) || alerts.gone(s.alert) {
+			delete(f.states, key)
+		}
+	}
+
+	return nil
+}
+
+// idSet maps the ids looked up to whether they still match a document, ids added since the lookup
+// (eg. a newly raised alert) aren't in it and are never gone
+type idSet map[primitive.ObjectID]bool
+
+func (set idSet) add(id primitive.ObjectID) {
+	if id != primitive.NilObjectID {
+		set[id] = false
+	}
+}
+
+func (set idSet) gone(id primitive.ObjectID) bool {
+	live, ok := set[id]
+	return ok && !live
+}
+
+// lookup marks the ids still matching a document of the collection
+func (set idSet) lookup(db *mongo.Database, collection string, filter bson.M) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "flapping.lookup"}
+
+	if len(set) == 0 {
+		return nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	if filter == nil {
+		filter = bson.M{}
+	}
+	filter["_id"] = bson.M{"$in": ids}
+
+	found, err := db.Collection(collection).Distinct(context.TODO(), "_id", filter)
+	if err != nil {
+		ee.Message = "unable to look up " + collection
+		ee.Error = err
+		return ee.ToError()
+	}
+	for _, v := range found {
+		if id, ok := v.(primitive.ObjectID); ok {
+			set[id] = true
+		}
+	}
+
+	return nil
+}
+
+// setAlert sets the open alert of the state
+func (f *FlapDetector) setAlert(s *alertState, alert primitive.ObjectID) {
+	f.mu.Lock()
+	s.alert = alert
+	f.mu.Unlock()
+}
+
+// flapPercent is the Nagios style percent state change over the history, later changes are
+// weighted more (0.8 for the oldest up to 1.2 for the newest) so flapping is picked up and
+// cleared quicker than a plain average would
+func flapPercent(history []bool) float64 {
+	if len(history) < 2 {
+		return 0
+	}
+
+	var total float64
+	transitions := len(history) - 1
+	for i := 1; i < len(history); i++ {
+		if history[i] == history[i-1] {
+			continue
+		}
+
+		weight := 1.0
+		if transitions > 1 {
+			weight = 0.8 + 0.4*float64(i-1)/float64(transitions-1)
+		}
+		total += weight
+	}
+
+	return total / float64(transitions) * 100
+}
+
+// dampen records the evaluation in the state of the signal and decides what should happen to its alert.
+// It sits between evaluating a signal and notifying anyone: flapping holds the alert with a single
+// notification, and the minimum firing / resolve durations delay the state changes.
+func (f *FlapDetector) dampen(s *alertState, d dampening, breached bool, t time.Time) dampenAction {
+	s.history = append(s.history, breached)
+	if len(s.history) > f.Window {
+		s.history = s.history[len(s.history)-f.Window:]
+	}
+
+	if breached {
+		s.breaches++
+		s.clearSince = time.Time{}
+		if s.breachSince.IsZero() {
+			s.breachSince = t
+		}
+	} else {
+		s.breaches = 0
+		s.breachSince = time.Time{}
+		if s.clearSince.IsZero() {
+			s.clearSince = t
+		}
+	}
+
+	// a few evaluations are needed before the percentage means anything
+	if len(s.history) >= f.Window/2 {
+		pct := flapPercent(s.history)
+		if !s.flapping && pct >= f.High {
+			s.flapping = true
+			return dampenFlapStart
+		}
+		if s.flapping && pct < f.Low {
+			s.flapping = false
+			return dampenFlapStop
+		}
+	}
+
+	if s.flapping {
+		return dampenNone
+	}
+
+	open := s.alert != primitive.NilObjectID
+
+	if breached && !open && s.breaches >= d.samples && t.Sub(s.breachSince) >= d.minFiring {
+		return dampenFire
+	}
+	if !breached && open && t.Sub(s.clearSince) >= d.minResolve {
+		return dampenResolve
+	}
+
+	return dampenNone
+}
+
+// restore loads the open alert into a new state, as if it had fired after the required samples
+func (s *alertState) restore(open *agent.ProbeAlert, samples int) {
+	if open == nil {
+		return
+	}
+	s.alert = open.ID
+	s.breaches = samples
+	s.breachSince = open.Timestamp
+	s.flapping = open.Status == agent.AlertStatus_FLAPPING
+}
+
+// alertEffect is the alert write & notification an evaluation decided on, held back until the probe data it was
+// decided on is stored. The state is updated right away, so the next evaluation of the signal sees the alert.
+type alertEffect func()
+
+func (e alertEffect) run() {
+	if e != nil {
+		e()
+	}
+}
+
+// alertEffects are run in the order they were decided on
+type alertEffects []alertEffect
+
+func (es *alertEffects) add(e alertEffect) {
+	if e != nil {
+		*es = append(*es, e)
+	}
+}
+
+func (es alertEffects) run() {
+	for _, e := range es {
+		e()
+	}
+}
+
+// dropAlert clears the open alert of the state unless another alert was raised since
+func (f *FlapDetector) dropAlert(s *alertState, alert primitive.ObjectID) {
+	f.mu.Lock()
+	if s.alert == alert {
+		s.alert = primitive.NilObjectID
+	}
+	f.mu.Unlock()
+}
+
+// setAlertStatus moves the open alert of the state between firing and flapping, notifying once. An acknowledged
+// alert keeps its status and isn't notified again.
+func (f *FlapDetector) setAlertStatus(db *mongo.Database, notifier *notifications.Dispatcher, s *alertState, status agent.AlertStatus) alertEffect {
+	id := s.alert
+	return func() {
+		alert := agent.ProbeAlert{ID: id}
+		changed, err := alert.SetStatus(db, status)
+		if err != nil {
+			// the alert might have been resolved by a user in the meantime
+			log.Warn(err)
+			f.dropAlert(s, id)
+			return
+		}
+		if !changed {
+			log.Debugf("alert %s is %s, not moving it to %s", alert.ID.Hex(), alert.Status, status)
+			return
+		}
+
+		event := notifications.EventType_ALERT_FIRING
+		if status == agent.AlertStatus_FLAPPING {
+			event = notifications.EventType_ALERT_FLAPPING
+		}
+		notifier.Dispatch(event, &alert)
+
+		log.Infof("alert %s is now %s", alert.ID.Hex(), status)
+	}
+}
+
+// resolveAlert auto resolves the open alert of the state
+func (f *FlapDetector) resolveAlert(db *mongo.Database, notifier *notifications.Dispatcher, s *alertState) alertEffect {
+	alert := agent.ProbeAlert{ID: s.alert}
+	f.setAlert(s, primitive.NilObjectID)
+
+	return func() {
+		err := alert.Resolve(db, primitive.NilObjectID)
+		if err != nil {
+			// the alert might have already been resolved by a user
+			log.Warn(err)
+			return
+		}
+
+		notifier.Dispatch(notifications.EventType_ALERT_RESOLVED, &alert)
+
+		log.Infof("alert %s auto resolved", alert.ID.Hex())
+	}
+}
+
+// raiseAlert opens the alert in the state, then creates it with the status and notifies it, FLAPPING when the signal
+// started flapping before it fired
+func (f *FlapDetector) raiseAlert(db *mongo.Database, notifier *notifications.Dispatcher, s *alertState, alert *agent.ProbeAlert, status agent.AlertStatus) alertEffect {
+	alert.ID = primitive.NewObjectID()
+	alert.Status = status
+	f.setAlert(s, alert.ID)
+
+	return func() {
+		err := alert.Create(db)
+		if err != nil {
+			log.Error(err)
+			f.dropAlert(s, alert.ID)
+			return
+		}
+
+		event := notifications.EventType_ALERT_FIRING
+		if status == agent.AlertStatus_FLAPPING {
+			event = notifications.EventType_ALERT_FLAPPING
+		}
+		notifier.Raise(event, alert)
+	}
+}
+
+// apply updates the state with the action dampen decided on and returns the alert write & notification it needs, build
+// returns the alert to raise when one is needed, nil when none should be raised
+func (f *FlapDetector) apply(db *mongo.Database, notifier *notifications.Dispatcher, s *alertState, action dampenAction, breached bool, build func() *agent.ProbeAlert) alertEffect {
+	switch action {
+	case dampenFire:
+		if alert := build(); alert != nil {
+			return f.raiseAlert(db, notifier, s, alert, agent.AlertStatus_FIRING)
+		}
+	case dampenResolve:
+		return f.resolveAlert(db, notifier, s)
+	case dampenFlapStart:
+		if s.alert == primitive.NilObjectID {
+			if alert := build(); alert != nil {
+				return f.raiseAlert(db, notifier, s, alert, agent.AlertStatus_FLAPPING)
+			}
+			break
+		}
+		return f.setAlertStatus(db, notifier, s, agent.AlertStatus_FLAPPING)
+	case dampenFlapStop:
+		if s.alert == primitive.NilObjectID {
+			break
+		}
+		if breached {
+			return f.setAlertStatus(db, notifier, s, agent.AlertStatus_FIRING)
+		}
+		return f.resolveAlert(db, notifier, s)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"nw-guardian/internal/agent"
+	"testing"
+	"time"
+)
+
+func TestFlapPercent(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []bool
+		want    float64
+	}{
+		{"empty", nil, 0},
+		{"single", []bool{true}, 0},
+		{"steady", []bool{true, true, true, true}, 0},
+		{"one change", []bool{false, true}, 100},
+		{"alternating", []bool{true, false, true, false, true, false}, 100},
+		{"old change", []bool{true, false, false}, 40},
+		{"new change", []bool{true, true, false}, 60},
+		{"two of four", []bool{false, true, true, false, false}, (0.8 + 1.0667) / 4 * 100},
+	}
+
+	for _, tt := range tests {
+		got := flapPercent(tt.history)
+		if math.Abs(got-tt.want) > 0.01 {
+			t.Errorf("%s: flapPercent(%v) = %.2f, want %.2f", tt.name, tt.history, got, tt.want)
+		}
+	}
+}
+
+func TestDampen(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		d        dampening
+		open     bool // an alert is open before the first evaluation
+		breaches []bool
+		want     []dampenAction
+	}{
+		{
+			name:     "fires after the required samples",
+			d:        dampening{samples: 3},
+			breaches: []bool{true, true, true, true},
+			want:     []dampenAction{dampenNone, dampenNone, dampenFire, dampenNone},
+		},
+		{
+			name:     "breach resets when cleared",
+			d:        dampening{samples: 2},
+			breaches: []bool{true, false, true, true},
+			want:     []dampenAction{dampenNone, dampenNone, dampenNone, dampenFire},
+		},
+		{
+			name:     "waits for the minimum firing duration",
+			d:        dampening{samples: 1, minFiring: 2 * time.Minute},
+			breaches: []bool{true, true, true},
+			want:     []dampenAction{dampenNone, dampenNone, dampenFire},
+		},
+		{
+			name:     "resolves on the first clear sample",
+			d:        dampening{samples: 1},
+			open:     true,
+			breaches: []bool{true, false},
+			want:     []dampenAction{dampenNone, dampenResolve},
+		},
+		{
+			name:     "waits for the minimum resolve duration",
+			d:        dampening{samples: 1, minResolve: 2 * time.Minute},
+			open:     true,
+			breaches: []bool{false, false, true, false, false, false},
+			want:     []dampenAction{dampenNone, dampenNone, dampenNone, dampenNone, dampenNone, dampenResolve},
+		},
+		{
+			name:     "flapping holds the alert",
+			d:        dampening{samples: 1},
+			breaches: []bool{true, false, true, false, true, false, true, false, true, false, true, false},
+			want: []dampenAction{
+				dampenFire, dampenResolve, dampenFire, dampenResolve, dampenFire, dampenResolve,
+				dampenFire, dampenResolve, dampenFire, dampenFlapStart, dampenNone, dampenNone,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		f := NewFlapDetector()
+		s := &alertState{}
+		if tt.open {
+			s.alert = primitive.NewObjectID()
+		}
+
+		for i, breached := range tt.breaches {
+			got := f.dampen(s, tt.d, breached, start.Add(time.Duration(i)*time.Minute))
+
+			// mirror what apply does with the alert
+			switch got {
+			case dampenFire, dampenFlapStart:
+				if s.alert == primitive.NilObjectID {
+					s.alert = primitive.NewObjectID()
+				}
+			case dampenResolve:
+				s.alert = primitive.NilObjectID
+			}
+
+			if got != tt.want[i] {
+				t.Errorf("%s: evaluation %d = %d, want %d", tt.name, i, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	f := NewFlapDetector()
+	alert := primitive.NewObjectID()
+
+	f.state("released", func(s *alertState) { s.alert = alert })
+	f.state("other", func(s *alertState) { s.alert = primitive.NewObjectID() })
+
+	f.Release(alert)
+
+	if _, ok := f.states["released"]; ok {
+		t.Errorf("state holding the released alert was kept")
+	}
+	if _, ok := f.states["other"]; !ok {
+		t.Errorf("state holding another alert was dropped")
+	}
+}
+
+func TestApplyHoldsBackAlertWrites(t *testing.T) {
+	f := NewFlapDetector()
+	s := &alertState{}
+	alert := &agent.ProbeAlert{}
+
+	// the effects aren't run, they'd need the database
+	effect := f.apply(nil, nil, s, dampenFire, true, func() *agent.ProbeAlert { return alert })
+	if effect == nil {
+		t.Fatalf("firing returned no alert write")
+	}
+	if s.alert.IsZero() || s.alert != alert.ID {
+		t.Errorf("state holds alert %s before the write, want %s", s.alert.Hex(), alert.ID.Hex())
+	}
+
+	if f.apply(nil, nil, s, dampenResolve, false, nil) == nil {
+		t.Fatalf("resolving returned no alert write")
+	}
+	if !s.alert.IsZero() {
+		t.Errorf("state still holds alert %s after resolving", s.alert.Hex())
+	}
+
+	if effect := f.apply(nil, nil, s, dampenNone, false, nil); effect != nil {
+		t.Errorf("no action returned an alert write")
+	}
+}
@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"hash/fnv"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/sinks"
+	"nw-guardian/internal/telemetry"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultIngestWorkers   = 4
+	defaultIngestQueueSize = 10000
+	defaultIngestBatchSize = 100
+	defaultIngestFlush     = time.Second
+	defaultEnqueueTimeout  = 5 * time.Second
+
+	// agentTouchInterval throttles the heart beat updates of agents reporting a lot of data
+	agentTouchInterval = 15 * time.Second
+)
+
+// ProbeDataPipeline queues the probe data received from the agents and stores it in batches on a pool of workers.
+// The data of a probe always goes to the same worker, so it is stored, tracked & evaluated in the order it arrived.
+type ProbeDataPipeline struct {
+	DB          *mongo.Database
+	Engine      *AlertEngine
+	Probes      *agent.ProbeCache
+	Agents      *agent.AgentCache
+	Maintenance *MaintenanceCache
+	Metrics     *ProbeMetrics
+	Sinks       *sinks.Fanout // the stored probe data is pushed to the sinks of the workspaces
+
+	Workers        int
+	QueueSize      int           // queued data across the workers
+	BatchSize      int           // data inserted at once
+	FlushInterval  time.Duration // how long a partial batch waits before being inserted
+	EnqueueTimeout time.Duration // how long to wait for room in a full queue before dropping the data
+
+	queues []chan agent.ProbeData
+
+	touchMu sync.Mutex
+	touched map[primitive.ObjectID]time.Time // last heart beat update per agent
+
+	received  uint64
+	rejected  uint64
+	processed uint64
+	failed    uint64
+	dropped   uint64
+	batches   uint64
+}
+
+func envInt(name string, fallback int) int {
+	env := os.Getenv(name)
+	if env == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(env)
+	if err != nil || n <= 0 {
+		log.Warnf("invalid %s %q, using %d", name, env, fallback)
+		return fallback
+	}
+	return n
+}
+
+// NewProbeDataPipeline creates the pipeline using the INGEST_WORKERS, INGEST_QUEUE_SIZE, INGEST_BATCH_SIZE and
+// INGEST_FLUSH_INTERVAL env variables, falling back to the defaults when unset or invalid
+func NewProbeDataPipeline(db *mongo.Database, engine *AlertEngine) *ProbeDataPipeline {
+	p := &ProbeDataPipeline{
+		DB:             db,
+		Engine:         engine,
+		Probes:         agent.NewProbeCache(0),
+		Agents:         agent.NewAgentCache(0),
+		Maintenance:    NewMaintenanceCache(0),
+		Metrics:        NewProbeMetrics(db),
+		Sinks:          sinks.NewFanout(db),
+		Workers:        envInt("INGEST_WORKERS", defaultIngestWorkers),
+		QueueSize:      envInt("INGEST_QUEUE_SIZE", defaultIngestQueueSize),
+		BatchSize:      envInt("INGEST_BATCH_SIZE", defaultIngestBatchSize),
+		FlushInterval:  defaultIngestFlush,
+		EnqueueTimeout: defaultEnqueueTimeout,
+		touched:        make(map[primitive.ObjectID]time.Time),
+	}
+
+	if env := os.Getenv("INGEST_FLUSH_INTERVAL"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil || d <= 0 {
+			log.Warnf("invalid INGEST_FLUSH_INTERVAL %q, using %s", env, defaultIngestFlush)
+		} else {
+			p.FlushInterval = d
+		}
+	}
+
+	size := p.QueueSize / p.Workers
+	if size < 1 {
+		size = 1
+	}
+	// the sinks need the agents of the stored data too
+	p.Sinks.Agents = p.Agents
+
+	for i := 0; i < p.Workers; i++ {
+		p.queues = append(p.queues, make(chan agent.ProbeData, size))
+	}
+
+	return p
+}
+
+// Queue returns the queue of the worker
+func (p *ProbeDataPipeline) Queue(worker int) <-chan agent.ProbeData {
+	return p.queues[worker]
+}
+
+func (p *ProbeDataPipeline) partition(probe primitive.ObjectID) int {
+	h := fnv.New32a()
+	_, _ = h.Write(probe[:])
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// reject quarantines the probe data sent by the agent
+func (p *ProbeDataPipeline) reject(pd *agent.ProbeData, agentID primitive.ObjectID, reason *agent.ProbeDataError) error {
+	atomic.AddUint64(&p.rejected, 1)
+	log.Warn(reason)
+
+	err := pd.Quarantine(p.DB, agentID, reason)
+	if err != nil {
+		log.Error(err)
+	}
+	return reason
+}
+
+// Enqueue validates the probe data sent by the agent and queues it, waiting up to EnqueueTimeout for room when
+// the queue of its worker is full. Invalid data is quarantined and a *agent.ProbeDataError is returned.
+func (p *ProbeDataPipeline) Enqueue(pd agent.ProbeData, agentID primitive.ObjectID) error {
+	atomic.AddUint64(&p.received, 1)
+
+	probe, err := p.Probes.Get(p.DB, pd.ProbeID)
+	if err == agent.ErrProbeNotFound {
+		return p.reject(&pd, agentID, &agent.ProbeDataError{Probe: pd.ProbeID, Target: pd.Target.Target, Reason: "unknown probe"})
+	}
+	if err != nil {
+		return err
+	}
+
+	err = pd.Decode(probe)
+	if reason, ok := err.(*agent.ProbeDataError); ok {
+		return p.reject(&pd, agentID, reason)
+	}
+	if err != nil {
+		return err
+	}
+
+	q := p.queues[p.partition(pd.ProbeID)]
+
+	select {
+	case q <- pd:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(p.EnqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case q <- pd:
+		return nil
+	case <-timer.C:
+		atomic.AddUint64(&p.dropped, 1)
+		log.Warnf("probe data queue is full, dropped data of probe %s", pd.ProbeID.Hex())
+		return errors.New("probe data queue is full")
+	}
+}
+
+// touchAgents updates the heart beat of the agents, at most once per agentTouchInterval
+func (p *ProbeDataPipeline) touchAgents(ctx context.Context, agents map[primitive.ObjectID]bool) {
+	now := time.Now()
+	for id := range agents {
+		p.touchMu.Lock()
+		last := p.touched[id]
+		if now.Sub(last) < agentTouchInterval {
+			p.touchMu.Unlock()
+			continue
+		}
+		p.touched[id] = now
+		p.touchMu.Unlock()
+
+		a := agent.Agent{ID: id}
+		err := a.UpdateTimestamp(ctx, p.DB)
+		if err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+// ProcessBatch evaluates the alerts of the batch of decoded probe data in order, stores it with a single insert, then
+// writes & notifies the alerts, records the rollups & tracks the routes of the data that was stored before handing it
+// to the sinks. The probes, agents, maintenance windows & rules are served from caches, a batch only queries what
+// changed.
+func (p *ProbeDataPipeline) ProcessBatch(batch []agent.ProbeData) {
+	if len(batch) == 0 {
+		return
+	}
+	atomic.AddUint64(&p.batches, 1)
+
+	// the writes of the batch are traced as its children
+	ctx, span := telemetry.Start(context.Background(), "ingest batch", telemetry.SpanKind_INTERNAL)
+	defer span.End()
+	span.SetAttribute("guardian.ingest.batch.size", len(batch))
+
+	prepared := make([]*agent.ProbeData, 0, len(batch))
+	agents := make(map[primitive.ObjectID]bool)
+	// alert writes & notifications per probe data, only run for the data that was stored. The alerts of data that
+	// failed to insert are never created, the flap states still holding them are dropped by the next prune.
+	effects := make(map[*agent.ProbeData]func())
+
+	for i := range batch {
+		data := &batch[i]
+
+		probe, err := p.Probes.Get(p.DB, data.ProbeID)
+		if err != nil {
+			log.Errorf("unable to get probe %s of probe data: %v", data.ProbeID.Hex(), err)
+			atomic.AddUint64(&p.failed, 1)
+			continue
+		}
+
+		data.Prepare(p.DB, probe)
+		if probe.Type == agent.ProbeType_SPEEDTEST {
+			// parsing a speedtest updates the target of the probe
+			p.Probes.Invalidate(probe.ID)
+		}
+
+		// the data is evaluated before it is inserted, so its maintenance, triggered & anomalous flags are stored with it
+		a, err := p.Agents.Get(p.DB, probe.Agent)
+		if err != nil {
+			log.Errorf("unable to get agent %s of probe data: %v", probe.Agent.Hex(), err)
+		} else {
+			data.Maintenance, err = p.Maintenance.InMaintenance(p.DB, a, data.ProbeID, data.Timestamp)
+			if err != nil {
+				log.Error(err)
+			}
+
+			effects[data], err = p.Engine.Process(data, probe, a)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+
+		prepared = append(prepared, data)
+		agents[probe.Agent] = true
+	}
+
+	err := p.Engine.Flush(ctx)
+	if err != nil {
+		log.Error(err)
+	}
+
+	stored, err := agent.InsertProbeData(ctx, p.DB, prepared)
+	if err != nil {
+		atomic.AddUint64(&p.failed, uint64(len(prepared)-len(stored)))
+		span.SetError(err)
+	}
+	span.SetAttribute("guardian.ingest.batch.stored", len(stored))
+
+	for _, data := range stored {
+		if run := effects[data]; run != nil {
+			run()
+		}
+	}
+
+	p.touchAgents(ctx, agents)
+
+	err = agent.RecordRollups(ctx, p.DB, stored)
+	if err != nil {
+		log.Error(err)
+	}
+
+	for _, data := range stored {
+		route, changed, err := agent.TrackRoute(p.DB, data)
+		if err != nil {
+			log.Error(err)
+		} else if changed {
+			log.Infof("route changed for probe %s (%s), now at version %d", data.ProbeID.Hex(), data.Target.Target, route.Version)
+		}
+
+		p.Metrics.Record(data)
+		p.Metrics.Seen(data.Meta.Agent, time.Now())
+	}
+
+	p.Sinks.Push(stored)
+
+	atomic.AddUint64(&p.processed, uint64(len(stored)))
+}
+
+// IngestStats is the state of the pipeline, the counters are since startup
+type IngestStats struct {
+	Workers      int    `json:"workers"`
+	Queued       int    `json:"queued"`
+	QueuedWorker []int  `json:"queuedWorker"` // queued per worker
+	Capacity     int    `json:"capacity"`
+	BatchSize    int    `json:"batchSize"`
+	Received     uint64 `json:"received"`
+	Rejected     uint64 `json:"rejected"` // failed validation & quarantined
+	Processed    uint64 `json:"processed"`
+	Failed       uint64 `json:"failed"`
+	Dropped      uint64 `json:"dropped"`
+	Batches      uint64 `json:"batches"`
+	CachedProbes int    `json:"cachedProbes"`
+
+	Sinks sinks.FanoutStats `json:"sinks"`
+}
+
+func (p *ProbeDataPipeline) Stats() IngestStats {
+	stats := IngestStats{
+		Workers:      p.Workers,
+		BatchSize:    p.BatchSize,
+		Received:     atomic.LoadUint64(&p.received),
+		Rejected:     atomic.LoadUint64(&p.rejected),
+		Processed:    atomic.LoadUint64(&p.processed),
+		Failed:       atomic.LoadUint64(&p.failed),
+		Dropped:      atomic.LoadUint64(&p.dropped),
+		Batches:      atomic.LoadUint64(&p.batches),
+		CachedProbes: p.Probes.Len(),
+		Sinks:        p.Sinks.Stats(),
+	}
+	for _, q := range p.queues {
+		stats.Queued += len(q)
+		stats.QueuedWorker = append(stats.QueuedWorker, len(q))
+		stats.Capacity += cap(q)
+	}
+	return stats
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/notifications"
+	"os"
+	"testing"
+	"time"
+)
+
+// benchmarkDB returns a throwaway database on TEST_MONGO_URI with an agent & a ping probe, the benchmarks are
+// skipped when it isn't set
+func benchmarkDB(b *testing.B) (*mongo.Database, *agent.Probe) {
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		b.Skip("TEST_MONGO_URI is not set")
+	}
+	log.SetLevel(log.ErrorLevel)
+
+	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
+	if err != nil {
+		b.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("guardian_bench_%d", time.Now().UnixNano()))
+	b.Cleanup(func() {
+		_ = db.Drop(context.TODO())
+		_ = client.Disconnect(context.TODO())
+	})
+
+	if err = agent.EnsureProbeDataCollection(db); err != nil {
+		b.Fatal(err)
+	}
+
+	a := agent.Agent{ID: primitive.NewObjectID(), Site: primitive.NewObjectID(), Name: "bench"}
+	if _, err = db.Collection("agents").InsertOne(context.TODO(), a); err != nil {
+		b.Fatal(err)
+	}
+	probe := &agent.Probe{ID: primitive.NewObjectID(), Agent: a.ID, Type: agent.ProbeType_PING,
+		Config: agent.ProbeConfig{Target: []agent.ProbeTarget{{Target: "1.1.1.1"}}}}
+	if _, err = db.Collection("probes").InsertOne(context.TODO(), probe); err != nil {
+		b.Fatal(err)
+	}
+
+	return db, probe
+}
+
+func benchmarkData(probe *agent.Probe, n int) []agent.ProbeData {
+	data := make([]agent.ProbeData, n)
+	now := time.Now()
+	for i := range data {
+		data[i] = agent.ProbeData{
+			ProbeID:   probe.ID,
+			CreatedAt: now,
+			Target:    probe.Config.Target[0],
+			Data: agent.PingResult{
+				StartTimestamp: now.Add(-time.Minute),
+				StopTimestamp:  now,
+				PacketsSent:    10,
+				PacketsRecv:    10,
+				MinRtt:         10 * time.Millisecond,
+				AvgRtt:         12 * time.Millisecond,
+				MaxRtt:         15 * time.Millisecond,
+			},
+		}
+	}
+	return data
+}
+
+// BenchmarkProcessBatch stores the same amount of probe data per record and in batches, one op is one probe data
+func BenchmarkProcessBatch(b *testing.B) {
+	db, probe := benchmarkDB(b)
+
+	for _, size := range []int{1, 10, 100, 500} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			p := NewProbeDataPipeline(db, NewAlertEngine(db, notifications.NewDispatcher(db)))
+
+			b.ResetTimer()
+			for done := 0; done < b.N; done += size {
+				n := size
+				if b.N-done < n {
+					n = b.N - done
+				}
+				batch := benchmarkData(probe, n)
+				p.ProcessBatch(batch)
+			}
+		})
+	}
+}
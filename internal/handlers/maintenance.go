@@ -0,0 +1,388 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"sync"
+	"time"
+)
+
+type MaintenanceScope string
+
+const (
+	MaintenanceScope_SITE  MaintenanceScope = "SITE"
+	MaintenanceScope_GROUP MaintenanceScope = "GROUP"
+	MaintenanceScope_AGENT MaintenanceScope = "AGENT"
+	MaintenanceScope_PROBE MaintenanceScope = "PROBE"
+)
+
+// maximum length of a recurring window, keeps the schedule lookup cheap
+const maxRecurringDuration = 7 * 24 * 60
+
+// MaintenanceWindow suppresses alerting for its scope while active. One-off windows use StartsAt and EndsAt,
+// recurring windows start whenever Cron matches and last Duration minutes, optionally bounded by StartsAt/EndsAt
+type MaintenanceWindow struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Site        primitive.ObjectID `json:"site" bson:"site"`
+	Name        string             `json:"name" bson:"name"`
+	Description string             `json:"description" bson:"description"`
+	Scope       MaintenanceScope   `json:"scope" bson:"scope"`
+	Target      primitive.ObjectID `json:"target,omitempty" bson:"target"` // group, agent or probe id, unset for SITE
+	StartsAt    time.Time          `json:"startsAt" bson:"startsAt"`
+	EndsAt      time.Time          `json:"endsAt" bson:"endsAt"`
+	Cron        string             `json:"cron,omitempty" bson:"cron"`
+	Duration    int                `json:"duration,omitempty" bson:"duration"` // minutes, recurring windows only
+	Timezone    string             `json:"timezone,omitempty" bson:"timezone"` // location the cron is evaluated in, defaults to UTC
+	Enabled     bool               `json:"enabled" bson:"enabled"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time          `json:"updatedAt" bson:"updatedAt"`
+
+	schedule *cronSchedule  // parsed cron, set by compile
+	location *time.Location // location of the cron, set by compile
+}
+
+// compile parses the cron & timezone of a recurring window once, so checking it doesn't parse them every time
+func (m *MaintenanceWindow) compile() error {
+	if m.Cron == "" || m.schedule != nil {
+		return nil
+	}
+
+	schedule, err := parseCron(m.Cron)
+	if err != nil {
+		return err
+	}
+
+	m.location = time.UTC
+	if m.Timezone != "" {
+		if l, err := time.LoadLocation(m.Timezone); err == nil {
+			m.location = l
+		}
+	}
+	m.schedule = schedule
+
+	return nil
+}
+
+func (m *MaintenanceWindow) Validate() error {
+	switch m.Scope {
+	case MaintenanceScope_SITE:
+	case MaintenanceScope_GROUP, MaintenanceScope_AGENT, MaintenanceScope_PROBE:
+		if m.Target == primitive.NilObjectID {
+			return errors.New("a target is required for scope " + string(m.Scope))
+		}
+	default:
+		return errors.New("unknown scope " + string(m.Scope))
+	}
+
+	if m.Timezone != "" {
+		if _, err := time.LoadLocation(m.Timezone); err != nil {
+			return errors.New("unknown timezone " + m.Timezone)
+		}
+	}
+
+	if m.Cron == "" {
+		if m.StartsAt.IsZero() || !m.EndsAt.After(m.StartsAt) {
+			return errors.New("one-off windows need a start before their end")
+		}
+		return nil
+	}
+
+	if _, err := parseCron(m.Cron); err != nil {
+		return err
+	}
+	if m.Duration < 1 || m.Duration > maxRecurringDuration {
+		return errors.New("recurring windows need a duration between 1 minute and 7 days")
+	}
+
+	return nil
+}
+
+// Active reports if the window covers t
+func (m *MaintenanceWindow) Active(t time.Time) bool {
+	if !m.Enabled {
+		return false
+	}
+
+	if m.Cron == "" {
+		return !t.Before(m.StartsAt) && t.Before(m.EndsAt)
+	}
+
+	if !m.StartsAt.IsZero() && t.Before(m.StartsAt) {
+		return false
+	}
+	if !m.EndsAt.IsZero() && !t.Before(m.EndsAt) {
+		return false
+	}
+
+	if m.compile() != nil {
+		return false
+	}
+
+	// active when the latest occurrence started less than the duration ago
+	now := t.In(m.location).Truncate(time.Minute)
+	_, ok := m.schedule.prev(now, now.Add(-time.Duration(m.Duration-1)*time.Minute))
+	return ok
+}
+
+// covers reports if the scope of the window includes the agent (and probe, if set)
+func (m *MaintenanceWindow) covers(agentID primitive.ObjectID, probeID primitive.ObjectID, groups []primitive.ObjectID) bool {
+	switch m.Scope {
+	case MaintenanceScope_SITE:
+		return true
+	case MaintenanceScope_AGENT:
+		return m.Target == agentID
+	case MaintenanceScope_PROBE:
+		return probeID != primitive.NilObjectID && m.Target == probeID
+	case MaintenanceScope_GROUP:
+		for _, g := range groups {
+			if g == m.Target {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *MaintenanceWindow) Create(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "maintenance.Create", ObjectID: m.Site}
+
+	err := m.Validate()
+	if err != nil {
+		ee.Message = "invalid maintenance window"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	m.ID = primitive.NewObjectID()
+	m.CreatedAt = time.Now()
+	m.UpdatedAt = time.Now()
+
+	_, err = db.Collection("maintenance_windows").InsertOne(context.TODO(), m)
+	if err != nil {
+		ee.Message = "error inserting maintenance window"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (m *MaintenanceWindow) Get(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "maintenance.Get", ObjectID: m.ID}
+
+	err := db.Collection("maintenance_windows").FindOne(context.TODO(), bson.M{"_id": m.ID}).Decode(m)
+	if err != nil {
+		ee.Message = "unable to find maintenance window"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (m *MaintenanceWindow) Update(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "maintenance.Update", ObjectID: m.ID}
+
+	err := m.Validate()
+	if err != nil {
+		ee.Message = "invalid maintenance window"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	m.UpdatedAt = time.Now()
+
+	update := bson.M{"$set": bson.M{
+		"name":        m.Name,
+		"description": m.Description,
+		"scope":       m.Scope,
+		"target":      m.Target,
+		"startsAt":    m.StartsAt,
+		"endsAt":      m.EndsAt,
+		"cron":        m.Cron,
+		"duration":    m.Duration,
+		"timezone":    m.Timezone,
+		"enabled":     m.Enabled,
+		"updatedAt":   m.UpdatedAt,
+	}}
+
+	_, err = db.Collection("maintenance_windows").UpdateOne(context.TODO(), bson.M{"_id": m.ID}, update)
+	if err != nil {
+		ee.Message = "unable to update maintenance window"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (m *MaintenanceWindow) Delete(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "maintenance.Delete", ObjectID: m.ID}
+
+	_, err := db.Collection("maintenance_windows").DeleteOne(context.TODO(), bson.M{"_id": m.ID})
+	if err != nil {
+		ee.Message = "unable to delete maintenance window"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func GetMaintenanceWindowsForSite(db *mongo.Database, site primitive.ObjectID) ([]MaintenanceWindow, error) {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "maintenance.GetMaintenanceWindowsForSite", ObjectID: site}
+
+	cursor, err := db.Collection("maintenance_windows").Find(context.TODO(), bson.M{"site": site})
+	if err != nil {
+		ee.Message = "unable to find maintenance windows"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var windows []MaintenanceWindow
+	if err = cursor.All(context.TODO(), &windows); err != nil {
+		ee.Message = "unable to decode maintenance windows"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	for i := range windows {
+		if err = windows[i].compile(); err != nil {
+			log.Warnf("invalid cron of maintenance window %s: %v", windows[i].ID.Hex(), err)
+		}
+	}
+
+	return windows, nil
+}
+
+// activeWindows returns the windows that are active at t
+func activeWindows(windows []MaintenanceWindow, t time.Time) []MaintenanceWindow {
+	var active []MaintenanceWindow
+	for _, w := range windows {
+		if w.Active(t) {
+			active = append(active, w)
+		}
+	}
+	return active
+}
+
+// GetActiveMaintenanceWindows returns the windows of the site that are active at t
+func GetActiveMaintenanceWindows(db *mongo.Database, site primitive.ObjectID, t time.Time) ([]MaintenanceWindow, error) {
+	windows, err := GetMaintenanceWindowsForSite(db, site)
+	if err != nil {
+		return nil, err
+	}
+
+	return activeWindows(windows, t), nil
+}
+
+// coveredBy reports if the agent, or the probe when set, is covered by one of the active windows
+func coveredBy(db *mongo.Database, active []MaintenanceWindow, a *agent.Agent, probeID primitive.ObjectID) (bool, error) {
+	if len(active) == 0 {
+		return false, nil
+	}
+
+	var groups []primitive.ObjectID
+	var err error
+	for _, w := range active {
+		if w.Scope == MaintenanceScope_GROUP {
+			groups, err = agent.GetGroupIDsForAgent(db, a.ID)
+			if err != nil {
+				return false, err
+			}
+			break
+		}
+	}
+
+	for _, w := range active {
+		if w.covers(a.ID, probeID, groups) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// InMaintenance reports if the agent, or the probe when set, is covered by an active maintenance window at t
+func InMaintenance(db *mongo.Database, a *agent.Agent, probeID primitive.ObjectID, t time.Time) (bool, error) {
+	active, err := GetActiveMaintenanceWindows(db, a.Site, t)
+	if err != nil {
+		return false, err
+	}
+
+	return coveredBy(db, active, a, probeID)
+}
+
+// defaultMaintenanceCacheTTL is how long the windows of a site are cached, edits to a window apply within it
+const defaultMaintenanceCacheTTL = 30 * time.Second
+
+type cachedWindows struct {
+	windows []MaintenanceWindow
+	expires time.Time
+}
+
+// MaintenanceCache keeps the compiled maintenance windows of the sites reporting data in memory, so checking every
+// probe data against them doesn't query them every time
+type MaintenanceCache struct {
+	TTL time.Duration
+
+	mu    sync.RWMutex
+	sites map[primitive.ObjectID]cachedWindows
+}
+
+func NewMaintenanceCache(ttl time.Duration) *MaintenanceCache {
+	if ttl <= 0 {
+		ttl = defaultMaintenanceCacheTTL
+	}
+	return &MaintenanceCache{TTL: ttl, sites: make(map[primitive.ObjectID]cachedWindows)}
+}
+
+// Get returns the windows of the site, looking them up when they aren't cached or expired. The windows are shared,
+// they must not be modified.
+func (c *MaintenanceCache) Get(db *mongo.Database, site primitive.ObjectID) ([]MaintenanceWindow, error) {
+	c.mu.RLock()
+	cached, ok := c.sites[site]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.windows, nil
+	}
+
+	windows, err := GetMaintenanceWindowsForSite(db, site)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.sites[site] = cachedWindows{windows: windows, expires: time.Now().Add(c.TTL)}
+	c.mu.Unlock()
+
+	return windows, nil
+}
+
+// Prune drops the expired sites
+func (c *MaintenanceCache) Prune() {
+	now := time.Now()
+	c.mu.Lock()
+	for id, cached := range c.sites {
+		if now.After(cached.expires) {
+			delete(c.sites, id)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// InMaintenance reports if the agent, or the probe when set, is covered by an active maintenance window at t
+func (c *MaintenanceCache) InMaintenance(db *mongo.Database, a *agent.Agent, probeID primitive.ObjectID, t time.Time) (bool, error) {
+	windows, err := c.Get(db, a.Site)
+	if err != nil {
+		return false, err
+	}
+
+	return coveredBy(db, activeWindows(windows, t), a, probeID)
+}
@@ -0,0 +1,374 @@
+package handlers
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/telemetry"
+	"nw-guardian/internal/workspace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// metricsStaleAfter drops the series of probes that stopped reporting, deleted ones would otherwise be scraped forever
+	metricsStaleAfter = time.Hour
+	// metricsLabelsTTL is how long the name & location of an agent are cached, renames show up within it
+	metricsLabelsTTL = time.Minute
+)
+
+// metricDesc is a gauge, name & help are its prometheus metadata, otelName & unit its otlp ones
+type metricDesc struct {
+	name     string
+	help     string
+	otelName string
+	unit     string
+}
+
+var (
+	metricPingRttMin       = metricDesc{"guardian_ping_rtt_min_seconds", "Minimum round-trip time of the latest ping.", "guardian.ping.rtt.min", "s"}
+	metricPingRttAvg       = metricDesc{"guardian_ping_rtt_avg_seconds", "Average round-trip time of the latest ping.", "guardian.ping.rtt.avg", "s"}
+	metricPingRttMax       = metricDesc{"guardian_ping_rtt_max_seconds", "Maximum round-trip time of the latest ping.", "guardian.ping.rtt.max", "s"}
+	metricPingLoss         = metricDesc{"guardian_ping_packet_loss_percent", "Packet loss of the latest ping.", "guardian.ping.packet_loss", "%"}
+	metricMtrFinalHopLoss  = metricDesc{"guardian_mtr_final_hop_loss_percent", "Loss at the final hop of the latest mtr.", "guardian.mtr.final_hop.loss", "%"}
+	metricTrafficSimP95    = metricDesc{"guardian_trafficsim_rtt_p95_seconds", "Highest p95 round-trip time across the flows of the latest trafficsim report.", "guardian.trafficsim.rtt.p95", "s"}
+	metricTrafficSimLoss   = metricDesc{"guardian_trafficsim_packet_loss_percent", "Packet loss of the latest trafficsim report.", "guardian.trafficsim.packet_loss", "%"}
+	metricSpeedTestDown    = metricDesc{"guardian_speedtest_download_bytes_per_second", "Download speed of the latest speedtest.", "guardian.speedtest.download", "By/s"}
+	metricSpeedTestUp      = metricDesc{"guardian_speedtest_upload_bytes_per_second", "Upload speed of the latest speedtest.", "guardian.speedtest.upload", "By/s"}
+	metricProbeLastResult  = metricDesc{"guardian_probe_last_result_timestamp_seconds", "Time the latest result of the probe was measured.", "guardian.probe.last_result", "s"}
+	metricAgentLastSeenAge = metricDesc{"guardian_agent_last_seen_age_seconds", "Seconds since the agent last reported probe data.", "guardian.agent.last_seen.age", "s"}
+)
+
+type metricSample struct {
+	desc    metricDesc
+	labels  string // rendered labels, {a="b",...}
+	value   float64
+	updated time.Time
+
+	// the labels as otlp attributes
+	agent     primitive.ObjectID
+	probe     string
+	probeType string
+	target    string
+}
+
+type agentLabels struct {
+	name      string
+	location  string
+	workspace string
+	site      primitive.ObjectID
+	expires   time.Time
+}
+
+// ProbeMetrics keeps the latest value of every probe/target in memory for the prometheus scrapes, it is fed by the
+// ingestion so a scrape never queries the database
+type ProbeMetrics struct {
+	DB *mongo.Database
+
+	mu      sync.RWMutex
+	samples map[string]metricSample
+	agents  map[primitive.ObjectID]agentLabels
+	seen    map[primitive.ObjectID]time.Time // last probe data per agent
+}
+
+func NewProbeMetrics(db *mongo.Database) *ProbeMetrics {
+	return &ProbeMetrics{
+		DB:      db,
+		samples: make(map[string]metricSample),
+		agents:  make(map[primitive.ObjectID]agentLabels),
+		seen:    make(map[primitive.ObjectID]time.Time),
+	}
+}
+
+// labelsOf returns the labels of the agent, looking them up when they aren't cached or expired
+func (m *ProbeMetrics) labelsOf(agentID primitive.ObjectID) agentLabels {
+	m.mu.RLock()
+	cached, ok := m.agents[agentID]
+	m.mu.RUnlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached
+	}
+
+	labels := agentLabels{name: agentID.Hex(), expires: time.Now().Add(metricsLabelsTTL)}
+	a := agent.Agent{ID: agentID}
+	if err := a.Get(m.DB); err == nil {
+		labels.name = a.Name
+		labels.location = a.Location
+		labels.workspace = a.Site.Hex()
+		labels.site = a.Site
+		w := workspace.Workspace{ID: a.Site}
+		if err = w.Get(m.DB); err == nil && w.Name != "" {
+			labels.workspace = w.Name
+		}
+	} else if ok {
+		// keep the previous labels when the lookup fails
+		labels = cached
+		labels.expires = time.Now().Add(metricsLabelsTTL)
+	}
+
+	m.mu.Lock()
+	m.agents[agentID] = labels
+	m.mu.Unlock()
+
+	return labels
+}
+
+// Seen records that the agent reported probe data
+func (m *ProbeMetrics) Seen(agentID primitive.ObjectID, t time.Time) {
+	m.mu.Lock()
+	if t.After(m.seen[agentID]) {
+		m.seen[agentID] = t
+	}
+	m.mu.Unlock()
+}
+
+// Record updates the gauges of the probe/target with the stored probe data, data of other types is ignored
+func (m *ProbeMetrics) Record(data *agent.ProbeData) {
+	a := m.labelsOf(data.Meta.Agent)
+
+	target := data.Target.Target
+	if data.Meta.Type != "" {
+		// AGENT probes prefix the target with the type
+		target = strings.TrimPrefix(target, string(data.Meta.Type)+"%%%")
+	}
+	if target == "" && !data.Target.Agent.IsZero() {
+		target = data.Target.Agent.Hex()
+	}
+
+	labels := renderLabels(
+		"workspace", a.workspace,
+		"agent", a.name,
+		"location", a.location,
+		"probe", data.Meta.Probe.Hex(),
+		"probe_type", string(data.Meta.Type),
+		"target", target,
+	)
+
+	var values []metricSample
+	set := func(desc metricDesc, v float64) {
+		values = append(values, metricSample{desc: desc, labels: labels, value: v,
+			agent: data.Meta.Agent, probe: data.Meta.Probe.Hex(), probeType: string(data.Meta.Type), target: target})
+	}
+
+	switch d := data.Data.(type) {
+	case agent.PingResult:
+		set(metricPingRttMin, d.MinRtt.Seconds())
+		set(metricPingRttAvg, d.AvgRtt.Seconds())
+		set(metricPingRttMax, d.MaxRtt.Seconds())
+		set(metricPingLoss, d.PacketLoss)
+	case agent.MtrResult:
+		if len(d.Report.Hops) > 0 {
+			last := d.Report.Hops[len(d.Report.Hops)-1]
+			loss, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(last.LossPct), "%")), 64)
+			if err == nil {
+				set(metricMtrFinalHopLoss, loss)
+			}
+		}
+	case agent.TrafficSimClientStats:
+		set(metricTrafficSimLoss, float64(d.LossPercentage))
+		if len(d.Flows) > 0 {
+			p95 := 0
+			for _, f := range d.Flows {
+				if f.RttStats.P95 > p95 {
+					p95 = f.RttStats.P95
+				}
+			}
+			// the flow stats are in milliseconds
+			set(metricTrafficSimP95, float64(p95)/1000)
+		}
+	case agent.SpeedTestResult:
+		if len(d.TestData) > 0 {
+			set(metricSpeedTestDown, float64(d.TestData[0].DLSpeed))
+			set(metricSpeedTestUp, float64(d.TestData[0].ULSpeed))
+		}
+	default:
+		return
+	}
+	set(metricProbeLastResult, float64(data.Timestamp.UnixMilli())/1000)
+
+	now := time.Now()
+	m.mu.Lock()
+	for _, s := range values {
+		s.updated = now
+		m.samples[s.desc.name+s.labels] = s
+	}
+	m.mu.Unlock()
+}
+
+// escapeLabel escapes a label value as the text exposition format expects
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func renderLabels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(pairs[i+1]))
+		b.WriteString(`"`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// prune drops the probe series that didn't report past metricsStaleAfter, deleted probes would otherwise be exported
+// forever. The agents are kept, the age of a silent agent keeps growing until Prune finds it deleted. The caller holds
+// the lock.
+func (m *ProbeMetrics) prune(now time.Time) {
+	for key, s := range m.samples {
+		if now.Sub(s.updated) > metricsStaleAfter {
+			delete(m.samples, key)
+		}
+	}
+	for id, labels := range m.agents {
+		if _, ok := m.seen[id]; !ok && now.After(labels.expires) {
+			delete(m.agents, id)
+		}
+	}
+}
+
+// Prune drops the series of the agents that were deleted
+func (m *ProbeMetrics) Prune(db *mongo.Database) error {
+	agents := idSet{}
+
+	m.mu.RLock()
+	for id := range m.seen {
+		agents.add(id)
+	}
+	m.mu.RUnlock()
+
+	if err := agents.lookup(db, "agents", nil); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, s := range m.samples {
+		if agents.gone(s.agent) {
+			delete(m.samples, key)
+		}
+	}
+	for id := range m.seen {
+		if agents.gone(id) {
+			delete(m.seen, id)
+			delete(m.agents, id)
+		}
+	}
+
+	return nil
+}
+
+// Write writes the gauges in the prometheus text exposition format, dropping the series past metricsStaleAfter
+func (m *ProbeMetrics) Write(w io.Writer) error {
+	now := time.Now()
+
+	m.mu.Lock()
+	m.prune(now)
+	samples := make([]metricSample, 0, len(m.samples)+len(m.seen))
+	for _, s := range m.samples {
+		samples = append(samples, s)
+	}
+	for id, seen := range m.seen {
+		a, ok := m.agents[id]
+		if !ok {
+			continue
+		}
+		samples = append(samples, metricSample{
+			desc:   metricAgentLastSeenAge,
+			labels: renderLabels("workspace", a.workspace, "agent", a.name, "agent_id", id.Hex(), "location", a.location),
+			value:  now.Sub(seen).Seconds(),
+		})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].desc.name != samples[j].desc.name {
+			return samples[i].desc.name < samples[j].desc.name
+		}
+		return samples[i].labels < samples[j].labels
+	})
+
+	last := ""
+	for _, s := range samples {
+		if s.desc.name != last {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", s.desc.name, s.desc.help, s.desc.name); err != nil {
+				return err
+			}
+			last = s.desc.name
+		}
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", s.desc.name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Gauges returns the gauges for the otlp export, the agent of a gauge is its resource
+func (m *ProbeMetrics) Gauges() []telemetry.Gauge {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(now)
+
+	resources := make(map[primitive.ObjectID]map[string]string, len(m.agents))
+	resourceOf := func(id primitive.ObjectID) map[string]string {
+		if r, ok := resources[id]; ok {
+			return r
+		}
+		a := m.agents[id]
+		r := map[string]string{
+			"host.id":                 id.Hex(),
+			"host.name":               a.name,
+			"guardian.workspace.name": a.workspace,
+		}
+		if !a.site.IsZero() {
+			r["guardian.workspace.id"] = a.site.Hex()
+		}
+		if a.location != "" {
+			r["guardian.agent.location"] = a.location
+		}
+		resources[id] = r
+		return r
+	}
+
+	gauges := make([]telemetry.Gauge, 0, len(m.samples)+len(m.seen))
+	for _, s := range m.samples {
+		gauges = append(gauges, telemetry.Gauge{
+			Name:        s.desc.otelName,
+			Unit:        s.desc.unit,
+			Description: s.desc.help,
+			Value:       s.value,
+			Time:        s.updated,
+			Resource:    resourceOf(s.agent),
+			Attributes:  map[string]string{"probe": s.probe, "probe.type": s.probeType, "target": s.target},
+		})
+	}
+	for id, seen := range m.seen {
+		if _, ok := m.agents[id]; !ok {
+			continue
+		}
+		gauges = append(gauges, telemetry.Gauge{
+			Name:        metricAgentLastSeenAge.otelName,
+			Unit:        metricAgentLastSeenAge.unit,
+			Description: metricAgentLastSeenAge.help,
+			Value:       now.Sub(seen).Seconds(),
+			Time:        now,
+			Resource:    resourceOf(id),
+		})
+	}
+
+	return gauges
+}
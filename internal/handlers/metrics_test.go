@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"bytes"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeMetricsKeepsSilentAgents(t *testing.T) {
+	m := NewProbeMetrics(nil)
+	now := time.Now()
+	stale := now.Add(-2 * metricsStaleAfter)
+
+	silent, reporting := primitive.NewObjectID(), primitive.NewObjectID()
+	for _, id := range []primitive.ObjectID{silent, reporting} {
+		// both agents share a name, the id tells their series apart
+		m.agents[id] = agentLabels{name: "edge", workspace: "hq", expires: now.Add(-time.Minute)}
+	}
+	m.seen[silent] = stale
+	m.seen[reporting] = now
+
+	m.samples["stale"] = metricSample{desc: metricProbeLastResult, labels: `{probe="stale"}`, agent: silent, updated: stale}
+	m.samples["fresh"] = metricSample{desc: metricProbeLastResult, labels: `{probe="fresh"}`, agent: reporting, updated: now}
+
+	var out bytes.Buffer
+	if err := m.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+
+	for _, id := range []primitive.ObjectID{silent, reporting} {
+		if !strings.Contains(got, `agent_id="`+id.Hex()+`"`) {
+			t.Errorf("no last seen series for agent %s:\n%s", id.Hex(), got)
+		}
+	}
+	if strings.Contains(got, `probe="stale"`) {
+		t.Errorf("stale probe series was kept:\n%s", got)
+	}
+	if !strings.Contains(got, `probe="fresh"`) {
+		t.Errorf("fresh probe series was dropped:\n%s", got)
+	}
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"time"
+)
+
+type RuleOperator string
+
+const (
+	RuleOperator_GT  RuleOperator = ">"
+	RuleOperator_GTE RuleOperator = ">="
+	RuleOperator_LT  RuleOperator = "<"
+	RuleOperator_LTE RuleOperator = "<="
+	RuleOperator_EQ  RuleOperator = "=="
+	RuleOperator_NEQ RuleOperator = "!="
+)
+
+// AlertRule is a threshold evaluated against a single metric of incoming probe data,
+// rules are scoped to a workspace (site) and optionally narrowed down to a single probe
+type AlertRule struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Site        primitive.ObjectID `json:"site" bson:"site"`
+	Probe       primitive.ObjectID `json:"probe,omitempty" bson:"probe"` // when not set the rule applies to every probe in the site
+	Name        string             `json:"name" bson:"name"`
+	Metric      string             `json:"metric" bson:"metric"` // eg. PingResult.PacketLoss, see agent.MetricKeys
+	Operator    RuleOperator       `json:"operator" bson:"operator"`
+	Threshold   float64            `json:"threshold" bson:"threshold"`
+	Consecutive int                `json:"consecutive" bson:"consecutive"` // samples in a row that need to breach before firing
+	Enabled     bool               `json:"enabled" bson:"enabled"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time          `json:"updatedAt" bson:"updatedAt"`
+
+	MinFiringDuration  int `json:"minFiringDuration" bson:"minFiringDuration"`   // seconds the rule needs to breach before firing
+	MinResolveDuration int `json:"minResolveDuration" bson:"minResolveDuration"` // seconds the rule needs to be clear before resolving
+
+	Severity agent.AlertSeverity `json:"severity" bson:"severity"` // severity of the alerts raised, defaults to CRITICAL
+}
+
+// Validate checks that the rule references a known metric and operator
+func (r *AlertRule) Validate() error {
+	if !agent.IsMetricKey(r.Metric) {
+		return fmt.Errorf("unknown metric: %s", r.Metric)
+	}
+
+	switch r.Operator {
+	case RuleOperator_GT, RuleOperator_GTE, RuleOperator_LT, RuleOperator_LTE, RuleOperator_EQ, RuleOperator_NEQ:
+	default:
+		return fmt.Errorf("unknown operator: %s", r.Operator)
+	}
+
+	if r.Consecutive < 0 {
+		return errors.New("consecutive samples cannot be negative")
+	}
+
+	if r.MinFiringDuration < 0 || r.MinResolveDuration < 0 {
+		return errors.New("minimum firing and resolve durations cannot be negative")
+	}
+
+	if !agent.ValidSeverity(r.Severity) {
+		return fmt.Errorf("unknown severity: %s", r.Severity)
+	}
+
+	return nil
+}
+
+// Breached reports if the value breaches the rule threshold
+func (r *AlertRule) Breached(value float64) bool {
+	switch r.Operator {
+	case RuleOperator_GT:
+		return value > r.Threshold
+	case RuleOperator_GTE:
+		return value >= r.Threshold
+	case RuleOperator_LT:
+		return value < r.Threshold
+	case RuleOperator_LTE:
+		return value <= r.Threshold
+	case RuleOperator_EQ:
+		return value == r.Threshold
+	case RuleOperator_NEQ:
+		return value != r.Threshold
+	default:
+		return false
+	}
+}
+
+// RequiredSamples is the amount of consecutive samples required to fire, defaults to 1
+func (r *AlertRule) RequiredSamples() int {
+	if r.Consecutive < 1 {
+		return 1
+	}
+	return r.Consecutive
+}
+
+func (r *AlertRule) MinFiring() time.Duration {
+	return time.Duration(r.MinFiringDuration) * time.Second
+}
+
+func (r *AlertRule) MinResolve() time.Duration {
+	return time.Duration(r.MinResolveDuration) * time.Second
+}
+
+func (r *AlertRule) dampening() dampening {
+	return dampening{samples: r.RequiredSamples(), minFiring: r.MinFiring(), minResolve: r.MinResolve()}
+}
+
+func (r *AlertRule) Create(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "rules.Create", ObjectID: r.Site}
+
+	err := r.Validate()
+	if err != nil {
+		ee.Message = "invalid alert rule"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	r.ID = primitive.NewObjectID()
+	r.CreatedAt = time.Now()
+	r.UpdatedAt = time.Now()
+
+	_, err = db.Collection("alert_rules").InsertOne(context.TODO(), r)
+	if err != nil {
+		ee.Message = "unable to insert alert rule"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (r *AlertRule) Get(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "rules.Get", ObjectID: r.ID}
+
+	err := db.Collection("alert_rules").FindOne(context.TODO(), bson.M{"_id": r.ID}).Decode(r)
+	if err != nil {
+		ee.Message = "unable to find alert rule"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (r *AlertRule) Update(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "rules.Update", ObjectID: r.ID}
+
+	err := r.Validate()
+	if err != nil {
+		ee.Message = "invalid alert rule"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	r.UpdatedAt = time.Now()
+
+	update := bson.M{"$set": bson.M{
+		"probe":       r.Probe,
+		"name":        r.Name,
+		"metric":      r.Metric,
+		"operator":    r.Operator,
+		"threshold":   r.Threshold,
+		"consecutive": r.Consecutive,
+		"enabled":     r.Enabled,
+		"updatedAt":   r.UpdatedAt,
+
+		"minFiringDuration":  r.MinFiringDuration,
+		"minResolveDuration": r.MinResolveDuration,
+		"severity":           r.Severity,
+	}}
+
+	_, err = db.Collection("alert_rules").UpdateOne(context.TODO(), bson.M{"_id": r.ID}, update)
+	if err != nil {
+		ee.Message = "unable to update alert rule"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (r *AlertRule) Delete(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "rules.Delete", ObjectID: r.ID}
+
+	_, err := db.Collection("alert_rules").DeleteOne(context.TODO(), bson.M{"_id": r.ID})
+	if err != nil {
+		ee.Message = "unable to delete alert rule"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// GetRulesForSite returns every rule defined in the site
+func GetRulesForSite(db *mongo.Database, siteID primitive.ObjectID) ([]AlertRule, error) {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "rules.GetRulesForSite", ObjectID: siteID}
+
+	cursor, err := db.Collection("alert_rules").Find(context.TODO(), bson.M{"site": siteID})
+	if err != nil {
+		ee.Message = "unable to find alert rules"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var rules []AlertRule
+	if err = cursor.All(context.TODO(), &rules); err != nil {
+		ee.Message = "unable to decode alert rules"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return rules, nil
+}
+
+// GetRulesForProbe returns the enabled rules that apply to the probe, either
+// because they target it directly or because they are site wide
+func GetRulesForProbe(db *mongo.Database, siteID primitive.ObjectID, probeID primitive.ObjectID) ([]AlertRule, error) {
+	ee := internal.ErrorFormat{Package: "internal.handlers", Level: log.ErrorLevel, Function: "rules.GetRulesForProbe", ObjectID: probeID}
+
+	filter := bson.M{
+		"site":    siteID,
+		"enabled": true,
+		"probe":   bson.M{"$in": []primitive.ObjectID{probeID, primitive.NilObjectID}},
+	}
+
+	cursor, err := db.Collection("alert_rules").Find(context.TODO(), filter)
+	if err != nil {
+		ee.Message = "unable to find alert rules for probe"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var rules []AlertRule
+	if err = cursor.All(context.TODO(), &rules); err != nil {
+		ee.Message = "unable to decode alert rules for probe"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/notifications"
+	"os"
+	"time"
+)
+
+const defaultOfflineWindow = 5 * time.Minute
+
+// AgentWatchdog marks agents offline once their heart beat (Agent.UpdatedAt) is older than the window,
+// and back online when they check in again. AGENT_OFFLINE alerts go through the same flap detection as
+// the other alerts, so an agent with a patchy connection is held as flapping instead of paging every pass.
+type AgentWatchdog struct {
+	DB       *mongo.Database
+	Notifier *notifications.Dispatcher
+	Flaps    *FlapDetector
+	Window   time.Duration
+}
+
+// NewAgentWatchdog creates a watchdog using the AGENT_OFFLINE_WINDOW env variable (eg. "5m"),
+// falling back to 5 minutes when unset or invalid
+func NewAgentWatchdog(db *mongo.Database, notifier *notifications.Dispatcher, flaps *FlapDetector) *AgentWatchdog {
+	window := defaultOfflineWindow
+
+	if env := os.Getenv("AGENT_OFFLINE_WINDOW"); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil || d <= 0 {
+			log.Warnf("invalid AGENT_OFFLINE_WINDOW %q, using %s", env, defaultOfflineWindow)
+		} else {
+			window = d
+		}
+	}
+
+	return &AgentWatchdog{DB: db, Notifier: notifier, Flaps: flaps, Window: window}
+}
+
+// Check runs a single pass over the agents, recording the transitions since the last pass and evaluating
+// the heart beat of every agent for its AGENT_OFFLINE alert
+func (w *AgentWatchdog) Check() error {
+	now := time.Now()
+	cutoff := now.Add(-w.Window)
+
+	offline, err := agent.GetAgentsByHeartbeat(w.DB, true, true, cutoff)
+	if err != nil {
+		return err
+	}
+	for i := range offline {
+		w.setOnline(&offline[i], false)
+	}
+
+	online, err := agent.GetAgentsByHeartbeat(w.DB, false, false, cutoff)
+	if err != nil {
+		return err
+	}
+	for i := range online {
+		w.setOnline(&online[i], true)
+	}
+
+	agents, err := agent.GetInitializedAgents(w.DB)
+	if err != nil {
+		return err
+	}
+	for i := range agents {
+		w.evaluate(&agents[i], agents[i].UpdatedAt.Before(cutoff), now)
+	}
+
+	return nil
+}
+
+func (w *AgentWatchdog) setOnline(a *agent.Agent, online bool) {
+	err := a.SetOnline(w.DB, online)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if online {
+		log.Infof("agent %s (%s) is online", a.Name, a.ID.Hex())
+	} else {
+		log.Warnf("agent %s (%s) went offline, last seen %s", a.Name, a.ID.Hex(), a.UpdatedAt.Format(time.RFC3339))
+	}
+}
+
+// state returns the flap detection state of the agent heart beat, the first time it is seen the open
+// AGENT_OFFLINE alert is loaded from the database
+func (w *AgentWatchdog) state(a *agent.Agent) *alertState {
+	return w.Flaps.state("offline|"+a.ID.Hex(), func(s *alertState) {
+		s.agent = a.ID
+		open, err := agent.FindOpenAgentAlert(w.DB, a.ID, agent.AlertSignal_AGENT_OFFLINE)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		s.restore(open, 1)
+	})
+}
+
+func (w *AgentWatchdog) evaluate(a *agent.Agent, offline bool, now time.Time) {
+	s := w.state(a)
+	action := w.Flaps.dampen(s, dampening{samples: 1}, offline, now)
+
+	// no probe data is stored here, the alert is written right away
+	w.Flaps.apply(w.DB, w.Notifier, s, action, offline, func() *agent.ProbeAlert {
+		maintenance, err := InMaintenance(w.DB, a, primitive.NilObjectID, now)
+		if err != nil {
+			log.Error(err)
+		}
+		if maintenance {
+			return nil
+		}
+
+		// only alert when the agent has opted in through one of its probes
+		probe, err := w.notifyingProbe(a)
+		if err != nil {
+			log.Error(err)
+			return nil
+		}
+		if probe == nil {
+			return nil
+		}
+
+		return &agent.ProbeAlert{
+			Agent:    a.ID,
+			Site:     a.Site,
+			Signal:   agent.AlertSignal_AGENT_OFFLINE,
+			Severity: agent.AlertSeverity_CRITICAL,
+			Message:  fmt.Sprintf("agent %s has not checked in since %s", a.Name, a.UpdatedAt.Format(time.RFC3339)),
+			Probe:    *probe,
+		}
+	}).run()
+}
+
+// notifyingProbe returns the first probe of the agent with notifications enabled, if any
+func (w *AgentWatchdog) notifyingProbe(a *agent.Agent) (*agent.Probe, error) {
+	p := agent.Probe{Agent: a.ID}
+	probes, err := p.GetAllProbesForAgent(context.TODO(), w.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, probe := range probes {
+		if probe.Notifications {
+			return probe, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+)
+
+// Index is an index guardian expects on a collection, the name defaults to the one mongo generates from the keys
+type Index struct {
+	Collection string
+	Keys       bson.D
+	Unique     bool
+	Name       string
+}
+
+func idx(collection string, unique bool, keys ...string) Index {
+	i := Index{Collection: collection, Unique: unique}
+	for _, k := range keys {
+		order := 1
+		if strings.HasPrefix(k, "-") {
+			order = -1
+			k = k[1:]
+		}
+		i.Keys = append(i.Keys, bson.E{Key: k, Value: order})
+	}
+	return i
+}
+
+// Indexes are the indexes backing the queries of guardian, keep it in sync when adding filters on hot paths
+var Indexes = []Index{
+	idx("agents", false, "site"),
+	idx("agent_events", false, "agent", "-timestamp"),
+	idx("agent_groups", false, "site"),
+	idx("alert_rules", false, "site", "enabled", "probe"),
+	idx("data_sinks", false, "site", "enabled"),
+	idx("email_queue", false, "status", "attempts"),
+	idx("escalation_policies", false, "site"),
+	idx("incidents", false, "site", "dimension", "key", "status", "-updatedAt"),
+	idx("incidents", false, "site", "-createdAt"),
+	idx("maintenance_windows", false, "site"),
+	idx("mtr_routes", false, "probe", "target.target", "target.agent", "-version"),
+	idx("notification_channels", false, "site"),
+	idx("notification_deliveries", false, "channel", "-timestamp"),
+	idx("probe_alerts", false, "probe._id", "target.target", "target.agent", "status"),
+	idx("probe_alerts", false, "agent", "signal", "status"),
+	idx("probe_alerts", false, "site", "-timestamp"),
+	idx("probe_alerts", false, "site", "dedupKey", "status"),
+	idx("probe_alerts", false, "incident", "timestamp"),
+	idx("probe_alerts", false, "status", "policy"),
+	idx("probe_baselines", true, "probe", "target.target", "target.agent", "target.group", "metric", "hour"),
+	idx("probe_data", false, "meta.agent", "meta.type", "timestamp"),
+	idx("probe_data", false, "meta.probe", "-timestamp"),
+	idx("probe_data_quarantine", false, "probe", "-receivedAt"),
+	idx("probe_data_quarantine", false, "receivedAt"),
+	idx("probe_rollups", true, "probe", "target.target", "target.agent", "target.group", "resolution", "bucket"),
+	idx("probe_rollups", false, "probe", "resolution", "bucket"),
+	idx("probe_rollups", false, "resolution", "bucket"),
+	idx("probes", false, "agent", "type"),
+	idx("probes", false, "config.target.agent"),
+	idx("retention_policies", true, "site"),
+	idx("sessions", false, "ws_conn"),
+	idx("sites", false, "members.user"),
+	idx("users", false, "email"),
+	idx("verification_tokens", false, "token", "type"),
+	idx("verification_tokens", false, "expiresAt"),
+}
+
+// name returns the name of the index, mongo names indexes after their keys (eg. site_1_timestamp_-1)
+func (i Index) name() string {
+	if i.Name != "" {
+		return i.Name
+	}
+	parts := make([]string, 0, len(i.Keys))
+	for _, k := range i.Keys {
+		parts = append(parts, fmt.Sprintf("%s_%v", k.Key, k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+func (i Index) keys() string {
+	parts := make([]string, 0, len(i.Keys))
+	for _, k := range i.Keys {
+		parts = append(parts, fmt.Sprintf("%s:%v", k.Key, keyOrder(k.Value)))
+	}
+	return strings.Join(parts, ",")
+}
+
+// keyOrder normalizes the direction of a key, mongo returns it as an int32, int64 or double
+func keyOrder(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return v
+}
+
+type IndexStatus string
+
+const (
+	IndexStatus_OK        IndexStatus = "OK"
+	IndexStatus_CREATED   IndexStatus = "CREATED"
+	IndexStatus_CHANGED   IndexStatus = "CHANGED"   // an index with the name exists with other keys or options
+	IndexStatus_UNMANAGED IndexStatus = "UNMANAGED" // exists but isn't in the registry
+	IndexStatus_FAILED    IndexStatus = "FAILED"
+)
+
+// IndexReport is the state of an index after ensuring the registry
+type IndexReport struct {
+	Collection string      `json:"collection"`
+	Name       string      `json:"name"`
+	Status     IndexStatus `json:"status"`
+	Detail     string      `json:"detail,omitempty"`
+}
+
+type existingIndex struct {
+	Name   string `bson:"name"`
+	Key    bson.D `bson:"key"`
+	Unique bool   `bson:"unique"`
+}
+
+func listIndexes(db *mongo.Database, collection string) ([]Index, error) {
+	cursor, err := db.Collection(collection).Indexes().List(context.TODO())
+	if err != nil {
+		// listing the indexes of a collection that doesn't exist yet fails with NamespaceNotFound
+		if ce, ok := err.(mongo.CommandError); ok && ce.Code == 26 {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var results []existingIndex
+	if err = cursor.All(context.TODO(), &results); err != nil {
+		return nil, err
+	}
+
+	indexes := make([]Index, 0, len(results))
+	for _, r := range results {
+		indexes = append(indexes, Index{Collection: collection, Keys: r.Key, Unique: r.Unique, Name: r.Name})
+	}
+	return indexes, nil
+}
+
+// EnsureIndexes creates the missing indexes of the registry, and reports the indexes that drifted from it.
+// Changed and unmanaged indexes are never dropped, they are left for an operator to look at.
+func EnsureIndexes(db *mongo.Database) ([]IndexReport, error) {
+	ee := ErrorFormat{Package: "internal", Level: logrus.ErrorLevel, Function: "indexes.EnsureIndexes"}
+
+	var collections []string
+	byCollection := make(map[string][]Index)
+	for _, i := range Indexes {
+		if _, ok := byCollection[i.Collection]; !ok {
+			collections = append(collections, i.Collection)
+		}
+		byCollection[i.Collection] = append(byCollection[i.Collection], i)
+	}
+
+	var reports []IndexReport
+	failed := 0
+
+	for _, collection := range collections {
+		existing, err := listIndexes(db, collection)
+		if err != nil {
+			ee.Message = "unable to list indexes of " + collection
+			ee.Error = err
+			return reports, ee.ToError()
+		}
+
+		matched := make(map[string]bool)
+		for _, want := range byCollection[collection] {
+			report := IndexReport{Collection: collection, Name: want.name(), Status: IndexStatus_OK}
+
+			var found *Index
+			for j := range existing {
+				if existing[j].keys() == want.keys() || existing[j].Name == want.name() {
+					found = &existing[j]
+					break
+				}
+			}
+
+			if found != nil {
+				matched[found.Name] = true
+				report.Name = found.Name
+				switch {
+				case found.keys() != want.keys():
+					report.Status = IndexStatus_CHANGED
+					report.Detail = fmt.Sprintf("keys are %s, expected %s", found.keys(), want.keys())
+				case found.Unique != want.Unique:
+					report.Status = IndexStatus_CHANGED
+					report.Detail = fmt.Sprintf("unique is %t, expected %t", found.Unique, want.Unique)
+				}
+				reports = append(reports, report)
+				continue
+			}
+
+			model := mongo.IndexModel{Keys: want.Keys, Options: options.Index().SetName(want.name())}
+			if want.Unique {
+				model.Options.SetUnique(true)
+			}
+			_, err = db.Collection(collection).Indexes().CreateOne(context.TODO(), model)
+			if err != nil {
+				report.Status = IndexStatus_FAILED
+				report.Detail = err.Error()
+				failed++
+			} else {
+				report.Status = IndexStatus_CREATED
+			}
+			reports = append(reports, report)
+		}
+
+		for _, e := range existing {
+			if e.Name == "_id_" || matched[e.Name] {
+				continue
+			}
+			// time-series collections index their meta & time fields on their own
+			if collection == "probe_data" && strings.HasPrefix(e.Name, "meta_1_timestamp_1") {
+				continue
+			}
+			reports = append(reports, IndexReport{Collection: collection, Name: e.Name, Status: IndexStatus_UNMANAGED, Detail: "keys are " + e.keys()})
+		}
+	}
+
+	for _, r := range reports {
+		switch r.Status {
+		case IndexStatus_CREATED:
+			logrus.Infof("created index %s.%s", r.Collection, r.Name)
+		case IndexStatus_CHANGED, IndexStatus_UNMANAGED:
+			logrus.Warnf("index %s.%s is %s: %s", r.Collection, r.Name, strings.ToLower(string(r.Status)), r.Detail)
+		case IndexStatus_FAILED:
+			logrus.Errorf("unable to create index %s.%s: %s", r.Collection, r.Name, r.Detail)
+		}
+	}
+
+	if failed > 0 {
+		ee.Error = fmt.Errorf("%d indexes couldn't be created", failed)
+		return reports, ee.ToError()
+	}
+
+	return reports, nil
+}
@@ -0,0 +1,252 @@
+package notifications
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/url"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"time"
+)
+
+type ChannelType string
+
+const (
+	ChannelType_WEBHOOK   ChannelType = "WEBHOOK"
+	ChannelType_PAGERDUTY ChannelType = "PAGERDUTY" // pagerduty events api v2
+	ChannelType_OPSGENIE  ChannelType = "OPSGENIE"  // opsgenie alert api
+	ChannelType_SLACK     ChannelType = "SLACK"     // slack incoming webhook
+	ChannelType_DISCORD   ChannelType = "DISCORD"   // discord webhook
+	ChannelType_MATRIX    ChannelType = "MATRIX"    // matrix room, the url is the homeserver
+)
+
+// default api urls of the incident channels, the url of the channel overrides them (eg. the opsgenie eu instance)
+const (
+	pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+	opsgenieURL  = "https://api.opsgenie.com"
+)
+
+// Channel is a destination configured on a workspace that alert notifications are delivered to
+type Channel struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	Site      primitive.ObjectID `json:"site" bson:"site"`
+	Name      string             `json:"name" bson:"name"`
+	Type      ChannelType        `json:"type" bson:"type"`
+	URL       string             `json:"url" bson:"url"`
+	Secret    string             `json:"secret" bson:"secret"` // used to sign webhook payloads & verify inbound incident updates, generated when left empty
+	Key       string             `json:"key" bson:"key"`       // pagerduty routing key, opsgenie api key or matrix access token
+	Room      string             `json:"room" bson:"room"`     // matrix room id
+	Enabled   bool               `json:"enabled" bson:"enabled"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+
+	MinSeverity agent.AlertSeverity `json:"minSeverity" bson:"minSeverity"` // alerts below the severity aren't delivered, empty delivers everything
+}
+
+func validURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (c *Channel) Validate() error {
+	if !agent.ValidSeverity(c.MinSeverity) {
+		return errors.New("unknown severity " + string(c.MinSeverity))
+	}
+
+	switch c.Type {
+	case ChannelType_WEBHOOK, ChannelType_SLACK, ChannelType_DISCORD:
+		if !validURL(c.URL) {
+			return errors.New("webhook url must be a valid http(s) url")
+		}
+	case ChannelType_PAGERDUTY, ChannelType_OPSGENIE:
+		if c.Key == "" {
+			return errors.New("an integration key is required for " + string(c.Type) + " channels")
+		}
+		if c.URL != "" && !validURL(c.URL) {
+			return errors.New("url must be a valid http(s) url")
+		}
+	case ChannelType_MATRIX:
+		if !validURL(c.URL) {
+			return errors.New("homeserver url must be a valid http(s) url")
+		}
+		if c.Key == "" || c.Room == "" {
+			return errors.New("an access token and room are required for matrix channels")
+		}
+	default:
+		return errors.New("unknown channel type " + string(c.Type))
+	}
+
+	return nil
+}
+
+// Incident reports if the channel is an incident tool that tracks alerts by their dedup key
+func (c *Channel) Incident() bool {
+	return c.Type == ChannelType_PAGERDUTY || c.Type == ChannelType_OPSGENIE
+}
+
+// Accepts reports if alerts of the severity are delivered to the channel
+func (c *Channel) Accepts(severity agent.AlertSeverity) bool {
+	return c.MinSeverity == "" || severity.Rank() >= c.MinSeverity.Rank()
+}
+
+// endpoint returns the url of the channel, falling back to the default api url of its type
+func (c *Channel) endpoint() string {
+	if c.URL != "" {
+		return c.URL
+	}
+	switch c.Type {
+	case ChannelType_PAGERDUTY:
+		return pagerDutyURL
+	case ChannelType_OPSGENIE:
+		return opsgenieURL
+	}
+	return ""
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (c *Channel) Create(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "channels.Create", ObjectID: c.Site}
+
+	err := c.Validate()
+	if err != nil {
+		ee.Message = "invalid notification channel"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	if c.Secret == "" {
+		c.Secret, err = generateSecret()
+		if err != nil {
+			ee.Message = "unable to generate channel secret"
+			ee.Error = err
+			return ee.ToError()
+		}
+	}
+
+	c.ID = primitive.NewObjectID()
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = time.Now()
+
+	_, err = db.Collection("notification_channels").InsertOne(context.TODO(), c)
+	if err != nil {
+		ee.Message = "error inserting notification channel"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (c *Channel) Get(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "channels.Get", ObjectID: c.ID}
+
+	err := db.Collection("notification_channels").FindOne(context.TODO(), bson.M{"_id": c.ID}).Decode(c)
+	if err != nil {
+		ee.Message = "unable to find notification channel"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// Update updates the editable fields of the channel, the secret & key are only replaced when provided
+func (c *Channel) Update(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "channels.Update", ObjectID: c.ID}
+
+	if (c.Incident() || c.Type == ChannelType_MATRIX) && c.Key == "" {
+		// keep the stored key when validating
+		existing := Channel{ID: c.ID}
+		if existing.Get(db) == nil {
+			c.Key = existing.Key
+		}
+	}
+
+	err := c.Validate()
+	if err != nil {
+		ee.Message = "invalid notification channel"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	c.UpdatedAt = time.Now()
+
+	set := bson.M{
+		"name":      c.Name,
+		"type":      c.Type,
+		"url":       c.URL,
+		"room":      c.Room,
+		"enabled":   c.Enabled,
+		"updatedAt": c.UpdatedAt,
+
+		"minSeverity": c.MinSeverity,
+	}
+	if c.Secret != "" {
+		set["secret"] = c.Secret
+	}
+	if c.Key != "" {
+		set["key"] = c.Key
+	}
+
+	_, err = db.Collection("notification_channels").UpdateOne(context.TODO(), bson.M{"_id": c.ID}, bson.M{"$set": set})
+	if err != nil {
+		ee.Message = "unable to update notification channel"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (c *Channel) Delete(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "channels.Delete", ObjectID: c.ID}
+
+	_, err := db.Collection("notification_channels").DeleteOne(context.TODO(), bson.M{"_id": c.ID})
+	if err != nil {
+		ee.Message = "unable to delete notification channel"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// GetChannelsForSite returns the channels of the site, only the enabled ones when enabledOnly is set
+func GetChannelsForSite(db *mongo.Database, site primitive.ObjectID, enabledOnly bool) ([]Channel, error) {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "channels.GetChannelsForSite", ObjectID: site}
+
+	filter := bson.M{"site": site}
+	if enabledOnly {
+		filter["enabled"] = true
+	}
+
+	cursor, err := db.Collection("notification_channels").Find(context.TODO(), filter)
+	if err != nil {
+		ee.Message = "unable to find notification channels"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var channels []Channel
+	if err = cursor.All(context.TODO(), &channels); err != nil {
+		ee.Message = "unable to decode notification channels"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return channels, nil
+}
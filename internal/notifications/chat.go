@@ -0,0 +1,231 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"nw-guardian/internal/agent"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chatField is a labelled value shown on a chat message
+type chatField struct {
+	Name  string
+	Value string
+}
+
+// chatMessage is an alert event rendered once and formatted for each chat platform
+type chatMessage struct {
+	ID        string // unique per event, retries of the event share it
+	Title     string
+	Text      string
+	Color     int
+	Fields    []chatField
+	Link      string // probe in the frontend, empty when BASE_URL isn't configured
+	Timestamp time.Time
+}
+
+func chatStatus(e *Event) (string, int) {
+	switch e.Type {
+	case EventType_ALERT_FIRING:
+		return "FIRING", 0xE01E5A
+	case EventType_ALERT_FLAPPING:
+		return "FLAPPING", 0xF2A93B
+	case EventType_ALERT_ACKNOWLEDGED:
+		return "ACKNOWLEDGED", 0x3B82F6
+	case EventType_ALERT_RESOLVED:
+		return "RESOLVED", 0x2EB67D
+	}
+	return "TEST", 0x6B7280
+}
+
+// metricSummary is a short summary of the probe data behind the alert (loss, rtt & the furthest mtr hop
+// losing packets), falling back to the alerted metric when the data isn't available
+func metricSummary(e *Event) string {
+	var parts []string
+	m := e.ProbeData.Metrics()
+
+	switch d := e.ProbeData.Data.(type) {
+	case agent.PingResult:
+		parts = append(parts, fmt.Sprintf("loss %.1f%%", m["PingResult.PacketLoss"]), fmt.Sprintf("rtt %.1f ms", m["PingResult.AvgRtt"]))
+	case agent.TrafficSimClientStats:
+		parts = append(parts, fmt.Sprintf("loss %.1f%%", m["TrafficSimClientStats.LossPercentage"]), fmt.Sprintf("rtt %.1f ms", m["TrafficSimClientStats.AverageRTT"]))
+	case agent.MtrResult:
+		parts = append(parts, fmt.Sprintf("loss %.1f%%", m["MtrResult.FinalHopLoss"]), fmt.Sprintf("rtt %.1f ms", m["MtrResult.FinalHopAvg"]))
+		if hop, ok := d.LastLossHop(); ok {
+			host := hop.IP
+			if host == "" {
+				host = "???"
+			} else if hop.Hostname != "" && hop.Hostname != hop.IP {
+				host = hop.Hostname + " (" + hop.IP + ")"
+			}
+			parts = append(parts, fmt.Sprintf("last hop with loss #%d %s (%.1f%%)", hop.TTL, host, hop.Loss))
+		}
+	}
+
+	if len(parts) == 0 && e.Alert.Metric != "" {
+		parts = append(parts, fmt.Sprintf("%s %s", e.Alert.Metric, strconv.FormatFloat(e.Alert.Value, 'f', -1, 64)))
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+func (d *Dispatcher) probeLink(e *Event) string {
+	if d.BaseURL == "" || e.Probe.ID.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%s/workspace/%s/agent/%s/probe/%s", d.BaseURL, e.Alert.Site.Hex(), e.Alert.Agent.Hex(), e.Probe.ID.Hex())
+}
+
+func (d *Dispatcher) chatMessage(e *Event) chatMessage {
+	status, color := chatStatus(e)
+
+	msg := chatMessage{
+		ID:        fmt.Sprintf("%s-%s-%d", e.Alert.ID.Hex(), e.Type, e.Timestamp.UnixNano()),
+		Title:     status,
+		Text:      e.Alert.Message,
+		Color:     color,
+		Link:      d.probeLink(e),
+		Timestamp: e.Timestamp,
+	}
+	if e.Agent.Name != "" {
+		msg.Title = fmt.Sprintf("%s: %s", status, e.Agent.Name)
+	}
+
+	agentName := e.Agent.Name
+	if e.Agent.Location != "" {
+		agentName += " (" + e.Agent.Location + ")"
+	}
+	if agentName != "" {
+		msg.Fields = append(msg.Fields, chatField{"Agent", agentName})
+	}
+
+	if e.Probe.Type != "" {
+		probe := string(e.Probe.Type)
+		if e.Target.Target != "" {
+			probe += " → " + e.Target.Target
+		}
+		msg.Fields = append(msg.Fields, chatField{"Probe", probe})
+	}
+
+	if e.Alert.Severity != "" {
+		msg.Fields = append(msg.Fields, chatField{"Severity", string(e.Alert.Severity)})
+	}
+
+	if summary := metricSummary(e); summary != "" {
+		msg.Fields = append(msg.Fields, chatField{"Metrics", summary})
+	}
+
+	return msg
+}
+
+// slackEscape escapes the characters slack treats as control sequences in mrkdwn
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// sendSlack posts the message as slack blocks to an incoming webhook
+func sendSlack(client *http.Client, ch *Channel, msg chatMessage) (int, error) {
+	fields := make([]map[string]interface{}, 0, len(msg.Fields))
+	for _, f := range msg.Fields {
+		fields = append(fields, map[string]interface{}{"type": "mrkdwn", "text": "*" + f.Name + "*\n" + slackEscape(f.Value)})
+	}
+
+	blocks := []map[string]interface{}{
+		{"type": "header", "text": map[string]interface{}{"type": "plain_text", "text": msg.Title}},
+	}
+	if msg.Text != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "section", "text": map[string]interface{}{"type": "mrkdwn", "text": slackEscape(msg.Text)}})
+	}
+	if len(fields) > 0 {
+		blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields})
+	}
+	if msg.Link != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "actions", "elements": []map[string]interface{}{
+			{"type": "button", "text": map[string]interface{}{"type": "plain_text", "text": "View probe"}, "url": msg.Link},
+		}})
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"text":   msg.Title + " " + msg.Text, // notification fallback
+		"blocks": blocks,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return sendJSON(client, http.MethodPost, ch.URL, nil, body)
+}
+
+// sendDiscord posts the message as an embed to a discord webhook
+func sendDiscord(client *http.Client, ch *Channel, msg chatMessage) (int, error) {
+	fields := make([]map[string]interface{}, 0, len(msg.Fields))
+	for _, f := range msg.Fields {
+		fields = append(fields, map[string]interface{}{"name": f.Name, "value": f.Value, "inline": f.Name != "Metrics"})
+	}
+
+	embed := map[string]interface{}{
+		"title":       msg.Title,
+		"description": msg.Text,
+		"color":       msg.Color,
+		"fields":      fields,
+		"timestamp":   msg.Timestamp.UTC().Format(time.RFC3339),
+		"footer":      map[string]string{"text": "nw-guardian"},
+	}
+	if msg.Link != "" {
+		embed["url"] = msg.Link
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"username": "Guardian",
+		"embeds":   []map[string]interface{}{embed},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return sendJSON(client, http.MethodPost, ch.URL, nil, body)
+}
+
+// sendMatrix sends the message to the room as an html formatted m.room.message
+func sendMatrix(client *http.Client, ch *Channel, msg chatMessage) (int, error) {
+	var text, formatted strings.Builder
+
+	text.WriteString(msg.Title + "\n")
+	formatted.WriteString(fmt.Sprintf(`<h4><font color="#%06x">%s</font></h4>`, msg.Color, html.EscapeString(msg.Title)))
+	if msg.Text != "" {
+		text.WriteString(msg.Text + "\n")
+		formatted.WriteString("<p>" + html.EscapeString(msg.Text) + "</p>")
+	}
+	if len(msg.Fields) > 0 {
+		formatted.WriteString("<ul>")
+		for _, f := range msg.Fields {
+			text.WriteString(f.Name + ": " + f.Value + "\n")
+			formatted.WriteString("<li><b>" + html.EscapeString(f.Name) + "</b>: " + html.EscapeString(f.Value) + "</li>")
+		}
+		formatted.WriteString("</ul>")
+	}
+	if msg.Link != "" {
+		text.WriteString(msg.Link)
+		formatted.WriteString(`<p><a href="` + html.EscapeString(msg.Link) + `">View probe</a></p>`)
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"msgtype":        "m.notice",
+		"body":           strings.TrimSpace(text.String()),
+		"format":         "org.matrix.custom.html",
+		"formatted_body": formatted.String(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// the transaction id stays the same across retries so the homeserver doesn't post the message twice
+	target := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", strings.TrimSuffix(ch.URL, "/"), url.PathEscape(ch.Room), url.PathEscape(msg.ID))
+
+	return sendJSON(client, http.MethodPut, target, map[string]string{"Authorization": "Bearer " + ch.Key}, body)
+}
@@ -0,0 +1,110 @@
+package notifications
+
+import (
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChatDelivery(t *testing.T) {
+	tests := []struct {
+		channelType ChannelType
+		method      string
+		check       func(t *testing.T, r standInRequest)
+	}{
+		{
+			channelType: ChannelType_SLACK,
+			method:      http.MethodPost,
+			check: func(t *testing.T, r standInRequest) {
+				var got struct {
+					Text   string `json:"text"`
+					Blocks []struct {
+						Type string `json:"type"`
+						Text struct {
+							Text string `json:"text"`
+						} `json:"text"`
+					} `json:"blocks"`
+				}
+				if err := json.Unmarshal(r.body, &got); err != nil {
+					t.Fatalf("invalid body: %v", err)
+				}
+				if len(got.Blocks) < 2 || got.Blocks[0].Text.Text != "FIRING: edge-1" {
+					t.Errorf("blocks = %+v", got.Blocks)
+				}
+				if !strings.Contains(got.Blocks[1].Text.Text, "&lt;edge&gt; &amp; core") {
+					t.Errorf("message isn't escaped for mrkdwn: %q", got.Blocks[1].Text.Text)
+				}
+			},
+		},
+		{
+			channelType: ChannelType_DISCORD,
+			method:      http.MethodPost,
+			check: func(t *testing.T, r standInRequest) {
+				var got struct {
+					Embeds []struct {
+						Title       string `json:"title"`
+						Description string `json:"description"`
+						Color       int    `json:"color"`
+					} `json:"embeds"`
+				}
+				if err := json.Unmarshal(r.body, &got); err != nil {
+					t.Fatalf("invalid body: %v", err)
+				}
+				if len(got.Embeds) != 1 || got.Embeds[0].Title != "FIRING: edge-1" || got.Embeds[0].Color != 0xE01E5A {
+					t.Errorf("embeds = %+v", got.Embeds)
+				}
+			},
+		},
+		{
+			channelType: ChannelType_MATRIX,
+			method:      http.MethodPut,
+			check: func(t *testing.T, r standInRequest) {
+				if !strings.HasPrefix(r.path, "/_matrix/client/v3/rooms/!room:example.org/send/m.room.message/") {
+					t.Errorf("path = %s", r.path)
+				}
+				if got := r.header.Get("Authorization"); got != "Bearer token" {
+					t.Errorf("authorization = %q", got)
+				}
+				var got map[string]string
+				if err := json.Unmarshal(r.body, &got); err != nil {
+					t.Fatalf("invalid body: %v", err)
+				}
+				if got["msgtype"] != "m.notice" || !strings.Contains(got["formatted_body"], "&lt;edge&gt; &amp; core") {
+					t.Errorf("message = %v", got)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.channelType), func(t *testing.T) {
+			server := newStandIn(t, http.StatusServiceUnavailable)
+			d, deliveries := testDispatcher()
+			ch := &Channel{ID: primitive.NewObjectID(), Type: tt.channelType, URL: server.URL, Key: "token", Room: "!room:example.org"}
+			e := testEvent(EventType_ALERT_FIRING)
+			e.Alert.Message = "loss between <edge> & core"
+
+			d.deliver(ch, e)
+
+			requests := server.got()
+			if len(requests) != 2 {
+				t.Fatalf("%d requests, want the failed one & its retry", len(requests))
+			}
+			if n := len(*deliveries); n != 2 || (*deliveries)[0].Success || !(*deliveries)[1].Success {
+				t.Errorf("deliveries = %+v", *deliveries)
+			}
+			// the retry is the same message, matrix relies on it to not post it twice
+			if requests[0].path != requests[1].path || string(requests[0].body) != string(requests[1].body) {
+				t.Errorf("retry differs: %s %s, then %s %s", requests[0].path, requests[0].body, requests[1].path, requests[1].body)
+			}
+
+			r := requests[1]
+			if r.method != tt.method || r.header.Get("Content-Type") != "application/json" {
+				t.Errorf("%s with content type %q, want %s", r.method, r.header.Get("Content-Type"), tt.method)
+			}
+			tt.check(t, r)
+		})
+	}
+}
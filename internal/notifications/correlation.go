@@ -0,0 +1,520 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultCorrelationWindow = 5 * time.Minute
+
+// correlationWindowFromEnv reads the ALERT_CORRELATION_WINDOW env variable (eg. "5m"), "0" disables correlation
+func correlationWindowFromEnv() time.Duration {
+	env := os.Getenv("ALERT_CORRELATION_WINDOW")
+	if env == "" {
+		return defaultCorrelationWindow
+	}
+	if env == "0" {
+		return 0
+	}
+
+	w, err := time.ParseDuration(env)
+	if err != nil || w < 0 {
+		log.Warnf("invalid ALERT_CORRELATION_WINDOW %q, using %s", env, defaultCorrelationWindow)
+		return defaultCorrelationWindow
+	}
+	return w
+}
+
+// CorrelationDimension is what the alerts of an incident have in common
+type CorrelationDimension string
+
+const (
+	CorrelationDimension_HOP      CorrelationDimension = "HOP"      // the furthest mtr hop losing packets
+	CorrelationDimension_PROVIDER CorrelationDimension = "PROVIDER" // internet provider of the agents
+	CorrelationDimension_TARGET   CorrelationDimension = "TARGET"   // probe target
+	CorrelationDimension_GROUP    CorrelationDimension = "GROUP"    // agent group
+)
+
+type IncidentStatus string
+
+const (
+	IncidentStatus_OPEN         IncidentStatus = "OPEN"
+	IncidentStatus_ACKNOWLEDGED IncidentStatus = "ACKNOWLEDGED"
+	IncidentStatus_RESOLVED     IncidentStatus = "RESOLVED"
+)
+
+// Incident is the parent of alerts raised by different agents of a workspace around the same time that share
+// a dimension, eg. twenty agents losing packets because their common upstream provider is down
+type Incident struct {
+	ID         primitive.ObjectID   `json:"id" bson:"_id"`
+	Site       primitive.ObjectID   `json:"site" bson:"site"`
+	Dimension  CorrelationDimension `json:"dimension" bson:"dimension"`
+	Key        string               `json:"key" bson:"key"` // value of the dimension, eg. the provider name or hop address
+	Title      string               `json:"title" bson:"title"`
+	Severity   agent.AlertSeverity  `json:"severity" bson:"severity"` // highest severity of the alerts
+	Status     IncidentStatus       `json:"status" bson:"status"`
+	Alerts     []primitive.ObjectID `json:"alerts" bson:"alerts"`
+	Agents     []primitive.ObjectID `json:"agents" bson:"agents"`
+	CreatedAt  time.Time            `json:"createdAt" bson:"createdAt"`
+	UpdatedAt  time.Time            `json:"updatedAt" bson:"updatedAt"` // last time an alert joined
+	ResolvedAt time.Time            `json:"resolvedAt,omitempty" bson:"resolvedAt,omitempty"`
+}
+
+func (i *Incident) Get(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "correlation.Get", ObjectID: i.ID}
+
+	err := db.Collection("incidents").FindOne(context.TODO(), bson.M{"_id": i.ID}).Decode(i)
+	if err != nil {
+		ee.Message = "unable to find incident"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// GetIncidentsForSite returns the incidents of the site, newest first. The status is optional.
+func GetIncidentsForSite(db *mongo.Database, site primitive.ObjectID, status IncidentStatus, limit int64) ([]Incident, error) {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "correlation.GetIncidentsForSite", ObjectID: site}
+
+	filter := bson.M{"site": site}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	opts := options.Find().SetSort(bson.M{"createdAt": -1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := db.Collection("incidents").Find(context.TODO(), filter, opts)
+	if err != nil {
+		ee.Message = "unable to find incidents"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var incidents []Incident
+	if err = cursor.All(context.TODO(), &incidents); err != nil {
+		ee.Message = "unable to decode incidents"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return incidents, nil
+}
+
+// dimension is a value of a correlation dimension an alert has
+type dimension struct {
+	Dimension CorrelationDimension
+	Key       string
+	Label     string
+}
+
+// correlator computes the dimensions of the alerts of a site, caching the lookups done per agent
+type correlator struct {
+	db         *mongo.Database
+	site       primitive.ObjectID
+	providers  map[primitive.ObjectID]string
+	groups     map[primitive.ObjectID][]primitive.ObjectID
+	groupNames map[primitive.ObjectID]string
+}
+
+func newCorrelator(db *mongo.Database, site primitive.ObjectID) *correlator {
+	c := &correlator{
+		db:         db,
+		site:       site,
+		providers:  make(map[primitive.ObjectID]string),
+		groups:     make(map[primitive.ObjectID][]primitive.ObjectID),
+		groupNames: make(map[primitive.ObjectID]string),
+	}
+
+	groups, err := (&agent.Group{SiteID: site}).GetAll(db)
+	if err != nil {
+		log.Error(err)
+	}
+	for _, g := range groups {
+		c.groupNames[g.ID] = g.Name
+	}
+
+	return c
+}
+
+func (c *correlator) provider(agentID primitive.ObjectID) string {
+	if p, ok := c.providers[agentID]; ok {
+		return p
+	}
+
+	var provider string
+	netInfo, err := agent.GetAgentNetInfo(c.db, agentID)
+	if err != nil {
+		log.Warn(err)
+	} else if netInfo != nil {
+		provider = netInfo.InternetProvider
+	}
+
+	c.providers[agentID] = provider
+	return provider
+}
+
+func (c *correlator) agentGroups(agentID primitive.ObjectID) []primitive.ObjectID {
+	if g, ok := c.groups[agentID]; ok {
+		return g
+	}
+
+	groups, err := agent.GetGroupIDsForAgent(c.db, agentID)
+	if err != nil {
+		log.Warn(err)
+	}
+
+	c.groups[agentID] = groups
+	return groups
+}
+
+// dimensions returns the dimensions of the alert, the most specific first
+func (c *correlator) dimensions(alert *agent.ProbeAlert) []dimension {
+	var dims []dimension
+
+	if mtr, ok := alert.ProbeData.Data.(agent.MtrResult); ok {
+		if hop, ok := mtr.LastLossHop(); ok && hop.IP != "" {
+			dims = append(dims, dimension{CorrelationDimension_HOP, hop.IP, "mtr hop " + hop.IP})
+		}
+	}
+
+	if provider := c.provider(alert.Agent); provider != "" {
+		dims = append(dims, dimension{CorrelationDimension_PROVIDER, provider, "internet provider " + provider})
+	}
+
+	if alert.Target.Target != "" {
+		dims = append(dims, dimension{CorrelationDimension_TARGET, alert.Target.Target, "target " + alert.Target.Target})
+	} else if alert.Target.Agent != primitive.NilObjectID {
+		dims = append(dims, dimension{CorrelationDimension_TARGET, "agent:" + alert.Target.Agent.Hex(), "target agent " + alert.Target.Agent.Hex()})
+	}
+
+	for _, g := range c.agentGroups(alert.Agent) {
+		name := c.groupNames[g]
+		if name == "" {
+			name = g.Hex()
+		}
+		dims = append(dims, dimension{CorrelationDimension_GROUP, g.Hex(), "agent group " + name})
+	}
+
+	return dims
+}
+
+func hasDimension(dims []dimension, dim dimension) bool {
+	for _, d := range dims {
+		if d.Dimension == dim.Dimension && d.Key == dim.Key {
+			return true
+		}
+	}
+	return false
+}
+
+// correlate groups a newly raised alert into an incident, either by joining an open incident sharing one
+// of its dimensions or by opening one with the alerts other agents raised within the correlation window.
+// True is returned when the alert was grouped, it is then only notified through its incident.
+func (d *Dispatcher) correlate(alert *agent.ProbeAlert) bool {
+	if d.CorrelationWindow <= 0 || alert.Incident != primitive.NilObjectID {
+		return false
+	}
+
+	// alerts are raised concurrently, without the lock two of them could open the same incident
+	d.correlateMu.Lock()
+	defer d.correlateMu.Unlock()
+
+	since := time.Now().Add(-d.CorrelationWindow)
+	c := newCorrelator(d.DB, alert.Site)
+
+	dims := c.dimensions(alert)
+	if len(dims) == 0 {
+		return false
+	}
+
+	for _, dim := range dims {
+		var incident Incident
+		filter := bson.M{
+			"site":      alert.Site,
+			"dimension": dim.Dimension,
+			"key":       dim.Key,
+			"status":    bson.M{"$ne": IncidentStatus_RESOLVED},
+			"updatedAt": bson.M{"$gte": since},
+		}
+		err := d.DB.Collection("incidents").FindOne(context.TODO(), filter).Decode(&incident)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			log.Error(err)
+			return false
+		}
+
+		return d.joinIncident(&incident, alert)
+	}
+
+	candidates, err := agent.GetUncorrelatedAlerts(d.DB, alert.Site, since, alert.Agent)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+
+	candidateDims := make([][]dimension, len(candidates))
+	for i := range candidates {
+		candidateDims[i] = c.dimensions(&candidates[i])
+	}
+
+	for _, dim := range dims {
+		var matched []agent.ProbeAlert
+		for i := range candidates {
+			if hasDimension(candidateDims[i], dim) {
+				matched = append(matched, candidates[i])
+			}
+		}
+		if len(matched) > 0 {
+			return d.openIncident(dim, alert, matched)
+		}
+	}
+
+	return false
+}
+
+func maxSeverity(a agent.AlertSeverity, b agent.AlertSeverity) agent.AlertSeverity {
+	if a == "" {
+		a = agent.AlertSeverity_CRITICAL
+	}
+	if b == "" {
+		b = agent.AlertSeverity_CRITICAL
+	}
+	if b.Rank() > a.Rank() {
+		return b
+	}
+	return a
+}
+
+// openIncident opens an incident for the alert and the earlier alerts it correlates with, the earlier
+// alerts have already been notified on their own so only the new alert is grouped
+func (d *Dispatcher) openIncident(dim dimension, alert *agent.ProbeAlert, matched []agent.ProbeAlert) bool {
+	incident := Incident{
+		ID:        primitive.NewObjectID(),
+		Site:      alert.Site,
+		Dimension: dim.Dimension,
+		Key:       dim.Key,
+		Title:     "Alerts correlated by " + dim.Label,
+		Severity:  alert.Severity,
+		Status:    IncidentStatus_OPEN,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	for _, a := range append(matched, *alert) {
+		incident.Alerts = append(incident.Alerts, a.ID)
+		if !containsID(incident.Agents, a.Agent) {
+			incident.Agents = append(incident.Agents, a.Agent)
+		}
+		incident.Severity = maxSeverity(incident.Severity, a.Severity)
+	}
+
+	_, err := d.DB.Collection("incidents").InsertOne(context.TODO(), incident)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+
+	for i := range matched {
+		if err := matched[i].SetIncident(d.DB, incident.ID, false); err != nil {
+			log.Error(err)
+		}
+	}
+	if err := alert.SetIncident(d.DB, incident.ID, true); err != nil {
+		log.Error(err)
+		return false
+	}
+
+	log.Warnf("opened incident %s - %s (%d alerts across %d agents)", incident.ID.Hex(), incident.Title, len(incident.Alerts), len(incident.Agents))
+
+	d.notifyIncident(EventType_ALERT_FIRING, &incident)
+	return true
+}
+
+// joinIncident adds the alert to the open incident without notifying anyone
+func (d *Dispatcher) joinIncident(incident *Incident, alert *agent.ProbeAlert) bool {
+	update := bson.M{
+		"$addToSet": bson.M{"alerts": alert.ID, "agents": alert.Agent},
+		"$set":      bson.M{"updatedAt": time.Now(), "severity": maxSeverity(incident.Severity, alert.Severity)},
+	}
+	_, err := d.DB.Collection("incidents").UpdateOne(context.TODO(), bson.M{"_id": incident.ID}, update)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+
+	if err := alert.SetIncident(d.DB, incident.ID, true); err != nil {
+		log.Error(err)
+		return false
+	}
+
+	log.Infof("alert %s joined incident %s", alert.ID.Hex(), incident.ID.Hex())
+	return true
+}
+
+// closeIncident resolves the incident once none of its alerts are open
+func (d *Dispatcher) closeIncident(id primitive.ObjectID) {
+	open, err := agent.GetIncidentAlerts(d.DB, id, true)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(open) > 0 {
+		return
+	}
+
+	// only the resolve that changes the status notifies, the last alerts may resolve concurrently
+	filter := bson.M{"_id": id, "status": bson.M{"$ne": IncidentStatus_RESOLVED}}
+	update := bson.M{"$set": bson.M{"status": IncidentStatus_RESOLVED, "resolvedAt": time.Now()}}
+	result, err := d.DB.Collection("incidents").UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if result.ModifiedCount == 0 {
+		return
+	}
+
+	incident := Incident{ID: id}
+	if err := incident.Get(d.DB); err != nil {
+		log.Error(err)
+		return
+	}
+
+	log.Infof("resolved incident %s", id.Hex())
+	d.notifyIncident(EventType_ALERT_RESOLVED, &incident)
+}
+
+// incidentKeyPrefix starts the dedup key of correlated incidents sent to incident tools
+const incidentKeyPrefix = "guardian-incident-"
+
+func incidentDedupKey(incident primitive.ObjectID) string {
+	return incidentKeyPrefix + incident.Hex()
+}
+
+// incidentFromDedupKey returns the incident of the dedup key, false when the key isn't one of an incident
+func incidentFromDedupKey(key string) (primitive.ObjectID, bool) {
+	if !strings.HasPrefix(key, incidentKeyPrefix) {
+		return primitive.NilObjectID, false
+	}
+	id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(key, incidentKeyPrefix))
+	if err != nil {
+		return primitive.NilObjectID, false
+	}
+	return id, true
+}
+
+// notifyIncident sends a single event for the whole incident to every member and enabled channel of the
+// workspace, the alert of the event summarizes the incident so every channel type can render it
+func (d *Dispatcher) notifyIncident(eventType EventType, incident *Incident) {
+	alerts, err := agent.GetIncidentAlerts(d.DB, incident.ID, false)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	status := agent.AlertStatus_FIRING
+	switch incident.Status {
+	case IncidentStatus_ACKNOWLEDGED:
+		status = agent.AlertStatus_ACKNOWLEDGED
+	case IncidentStatus_RESOLVED:
+		status = agent.AlertStatus_RESOLVED
+	}
+
+	e := Event{
+		Type:      eventType,
+		Timestamp: time.Now(),
+		Alert: agent.ProbeAlert{
+			ID:        incident.ID,
+			Site:      incident.Site,
+			Severity:  incident.Severity,
+			Status:    status,
+			Message:   fmt.Sprintf("%s: %d alerts across %d agents", incident.Title, len(incident.Alerts), len(incident.Agents)),
+			Timestamp: incident.CreatedAt,
+			DedupKey:  incidentDedupKey(incident.ID),
+			Incident:  incident.ID,
+		},
+		Agent:    EventAgent{Name: fmt.Sprintf("%d agents", len(incident.Agents))},
+		Incident: incident,
+		Alerts:   alerts,
+	}
+	if incident.Dimension == CorrelationDimension_TARGET {
+		e.Target = agent.ProbeTarget{Target: incident.Key}
+	}
+	for _, a := range alerts {
+		if a.Probe.Notifications {
+			e.Probe.Notifications = true
+			break
+		}
+	}
+
+	d.broadcast(&e)
+}
+
+// AcknowledgeIncident acknowledges every firing alert of the incident, notifying the incident once
+func (d *Dispatcher) AcknowledgeIncident(incident *Incident, user primitive.ObjectID) error {
+	alerts, err := agent.GetIncidentAlerts(d.DB, incident.ID, true)
+	if err != nil {
+		return err
+	}
+
+	for i := range alerts {
+		alert := alerts[i]
+		if alert.Status == agent.AlertStatus_ACKNOWLEDGED {
+			continue
+		}
+		if err := alert.Acknowledge(d.DB, user); err != nil {
+			log.Warn(err)
+			continue
+		}
+		d.Dispatch(EventType_ALERT_ACKNOWLEDGED, &alert)
+	}
+
+	_, err = d.DB.Collection("incidents").UpdateOne(context.TODO(), bson.M{"_id": incident.ID, "status": IncidentStatus_OPEN},
+		bson.M{"$set": bson.M{"status": IncidentStatus_ACKNOWLEDGED}})
+	if err != nil {
+		return err
+	}
+	incident.Status = IncidentStatus_ACKNOWLEDGED
+
+	go d.notifyIncident(EventType_ALERT_ACKNOWLEDGED, incident)
+	return nil
+}
+
+// ResolveIncident resolves every open alert of the incident, the incident resolves with its last alert
+func (d *Dispatcher) ResolveIncident(incident *Incident, user primitive.ObjectID) error {
+	alerts, err := agent.GetIncidentAlerts(d.DB, incident.ID, true)
+	if err != nil {
+		return err
+	}
+
+	for i := range alerts {
+		alert := alerts[i]
+		if err := alert.Resolve(d.DB, user); err != nil {
+			log.Warn(err)
+			continue
+		}
+		d.release(alert.ID)
+		d.Dispatch(EventType_ALERT_RESOLVED, &alert)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package notifications
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"nw-guardian/internal"
+	"time"
+)
+
+// Delivery is a single attempt at delivering an event to a channel
+type Delivery struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	Channel    primitive.ObjectID `json:"channel" bson:"channel"`
+	Site       primitive.ObjectID `json:"site" bson:"site"`
+	Alert      primitive.ObjectID `json:"alert" bson:"alert"`
+	Event      EventType          `json:"event" bson:"event"`
+	Attempt    int                `json:"attempt" bson:"attempt"`
+	StatusCode int                `json:"statusCode" bson:"statusCode"`
+	Error      string             `json:"error,omitempty" bson:"error,omitempty"`
+	Success    bool               `json:"success" bson:"success"`
+	Duration   int64              `json:"duration" bson:"duration"` // milliseconds
+	Timestamp  time.Time          `json:"timestamp" bson:"timestamp"`
+}
+
+func (d *Delivery) Create(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "deliveries.Create", ObjectID: d.Channel}
+
+	d.ID = primitive.NewObjectID()
+	if (d.Timestamp == time.Time{}) {
+		d.Timestamp = time.Now()
+	}
+
+	_, err := db.Collection("notification_deliveries").InsertOne(context.TODO(), d)
+	if err != nil {
+		ee.Message = "error inserting notification delivery"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// GetDeliveries returns the delivery log of a channel, newest first
+func GetDeliveries(db *mongo.Database, channel primitive.ObjectID, limit int64) ([]Delivery, error) {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "deliveries.GetDeliveries", ObjectID: channel}
+
+	opts := options.Find().SetSort(bson.M{"timestamp": -1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := db.Collection("notification_deliveries").Find(context.TODO(), bson.M{"channel": channel}, opts)
+	if err != nil {
+		ee.Message = "unable to find notification deliveries"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var deliveries []Delivery
+	if err = cursor.All(context.TODO(), &deliveries); err != nil {
+		ee.Message = "unable to decode notification deliveries"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return deliveries, nil
+}
@@ -0,0 +1,304 @@
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/users"
+	"nw-guardian/internal/workspace"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventType_ALERT_FIRING       EventType = "ALERT_FIRING"
+	EventType_ALERT_ACKNOWLEDGED EventType = "ALERT_ACKNOWLEDGED"
+	EventType_ALERT_FLAPPING     EventType = "ALERT_FLAPPING"
+	EventType_ALERT_RESOLVED     EventType = "ALERT_RESOLVED"
+	EventType_TEST               EventType = "TEST"
+)
+
+// Event is the payload delivered to the notification channels
+type Event struct {
+	Type      EventType         `json:"type"`
+	Timestamp time.Time         `json:"timestamp"`
+	Alert     agent.ProbeAlert  `json:"alert"`
+	Agent     EventAgent        `json:"agent"`
+	Probe     agent.Probe       `json:"probe"`
+	Target    agent.ProbeTarget `json:"target"`
+	ProbeData agent.ProbeData   `json:"probe_data"`
+
+	EscalationStep int `json:"escalationStep,omitempty"` // step of the escalation policy being notified
+
+	Incident *Incident          `json:"incident,omitempty"` // set for events of a correlated incident
+	Alerts   []agent.ProbeAlert `json:"alerts,omitempty"`   // alerts of the incident
+}
+
+// EventAgent is the agent of an event as sent to the channels, it leaves out the pin the agent
+// authenticates with along with everything else channels have no use for
+type EventAgent struct {
+	ID       primitive.ObjectID `json:"id"`
+	Name     string             `json:"name"`
+	Site     primitive.ObjectID `json:"site"`
+	Location string             `json:"location"`
+}
+
+// Dispatcher delivers alert events to the channels configured on the workspace of the alert
+type Dispatcher struct {
+	DB          *mongo.Database
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration       // delay before the first retry, doubled after every attempt
+	Email       *users.EmailService // alert emails are only sent when set
+	BaseURL     string              // url of the frontend, chat messages link back to it
+
+	// Release is called with the alerts closed outside of the alert engine (by an incident or its incident tool),
+	// so the engine drops their state instead of waiting for its next prune
+	Release func(alert primitive.ObjectID)
+
+	CorrelationWindow time.Duration // alerts raised within the window are correlated, 0 disables correlation
+	correlateMu       sync.Mutex
+
+	record func(delivery *Delivery) error // stores the delivery log, Delivery.Create when nil
+}
+
+func NewDispatcher(db *mongo.Database) *Dispatcher {
+	return &Dispatcher{
+		DB:          db,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 5,
+		Backoff:     2 * time.Second,
+		BaseURL:     strings.TrimSuffix(os.Getenv("BASE_URL"), "/"),
+
+		CorrelationWindow: correlationWindowFromEnv(),
+	}
+}
+
+func (d *Dispatcher) newEvent(eventType EventType, alert *agent.ProbeAlert) Event {
+	event := Event{
+		Type:      eventType,
+		Timestamp: time.Now(),
+		Alert:     *alert,
+		Probe:     alert.Probe,
+		Target:    alert.Target,
+		ProbeData: alert.ProbeData,
+	}
+
+	a := agent.Agent{ID: alert.Agent}
+	err := a.Get(d.DB)
+	if err != nil {
+		log.Error(err)
+	}
+	event.Agent = EventAgent{ID: a.ID, Name: a.Name, Site: a.Site, Location: a.Location}
+
+	return event
+}
+
+// release hands the alert closed outside of the alert engine to Release, if set
+func (d *Dispatcher) release(alert primitive.ObjectID) {
+	if d.Release != nil {
+		d.Release(alert)
+	}
+}
+
+// Dispatch delivers the event for the alert in the background, a nil dispatcher does nothing.
+// Alerts grouped into a correlated incident are only notified through the incident, which is
+// resolved once its last alert is.
+func (d *Dispatcher) Dispatch(eventType EventType, alert *agent.ProbeAlert) {
+	if d == nil {
+		return
+	}
+
+	alertCopy := *alert
+
+	go func(alert agent.ProbeAlert) {
+		if !alert.Grouped {
+			d.notify(eventType, &alert)
+		}
+		if eventType == EventType_ALERT_RESOLVED && alert.Incident != primitive.NilObjectID {
+			d.closeIncident(alert.Incident)
+		}
+	}(alertCopy)
+}
+
+// Raise dispatches the event of a newly created alert, the alert is first correlated with the
+// alerts other agents of the workspace raised recently and isn't notified on its own when grouped
+func (d *Dispatcher) Raise(eventType EventType, alert *agent.ProbeAlert) {
+	if d == nil {
+		return
+	}
+
+	alertCopy := *alert
+
+	go func(alert agent.ProbeAlert) {
+		if d.correlate(&alert) {
+			return
+		}
+		d.notify(eventType, &alert)
+	}(alertCopy)
+}
+
+// notify sends the event for the alert. Alerts routed by an escalation policy only notify the steps
+// that are due (or have already been notified for acknowledgements and resolves), every other alert
+// goes to all the enabled channels and members of its workspace.
+func (d *Dispatcher) notify(eventType EventType, alert *agent.ProbeAlert) {
+	e := d.newEvent(eventType, alert)
+
+	if alert.Policy == primitive.NilObjectID && (eventType == EventType_ALERT_FIRING || eventType == EventType_ALERT_FLAPPING) {
+		policy, err := d.policyFor(alert)
+		if err != nil {
+			log.Error(err)
+		}
+		if policy != nil {
+			err = e.Alert.SetPolicy(d.DB, policy.ID)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			d.escalate(&e, policy)
+			return
+		}
+	}
+
+	if alert.Policy != primitive.NilObjectID {
+		policy := EscalationPolicy{ID: alert.Policy}
+		err := policy.Get(d.DB)
+		if err == nil {
+			steps := policy.Steps
+			if alert.EscalationStep < len(steps) {
+				steps = steps[:alert.EscalationStep]
+			}
+			d.notifySteps(&e, steps)
+			return
+		}
+		// the policy was deleted, fall back to notifying everyone
+		log.Warn(err)
+	}
+
+	d.broadcast(&e)
+}
+
+// broadcast sends the event to every member and enabled channel of the workspace
+func (d *Dispatcher) broadcast(e *Event) {
+	d.emailMembers(e, func(workspace.Member) bool {
+		return true
+	})
+
+	channels, err := GetChannelsForSite(d.DB, e.Alert.Site, true)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	for i := range channels {
+		go d.deliver(&channels[i], e)
+	}
+}
+
+// Test sends a single test event to the channel without retrying, returning the logged delivery.
+// The incident opened on incident channels is resolved straight away.
+func (d *Dispatcher) Test(ch *Channel) (*Delivery, error) {
+	event := Event{
+		Type:      EventType_TEST,
+		Timestamp: time.Now(),
+		Alert: agent.ProbeAlert{
+			Site:      ch.Site,
+			Message:   "test notification from guardian",
+			Timestamp: time.Now(),
+			DedupKey:  "guardian-test-" + ch.ID.Hex(),
+		},
+	}
+
+	delivery := d.attempt(ch, &event, 1)
+	if ch.Incident() && delivery.Success {
+		resolve := event
+		resolve.Type = EventType_ALERT_RESOLVED
+		if _, err := d.send(ch, &resolve); err != nil {
+			log.Warn(err)
+		}
+	}
+
+	return delivery, nil
+}
+
+// send delivers the event in the format of the channel type
+func (d *Dispatcher) send(ch *Channel, e *Event) (int, error) {
+	switch ch.Type {
+	case ChannelType_PAGERDUTY:
+		return sendPagerDuty(d.Client, ch, e)
+	case ChannelType_OPSGENIE:
+		return sendOpsgenie(d.Client, ch, e)
+	case ChannelType_SLACK:
+		return sendSlack(d.Client, ch, d.chatMessage(e))
+	case ChannelType_DISCORD:
+		return sendDiscord(d.Client, ch, d.chatMessage(e))
+	case ChannelType_MATRIX:
+		return sendMatrix(d.Client, ch, d.chatMessage(e))
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	return sendWebhook(d.Client, ch, e.Type, body)
+}
+
+// deliver sends the event to the channel, retrying with an exponential backoff
+func (d *Dispatcher) deliver(ch *Channel, e *Event) {
+	if !ch.Accepts(e.Alert.Severity) {
+		return
+	}
+	if ch.Incident() && e.Type == EventType_ALERT_RESOLVED && d.incidentShared(e) {
+		log.Debugf("not resolving incident %s on channel %s, other alerts of it are still open", e.Alert.DedupKey, ch.Name)
+		return
+	}
+
+	attempts, err := internal.Retry(d.MaxAttempts, d.Backoff, func(attempt int) (int, error) {
+		delivery := d.attempt(ch, e, attempt)
+		if !delivery.Success {
+			return delivery.StatusCode, errors.New(delivery.Error)
+		}
+		return delivery.StatusCode, nil
+	})
+	if err != nil && attempts == d.MaxAttempts {
+		log.Warnf("giving up delivering %s for alert %s to channel %s after %d attempts", e.Type, e.Alert.ID.Hex(), ch.Name, d.MaxAttempts)
+	}
+}
+
+func (d *Dispatcher) attempt(ch *Channel, e *Event, attempt int) *Delivery {
+	delivery := Delivery{
+		Channel: ch.ID,
+		Site:    ch.Site,
+		Alert:   e.Alert.ID,
+		Event:   e.Type,
+		Attempt: attempt,
+	}
+
+	start := time.Now()
+	status, err := d.send(ch, e)
+	delivery.Duration = time.Since(start).Milliseconds()
+	delivery.StatusCode = status
+	delivery.Success = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	record := d.record
+	if record == nil {
+		record = func(delivery *Delivery) error { return delivery.Create(d.DB) }
+	}
+	if err := record(&delivery); err != nil {
+		log.Error(err)
+	}
+
+	return &delivery
+}
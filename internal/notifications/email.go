@@ -0,0 +1,69 @@
+package notifications
+
+import (
+	log "github.com/sirupsen/logrus"
+	"nw-guardian/internal/users"
+	"nw-guardian/internal/workspace"
+	"strings"
+	"time"
+)
+
+// emailMembers queues the alert email for the members of the workspace selected by the filter that
+// haven't opted out, only probes with notifications enabled are emailed
+func (d *Dispatcher) emailMembers(e *Event, filter func(workspace.Member) bool) {
+	if d.Email == nil || !e.Probe.Notifications {
+		return
+	}
+	var status string
+	switch e.Type {
+	case EventType_ALERT_FIRING:
+		status = "FIRING"
+	case EventType_ALERT_FLAPPING:
+		status = "FLAPPING"
+	case EventType_ALERT_RESOLVED:
+		status = "RESOLVED"
+	default:
+		return
+	}
+
+	site := workspace.Workspace{ID: e.Alert.Site}
+	err := site.Get(d.DB)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	target := e.Target.Target
+	if target == "" && len(e.Probe.Config.Target) > 0 {
+		target = e.Probe.Config.Target[0].Target
+	}
+
+	data := map[string]string{
+		"AlertID":   e.Alert.ID.Hex(),
+		"Status":    status,
+		"Message":   e.Alert.Message,
+		"SiteName":  site.Name,
+		"AgentName": e.Agent.Name,
+		"ProbeType": strings.ToUpper(string(e.Probe.Type)),
+		"Target":    target,
+		"Timestamp": e.Timestamp.Format(time.RFC1123),
+	}
+
+	for _, member := range site.Members {
+		if member.OptOutAlerts || !filter(member) {
+			continue
+		}
+
+		u := users.User{ID: member.User}
+		user, err := u.FromID(d.DB)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		err = d.Email.QueueAlertEmail(user, data)
+		if err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package notifications
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/workspace"
+	"time"
+)
+
+// EscalationStep notifies the members with the roles, and the channels, once the alert has been
+// unacknowledged for Delay minutes
+type EscalationStep struct {
+	Delay    int                  `json:"delay" bson:"delay"`
+	Roles    []workspace.Role     `json:"roles" bson:"roles"`
+	Channels []primitive.ObjectID `json:"channels" bson:"channels"`
+}
+
+// EscalationPolicy routes the alerts of the selected probes & agent groups through its steps,
+// the default policy of a workspace routes everything that isn't selected by another policy
+type EscalationPolicy struct {
+	ID          primitive.ObjectID   `json:"id" bson:"_id"`
+	Site        primitive.ObjectID   `json:"site" bson:"site"`
+	Name        string               `json:"name" bson:"name"`
+	Description string               `json:"description" bson:"description"`
+	Probes      []primitive.ObjectID `json:"probes" bson:"probes"`
+	Groups      []primitive.ObjectID `json:"groups" bson:"groups"`
+	Default     bool                 `json:"default" bson:"default"`
+	Steps       []EscalationStep     `json:"steps" bson:"steps"`
+	CreatedAt   time.Time            `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time            `json:"updatedAt" bson:"updatedAt"`
+}
+
+func (p *EscalationPolicy) Validate() error {
+	if len(p.Steps) == 0 {
+		return errors.New("an escalation policy needs at least one step")
+	}
+
+	last := 0
+	for _, step := range p.Steps {
+		if step.Delay < last {
+			return errors.New("escalation steps must be ordered by delay")
+		}
+		last = step.Delay
+
+		if len(step.Roles) == 0 && len(step.Channels) == 0 {
+			return errors.New("every escalation step needs a role or a channel to notify")
+		}
+		for _, role := range step.Roles {
+			switch role {
+			case workspace.MemberRole_READONLY, workspace.MemberRole_READWRITE, workspace.MemberRole_ADMIN, workspace.MemberRole_OWNER:
+			default:
+				return errors.New("unknown role " + string(role))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *EscalationPolicy) Create(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "escalation.Create", ObjectID: p.Site}
+
+	err := p.Validate()
+	if err != nil {
+		ee.Message = "invalid escalation policy"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	p.ID = primitive.NewObjectID()
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = time.Now()
+
+	_, err = db.Collection("escalation_policies").InsertOne(context.TODO(), p)
+	if err != nil {
+		ee.Message = "error inserting escalation policy"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (p *EscalationPolicy) Get(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "escalation.Get", ObjectID: p.ID}
+
+	err := db.Collection("escalation_policies").FindOne(context.TODO(), bson.M{"_id": p.ID}).Decode(p)
+	if err != nil {
+		ee.Message = "unable to find escalation policy"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (p *EscalationPolicy) Update(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "escalation.Update", ObjectID: p.ID}
+
+	err := p.Validate()
+	if err != nil {
+		ee.Message = "invalid escalation policy"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	p.UpdatedAt = time.Now()
+
+	update := bson.M{"$set": bson.M{
+		"name":        p.Name,
+		"description": p.Description,
+		"probes":      p.Probes,
+		"groups":      p.Groups,
+		"default":     p.Default,
+		"steps":       p.Steps,
+		"updatedAt":   p.UpdatedAt,
+	}}
+
+	_, err = db.Collection("escalation_policies").UpdateOne(context.TODO(), bson.M{"_id": p.ID}, update)
+	if err != nil {
+		ee.Message = "unable to update escalation policy"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (p *EscalationPolicy) Delete(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "escalation.Delete", ObjectID: p.ID}
+
+	_, err := db.Collection("escalation_policies").DeleteOne(context.TODO(), bson.M{"_id": p.ID})
+	if err != nil {
+		ee.Message = "unable to delete escalation policy"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func GetEscalationPoliciesForSite(db *mongo.Database, site primitive.ObjectID) ([]EscalationPolicy, error) {
+	ee := internal.ErrorFormat{Package: "internal.notifications", Level: log.ErrorLevel, Function: "escalation.GetEscalationPoliciesForSite", ObjectID: site}
+
+	cursor, err := db.Collection("escalation_policies").Find(context.TODO(), bson.M{"site": site})
+	if err != nil {
+		ee.Message = "unable to find escalation policies"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var policies []EscalationPolicy
+	if err = cursor.All(context.TODO(), &policies); err != nil {
+		ee.Message = "unable to decode escalation policies"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return policies, nil
+}
+
+// policyFor selects the policy of the alert, a policy selecting the probe wins over one selecting
+// a group of the agent, which wins over the default policy. A nil policy is returned if none apply.
+func (d *Dispatcher) policyFor(alert *agent.ProbeAlert) (*EscalationPolicy, error) {
+	policies, err := GetEscalationPoliciesForSite(d.DB, alert.Site)
+	if err != nil || len(policies) == 0 {
+		return nil, err
+	}
+
+	for i := range policies {
+		if containsID(policies[i].Probes, alert.Probe.ID) {
+			return &policies[i], nil
+		}
+	}
+
+	groups, err := agent.GetGroupIDsForAgent(d.DB, alert.Agent)
+	if err != nil {
+		return nil, err
+	}
+	for i := range policies {
+		for _, g := range groups {
+			if containsID(policies[i].Groups, g) {
+				return &policies[i], nil
+			}
+		}
+	}
+
+	for i := range policies {
+		if policies[i].Default {
+			return &policies[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// escalate notifies every step of the policy that is due and hasn't been notified yet
+func (d *Dispatcher) escalate(e *Event, policy *EscalationPolicy) {
+	alert := &e.Alert
+
+	for step := alert.EscalationStep; step < len(policy.Steps); step++ {
+		if time.Since(alert.Timestamp) < time.Duration(policy.Steps[step].Delay)*time.Minute {
+			return
+		}
+
+		ok, err := alert.AdvanceEscalation(d.DB, step)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		if !ok {
+			// already notified elsewhere
+			return
+		}
+
+		e.EscalationStep = step + 1
+		d.notifySteps(e, policy.Steps[step:step+1])
+
+		log.Infof("alert %s escalated to step %d of policy %s", alert.ID.Hex(), step+1, policy.Name)
+	}
+}
+
+// notifySteps notifies the roles and channels of the steps, each only once
+func (d *Dispatcher) notifySteps(e *Event, steps []EscalationStep) {
+	roles := make(map[workspace.Role]bool)
+	var channelIDs []primitive.ObjectID
+
+	for _, step := range steps {
+		for _, role := range step.Roles {
+			roles[role] = true
+		}
+		for _, ch := range step.Channels {
+			if !containsID(channelIDs, ch) {
+				channelIDs = append(channelIDs, ch)
+			}
+		}
+	}
+
+	d.emailMembers(e, func(m workspace.Member) bool {
+		return roles[m.Role]
+	})
+
+	if len(channelIDs) == 0 {
+		return
+	}
+
+	channels, err := GetChannelsForSite(d.DB, e.Alert.Site, true)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for i := range channels {
+		if containsID(channelIDs, channels[i].ID) {
+			go d.deliver(&channels[i], e)
+		}
+	}
+}
+
+// Escalate runs the due steps of every unacknowledged alert routed by a policy, called periodically by the escalation worker
+func (d *Dispatcher) Escalate() error {
+	alerts, err := agent.GetEscalatingAlerts(d.DB)
+	if err != nil {
+		return err
+	}
+
+	policies := make(map[primitive.ObjectID]*EscalationPolicy)
+
+	for i := range alerts {
+		alert := alerts[i]
+
+		policy, ok := policies[alert.Policy]
+		if !ok {
+			policy = &EscalationPolicy{ID: alert.Policy}
+			if err := policy.Get(d.DB); err != nil {
+				// the policy was deleted, the alert stays where it is
+				policy = nil
+			}
+			policies[alert.Policy] = policy
+		}
+		if policy == nil || alert.EscalationStep >= len(policy.Steps) {
+			continue
+		}
+
+		eventType := EventType_ALERT_FIRING
+		if alert.Status == agent.AlertStatus_FLAPPING {
+			eventType = EventType_ALERT_FLAPPING
+		}
+
+		e := d.newEvent(eventType, &alert)
+		d.escalate(&e, policy)
+	}
+
+	return nil
+}
@@ -0,0 +1,359 @@
+package notifications
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/http"
+	"net/url"
+	"nw-guardian/internal/agent"
+	"strings"
+)
+
+type incidentAction string
+
+const (
+	incidentTrigger     incidentAction = "trigger"
+	incidentAcknowledge incidentAction = "acknowledge"
+	incidentResolve     incidentAction = "resolve"
+)
+
+func actionFor(event EventType) incidentAction {
+	switch event {
+	case EventType_ALERT_ACKNOWLEDGED:
+		return incidentAcknowledge
+	case EventType_ALERT_RESOLVED:
+		return incidentResolve
+	}
+	return incidentTrigger
+}
+
+// incidentSeverity maps the alert to the pagerduty severity, flapping alerts are at most warnings
+func incidentSeverity(e *Event) string {
+	if e.Type == EventType_TEST {
+		return "info"
+	}
+	switch {
+	case e.Alert.Severity == agent.AlertSeverity_INFO:
+		return "info"
+	case e.Alert.Severity == agent.AlertSeverity_WARNING || e.Alert.Status == agent.AlertStatus_FLAPPING:
+		return "warning"
+	}
+	return "critical"
+}
+
+func incidentSummary(e *Event) string {
+	summary := e.Alert.Message
+	if summary == "" {
+		summary = fmt.Sprintf("%s alert on %s", e.Alert.Metric, e.Agent.Name)
+	}
+	if e.Agent.Name != "" && !strings.Contains(summary, e.Agent.Name) {
+		summary = "[" + e.Agent.Name + "] " + summary
+	}
+	if len(summary) > 1024 {
+		summary = summary[:1024]
+	}
+	return summary
+}
+
+func incidentDetails(e *Event) map[string]string {
+	details := map[string]string{
+		"alert":  e.Alert.ID.Hex(),
+		"signal": string(e.Alert.Signal),
+		"status": string(e.Alert.Status),
+		"agent":  e.Agent.Name,
+		"probe":  string(e.Probe.Type),
+	}
+	if e.Alert.Metric != "" {
+		details["metric"] = e.Alert.Metric
+		details["value"] = fmt.Sprintf("%.2f", e.Alert.Value)
+		details["threshold"] = fmt.Sprintf("%.2f", e.Alert.Threshold)
+	}
+	if e.Target.Target != "" {
+		details["target"] = e.Target.Target
+	}
+	return details
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Timestamp     string            `json:"timestamp,omitempty"`
+	Component     string            `json:"component,omitempty"`
+	Group         string            `json:"group,omitempty"`
+	Class         string            `json:"class,omitempty"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction incidentAction    `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Client      string            `json:"client,omitempty"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"` // only sent when triggering
+}
+
+// sendPagerDuty sends the event to the pagerduty events api v2, the dedup key of the alert ties
+// the trigger, acknowledge & resolve events to the same incident
+func sendPagerDuty(client *http.Client, ch *Channel, e *Event) (int, error) {
+	event := pagerDutyEvent{
+		RoutingKey:  ch.Key,
+		EventAction: actionFor(e.Type),
+		DedupKey:    e.Alert.DedupKey,
+		Client:      "nw-guardian",
+	}
+	if event.EventAction == incidentTrigger {
+		event.Payload = &pagerDutyPayload{
+			Summary:       incidentSummary(e),
+			Source:        e.Agent.Name,
+			Severity:      incidentSeverity(e),
+			Timestamp:     e.Alert.Timestamp.Format("2006-01-02T15:04:05.000Z07:00"),
+			Component:     e.Target.Target,
+			Group:         string(e.Probe.Type),
+			Class:         string(e.Alert.Signal),
+			CustomDetails: incidentDetails(e),
+		}
+		if event.Payload.Source == "" {
+			event.Payload.Source = "nw-guardian"
+		}
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+
+	return sendJSON(client, http.MethodPost, ch.endpoint(), nil, body)
+}
+
+type opsgenieCreate struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Priority    string            `json:"priority,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Entity      string            `json:"entity,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+type opsgenieNote struct {
+	Source string `json:"source,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// sendOpsgenie creates, acknowledges or closes the opsgenie alert using the dedup key of the alert as its alias
+func sendOpsgenie(client *http.Client, ch *Channel, e *Event) (int, error) {
+	base := strings.TrimSuffix(ch.endpoint(), "/")
+	headers := map[string]string{"Authorization": "GenieKey " + ch.Key}
+
+	var target string
+	var payload interface{}
+	switch actionFor(e.Type) {
+	case incidentAcknowledge:
+		target = base + "/v2/alerts/" + url.PathEscape(e.Alert.DedupKey) + "/acknowledge?identifierType=alias"
+		payload = opsgenieNote{Source: "nw-guardian", Note: "acknowledged in guardian"}
+	case incidentResolve:
+		target = base + "/v2/alerts/" + url.PathEscape(e.Alert.DedupKey) + "/close?identifierType=alias"
+		payload = opsgenieNote{Source: "nw-guardian", Note: "resolved in guardian"}
+	default:
+		message := incidentSummary(e)
+		if len(message) > 130 {
+			message = message[:130]
+		}
+		priority := "P2"
+		switch incidentSeverity(e) {
+		case "warning":
+			priority = "P3"
+		case "info":
+			priority = "P5"
+		}
+		create := opsgenieCreate{
+			Message:     message,
+			Alias:       e.Alert.DedupKey,
+			Description: incidentSummary(e),
+			Priority:    priority,
+			Source:      "nw-guardian",
+			Entity:      e.Agent.Name,
+			Tags:        []string{"guardian"},
+			Details:     incidentDetails(e),
+		}
+		if e.Alert.Signal != "" {
+			create.Tags = append(create.Tags, strings.ToLower(string(e.Alert.Signal)))
+		}
+		payload = create
+		target = base + "/v2/alerts"
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	return sendJSON(client, http.MethodPost, target, headers, body)
+}
+
+// sendJSON sends the body, the returned status code is 0 if the request never completed
+func sendJSON(client *http.Client, method string, target string, headers map[string]string, body []byte) (int, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nw-guardian")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s responded with %s", req.URL.Host, resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// incidentShared reports if other alerts of the incident are still open, in which case resolving
+// the alert shouldn't resolve the incident
+func (d *Dispatcher) incidentShared(e *Event) bool {
+	alerts, err := agent.GetOpenAlertsByDedupKey(d.DB, e.Alert.Site, e.Alert.DedupKey)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	for _, a := range alerts {
+		if a.ID != e.Alert.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyInbound checks the token of an inbound incident update against the secret of the channel
+func (c *Channel) VerifyInbound(token string) bool {
+	return c.Secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.Secret)) == 1
+}
+
+// pagerDutyWebhook is the part of a pagerduty v3 webhook needed to sync the alert state
+type pagerDutyWebhook struct {
+	Event struct {
+		EventType string `json:"event_type"`
+		Data      struct {
+			IncidentKey string `json:"incident_key"`
+		} `json:"data"`
+	} `json:"event"`
+}
+
+// opsgenieWebhook is the part of an opsgenie webhook integration payload needed to sync the alert state
+type opsgenieWebhook struct {
+	Action string `json:"action"`
+	Alert  struct {
+		Alias string `json:"alias"`
+	} `json:"alert"`
+}
+
+// incidentAlerts returns the open alerts paged with the dedup key, the member alerts for the key of a
+// correlated incident
+func (d *Dispatcher) incidentAlerts(site primitive.ObjectID, key string) ([]agent.ProbeAlert, error) {
+	id, ok := incidentFromDedupKey(key)
+	if !ok {
+		return agent.GetOpenAlertsByDedupKey(d.DB, site, key)
+	}
+
+	incident := Incident{ID: id}
+	if err := incident.Get(d.DB); err != nil {
+		return nil, err
+	}
+	if incident.Site != site {
+		return nil, errors.New("incident " + key + " isn't part of the workspace of the channel")
+	}
+
+	return agent.GetIncidentAlerts(d.DB, id, true)
+}
+
+// SyncIncident applies an inbound webhook of the incident tool of the channel to the alerts of the
+// incident, so acknowledging or resolving the page there does the same in guardian. The alerts
+// that were updated are returned, updates for other events are ignored.
+func (d *Dispatcher) SyncIncident(ch *Channel, body []byte) ([]agent.ProbeAlert, error) {
+	var key string
+	var action incidentAction
+
+	switch ch.Type {
+	case ChannelType_PAGERDUTY:
+		var hook pagerDutyWebhook
+		if err := json.Unmarshal(body, &hook); err != nil {
+			return nil, err
+		}
+		key = hook.Event.Data.IncidentKey
+		switch hook.Event.EventType {
+		case "incident.acknowledged":
+			action = incidentAcknowledge
+		case "incident.resolved":
+			action = incidentResolve
+		}
+	case ChannelType_OPSGENIE:
+		var hook opsgenieWebhook
+		if err := json.Unmarshal(body, &hook); err != nil {
+			return nil, err
+		}
+		key = hook.Alert.Alias
+		switch hook.Action {
+		case "Acknowledge":
+			action = incidentAcknowledge
+		case "Close":
+			action = incidentResolve
+		}
+	default:
+		return nil, errors.New("channel " + string(ch.Type) + " doesn't accept incident updates")
+	}
+
+	if action == "" || key == "" {
+		return nil, nil
+	}
+
+	alerts, err := d.incidentAlerts(ch.Site, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated []agent.ProbeAlert
+	for i := range alerts {
+		alert := alerts[i]
+
+		if action == incidentAcknowledge {
+			if alert.Status == agent.AlertStatus_ACKNOWLEDGED {
+				continue
+			}
+			if err := alert.Acknowledge(d.DB, primitive.NilObjectID); err != nil {
+				log.Warn(err)
+				continue
+			}
+			d.Dispatch(EventType_ALERT_ACKNOWLEDGED, &alert)
+		} else {
+			if err := alert.Resolve(d.DB, primitive.NilObjectID); err != nil {
+				log.Warn(err)
+				continue
+			}
+			d.release(alert.ID)
+			d.Dispatch(EventType_ALERT_RESOLVED, &alert)
+		}
+		updated = append(updated, alert)
+	}
+
+	log.Infof("synced %d alerts of incident %s from channel %s (%s)", len(updated), key, ch.Name, action)
+
+	return updated, nil
+}
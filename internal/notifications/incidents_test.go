@@ -0,0 +1,149 @@
+package notifications
+
+import (
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"testing"
+)
+
+func TestIncidentFromDedupKey(t *testing.T) {
+	id := primitive.NewObjectID()
+
+	tests := []struct {
+		name string
+		key  string
+		want primitive.ObjectID
+		ok   bool
+	}{
+		{"incident", incidentDedupKey(id), id, true},
+		{"alert", "guardian-" + primitive.NewObjectID().Hex(), primitive.NilObjectID, false},
+		{"bad id", incidentKeyPrefix + "nope", primitive.NilObjectID, false},
+		{"empty", "", primitive.NilObjectID, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := incidentFromDedupKey(tt.key)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: incidentFromDedupKey(%q) = %s, %v, want %s, %v", tt.name, tt.key, got.Hex(), ok, tt.want.Hex(), tt.ok)
+		}
+	}
+}
+
+func TestPagerDutyDelivery(t *testing.T) {
+	tests := []struct {
+		event   EventType
+		action  incidentAction
+		payload bool
+	}{
+		{EventType_ALERT_FIRING, incidentTrigger, true},
+		{EventType_ALERT_ACKNOWLEDGED, incidentAcknowledge, false},
+		{EventType_ALERT_RESOLVED, incidentResolve, false},
+	}
+
+	for _, tt := range tests {
+		server := newStandIn(t)
+		ch := &Channel{Type: ChannelType_PAGERDUTY, URL: server.URL, Key: "routing-key"}
+		e := testEvent(tt.event)
+
+		if _, err := sendPagerDuty(server.Client(), ch, e); err != nil {
+			t.Errorf("%s: %v", tt.event, err)
+			continue
+		}
+
+		requests := server.got()
+		if len(requests) != 1 {
+			t.Errorf("%s: %d requests, want 1", tt.event, len(requests))
+			continue
+		}
+		r := requests[0]
+		if r.method != http.MethodPost || r.header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: %s with content type %q", tt.event, r.method, r.header.Get("Content-Type"))
+		}
+
+		var got pagerDutyEvent
+		if err := json.Unmarshal(r.body, &got); err != nil {
+			t.Errorf("%s: invalid body: %v", tt.event, err)
+			continue
+		}
+		if got.RoutingKey != "routing-key" || got.EventAction != tt.action || got.DedupKey != e.Alert.DedupKey {
+			t.Errorf("%s: event = %+v", tt.event, got)
+		}
+		if (got.Payload != nil) != tt.payload {
+			t.Errorf("%s: payload = %+v, want one: %v", tt.event, got.Payload, tt.payload)
+		}
+		if got.Payload != nil && (got.Payload.Source != "edge-1" || got.Payload.Severity != "critical") {
+			t.Errorf("%s: payload = %+v", tt.event, got.Payload)
+		}
+	}
+}
+
+func TestOpsgenieDelivery(t *testing.T) {
+	tests := []struct {
+		event EventType
+		path  string
+	}{
+		{EventType_ALERT_FIRING, "/v2/alerts"},
+		{EventType_ALERT_ACKNOWLEDGED, "/v2/alerts/guardian-test/acknowledge"},
+		{EventType_ALERT_RESOLVED, "/v2/alerts/guardian-test/close"},
+	}
+
+	for _, tt := range tests {
+		server := newStandIn(t)
+		ch := &Channel{Type: ChannelType_OPSGENIE, URL: server.URL, Key: "genie"}
+
+		if _, err := sendOpsgenie(server.Client(), ch, testEvent(tt.event)); err != nil {
+			t.Errorf("%s: %v", tt.event, err)
+			continue
+		}
+
+		requests := server.got()
+		if len(requests) != 1 {
+			t.Errorf("%s: %d requests, want 1", tt.event, len(requests))
+			continue
+		}
+		r := requests[0]
+		if r.method != http.MethodPost || r.path != tt.path {
+			t.Errorf("%s: %s %s, want POST %s", tt.event, r.method, r.path, tt.path)
+		}
+		if got := r.header.Get("Authorization"); got != "GenieKey genie" {
+			t.Errorf("%s: authorization = %q", tt.event, got)
+		}
+
+		if tt.event != EventType_ALERT_FIRING {
+			continue
+		}
+		var got opsgenieCreate
+		if err := json.Unmarshal(r.body, &got); err != nil {
+			t.Errorf("%s: invalid body: %v", tt.event, err)
+			continue
+		}
+		if got.Alias != "guardian-test" || got.Priority != "P2" || got.Entity != "edge-1" {
+			t.Errorf("%s: alert = %+v", tt.event, got)
+		}
+	}
+}
+
+func TestIncidentDeliveryRetries(t *testing.T) {
+	for _, channelType := range []ChannelType{ChannelType_PAGERDUTY, ChannelType_OPSGENIE} {
+		server := newStandIn(t, http.StatusInternalServerError, http.StatusBadGateway)
+		d, deliveries := testDispatcher()
+		ch := &Channel{ID: primitive.NewObjectID(), Type: channelType, URL: server.URL, Key: "key"}
+
+		d.deliver(ch, testEvent(EventType_ALERT_FIRING))
+
+		requests := server.got()
+		if len(requests) != 3 {
+			t.Errorf("%s: %d requests, want 3", channelType, len(requests))
+			continue
+		}
+		for _, r := range requests[1:] {
+			if string(r.body) != string(requests[0].body) {
+				t.Errorf("%s: retry sent %s, want %s", channelType, r.body, requests[0].body)
+			}
+		}
+		if n := len(*deliveries); n != 3 || !(*deliveries)[n-1].Success {
+			t.Errorf("%s: deliveries = %+v", channelType, *deliveries)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package notifications
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sign returns the signature sent in the X-Guardian-Signature header, receivers can verify a payload
+// by computing the HMAC-SHA256 of "<X-Guardian-Timestamp>.<body>" with the channel secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts the signed payload, the returned status code is 0 if the request never completed
+func sendWebhook(client *http.Client, ch *Channel, event EventType, body []byte) (int, error) {
+	ts := time.Now().Unix()
+	headers := map[string]string{
+		"X-Guardian-Event":     string(event),
+		"X-Guardian-Timestamp": strconv.FormatInt(ts, 10),
+		"X-Guardian-Signature": Sign(ch.Secret, ts, body),
+	}
+
+	return sendJSON(client, http.MethodPost, ch.URL, headers, body)
+}
@@ -0,0 +1,229 @@
+package notifications
+
+import (
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"nw-guardian/internal/agent"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	// expected signatures from: echo -n '<timestamp>.<body>' | openssl dgst -sha256 -hmac <secret>
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      string
+		want      string
+	}{
+		{
+			name:      "payload",
+			secret:    "secret",
+			timestamp: 1700000000,
+			body:      `{"type":"TEST"}`,
+			want:      "sha256=74d416dded73e5c9a545f5006e521f795ea8ea6fff7fbee829baddaf80c8fcf3",
+		},
+		{
+			name:      "empty body",
+			secret:    "secret",
+			timestamp: 0,
+			body:      "",
+			want:      "sha256=3445798a051818ef95def46c2eb62b43d377ce6e3c29b4d0aec3da0e59577f79",
+		},
+	}
+
+	for _, tt := range tests {
+		got := Sign(tt.secret, tt.timestamp, []byte(tt.body))
+		if got != tt.want {
+			t.Errorf("%s: Sign() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSignCoversEveryInput(t *testing.T) {
+	base := Sign("secret", 1700000000, []byte(`{"type":"TEST"}`))
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      string
+	}{
+		{"other secret", "secret2", 1700000000, `{"type":"TEST"}`},
+		{"replayed later", "secret", 1700000001, `{"type":"TEST"}`},
+		{"tampered body", "secret", 1700000000, `{"type":"TESTS"}`},
+		// the separator keeps the timestamp & body from being shifted into each other
+		{"shifted digits", "secret", 170000000, `0{"type":"TEST"}`},
+	}
+
+	for _, tt := range tests {
+		if Sign(tt.secret, tt.timestamp, []byte(tt.body)) == base {
+			t.Errorf("%s: signature didn't change", tt.name)
+		}
+	}
+}
+
+// standIn is a local http server standing in for the api of a channel, it answers with the queued statuses
+// (200 once they run out) and records the requests it got
+type standIn struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []standInRequest
+}
+
+type standInRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+func newStandIn(t *testing.T, statuses ...int) *standIn {
+	s := &standIn{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, standInRequest{method: r.Method, path: r.URL.Path, header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *standIn) got() []standInRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]standInRequest(nil), s.requests...)
+}
+
+// testDispatcher retries straight away and keeps the delivery log in memory
+func testDispatcher() (*Dispatcher, *[]Delivery) {
+	var mu sync.Mutex
+	var log []Delivery
+
+	d := &Dispatcher{Client: &http.Client{Timeout: 5 * time.Second}, MaxAttempts: 3, Backoff: time.Millisecond}
+	d.record = func(delivery *Delivery) error {
+		mu.Lock()
+		log = append(log, *delivery)
+		mu.Unlock()
+		return nil
+	}
+	return d, &log
+}
+
+func testEvent(eventType EventType) *Event {
+	return &Event{
+		Type:      eventType,
+		Timestamp: time.Now(),
+		Alert: agent.ProbeAlert{
+			ID:       primitive.NewObjectID(),
+			Severity: agent.AlertSeverity_CRITICAL,
+			Message:  "avg rtt above 100ms",
+			DedupKey: "guardian-test",
+		},
+		Agent: EventAgent{ID: primitive.NewObjectID(), Name: "edge-1", Location: "fra"},
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		success  bool
+	}{
+		{"delivered", nil, 1, true},
+		{"retried on server errors", []int{http.StatusBadGateway, http.StatusServiceUnavailable}, 3, true},
+		{"retried on throttling", []int{http.StatusTooManyRequests}, 2, true},
+		{"client errors aren't retried", []int{http.StatusBadRequest}, 1, false},
+		{"gives up after the max attempts", []int{500, 500, 500, 500}, 3, false},
+	}
+
+	for _, tt := range tests {
+		server := newStandIn(t, tt.statuses...)
+		d, deliveries := testDispatcher()
+		ch := &Channel{ID: primitive.NewObjectID(), Type: ChannelType_WEBHOOK, URL: server.URL, Secret: "secret"}
+		e := testEvent(EventType_ALERT_FIRING)
+
+		d.deliver(ch, e)
+
+		requests := server.got()
+		if len(requests) != tt.attempts {
+			t.Errorf("%s: %d requests, want %d", tt.name, len(requests), tt.attempts)
+			continue
+		}
+		for _, r := range requests {
+			ts, err := strconv.ParseInt(r.header.Get("X-Guardian-Timestamp"), 10, 64)
+			if err != nil {
+				t.Errorf("%s: invalid timestamp header %q", tt.name, r.header.Get("X-Guardian-Timestamp"))
+			}
+			if got, want := r.header.Get("X-Guardian-Signature"), Sign("secret", ts, r.body); got != want {
+				t.Errorf("%s: signature = %s, want %s", tt.name, got, want)
+			}
+			if got := r.header.Get("X-Guardian-Event"); got != string(EventType_ALERT_FIRING) {
+				t.Errorf("%s: event header = %s", tt.name, got)
+			}
+		}
+
+		if len(*deliveries) != tt.attempts {
+			t.Errorf("%s: %d deliveries logged, want %d", tt.name, len(*deliveries), tt.attempts)
+			continue
+		}
+		for i, delivery := range *deliveries {
+			last := i == len(*deliveries)-1
+			if delivery.Attempt != i+1 || delivery.Channel != ch.ID || delivery.Alert != e.Alert.ID {
+				t.Errorf("%s: delivery %d = %+v", tt.name, i, delivery)
+			}
+			if delivery.Success != (last && tt.success) {
+				t.Errorf("%s: delivery %d success = %v", tt.name, i, delivery.Success)
+			}
+			if !delivery.Success && (delivery.StatusCode == 0 || delivery.Error == "") {
+				t.Errorf("%s: failed delivery %d without its status & error: %+v", tt.name, i, delivery)
+			}
+		}
+	}
+}
+
+func TestWebhookPayloadLeavesOutAgentPin(t *testing.T) {
+	server := newStandIn(t)
+	d, _ := testDispatcher()
+	ch := &Channel{ID: primitive.NewObjectID(), Type: ChannelType_WEBHOOK, URL: server.URL, Secret: "secret"}
+
+	d.deliver(ch, testEvent(EventType_ALERT_FIRING))
+
+	requests := server.got()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	var payload struct {
+		Agent map[string]interface{} `json:"agent"`
+	}
+	if err := json.Unmarshal(requests[0].body, &payload); err != nil {
+		t.Fatalf("invalid payload: %v", err)
+	}
+	if _, ok := payload.Agent["pin"]; ok {
+		t.Errorf("payload agent has a pin: %v", payload.Agent)
+	}
+	if payload.Agent["name"] != "edge-1" {
+		t.Errorf("payload agent = %v, want edge-1", payload.Agent)
+	}
+	if strings.Contains(string(requests[0].body), `"pin"`) {
+		t.Errorf("payload contains a pin: %s", requests[0].body)
+	}
+}
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+)
+
+// Retryable reports if a request that got the http status can succeed when retried, 0 being a request
+// that never completed
+func Retryable(status int) bool {
+	if status == 0 || status >= 500 {
+		return true
+	}
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// Retry calls try up to attempts times for as long as it fails with a Retryable status, sleeping backoff
+// before the first retry and doubling it after every attempt. It returns the attempts made and the error
+// of the last one.
+func Retry(attempts int, backoff time.Duration, try func(attempt int) (int, error)) (int, error) {
+	var err error
+
+	attempt := 1
+	for ; ; attempt++ {
+		var status int
+		status, err = try(attempt)
+		if err == nil || !Retryable(status) || attempt >= attempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return attempt, err
+}
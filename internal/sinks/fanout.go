@@ -0,0 +1,259 @@
+package sinks
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/workspace"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSinkWorkers   = 2
+	defaultSinkQueueSize = 1000
+
+	// sitesTTL is how long the sinks of a workspace are cached, changes to the sinks are picked up within it
+	sitesTTL = 30 * time.Second
+	// statusInterval throttles the status updates of sinks that keep pushing successfully
+	statusInterval = time.Minute
+)
+
+type openSink struct {
+	config SinkConfig
+	sink   Sink
+}
+
+type siteSinks struct {
+	name    string
+	sinks   []*openSink
+	expires time.Time
+}
+
+type sinkJob struct {
+	sink    *openSink
+	records []Record
+}
+
+type sinkStatus struct {
+	err     string
+	updated time.Time
+}
+
+// Fanout pushes the probe data stored by the ingestion to the sinks of the workspace of its agent, in the
+// background so slow or unreachable sinks don't hold back the ingestion. Pushes are dropped when the queue is full.
+type Fanout struct {
+	DB     *mongo.Database
+	Client *http.Client
+	Agents *agent.AgentCache
+
+	mu    sync.Mutex
+	sites map[primitive.ObjectID]*siteSinks
+
+	statusMu sync.Mutex
+	status   map[primitive.ObjectID]sinkStatus
+
+	jobs    chan sinkJob
+	pushed  uint64
+	failed  uint64
+	dropped uint64
+}
+
+func envInt(name string, fallback int) int {
+	env := os.Getenv(name)
+	if env == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(env)
+	if err != nil || n <= 0 {
+		log.Warnf("invalid %s %q, using %d", name, env, fallback)
+		return fallback
+	}
+	return n
+}
+
+// NewFanout creates the fanout and starts its SINK_WORKERS workers
+func NewFanout(db *mongo.Database) *Fanout {
+	f := &Fanout{
+		DB:     db,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		Agents: agent.NewAgentCache(0),
+		sites:  make(map[primitive.ObjectID]*siteSinks),
+		status: make(map[primitive.ObjectID]sinkStatus),
+		jobs:   make(chan sinkJob, envInt("SINK_QUEUE_SIZE", defaultSinkQueueSize)),
+	}
+
+	for i := 0; i < envInt("SINK_WORKERS", defaultSinkWorkers); i++ {
+		go func() {
+			for job := range f.jobs {
+				f.push(job)
+			}
+		}()
+	}
+
+	return f
+}
+
+// sinksOf returns the name & enabled sinks of the site, looking them up when they aren't cached or expired
+func (f *Fanout) sinksOf(site primitive.ObjectID) *siteSinks {
+	f.mu.Lock()
+	cached, ok := f.sites[site]
+	f.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached
+	}
+
+	s := &siteSinks{name: site.Hex(), expires: time.Now().Add(sitesTTL)}
+
+	configs, err := GetSinksForSite(f.DB, site, true)
+	if err != nil {
+		log.Error(err)
+		if ok {
+			// keep pushing to the known sinks until the lookup works again
+			s.sinks = cached.sinks
+		}
+	}
+	for i := range configs {
+		sink, err := configs[i].Open(f.Client)
+		if err != nil {
+			log.Warnf("unable to open sink %s: %v", configs[i].ID.Hex(), err)
+			continue
+		}
+		s.sinks = append(s.sinks, &openSink{config: configs[i], sink: sink})
+	}
+
+	if len(s.sinks) > 0 {
+		w := workspace.Workspace{ID: site}
+		if err = w.Get(f.DB); err == nil && w.Name != "" {
+			s.name = w.Name
+		}
+	}
+
+	f.mu.Lock()
+	f.sites[site] = s
+	f.mu.Unlock()
+
+	return s
+}
+
+// Push queues the stored probe data for the sinks of their workspaces, a nil fanout does nothing
+func (f *Fanout) Push(stored []*agent.ProbeData) {
+	if f == nil || len(stored) == 0 {
+		return
+	}
+
+	bySite := make(map[primitive.ObjectID][]Record)
+	for _, data := range stored {
+		a, err := f.Agents.Get(f.DB, data.Meta.Agent)
+		if err != nil {
+			continue
+		}
+		bySite[a.Site] = append(bySite[a.Site], Record{Site: a.Site, Agent: a.ID, AgentName: a.Name, Data: data})
+	}
+
+	for site, records := range bySite {
+		s := f.sinksOf(site)
+		for _, sink := range s.sinks {
+			var accepted []Record
+			for _, r := range records {
+				if sink.config.Accepts(r.Data.Meta.Type) {
+					r.SiteName = s.name
+					accepted = append(accepted, r)
+				}
+			}
+			if len(accepted) == 0 {
+				continue
+			}
+
+			select {
+			case f.jobs <- sinkJob{sink: sink, records: accepted}:
+			default:
+				atomic.AddUint64(&f.dropped, uint64(len(accepted)))
+				log.Warnf("sink queue is full, dropped %d probe data for sink %s", len(accepted), sink.config.ID.Hex())
+			}
+		}
+	}
+}
+
+func (f *Fanout) push(job sinkJob) {
+	err := job.sink.sink.Push(job.records)
+	if err != nil {
+		atomic.AddUint64(&f.failed, uint64(len(job.records)))
+		log.Warnf("unable to push %d probe data to sink %s: %v", len(job.records), job.sink.config.ID.Hex(), err)
+	} else {
+		atomic.AddUint64(&f.pushed, uint64(len(job.records)))
+	}
+	f.recordStatus(&job.sink.config, err)
+}
+
+// recordStatus stores the result of the push on the sink, when it changed or at most once per statusInterval
+func (f *Fanout) recordStatus(c *SinkConfig, pushErr error) {
+	msg := ""
+	if pushErr != nil {
+		msg = pushErr.Error()
+	}
+
+	f.statusMu.Lock()
+	last, ok := f.status[c.ID]
+	if ok && last.err == msg && time.Since(last.updated) < statusInterval {
+		f.statusMu.Unlock()
+		return
+	}
+	f.status[c.ID] = sinkStatus{err: msg, updated: time.Now()}
+	f.statusMu.Unlock()
+
+	err := c.setStatus(f.DB, pushErr)
+	if err != nil {
+		log.Warn(err)
+	}
+}
+
+// Test pushes a record of made up probe data to the sink, returning the error of the push
+func (f *Fanout) Test(c *SinkConfig) error {
+	sink, err := c.Open(f.Client)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	data := &agent.ProbeData{
+		ID:        primitive.NewObjectID(),
+		CreatedAt: now,
+		Timestamp: now,
+		Target:    agent.ProbeTarget{Target: "test"},
+		Meta:      agent.ProbeDataMeta{Type: agent.ProbeType_PING},
+		Data:      agent.PingResult{StartTimestamp: now, StopTimestamp: now},
+	}
+
+	site := c.Site.Hex()
+	w := workspace.Workspace{ID: c.Site}
+	if w.Get(f.DB) == nil && w.Name != "" {
+		site = w.Name
+	}
+
+	err = sink.Push([]Record{{Site: c.Site, SiteName: site, AgentName: "test", Data: data}})
+	f.recordStatus(c, err)
+	return err
+}
+
+// FanoutStats are the probe data pushed to the sinks since startup
+type FanoutStats struct {
+	Queued  int    `json:"queued"` // pushes waiting for a worker
+	Pushed  uint64 `json:"pushed"`
+	Failed  uint64 `json:"failed"`
+	Dropped uint64 `json:"dropped"`
+}
+
+func (f *Fanout) Stats() FanoutStats {
+	return FanoutStats{
+		Queued:  len(f.jobs),
+		Pushed:  atomic.LoadUint64(&f.pushed),
+		Failed:  atomic.LoadUint64(&f.failed),
+		Dropped: atomic.LoadUint64(&f.dropped),
+	}
+}
@@ -0,0 +1,51 @@
+package sinks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"nw-guardian/internal"
+	"strings"
+	"time"
+)
+
+var (
+	pushAttempts = 3
+	pushBackoff  = time.Second // delay before the first retry, doubled after every attempt
+)
+
+// send posts the body, retrying up to pushAttempts times on network errors, throttling & server errors.
+// prepare sets the auth headers of the request.
+func send(client *http.Client, target string, contentType string, body []byte, prepare func(req *http.Request)) error {
+	_, err := internal.Retry(pushAttempts, pushBackoff, func(int) (int, error) {
+		return sendOnce(client, target, contentType, body, prepare)
+	})
+	return err
+}
+
+// sendOnce posts the body, the returned status code is 0 if the request never completed
+func sendOnce(client *http.Client, target string, contentType string, body []byte, prepare func(req *http.Request)) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "nw-guardian")
+	if prepare != nil {
+		prepare(req)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s responded with %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp.StatusCode, nil
+}
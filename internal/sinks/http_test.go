@@ -0,0 +1,112 @@
+package sinks
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"nw-guardian/internal/agent"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standIn is a local http server standing in for the sink, it answers with the queued statuses (204 once they
+// run out) and records the requests it got
+type standIn struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []standInRequest
+}
+
+type standInRequest struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   []byte
+}
+
+func newStandIn(t *testing.T, statuses ...int) *standIn {
+	// retry straight away
+	backoff := pushBackoff
+	pushBackoff = time.Millisecond
+	t.Cleanup(func() { pushBackoff = backoff })
+
+	s := &standIn{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, standInRequest{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery, header: r.Header.Clone(), body: body})
+		status := http.StatusNoContent
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		s.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *standIn) got() []standInRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]standInRequest(nil), s.requests...)
+}
+
+// pingRecords returns n records of ping data of the same agent
+func pingRecords(n int) []Record {
+	site, a := primitive.NewObjectID(), primitive.NewObjectID()
+	ts := time.Unix(1700000000, 0)
+
+	records := make([]Record, n)
+	for i := range records {
+		records[i] = Record{
+			Site:      site,
+			SiteName:  "hq",
+			Agent:     a,
+			AgentName: "edge-1",
+			Data: &agent.ProbeData{
+				ProbeID:   primitive.NewObjectID(),
+				Timestamp: ts.Add(time.Duration(i) * time.Second),
+				Target:    agent.ProbeTarget{Target: fmt.Sprintf("10.0.0.%d", i%250)},
+				Meta:      agent.ProbeDataMeta{Type: agent.ProbeType_PING},
+				Data:      agent.PingResult{PacketsSent: 10, PacketsRecv: 9, PacketLoss: 10, AvgRtt: 12 * time.Millisecond},
+			},
+		}
+	}
+	return records
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		fails    bool
+	}{
+		{"sent", nil, 1, false},
+		{"retried on server errors", []int{http.StatusInternalServerError, http.StatusBadGateway}, 3, false},
+		{"retried on throttling", []int{http.StatusTooManyRequests}, 2, false},
+		{"client errors aren't retried", []int{http.StatusBadRequest}, 1, true},
+		{"gives up after the attempts", []int{500, 500, 500, 500}, pushAttempts, true},
+	}
+
+	for _, tt := range tests {
+		server := newStandIn(t, tt.statuses...)
+
+		err := send(server.Client(), server.URL, "text/plain", []byte("body"), nil)
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: err = %v, want failure: %v", tt.name, err, tt.fails)
+		}
+		if got := len(server.got()); got != tt.requests {
+			t.Errorf("%s: %d requests, want %d", tt.name, got, tt.requests)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package sinks
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"nw-guardian/internal/agent"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxBatchSize is the amount of points written at once, mtr & trafficsim data have a point per hop or flow
+const influxBatchSize = 5000
+
+// influxSink writes the probe data as line protocol points, a measurement per probe type
+type influxSink struct {
+	client *http.Client
+	config SinkConfig
+}
+
+// point is a line protocol point, the fields are already formatted
+type point struct {
+	measurement string
+	tags        map[string]string
+	fields      []field
+	timestamp   time.Time
+}
+
+// field is a formatted line protocol field, numeric fields (booleans as 0 & 1) also keep their value for
+// remote-write
+type field struct {
+	key     string
+	value   string
+	num     float64
+	numeric bool
+}
+
+func newPoint(measurement string, tags map[string]string, ts time.Time) *point {
+	p := &point{measurement: measurement, tags: make(map[string]string, len(tags)), timestamp: ts}
+	for k, v := range tags {
+		p.tags[k] = v
+	}
+	return p
+}
+
+func (p *point) tag(k, v string) *point {
+	p.tags[k] = v
+	return p
+}
+
+func (p *point) int(k string, v int64) *point {
+	p.fields = append(p.fields, field{key: k, value: strconv.FormatInt(v, 10) + "i", num: float64(v), numeric: true})
+	return p
+}
+
+func (p *point) float(k string, v float64) *point {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return p
+	}
+	p.fields = append(p.fields, field{key: k, value: strconv.FormatFloat(v, 'f', -1, 64), num: v, numeric: true})
+	return p
+}
+
+// floatString adds the number reported as a string (eg. mtr hops), skipped when it isn't one
+func (p *point) floatString(k string, v string) *point {
+	f, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "%")), 64)
+	if err != nil {
+		return p
+	}
+	return p.float(k, f)
+}
+
+func (p *point) bool(k string, v bool) *point {
+	num := 0.0
+	if v {
+		num = 1
+	}
+	p.fields = append(p.fields, field{key: k, value: strconv.FormatBool(v), num: num, numeric: true})
+	return p
+}
+
+func (p *point) string(k string, v string) *point {
+	p.fields = append(p.fields, field{key: k, value: `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`})
+	return p
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// write appends the line of the point, points without fields are invalid and skipped
+func (p *point) write(b *strings.Builder) {
+	if len(p.fields) == 0 {
+		return
+	}
+
+	b.WriteString(measurementEscaper.Replace(p.measurement))
+
+	keys := make([]string, 0, len(p.tags))
+	for k, v := range p.tags {
+		// influxdb rejects empty tag values
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	// sorted tags are faster to write for influxdb
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(",")
+		b.WriteString(tagEscaper.Replace(k))
+		b.WriteString("=")
+		b.WriteString(tagEscaper.Replace(p.tags[k]))
+	}
+
+	for i, f := range p.fields {
+		if i == 0 {
+			b.WriteString(" ")
+		} else {
+			b.WriteString(",")
+		}
+		b.WriteString(tagEscaper.Replace(f.key))
+		b.WriteString("=")
+		b.WriteString(f.value)
+	}
+
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(p.timestamp.UnixNano(), 10))
+	b.WriteString("\n")
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// recordPoints converts the probe data of the record to points tagged with the static labels, probe data of unknown
+// types has none
+func recordPoints(r *Record, labels map[string]string) []*point {
+	data := r.Data
+	tags := map[string]string{
+		"agent":    r.AgentName,
+		"agent_id": r.Agent.Hex(),
+		"site":     r.SiteName,
+		"site_id":  r.Site.Hex(),
+		"probe":    data.ProbeID.Hex(),
+		"type":     string(data.Meta.Type),
+		"target":   data.Target.Target,
+	}
+	for k, v := range labels {
+		if _, ok := tags[k]; !ok {
+			tags[k] = v
+		}
+	}
+	ts := data.Timestamp
+
+	switch d := data.Data.(type) {
+	case agent.PingResult:
+		return []*point{newPoint("ping", tags, ts).
+			int("packets_sent", int64(d.PacketsSent)).
+			int("packets_recv", int64(d.PacketsRecv)).
+			int("packets_recv_duplicates", int64(d.PacketsRecvDuplicates)).
+			float("packet_loss", d.PacketLoss).
+			float("min_rtt_ms", ms(d.MinRtt)).
+			float("avg_rtt_ms", ms(d.AvgRtt)).
+			float("max_rtt_ms", ms(d.MaxRtt)).
+			float("std_dev_rtt_ms", ms(d.StdDevRtt))}
+
+	case agent.MtrResult:
+		points := make([]*point, 0, len(d.Report.Hops))
+		for _, hop := range d.Report.Hops {
+			p := newPoint("mtr_hop", tags, ts).tag("ttl", strconv.Itoa(hop.TTL))
+			if len(hop.Hosts) > 0 {
+				p.tag("host", hop.Hosts[0].IP)
+				p.string("hostname", hop.Hosts[0].Hostname)
+			}
+			p.floatString("loss_pct", hop.LossPct).
+				int("sent", int64(hop.Sent)).
+				int("recv", int64(hop.Recv)).
+				floatString("last_ms", hop.Last).
+				floatString("avg_ms", hop.Avg).
+				floatString("best_ms", hop.Best).
+				floatString("worst_ms", hop.Worst).
+				floatString("stddev_ms", hop.StdDev)
+			points = append(points, p)
+		}
+		return points
+
+	case agent.RPerfResults:
+		s := d.Summary
+		return []*point{newPoint("rperf", tags, ts).
+			bool("success", d.Success).
+			int("bytes_sent", int64(s.BytesSent)).
+			int("bytes_received", int64(s.BytesReceived)).
+			float("duration_send", s.DurationSend).
+			float("duration_receive", s.DurationReceive).
+			float("jitter_average", s.JitterAverage).
+			int("packets_sent", int64(s.PacketsSent)).
+			int("packets_received", int64(s.PacketsReceived)).
+			int("packets_lost", int64(s.PacketsLost)).
+			int("packets_duplicated", int64(s.PacketsDuplicated)).
+			int("packets_out_of_order", int64(s.PacketsOutOfOrder))}
+
+	case agent.TrafficSimClientStats:
+		points := []*point{newPoint("trafficsim", tags, ts).
+			float("average_rtt_ms", d.AverageRTT).
+			int("min_rtt_ms", int64(d.MinRTT)).
+			int("max_rtt_ms", int64(d.MaxRTT)).
+			int("loss_percentage", int64(d.LossPercentage)).
+			int("lost_packets", int64(d.LostPackets)).
+			int("duplicate_packets", int64(d.DuplicatePackets)).
+			int("out_of_sequence", int64(d.OutOfSequence))}
+		for id, f := range d.Flows {
+			points = append(points, newPoint("trafficsim_flow", tags, ts).
+				tag("flow", id).
+				tag("direction", f.Direction).
+				float("duration", f.Duration).
+				int("bytes_sent", int64(f.BytesSent)).
+				int("bytes_received", int64(f.BytesReceived)).
+				int("packets_sent", int64(f.PacketsSent)).
+				int("packets_received", int64(f.PacketsReceived)).
+				int("packets_lost", int64(f.PacketsLost)).
+				int("loss_percentage", int64(f.LossPercentage)).
+				int("rtt_min_ms", int64(f.RttStats.Min)).
+				int("rtt_avg_ms", int64(f.RttStats.Avg)).
+				int("rtt_max_ms", int64(f.RttStats.Max)).
+				int("rtt_p50_ms", int64(f.RttStats.P50)).
+				int("rtt_p95_ms", int64(f.RttStats.P95)).
+				int("rtt_p99_ms", int64(f.RttStats.P99)).
+				int("jitter_min_ms", int64(f.JitterStats.Min)).
+				int("jitter_avg_ms", int64(f.JitterStats.Avg)).
+				int("jitter_max_ms", int64(f.JitterStats.Max)).
+				float("throughput_send", f.ThroughputSend).
+				float("throughput_recv", f.ThroughputRecv))
+		}
+		return points
+
+	case agent.SpeedTestResult:
+		points := make([]*point, 0, len(d.TestData))
+		for _, s := range d.TestData {
+			points = append(points, newPoint("speedtest", tags, ts).
+				tag("server_id", s.ID).
+				tag("server_name", s.Name).
+				tag("sponsor", s.Sponsor).
+				tag("country", s.Country).
+				float("dl_speed", float64(s.DLSpeed)).
+				float("ul_speed", float64(s.ULSpeed)).
+				float("latency_ms", ms(s.Latency)).
+				float("jitter_ms", ms(s.Jitter)).
+				float("distance", s.Distance))
+		}
+		return points
+
+	case agent.CompleteSystemInfo:
+		m := d.MemoryInfo
+		c := d.CPUTimes
+		return []*point{
+			newPoint("sysinfo_memory", tags, ts).
+				int("total", int64(m.Total)).
+				int("used", int64(m.Used)).
+				int("available", int64(m.Available)).
+				int("free", int64(m.Free)).
+				int("virtual_total", int64(m.VirtualTotal)).
+				int("virtual_used", int64(m.VirtualUsed)).
+				int("virtual_free", int64(m.VirtualFree)),
+			newPoint("sysinfo_cpu", tags, ts).
+				float("user", c.User.Seconds()).
+				float("system", c.System.Seconds()).
+				float("idle", c.Idle.Seconds()).
+				float("iowait", c.IOWait.Seconds()).
+				float("irq", c.IRQ.Seconds()).
+				float("nice", c.Nice.Seconds()).
+				float("soft_irq", c.SoftIRQ.Seconds()).
+				float("steal", c.Steal.Seconds()),
+		}
+	}
+
+	return nil
+}
+
+func (i *influxSink) endpoint() string {
+	q := url.Values{}
+	q.Set("bucket", i.config.Bucket)
+	if i.config.Org != "" {
+		q.Set("org", i.config.Org)
+	}
+	q.Set("precision", "ns")
+	return strings.TrimSuffix(i.config.URL, "/") + "/api/v2/write?" + q.Encode()
+}
+
+// Push writes the points of the records in batches of influxBatchSize, stopping at the first batch that fails
+func (i *influxSink) Push(records []Record) error {
+	var points []*point
+	for r := range records {
+		points = append(points, recordPoints(&records[r], i.config.Labels)...)
+	}
+
+	for start := 0; start < len(points); start += influxBatchSize {
+		end := start + influxBatchSize
+		if end > len(points) {
+			end = len(points)
+		}
+
+		var b strings.Builder
+		for _, p := range points[start:end] {
+			p.write(&b)
+		}
+		if b.Len() == 0 {
+			continue
+		}
+
+		err := send(i.client, i.endpoint(), "text/plain; charset=utf-8", []byte(b.String()), func(req *http.Request) {
+			if i.config.Token != "" {
+				req.Header.Set("Authorization", "Token "+i.config.Token)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package sinks
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPointWrite(t *testing.T) {
+	ts := time.Unix(1700000000, 5)
+
+	tests := []struct {
+		name  string
+		point *point
+		want  string
+	}{
+		{
+			name:  "plain",
+			point: newPoint("ping", map[string]string{"agent": "a1"}, ts).float("avg_rtt_ms", 1.5).int("packets_sent", 10),
+			want:  "ping,agent=a1 avg_rtt_ms=1.5,packets_sent=10i 1700000000000000005\n",
+		},
+		{
+			name:  "sorted tags, empty tags left out",
+			point: newPoint("ping", map[string]string{"site": "s", "agent": "a", "target": ""}, ts).bool("ok", true),
+			want:  "ping,agent=a,site=s ok=true 1700000000000000005\n",
+		},
+		{
+			name:  "measurement escaping",
+			point: newPoint("my ping,v2", nil, ts).int("n", 1),
+			want:  `my\ ping\,v2 n=1i 1700000000000000005` + "\n",
+		},
+		{
+			name:  "tag escaping",
+			point: newPoint("ping", map[string]string{"agent name": "a=b, c"}, ts).int("n", 1),
+			want:  `ping,agent\ name=a\=b\,\ c n=1i 1700000000000000005` + "\n",
+		},
+		{
+			name:  "newlines escaped",
+			point: newPoint("ping", map[string]string{"agent": "a\nb"}, ts).int("n", 1),
+			want:  `ping,agent=a\nb n=1i 1700000000000000005` + "\n",
+		},
+		{
+			name:  "field key escaping",
+			point: newPoint("ping", nil, ts).int("loss pct,=", 1),
+			want:  `ping loss\ pct\,\==1i 1700000000000000005` + "\n",
+		},
+		{
+			name:  "string field escaping",
+			point: newPoint("mtr_hop", nil, ts).string("hostname", `a "quoted" \ host`),
+			want:  `mtr_hop hostname="a \"quoted\" \\ host" 1700000000000000005` + "\n",
+		},
+		{
+			name:  "non finite floats left out",
+			point: newPoint("ping", nil, ts).float("nan", math.NaN()).float("ok", 2),
+			want:  "ping ok=2 1700000000000000005\n",
+		},
+		{
+			name:  "number strings",
+			point: newPoint("mtr_hop", nil, ts).floatString("loss_pct", " 12.5% ").floatString("avg_ms", "???"),
+			want:  "mtr_hop loss_pct=12.5 1700000000000000005\n",
+		},
+		{
+			name:  "no fields",
+			point: newPoint("ping", map[string]string{"agent": "a"}, ts),
+			want:  "",
+		},
+	}
+
+	for _, tt := range tests {
+		var b strings.Builder
+		tt.point.write(&b)
+		if got := b.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInfluxPushBatches(t *testing.T) {
+	// the first batch is retried once, then the rest is written
+	server := newStandIn(t, http.StatusBadGateway)
+	sink := &influxSink{client: server.Client(), config: SinkConfig{URL: server.URL + "/", Org: "guardian", Bucket: "probes", Token: "tok"}}
+
+	if err := sink.Push(pingRecords(influxBatchSize + 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := server.got()
+	if len(requests) != 3 {
+		t.Fatalf("%d requests, want a failed batch, its retry & the second batch", len(requests))
+	}
+	if string(requests[0].body) != string(requests[1].body) {
+		t.Errorf("retry sent another batch")
+	}
+
+	for i, r := range requests {
+		if r.method != http.MethodPost || r.path != "/api/v2/write" || r.query != "bucket=probes&org=guardian&precision=ns" {
+			t.Errorf("request %d: %s %s?%s", i, r.method, r.path, r.query)
+		}
+		if got := r.header.Get("Authorization"); got != "Token tok" {
+			t.Errorf("request %d: authorization = %q", i, got)
+		}
+	}
+
+	for i, want := range map[int]int{1: influxBatchSize, 2: 1} {
+		lines := strings.Split(strings.TrimSuffix(string(requests[i].body), "\n"), "\n")
+		if len(lines) != want {
+			t.Errorf("request %d: %d lines, want %d", i, len(lines), want)
+		}
+		if !strings.HasPrefix(lines[0], "ping,agent=edge-1,") {
+			t.Errorf("request %d: line = %s", i, lines[0])
+		}
+	}
+}
+
+func TestInfluxPushStopsAtFailedBatch(t *testing.T) {
+	server := newStandIn(t, http.StatusUnauthorized)
+	sink := &influxSink{client: server.Client(), config: SinkConfig{URL: server.URL, Bucket: "probes"}}
+
+	if err := sink.Push(pingRecords(influxBatchSize + 1)); err == nil {
+		t.Errorf("push succeeded although the write was refused")
+	}
+	if got := len(server.got()); got != 1 {
+		t.Errorf("%d requests, want the refused batch only", got)
+	}
+}
@@ -0,0 +1,109 @@
+package sinks
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const lokiPushPath = "/loki/api/v1/push"
+
+// lokiSink pushes the probe data as json log lines, a stream per agent/site/check
+type lokiSink struct {
+	client *http.Client
+	config SinkConfig
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"` // unix nanoseconds & line
+}
+
+type lokiPush struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+// endpoint returns the push url, the configured url can be the base url of loki or the push url itself
+func (l *lokiSink) endpoint() string {
+	u := strings.TrimSuffix(l.config.URL, "/")
+	if strings.HasSuffix(u, lokiPushPath) {
+		return u
+	}
+	return u + lokiPushPath
+}
+
+// labels returns the labels of the stream of the record, the static labels of the sink can't override them
+func (l *lokiSink) labels(r *Record) map[string]string {
+	labels := make(map[string]string, len(l.config.Labels)+6)
+	for k, v := range l.config.Labels {
+		labels[k] = v
+	}
+	labels["agent"] = r.AgentName
+	labels["agent_id"] = r.Agent.Hex()
+	labels["site"] = r.SiteName
+	labels["site_id"] = r.Site.Hex()
+	labels["check_type"] = string(r.Data.Meta.Type)
+	labels["check_target"] = r.Data.Target.Target
+	return labels
+}
+
+func streamKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(labels[k])
+		b.WriteString(",")
+	}
+	return b.String()
+}
+
+func (l *lokiSink) Push(records []Record) error {
+	var push lokiPush
+	streams := make(map[string]int)
+
+	for i := range records {
+		r := &records[i]
+
+		line, err := json.Marshal(r.Data)
+		if err != nil {
+			return err
+		}
+
+		labels := l.labels(r)
+		key := streamKey(labels)
+		idx, ok := streams[key]
+		if !ok {
+			idx = len(push.Streams)
+			streams[key] = idx
+			push.Streams = append(push.Streams, lokiStream{Stream: labels})
+		}
+		push.Streams[idx].Values = append(push.Streams[idx].Values, [2]string{strconv.FormatInt(r.Data.Timestamp.UnixNano(), 10), string(line)})
+	}
+
+	if len(push.Streams) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+
+	return send(l.client, l.endpoint(), "application/json", body, func(req *http.Request) {
+		if l.config.Username != "" || l.config.Password != "" {
+			req.SetBasicAuth(l.config.Username, l.config.Password)
+		}
+		if l.config.Tenant != "" {
+			req.Header.Set("X-Scope-OrgID", l.config.Tenant)
+		}
+	})
+}
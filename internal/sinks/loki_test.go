@@ -0,0 +1,79 @@
+package sinks
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestLokiPush(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		config SinkConfig
+		auth   string
+	}{
+		{
+			name:   "base url",
+			config: SinkConfig{Username: "loki", Password: "secret", Tenant: "team-a", Labels: map[string]string{"env": "prod", "agent": "ignored"}},
+			auth:   "Basic " + base64.StdEncoding.EncodeToString([]byte("loki:secret")),
+		},
+		{
+			name: "push url",
+			url:  lokiPushPath,
+		},
+	}
+
+	for _, tt := range tests {
+		server := newStandIn(t, http.StatusServiceUnavailable)
+		config := tt.config
+		config.URL = server.URL + tt.url
+		sink := &lokiSink{client: server.Client(), config: config}
+
+		records := pingRecords(3)
+		records[2].Data.Target.Target = records[0].Data.Target.Target
+
+		if err := sink.Push(records); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		requests := server.got()
+		if len(requests) != 2 {
+			t.Errorf("%s: %d requests, want the failed one & its retry", tt.name, len(requests))
+			continue
+		}
+		r := requests[1]
+		if r.method != http.MethodPost || r.path != lokiPushPath || r.header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: %s %s (%s)", tt.name, r.method, r.path, r.header.Get("Content-Type"))
+		}
+		if got := r.header.Get("Authorization"); got != tt.auth {
+			t.Errorf("%s: authorization = %q, want %q", tt.name, got, tt.auth)
+		}
+		if got := r.header.Get("X-Scope-OrgID"); got != config.Tenant {
+			t.Errorf("%s: tenant = %q, want %q", tt.name, got, config.Tenant)
+		}
+
+		var push lokiPush
+		if err := json.Unmarshal(r.body, &push); err != nil {
+			t.Errorf("%s: invalid body: %v", tt.name, err)
+			continue
+		}
+		// the first & last record share their target, so their stream
+		if len(push.Streams) != 2 || len(push.Streams[0].Values) != 2 || len(push.Streams[1].Values) != 1 {
+			t.Errorf("%s: streams = %+v", tt.name, push.Streams)
+			continue
+		}
+		labels := push.Streams[0].Stream
+		if labels["agent"] != "edge-1" || labels["check_type"] != "PING" || labels["check_target"] != records[0].Data.Target.Target {
+			t.Errorf("%s: labels = %v", tt.name, labels)
+		}
+		if labels["env"] != tt.config.Labels["env"] {
+			t.Errorf("%s: static label env = %q, want %q", tt.name, labels["env"], tt.config.Labels["env"])
+		}
+		if push.Streams[0].Values[0][0] != "1700000000000000000" {
+			t.Errorf("%s: timestamp = %s", tt.name, push.Streams[0].Values[0][0])
+		}
+	}
+}
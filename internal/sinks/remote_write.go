@@ -0,0 +1,137 @@
+package sinks
+
+import (
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// remoteWriteBatchSize is the amount of series written at once, a series holds the single sample of a field
+const remoteWriteBatchSize = 5000
+
+// remoteWriteSink writes the numeric fields of the influxdb points as prometheus remote-write (1.0) series,
+// named guardian_<measurement>_<field> and labelled with the tags of the point
+type remoteWriteSink struct {
+	client *http.Client
+	config SinkConfig
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type series struct {
+	labels    []label // sorted by name, __name__ included
+	value     float64
+	timestamp int64 // unix milliseconds
+}
+
+// metricName replaces the characters prometheus doesn't allow in metric & label names with underscores
+func metricName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		letter := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if letter || (i > 0 && c >= '0' && c <= '9') {
+			continue
+		}
+		b[i] = '_'
+	}
+	return string(b)
+}
+
+// series converts the numeric fields of the point, empty tags are left out like prometheus does
+func (p *point) series() []series {
+	labels := make([]label, 0, len(p.tags)+1)
+	for k, v := range p.tags {
+		if v == "" {
+			continue
+		}
+		// colons are reserved for recording rules
+		labels = append(labels, label{name: strings.ReplaceAll(metricName(k), ":", "_"), value: v})
+	}
+
+	var out []series
+	for _, f := range p.fields {
+		if !f.numeric || math.IsNaN(f.num) || math.IsInf(f.num, 0) {
+			continue
+		}
+		l := make([]label, 0, len(labels)+1)
+		l = append(l, label{name: "__name__", value: metricName("guardian_" + p.measurement + "_" + f.key)})
+		l = append(l, labels...)
+		sort.Slice(l, func(i, j int) bool { return l[i].name < l[j].name })
+
+		out = append(out, series{labels: l, value: f.num, timestamp: p.timestamp.UnixMilli()})
+	}
+	return out
+}
+
+// encodeWriteRequest marshals the series as a prometheus.WriteRequest protobuf, a sample per series
+func encodeWriteRequest(ss []series) []byte {
+	var req []byte
+	for _, s := range ss {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.name)
+			lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+			lb = protowire.AppendString(lb, l.value)
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, lb)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
+
+// Push writes the series of the records in batches of remoteWriteBatchSize, stopping at the first batch that fails
+func (w *remoteWriteSink) Push(records []Record) error {
+	var ss []series
+	for r := range records {
+		for _, p := range recordPoints(&records[r], w.config.Labels) {
+			ss = append(ss, p.series()...)
+		}
+	}
+
+	for start := 0; start < len(ss); start += remoteWriteBatchSize {
+		end := start + remoteWriteBatchSize
+		if end > len(ss) {
+			end = len(ss)
+		}
+
+		body := snappy.Encode(nil, encodeWriteRequest(ss[start:end]))
+		err := send(w.client, w.config.URL, "application/x-protobuf", body, func(req *http.Request) {
+			req.Header.Set("Content-Encoding", "snappy")
+			req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+			if w.config.Tenant != "" {
+				req.Header.Set("X-Scope-OrgID", w.config.Tenant)
+			}
+			if w.config.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+w.config.Token)
+			} else if w.config.Username != "" {
+				req.SetBasicAuth(w.config.Username, w.config.Password)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
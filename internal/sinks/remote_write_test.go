@@ -0,0 +1,193 @@
+package sinks
+
+import (
+	"encoding/base64"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetricName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"guardian_ping_avg_rtt_ms", "guardian_ping_avg_rtt_ms"},
+		{"agent_id", "agent_id"},
+		{"1st", "_st"},
+		{"a1", "a1"},
+		{"loss-pct", "loss_pct"},
+		{"env.name", "env_name"},
+		{"rule:avg", "rule:avg"},
+	}
+
+	for _, tt := range tests {
+		if got := metricName(tt.in); got != tt.want {
+			t.Errorf("metricName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPointSeries(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+	p := newPoint("ping", map[string]string{"agent": "a1", "target": "", "env:x": "prod"}, ts).
+		float("avg_rtt_ms", 1.5).
+		bool("success", true).
+		string("hostname", "host").
+		float("nan", math.NaN())
+
+	want := []series{
+		{
+			labels:    []label{{"__name__", "guardian_ping_avg_rtt_ms"}, {"agent", "a1"}, {"env_x", "prod"}},
+			value:     1.5,
+			timestamp: 1700000000123,
+		},
+		{
+			labels:    []label{{"__name__", "guardian_ping_success"}, {"agent", "a1"}, {"env_x", "prod"}},
+			value:     1,
+			timestamp: 1700000000123,
+		},
+	}
+
+	if got := p.series(); !reflect.DeepEqual(got, want) {
+		t.Errorf("series() = %+v, want %+v", got, want)
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	in := []series{
+		{labels: []label{{"__name__", "guardian_ping_avg_rtt_ms"}, {"agent", "a1"}}, value: 1.5, timestamp: 1700000000123},
+		{labels: []label{{"__name__", "guardian_ping_packet_loss"}}, value: 0, timestamp: 1},
+	}
+
+	got := decodeWriteRequest(t, encodeWriteRequest(in))
+	if !reflect.DeepEqual(got, in) {
+		t.Errorf("decoded %+v, want %+v", got, in)
+	}
+}
+
+// decodeWriteRequest reads back the fields encodeWriteRequest writes
+func decodeWriteRequest(t *testing.T, b []byte) []series {
+	t.Helper()
+
+	fields := func(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = fn(num, typ, b)
+			if n < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+
+	var out []series
+	fields(b, func(_ protowire.Number, _ protowire.Type, b []byte) int {
+		ts, n := protowire.ConsumeBytes(b)
+		var s series
+		fields(ts, func(num protowire.Number, _ protowire.Type, b []byte) int {
+			v, n := protowire.ConsumeBytes(b)
+			switch num {
+			case 1:
+				var l label
+				fields(v, func(num protowire.Number, _ protowire.Type, b []byte) int {
+					str, n := protowire.ConsumeString(b)
+					if num == 1 {
+						l.name = str
+					} else {
+						l.value = str
+					}
+					return n
+				})
+				s.labels = append(s.labels, l)
+			case 2:
+				fields(v, func(num protowire.Number, _ protowire.Type, b []byte) int {
+					if num == 1 {
+						bits, n := protowire.ConsumeFixed64(b)
+						s.value = math.Float64frombits(bits)
+						return n
+					}
+					ms, n := protowire.ConsumeVarint(b)
+					s.timestamp = int64(ms)
+					return n
+				})
+			}
+			return n
+		})
+		out = append(out, s)
+		return n
+	})
+	return out
+}
+
+func TestRemoteWritePushBatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		config SinkConfig
+		auth   string
+	}{
+		{"bearer token", SinkConfig{Token: "tok", Tenant: "team-a"}, "Bearer tok"},
+		{"basic auth", SinkConfig{Username: "prom", Password: "secret"}, "Basic " + base64.StdEncoding.EncodeToString([]byte("prom:secret"))},
+	}
+
+	// a ping record is 8 series, enough records for two batches
+	records := pingRecords(remoteWriteBatchSize/8 + 1)
+
+	for _, tt := range tests {
+		server := newStandIn(t, http.StatusServiceUnavailable)
+		config := tt.config
+		config.URL = server.URL + "/api/v1/write"
+		sink := &remoteWriteSink{client: server.Client(), config: config}
+
+		if err := sink.Push(records); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		requests := server.got()
+		if len(requests) != 3 {
+			t.Errorf("%s: %d requests, want a failed batch, its retry & the second batch", tt.name, len(requests))
+			continue
+		}
+
+		total := 0
+		for i, r := range requests {
+			if r.path != "/api/v1/write" || r.header.Get("Content-Type") != "application/x-protobuf" || r.header.Get("Content-Encoding") != "snappy" {
+				t.Errorf("%s: request %d: %s (%s, %s)", tt.name, i, r.path, r.header.Get("Content-Type"), r.header.Get("Content-Encoding"))
+			}
+			if got := r.header.Get("Authorization"); got != tt.auth {
+				t.Errorf("%s: request %d: authorization = %q, want %q", tt.name, i, got, tt.auth)
+			}
+			if got := r.header.Get("X-Scope-OrgID"); got != config.Tenant {
+				t.Errorf("%s: request %d: tenant = %q, want %q", tt.name, i, got, config.Tenant)
+			}
+
+			body, err := snappy.Decode(nil, r.body)
+			if err != nil {
+				t.Errorf("%s: request %d: invalid snappy body: %v", tt.name, i, err)
+				continue
+			}
+			ss := decodeWriteRequest(t, body)
+			if i > 0 {
+				total += len(ss)
+			}
+			if i == 1 && len(ss) != remoteWriteBatchSize {
+				t.Errorf("%s: first batch has %d series, want %d", tt.name, len(ss), remoteWriteBatchSize)
+			}
+		}
+		if string(requests[0].body) != string(requests[1].body) {
+			t.Errorf("%s: retry sent another batch", tt.name)
+		}
+		if want := len(records) * 8; total != want {
+			t.Errorf("%s: %d series written, want %d", tt.name, total, want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"net/url"
+	"nw-guardian/internal"
+	"nw-guardian/internal/agent"
+	"time"
+)
+
+type SinkType string
+
+const (
+	SinkType_LOKI       SinkType = "LOKI"       // loki push api
+	SinkType_INFLUXDB   SinkType = "INFLUXDB"   // influxdb v2 write api, line protocol
+	SinkType_PROMETHEUS SinkType = "PROMETHEUS" // prometheus remote-write 1.0 (prometheus, mimir, thanos, victoriametrics...)
+)
+
+// Record is stored probe data handed to the sinks, with the names of its agent & workspace
+type Record struct {
+	Site      primitive.ObjectID
+	SiteName  string
+	Agent     primitive.ObjectID
+	AgentName string
+	Data      *agent.ProbeData
+}
+
+// Sink sends the probe data the ingestion stored to an external system
+type Sink interface {
+	Push(records []Record) error
+}
+
+// SinkConfig is a sink configured on a workspace, the probe data of the agents of the workspace is pushed to it
+type SinkConfig struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	Site     primitive.ObjectID `json:"site" bson:"site"`
+	Name     string             `json:"name" bson:"name"`
+	Type     SinkType           `json:"type" bson:"type"`
+	URL      string             `json:"url" bson:"url"`
+	Username string             `json:"username" bson:"username"` // basic auth
+	Password string             `json:"password" bson:"password"`
+	Tenant   string             `json:"tenant" bson:"tenant"` // loki & remote-write X-Scope-OrgID, for multi-tenant setups
+	Org      string             `json:"org" bson:"org"`       // influxdb organization
+	Bucket   string             `json:"bucket" bson:"bucket"` // influxdb bucket, database/retention-policy on influxdb 1.8+
+	Token    string             `json:"token" bson:"token"`   // influxdb api token (username:password on influxdb 1.8+), remote-write bearer token
+	Labels   map[string]string  `json:"labels" bson:"labels"` // static labels added to everything pushed
+	Types    []agent.ProbeType  `json:"types" bson:"types"`   // probe types pushed, empty pushes every type
+	Enabled  bool               `json:"enabled" bson:"enabled"`
+
+	CreatedAt    time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt" bson:"updatedAt"`
+	LastPushedAt time.Time `json:"lastPushedAt,omitempty" bson:"lastPushedAt,omitempty"`
+	LastError    string    `json:"lastError,omitempty" bson:"lastError,omitempty"` // error of the last push, empty when it succeeded
+}
+
+func validURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (c *SinkConfig) Validate() error {
+	switch c.Type {
+	case SinkType_LOKI:
+		if !validURL(c.URL) {
+			return errors.New("loki url must be a valid http(s) url")
+		}
+	case SinkType_INFLUXDB:
+		if !validURL(c.URL) {
+			return errors.New("influxdb url must be a valid http(s) url")
+		}
+		if c.Bucket == "" {
+			return errors.New("a bucket is required for influxdb sinks")
+		}
+	case SinkType_PROMETHEUS:
+		if !validURL(c.URL) {
+			return errors.New("remote-write url must be a valid http(s) url")
+		}
+	default:
+		return errors.New("unknown sink type " + string(c.Type))
+	}
+
+	return nil
+}
+
+// Accepts reports if probe data of the type is pushed to the sink
+func (c *SinkConfig) Accepts(t agent.ProbeType) bool {
+	if len(c.Types) == 0 {
+		return true
+	}
+	for _, st := range c.Types {
+		if st == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Open returns the sink of the config
+func (c *SinkConfig) Open(client *http.Client) (Sink, error) {
+	switch c.Type {
+	case SinkType_LOKI:
+		return &lokiSink{client: client, config: *c}, nil
+	case SinkType_INFLUXDB:
+		return &influxSink{client: client, config: *c}, nil
+	case SinkType_PROMETHEUS:
+		return &remoteWriteSink{client: client, config: *c}, nil
+	}
+	return nil, errors.New("unknown sink type " + string(c.Type))
+}
+
+func (c *SinkConfig) Create(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.sinks", Level: log.ErrorLevel, Function: "sinks.Create", ObjectID: c.Site}
+
+	err := c.Validate()
+	if err != nil {
+		ee.Message = "invalid sink"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	c.ID = primitive.NewObjectID()
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = time.Now()
+	c.LastError = ""
+	c.LastPushedAt = time.Time{}
+
+	_, err = db.Collection("data_sinks").InsertOne(context.TODO(), c)
+	if err != nil {
+		ee.Message = "error inserting sink"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (c *SinkConfig) Get(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.sinks", Level: log.ErrorLevel, Function: "sinks.Get", ObjectID: c.ID}
+
+	err := db.Collection("data_sinks").FindOne(context.TODO(), bson.M{"_id": c.ID}).Decode(c)
+	if err != nil {
+		ee.Message = "unable to find sink"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// Update updates the editable fields of the sink, the password & token are only replaced when provided
+func (c *SinkConfig) Update(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.sinks", Level: log.ErrorLevel, Function: "sinks.Update", ObjectID: c.ID}
+
+	err := c.Validate()
+	if err != nil {
+		ee.Message = "invalid sink"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	c.UpdatedAt = time.Now()
+
+	set := bson.M{
+		"name":      c.Name,
+		"type":      c.Type,
+		"url":       c.URL,
+		"username":  c.Username,
+		"tenant":    c.Tenant,
+		"org":       c.Org,
+		"bucket":    c.Bucket,
+		"labels":    c.Labels,
+		"types":     c.Types,
+		"enabled":   c.Enabled,
+		"updatedAt": c.UpdatedAt,
+	}
+	if c.Password != "" {
+		set["password"] = c.Password
+	}
+	if c.Token != "" {
+		set["token"] = c.Token
+	}
+
+	_, err = db.Collection("data_sinks").UpdateOne(context.TODO(), bson.M{"_id": c.ID}, bson.M{"$set": set})
+	if err != nil {
+		ee.Message = "unable to update sink"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+func (c *SinkConfig) Delete(db *mongo.Database) error {
+	ee := internal.ErrorFormat{Package: "internal.sinks", Level: log.ErrorLevel, Function: "sinks.Delete", ObjectID: c.ID}
+
+	_, err := db.Collection("data_sinks").DeleteOne(context.TODO(), bson.M{"_id": c.ID})
+	if err != nil {
+		ee.Message = "unable to delete sink"
+		ee.Error = err
+		return ee.ToError()
+	}
+
+	return nil
+}
+
+// setStatus records the result of the last push to the sink
+func (c *SinkConfig) setStatus(db *mongo.Database, pushErr error) error {
+	set := bson.M{"lastPushedAt": time.Now(), "lastError": ""}
+	if pushErr != nil {
+		set["lastError"] = pushErr.Error()
+	}
+
+	_, err := db.Collection("data_sinks").UpdateOne(context.TODO(), bson.M{"_id": c.ID}, bson.M{"$set": set})
+	return err
+}
+
+// GetSinksForSite returns the sinks of the site, only the enabled ones when enabledOnly is set
+func GetSinksForSite(db *mongo.Database, site primitive.ObjectID, enabledOnly bool) ([]SinkConfig, error) {
+	ee := internal.ErrorFormat{Package: "internal.sinks", Level: log.ErrorLevel, Function: "sinks.GetSinksForSite", ObjectID: site}
+
+	filter := bson.M{"site": site}
+	if enabledOnly {
+		filter["enabled"] = true
+	}
+
+	cursor, err := db.Collection("data_sinks").Find(context.TODO(), filter)
+	if err != nil {
+		ee.Message = "unable to find sinks"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	var sinks []SinkConfig
+	if err = cursor.All(context.TODO(), &sinks); err != nil {
+		ee.Message = "unable to decode sinks"
+		ee.Error = err
+		return nil, ee.ToError()
+	}
+
+	return sinks, nil
+}
@@ -0,0 +1,135 @@
+package telemetry
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Gauge is the latest value of a metric, Resource are the attributes of the entity it was measured on
+type Gauge struct {
+	Name        string
+	Unit        string
+	Description string
+	Value       float64
+	Time        time.Time
+	Resource    map[string]string
+	Attributes  map[string]string
+}
+
+// GaugeSource provides the gauges exported every metric interval
+type GaugeSource interface {
+	Gauges() []Gauge
+}
+
+// ExportMetrics exports the gauges of the source every metric interval, it does nothing when metrics are disabled
+func ExportMetrics(source GaugeSource) {
+	if !enabled || config.MetricsEndpoint == "" {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(config.MetricInterval)
+
+			err := exportGauges(source.Gauges())
+			if err != nil {
+				log.Warnf("unable to export metrics: %v", err)
+			}
+		}
+	}()
+}
+
+type numberDataPoint struct {
+	Attributes   []keyValue `json:"attributes"`
+	TimeUnixNano string     `json:"timeUnixNano"`
+	AsDouble     float64    `json:"asDouble"`
+}
+
+type otlpGauge struct {
+	DataPoints []numberDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Unit        string    `json:"unit,omitempty"`
+	Gauge       otlpGauge `json:"gauge"`
+}
+
+type scopeMetrics struct {
+	Scope   scope        `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type resourceMetrics struct {
+	Resource     resource       `json:"resource"`
+	ScopeMetrics []scopeMetrics `json:"scopeMetrics"`
+}
+
+// resourceKey identifies the resource of the attributes
+func resourceKey(attrs map[string]string) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + attrs[k] + ";")
+	}
+	return b.String()
+}
+
+// exportGauges sends the gauges grouped by resource, then by metric
+func exportGauges(gauges []Gauge) error {
+	if len(gauges) == 0 {
+		return nil
+	}
+
+	var payload struct {
+		ResourceMetrics []resourceMetrics `json:"resourceMetrics"`
+	}
+	resources := make(map[string]int)
+	metrics := make(map[string]map[string]int) // resource -> metric name -> index
+
+	for _, g := range gauges {
+		rk := resourceKey(g.Resource)
+		ri, ok := resources[rk]
+		if !ok {
+			attrs := baseResource()
+			for k, v := range g.Resource {
+				attrs[k] = v
+			}
+			ri = len(payload.ResourceMetrics)
+			resources[rk] = ri
+			metrics[rk] = make(map[string]int)
+			payload.ResourceMetrics = append(payload.ResourceMetrics, resourceMetrics{
+				Resource:     resource{Attributes: toAttributes(attrs)},
+				ScopeMetrics: []scopeMetrics{{Scope: scope{Name: defaultServiceName}}},
+			})
+		}
+
+		sm := &payload.ResourceMetrics[ri].ScopeMetrics[0]
+		mi, ok := metrics[rk][g.Name]
+		if !ok {
+			mi = len(sm.Metrics)
+			metrics[rk][g.Name] = mi
+			sm.Metrics = append(sm.Metrics, otlpMetric{Name: g.Name, Description: g.Description, Unit: g.Unit})
+		}
+
+		attrs := make(map[string]interface{}, len(g.Attributes))
+		for k, v := range g.Attributes {
+			attrs[k] = v
+		}
+		sm.Metrics[mi].Gauge.DataPoints = append(sm.Metrics[mi].Gauge.DataPoints, numberDataPoint{
+			Attributes:   toAttributes(attrs),
+			TimeUnixNano: unixNano(g.Time),
+			AsDouble:     g.Value,
+		})
+	}
+
+	return post(config.MetricsEndpoint, payload)
+}
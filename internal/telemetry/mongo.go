@@ -0,0 +1,71 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/event"
+	"sync"
+)
+
+// untracedCommands are the commands of the driver itself (handshakes, auth & sessions)
+var untracedCommands = map[string]bool{
+	"hello":        true,
+	"isMaster":     true,
+	"ismaster":     true,
+	"saslStart":    true,
+	"saslContinue": true,
+	"endSessions":  true,
+	"buildInfo":    true,
+}
+
+// CommandMonitor returns the mongo command monitor tracing the commands as client spans, nil when tracing is
+// disabled. Only commands run with a traced context are recorded, as children of its span, every other command
+// would be a trace of its own. The models mostly run their queries with context.TODO(), so only the ingestion writes,
+// the agent heart beat and the session, agent & probe lookups of the websocket events are recorded.
+func CommandMonitor() *event.CommandMonitor {
+	if tracer == nil {
+		return nil
+	}
+
+	var spans sync.Map // request id -> *Span
+
+	end := func(requestID int64, err error) {
+		s, ok := spans.LoadAndDelete(requestID)
+		if !ok {
+			return
+		}
+		span := s.(*Span)
+		span.SetError(err)
+		span.End()
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if untracedCommands[e.CommandName] || SpanFromContext(ctx) == nil {
+				return
+			}
+
+			// the collection is the value of the command name (eg. {"find": "probes", ...})
+			collection, _ := e.Command.Lookup(e.CommandName).StringValueOK()
+			name := e.CommandName + " " + e.DatabaseName
+			if collection != "" {
+				name += "." + collection
+			}
+
+			_, span := Start(ctx, name, SpanKind_CLIENT)
+			span.SetAttribute("db.system", "mongodb")
+			span.SetAttribute("db.name", e.DatabaseName)
+			span.SetAttribute("db.operation", e.CommandName)
+			if collection != "" {
+				span.SetAttribute("db.mongodb.collection", collection)
+			}
+			spans.Store(e.RequestID, span)
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			end(e.RequestID, nil)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			end(e.RequestID, errors.New(e.Failure))
+		},
+	}
+}
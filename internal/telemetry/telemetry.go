@@ -0,0 +1,212 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultServiceName    = "nw-guardian"
+	defaultMetricInterval = time.Minute
+)
+
+// Config is the export configuration, read from the standard OTEL_* env variables
+type Config struct {
+	TracesEndpoint  string // full url of the otlp/http traces endpoint, traces aren't exported when empty
+	MetricsEndpoint string // full url of the otlp/http metrics endpoint, metrics aren't exported when empty
+	Headers         map[string]string
+	ServiceName     string
+	SampleRatio     float64 // ratio of the root spans recorded, child spans follow their parent
+	MetricInterval  time.Duration
+}
+
+// signalEndpoint returns the endpoint of the signal, the signal specific env variable is used as is, the path of
+// the signal is appended to the generic one
+func signalEndpoint(signal string) string {
+	if env := os.Getenv("OTEL_EXPORTER_OTLP_" + strings.ToUpper(signal) + "_ENDPOINT"); env != "" {
+		return env
+	}
+	if env := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); env != "" {
+		return strings.TrimSuffix(env, "/") + "/v1/" + signal
+	}
+	return ""
+}
+
+// ConfigFromEnv reads the config from the OTEL_* env variables, false is returned when no endpoint is set or
+// OTEL_SDK_DISABLED is true
+func ConfigFromEnv() (Config, bool) {
+	cfg := Config{
+		TracesEndpoint:  signalEndpoint("traces"),
+		MetricsEndpoint: signalEndpoint("metrics"),
+		Headers:         make(map[string]string),
+		ServiceName:     defaultServiceName,
+		SampleRatio:     1,
+		MetricInterval:  defaultMetricInterval,
+	}
+
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" || (cfg.TracesEndpoint == "" && cfg.MetricsEndpoint == "") {
+		return cfg, false
+	}
+
+	if env := os.Getenv("OTEL_SERVICE_NAME"); env != "" {
+		cfg.ServiceName = env
+	}
+
+	// headers are a list of key=value with url encoded values (eg. authorization=Bearer%20xyz)
+	for _, h := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		k, v, ok := strings.Cut(h, "=")
+		if !ok {
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(v); err == nil {
+			v = unescaped
+		}
+		cfg.Headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+
+	if env := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); env != "" {
+		ratio, err := strconv.ParseFloat(env, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			log.Warnf("invalid OTEL_TRACES_SAMPLER_ARG %q, using %v", env, cfg.SampleRatio)
+		} else {
+			cfg.SampleRatio = ratio
+		}
+	}
+
+	// the interval is in milliseconds
+	if env := os.Getenv("OTEL_METRIC_EXPORT_INTERVAL"); env != "" {
+		ms, err := strconv.Atoi(env)
+		if err != nil || ms <= 0 {
+			log.Warnf("invalid OTEL_METRIC_EXPORT_INTERVAL %q, using %s", env, defaultMetricInterval)
+		} else {
+			cfg.MetricInterval = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	return cfg, true
+}
+
+var (
+	config  Config
+	client  = &http.Client{Timeout: 10 * time.Second}
+	tracer  *Tracer
+	enabled bool
+)
+
+// Init enables the export of the configured signals, nothing is exported before it is called
+func Init(cfg Config) {
+	config = cfg
+	enabled = true
+
+	if cfg.TracesEndpoint != "" {
+		tracer = newTracer(cfg)
+		log.Infof("Exporting traces to %s", cfg.TracesEndpoint)
+	}
+	if cfg.MetricsEndpoint != "" {
+		log.Infof("Exporting metrics to %s every %s", cfg.MetricsEndpoint, cfg.MetricInterval)
+	}
+}
+
+// otlp/json encoding of the common protobuf messages, 64 bit integers are encoded as strings
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+func toValue(v interface{}) anyValue {
+	switch t := v.(type) {
+	case string:
+		return anyValue{StringValue: &t}
+	case bool:
+		return anyValue{BoolValue: &t}
+	case int:
+		s := strconv.Itoa(t)
+		return anyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(t, 10)
+		return anyValue{IntValue: &s}
+	case float64:
+		return anyValue{DoubleValue: &t}
+	}
+	s := fmt.Sprint(v)
+	return anyValue{StringValue: &s}
+}
+
+func toAttributes(attrs map[string]interface{}) []keyValue {
+	kvs := make([]keyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kvs = append(kvs, keyValue{Key: k, Value: toValue(v)})
+	}
+	return kvs
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// baseResource is the resource of guardian itself
+func baseResource() map[string]interface{} {
+	attrs := map[string]interface{}{
+		"service.name":           config.ServiceName,
+		"telemetry.sdk.language": "go",
+	}
+	if host, err := os.Hostname(); err == nil {
+		attrs["service.instance.id"] = host
+	}
+	return attrs
+}
+
+// post sends the otlp/json payload
+func post(endpoint string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nw-guardian")
+	for k, v := range config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
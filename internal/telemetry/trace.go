@@ -0,0 +1,277 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	spanQueueSize   = 2048
+	spanBatchSize   = 512
+	spanFlushPeriod = 5 * time.Second
+)
+
+type SpanKind int
+
+// values of the otlp SpanKind enum
+const (
+	SpanKind_INTERNAL SpanKind = 1
+	SpanKind_SERVER   SpanKind = 2
+	SpanKind_CLIENT   SpanKind = 3
+)
+
+// statusError is the error value of the otlp StatusCode enum
+const statusError = 2
+
+type traceID [16]byte
+type spanID [8]byte
+
+// Span is an operation being traced, a nil span (tracing disabled) does nothing
+type Span struct {
+	trace   traceID
+	id      spanID
+	parent  spanID
+	name    string
+	kind    SpanKind
+	start   time.Time
+	sampled bool
+	remote  bool // the parent of a request that was traced by its sender, never exported
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	status     int
+	message    string
+	ended      bool
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span of the context, nil when there is none
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a span, the child of the span of the context when there is one. The returned context carries the span.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	s := &Span{name: name, kind: kind, start: time.Now(), attributes: make(map[string]interface{})}
+	_, _ = rand.Read(s.id[:])
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		s.trace = parent.trace
+		s.parent = parent.id
+		s.sampled = parent.sampled
+	} else {
+		_, _ = rand.Read(s.trace[:])
+		s.sampled = config.SampleRatio >= 1 || mrand.Float64() < config.SampleRatio
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// ContextWithTraceParent returns a context carrying the remote parent of the w3c traceparent header, spans started
+// from it join the trace of the sender. The context is returned as is when the header is empty or invalid.
+func ContextWithTraceParent(ctx context.Context, header string) context.Context {
+	if tracer == nil || header == "" {
+		return ctx
+	}
+
+	// version-traceid-parentid-flags
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+
+	s := &Span{remote: true}
+	if _, err := hex.Decode(s.trace[:], []byte(parts[1])); err != nil || s.trace == (traceID{}) {
+		return ctx
+	}
+	if _, err := hex.Decode(s.id[:], []byte(parts[2])); err != nil || s.id == (spanID{}) {
+		return ctx
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return ctx
+	}
+	s.sampled = flags[0]&1 == 1
+
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// TraceParent returns the w3c traceparent header of the span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.trace[:]), hex.EncodeToString(s.id[:]), flags)
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed, nil errors are ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.status = statusError
+	s.message = err.Error()
+	s.mu.Unlock()
+}
+
+// End ends the span and queues it for export when it is sampled
+func (s *Span) End() {
+	if s == nil || s.remote {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sampled && tracer != nil {
+		tracer.queue(s)
+	}
+}
+
+// Tracer batches the ended spans and exports them to the traces endpoint
+type Tracer struct {
+	endpoint string
+	spans    chan *Span
+	dropped  uint64
+}
+
+func newTracer(cfg Config) *Tracer {
+	t := &Tracer{endpoint: cfg.TracesEndpoint, spans: make(chan *Span, spanQueueSize)}
+	go t.run()
+	return t
+}
+
+func (t *Tracer) queue(s *Span) {
+	select {
+	case t.spans <- s:
+	default:
+		// tracing must never hold back the requests being traced
+		if atomic.AddUint64(&t.dropped, 1)%1000 == 1 {
+			log.Warn("span queue is full, dropping spans")
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(spanFlushPeriod)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, spanBatchSize)
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		err := t.export(batch)
+		if err != nil {
+			log.Warnf("unable to export %d spans: %v", len(batch), err)
+		}
+		batch = make([]*Span, 0, spanBatchSize)
+	}
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              SpanKind   `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes"`
+	Status            otlpStatus `json:"status"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.trace[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Attributes:        toAttributes(s.attributes),
+			Status:            otlpStatus{Code: s.status, Message: s.message},
+		}
+		s.mu.Unlock()
+		if s.parent != (spanID{}) {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		spans = append(spans, span)
+	}
+
+	payload := struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{{
+		Resource:   resource{Attributes: toAttributes(baseResource())},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: defaultServiceName}, Spans: spans}},
+	}}}
+
+	return post(t.endpoint, payload)
+}
@@ -7,6 +7,9 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"html"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -43,6 +46,17 @@ type EmailJob struct {
 	ProcessedAt  *time.Time         `bson:"processedAt,omitempty" json:"processedAt,omitempty"`
 }
 
+// maxEmailAttempts is how often a job is sent before it is left failed
+const maxEmailAttempts = 3
+
+// emailJobStatus is the status of a job that failed to send, it is queued again while attempts remain
+func emailJobStatus(attempts int) string {
+	if attempts < maxEmailAttempts {
+		return "pending"
+	}
+	return "failed"
+}
+
 // EmailTemplate represents an email template
 type EmailTemplate struct {
 	Name     string `json:"name"`
@@ -104,6 +118,37 @@ type EmailConfig struct {
 	Workers      int
 }
 
+// EmailConfigFromEnv reads the SMTP configuration from the environment, ok is false
+// when SMTP_HOST is not set and emails should not be sent
+func EmailConfigFromEnv() (config EmailConfig, ok bool) {
+	config = EmailConfig{
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     587,
+		SMTPUser:     os.Getenv("SMTP_USER"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		FromEmail:    os.Getenv("SMTP_FROM"),
+		FromName:     os.Getenv("SMTP_FROM_NAME"),
+		BaseURL:      strings.TrimSuffix(os.Getenv("BASE_URL"), "/"),
+		Workers:      2,
+	}
+
+	if config.SMTPHost == "" {
+		return config, false
+	}
+
+	if port, err := strconv.Atoi(os.Getenv("SMTP_PORT")); err == nil {
+		config.SMTPPort = port
+	}
+	if workers, err := strconv.Atoi(os.Getenv("EMAIL_WORKERS")); err == nil && workers > 0 {
+		config.Workers = workers
+	}
+	if config.FromName == "" {
+		config.FromName = "NetWatcher"
+	}
+
+	return config, true
+}
+
 // initializeTemplates sets up email templates
 func (es *EmailService) initializeTemplates() {
 	es.templates = map[string]EmailTemplate{
@@ -208,6 +253,65 @@ This link will expire in 1 hour. If you didn't request a password reset, you can
 
 Best regards,
 The NetWatcher Team`,
+		},
+		"alert": {
+			Name:    "alert",
+			Subject: "[{{.Status}}] {{.AgentName}}: {{.Message}}",
+			HTMLBody: `
+<!DOCTYPE html>
+<html>
+<head>
+    <style>
+        body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; }
+        .container { max-width: 600px; margin: 0 auto; padding: 20px; }
+        .header { background-color: #ef4444; color: white; padding: 30px; text-align: center; border-radius: 10px 10px 0 0; }
+        .content { background-color: #f8f9fa; padding: 30px; border-radius: 0 0 10px 10px; }
+        .button { display: inline-block; padding: 12px 30px; background-color: #3b82f6; color: white; text-decoration: none; border-radius: 5px; margin: 20px 0; }
+        .details td { padding: 4px 10px 4px 0; }
+        .footer { text-align: center; padding: 20px; color: #666; font-size: 14px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>Alert {{.Status}}</h1>
+        </div>
+        <div class="content">
+            <p>Hi {{.FirstName}},</p>
+            <p>{{.Message}}</p>
+            <table class="details">
+                <tr><td><b>Workspace</b></td><td>{{.SiteName}}</td></tr>
+                <tr><td><b>Agent</b></td><td>{{.AgentName}}</td></tr>
+                <tr><td><b>Probe</b></td><td>{{.ProbeType}}</td></tr>
+                <tr><td><b>Target</b></td><td>{{.Target}}</td></tr>
+                <tr><td><b>Time</b></td><td>{{.Timestamp}}</td></tr>
+            </table>
+            <div style="text-align: center;">
+                <a href="{{.AlertLink}}" class="button">View Alert</a>
+            </div>
+            <p>You are receiving this because you are a member of {{.SiteName}}, you can turn off alert emails in the workspace settings.</p>
+        </div>
+        <div class="footer">
+            <p>&copy; 2025 NetWatcher. All rights reserved.</p>
+        </div>
+    </div>
+</body>
+</html>`,
+			TextBody: `Alert {{.Status}}
+
+Hi {{.FirstName}},
+
+{{.Message}}
+
+Workspace: {{.SiteName}}
+Agent: {{.AgentName}}
+Probe: {{.ProbeType}}
+Target: {{.Target}}
+Time: {{.Timestamp}}
+
+View Alert: {{.AlertLink}}
+
+You are receiving this because you are a member of {{.SiteName}}, you can turn off alert emails in the workspace settings.`,
 		},
 		"welcome": {
 			Name:    "welcome",
@@ -357,7 +461,7 @@ func (es *EmailService) loadPendingJobs() {
 func (es *EmailService) loadJobs() {
 	filter := bson.M{
 		"status":   "pending",
-		"attempts": bson.M{"$lt": 3},
+		"attempts": bson.M{"$lt": maxEmailAttempts},
 	}
 
 	cursor, err := es.db.Collection("email_queue").Find(context.Background(), filter)
@@ -411,13 +515,13 @@ func (es *EmailService) processJob(jobID primitive.ObjectID) error {
 
 	now := time.Now()
 	if err != nil {
-		// Update as failed
+		// Update as failed, or pending to be picked up again by loadJobs
 		_, updateErr := es.db.Collection("email_queue").UpdateOne(
 			context.Background(),
 			bson.M{"_id": jobID},
 			bson.M{
 				"$set": bson.M{
-					"status":      "failed",
+					"status":      emailJobStatus(job.Attempts + 1),
 					"error":       err.Error(),
 					"processedAt": now,
 				},
@@ -455,8 +559,12 @@ func (es *EmailService) sendEmail(job EmailJob) error {
 		return fmt.Errorf("template %s not found", job.TemplateName)
 	}
 
-	// Process template
-	htmlBody := processTemplate(template.HTMLBody, job.TemplateData)
+	// Process template, values are escaped for the html body as alerts include user provided names
+	htmlData := make(map[string]string, len(job.TemplateData))
+	for key, value := range job.TemplateData {
+		htmlData[key] = html.EscapeString(value)
+	}
+	htmlBody := processTemplate(template.HTMLBody, htmlData)
 	textBody := processTemplate(template.TextBody, job.TemplateData)
 	subject := processTemplate(job.Subject, job.TemplateData)
 
@@ -571,6 +679,42 @@ func (es *EmailService) QueueWelcomeEmail(user *User) error {
 	return nil
 }
 
+// QueueAlertEmail queues an alert notification email, data holds the values of the alert template
+func (es *EmailService) QueueAlertEmail(user *User, data map[string]string) error {
+	templateData := map[string]string{
+		"FirstName": user.FirstName,
+		"AlertLink": fmt.Sprintf("%s/alerts/%s", es.baseURL, data["AlertID"]),
+	}
+	for key, value := range data {
+		templateData[key] = value
+	}
+
+	job := EmailJob{
+		ID:           primitive.NewObjectID(),
+		To:           user.Email,
+		Subject:      es.templates["alert"].Subject,
+		TemplateName: "alert",
+		TemplateData: templateData,
+		Status:       "pending",
+		Attempts:     0,
+		CreatedAt:    time.Now(),
+	}
+
+	_, err := es.db.Collection("email_queue").InsertOne(context.Background(), job)
+	if err != nil {
+		return fmt.Errorf("failed to queue email: %w", err)
+	}
+
+	// Try to add to queue immediately
+	select {
+	case es.queue <- job.ID:
+	default:
+		// Queue is full, will be picked up by loader
+	}
+
+	return nil
+}
+
 // User verification methods
 
 // CreateVerificationToken creates a new verification token for a user
@@ -0,0 +1,187 @@
+package users
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpStandIn is a local smtp server standing in for the mail relay, it advertises AUTH PLAIN, answers MAIL FROM
+// with mailFrom and records the credentials & messages it got
+type smtpStandIn struct {
+	listener net.Listener
+	mailFrom string
+
+	mu       sync.Mutex
+	auth     []string // decoded AUTH PLAIN responses
+	messages []string
+}
+
+func newSMTPStandIn(t *testing.T, mailFrom string) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: listener, mailFrom: mailFrom}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			_, _ = conn.Write([]byte(l + "\r\n"))
+		}
+	}
+
+	reply("220 stand-in ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch command {
+		case "EHLO", "HELO":
+			reply("250-stand-in", "250 AUTH PLAIN")
+		case "AUTH":
+			fields := strings.Fields(line)
+			decoded, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+			s.mu.Lock()
+			s.auth = append(s.auth, string(decoded))
+			s.mu.Unlock()
+			reply("235 authenticated")
+		case "MAIL":
+			reply(s.mailFrom)
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *smtpStandIn) got() ([]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.auth...), append([]string(nil), s.messages...)
+}
+
+func alertJob(es *EmailService) EmailJob {
+	return EmailJob{
+		To:           "ops@example.org",
+		Subject:      es.templates["alert"].Subject,
+		TemplateName: "alert",
+		TemplateData: map[string]string{
+			"Status":    "FIRING",
+			"AgentName": "<edge>",
+			"Message":   "packet loss above 5%",
+			"SiteName":  "hq",
+			"AlertLink": "https://guardian.example.org/alerts/1",
+		},
+	}
+}
+
+func TestAlertEmail(t *testing.T) {
+	server := newSMTPStandIn(t, "250 ok")
+	es := NewEmailService(nil, EmailConfig{SMTPHost: "127.0.0.1", SMTPPort: server.port(), SMTPUser: "guardian",
+		SMTPPassword: "secret", FromEmail: "alerts@example.org", FromName: "Guardian"})
+
+	if err := es.sendEmail(alertJob(es)); err != nil {
+		t.Fatal(err)
+	}
+
+	auth, messages := server.got()
+	if len(auth) != 1 || auth[0] != "\x00guardian\x00secret" {
+		t.Errorf("auth = %q, want the smtp credentials", auth)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("%d messages, want 1", len(messages))
+	}
+	// undo the soft line breaks of quoted-printable
+	message := strings.ReplaceAll(messages[0], "=\r\n", "")
+
+	for _, want := range []string{
+		"To: ops@example.org",
+		"Subject: [FIRING] <edge>: packet loss above 5%",
+		"Content-Type: text/html",
+		"&lt;edge&gt;",
+		"https://guardian.example.org/alerts/1",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message doesn't contain %q:\n%s", want, message)
+		}
+	}
+	if i := strings.Index(message, "Content-Type: text/html"); i >= 0 && strings.Contains(message[i:], "<edge>") {
+		t.Errorf("agent name isn't escaped in the html body:\n%s", message[i:])
+	}
+}
+
+func TestAlertEmailRejected(t *testing.T) {
+	// the refusal is reported, the queue sends the job again while attempts remain
+	server := newSMTPStandIn(t, "451 try again later")
+	es := NewEmailService(nil, EmailConfig{SMTPHost: "127.0.0.1", SMTPPort: server.port(), FromEmail: "alerts@example.org"})
+
+	if err := es.sendEmail(alertJob(es)); err == nil {
+		t.Errorf("sending succeeded although the relay refused the message")
+	}
+	if _, messages := server.got(); len(messages) != 0 {
+		t.Errorf("%d messages accepted, want none", len(messages))
+	}
+}
+
+func TestEmailJobStatus(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     string
+	}{
+		{1, "pending"},
+		{maxEmailAttempts - 1, "pending"},
+		{maxEmailAttempts, "failed"},
+	}
+
+	for _, tt := range tests {
+		if got := emailJobStatus(tt.attempts); got != tt.want {
+			t.Errorf("emailJobStatus(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
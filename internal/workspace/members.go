@@ -21,8 +21,9 @@ const (
 )
 
 type Member struct {
-	User primitive.ObjectID `bson:"user" json:"user"`
-	Role Role               `bson:"role" json:"role"`
+	User         primitive.ObjectID `bson:"user" json:"user"`
+	Role         Role               `bson:"role" json:"role"`
+	OptOutAlerts bool               `bson:"optOutAlerts" json:"optOutAlerts"` // member won't receive alert emails for the site
 	// roles: 0=READ ONLY, 1=READ-WRITE (Create only), 2=ADMIN (Delete Agents), 3=OWNER (Delete Sites)
 	// ADMINS can regenerate agent pins
 }
@@ -47,6 +48,8 @@ type MemberInfo struct {
 	LastName  string             `bson:"lastName"json:"lastName"`
 	Role      Role               `bson:"role"json:"role"`
 	ID        primitive.ObjectID `json:"id"bson:"_id"`
+
+	OptOutAlerts bool `bson:"-" json:"optOutAlerts"`
 }
 
 // UpdateMemberRole updates the role of a member in the site and the database
@@ -97,6 +100,7 @@ func (s *Workspace) GetMemberInfos(db *mongo.Database) ([]MemberInfo, error) {
 			log.Error(err)
 		}
 		memberInfo.Role = role
+		memberInfo.OptOutAlerts = s.HasOptedOutOfAlerts(memberInfo.ID)
 		memberInfos = append(memberInfos, memberInfo)
 	}
 
@@ -181,3 +185,40 @@ func (s *Workspace) RemoveMember(id primitive.ObjectID, db *mongo.Database) erro
 	}
 	return nil
 }
+
+// HasOptedOutOfAlerts reports if the member turned off alert emails for the site
+func (s *Workspace) HasOptedOutOfAlerts(memberID primitive.ObjectID) bool {
+	for _, member := range s.Members {
+		if member.User == memberID {
+			return member.OptOutAlerts
+		}
+	}
+	return false
+}
+
+// SetAlertOptOut turns alert emails for the member on or off
+func (s *Workspace) SetAlertOptOut(memberID primitive.ObjectID, optOut bool, db *mongo.Database) error {
+	found := false
+	for i, member := range s.Members {
+		if member.User == memberID {
+			s.Members[i].OptOutAlerts = optOut
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return errors.New("member not found")
+	}
+
+	_, err := db.Collection("sites").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": s.ID, "members.user": memberID},
+		bson.M{"$set": bson.M{"members.$.optOutAlerts": optOut}},
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
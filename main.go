@@ -1,12 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/joho/godotenv"
 	"github.com/kataras/iris/v12"
 	log "github.com/sirupsen/logrus"
 	"nw-guardian/internal"
 	"nw-guardian/internal/agent"
+	"nw-guardian/internal/handlers"
+	"nw-guardian/internal/notifications"
+	"nw-guardian/internal/telemetry"
+	"nw-guardian/internal/users"
 	"nw-guardian/web"
 	"nw-guardian/workers"
 	"os"
@@ -18,6 +23,10 @@ import (
 func main() {
 	var err error
 
+	migrateProbeData := flag.Bool("migrate-probe-data", false, "migrate probe_data to a time-series collection and exit")
+	ensureIndexes := flag.Bool("ensure-indexes", false, "create the missing indexes, report the ones that drifted and exit")
+	flag.Parse()
+
 	runtime.GOMAXPROCS(4)
 
 	log.SetFormatter(&log.TextFormatter{})
@@ -28,21 +37,70 @@ func main() {
 		log.Error(err)
 	}
 
+	// opentelemetry export, before connecting so the mongo commands are traced
+	if telemetryConfig, ok := telemetry.ConfigFromEnv(); ok {
+		telemetry.Init(telemetryConfig)
+	}
+
 	// connect to database
 	database := internal.DatabaseConnection{
-		URI:    os.Getenv("MONGO_URI"),
-		DB:     os.Getenv("MAIN_DB"),
-		Logger: log.New(),
+		URI:     os.Getenv("MONGO_URI"),
+		DB:      os.Getenv("MAIN_DB"),
+		Logger:  log.New(),
+		Monitor: telemetry.CommandMonitor(),
 	}
 
 	database.Connect()
 
+	err = agent.CheckServerVersion(database.MongoDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *migrateProbeData {
+		err = agent.MigrateProbeData(database.MongoDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err = agent.EnsureProbeDataCollection(database.MongoDB)
+	if err != nil {
+		log.Error(err)
+	}
+
+	// probe_data has to exist first, creating an index would create it as a regular collection
+	_, err = internal.EnsureIndexes(database.MongoDB)
+	if *ensureIndexes {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err != nil {
+		log.Error(err)
+	}
+
 	handleSignals()
 
 	// TODO load routes for main API (primarily front end, & agent auth?)
 	r := web.NewRouter(database.MongoDB)
-	r.ProbeDataChan = make(chan agent.ProbeData)
-	workers.CreateProbeDataWorker(r.ProbeDataChan, r.DB)
+	r.Notifier = notifications.NewDispatcher(r.DB)
+	if emailConfig, ok := users.EmailConfigFromEnv(); ok {
+		r.Notifier.Email = users.NewEmailService(r.DB, emailConfig)
+		r.Notifier.Email.Start()
+	} else {
+		log.Warn("SMTP_HOST is not set, alert emails are disabled")
+	}
+	alertEngine := handlers.NewAlertEngine(r.DB, r.Notifier)
+	r.Notifier.Release = alertEngine.Flaps.Release
+	r.Ingest = handlers.NewProbeDataPipeline(r.DB, alertEngine)
+	workers.CreateProbeDataWorker(r.Ingest)
+	telemetry.ExportMetrics(r.Ingest.Metrics)
+	workers.CreateAgentWatchdogWorker(handlers.NewAgentWatchdog(r.DB, r.Notifier, alertEngine.Flaps))
+	workers.CreateEscalationWorker(r.Notifier)
+	workers.CreateRetentionWorker(r.DB)
 
 	crs := func(ctx iris.Context) {
 		ctx.Header("Access-Control-Allow-Origin", "*")
@@ -39,7 +39,7 @@ func addRouteAgentAPI(r *Router) []*Route {
 			}
 
 			a := agent.Agent{ID: hex}
-			err = a.UpdateTimestamp(r.DB)
+			err = a.UpdateTimestamp(ctx.Request().Context(), r.DB)
 			if err != nil {
 				log.Error(err)
 			}
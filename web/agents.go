@@ -246,5 +246,37 @@ func addRouteAgents(r *Router) []*Route {
 		Type: RouteType_GET,
 	})
 
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Agent Events",
+		Path: "/agents/{agentid}/events",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			aId, err := primitive.ObjectIDFromHex(params.Get("agentid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			events, err := agent.GetAgentEvents(r.DB, aId, ctx.URLParamInt64Default("limit", 100))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(events)
+		},
+		Type: RouteType_GET,
+	})
+
 	return tempRoutes
 }
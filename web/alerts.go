@@ -0,0 +1,409 @@
+package web
+
+import (
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/handlers"
+	"nw-guardian/internal/notifications"
+	"strings"
+)
+
+func addRouteAlerts(r *Router) []*Route {
+	var tempRoutes []*Route
+
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Alert Metrics",
+		Path: "/alerts/metrics",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(agent.MetricKeys)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Probe Baselines",
+		Path: "/alerts/baselines/{probeid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			pId, err := primitive.ObjectIDFromHex(params.Get("probeid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			baselines, err := handlers.GetBaselines(r.DB, pId)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(baselines)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "New Alert Rule",
+		Path: "/alerts/rules/new/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			rule := handlers.AlertRule{}
+			err = ctx.ReadJSON(&rule)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			rule.Site = sId
+
+			err = rule.Create(r.DB)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			return ctx.JSON(rule)
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Alert Rules for Workspace",
+		Path: "/alerts/rules/site/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			rules, err := handlers.GetRulesForSite(r.DB, sId)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(rules)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Update Alert Rule",
+		Path: "/alerts/rules/update/{ruleid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			rId, err := primitive.ObjectIDFromHex(params.Get("ruleid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			rule := handlers.AlertRule{}
+			err = ctx.ReadJSON(&rule)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			rule.ID = rId
+
+			err = rule.Update(r.DB)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			ctx.StatusCode(http.StatusOK)
+			return nil
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Delete Alert Rule",
+		Path: "/alerts/rules/delete/{ruleid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			rId, err := primitive.ObjectIDFromHex(params.Get("ruleid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			rule := handlers.AlertRule{ID: rId}
+			err = rule.Delete(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			ctx.StatusCode(http.StatusOK)
+			return nil
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Alerts for Workspace",
+		Path: "/alerts/site/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			filter, err := readAlertFilter(ctx)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			alerts, err := agent.GetAlerts(r.DB, sId, filter)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(alerts)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Alerts for Agent",
+		Path: "/alerts/agent/{agentid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			aId, err := primitive.ObjectIDFromHex(params.Get("agentid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			filter, err := readAlertFilter(ctx)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			filter.Agent = aId
+
+			alerts, err := agent.GetAlerts(r.DB, primitive.NilObjectID, filter)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(alerts)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Alert",
+		Path: "/alerts/{alertid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			aId, err := primitive.ObjectIDFromHex(params.Get("alertid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			alert := agent.ProbeAlert{ID: aId}
+			err = alert.Get(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusNotFound)
+				return nil
+			}
+
+			return ctx.JSON(alert)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Acknowledge Alert",
+		Path: "/alerts/{alertid}/acknowledge",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			aId, err := primitive.ObjectIDFromHex(params.Get("alertid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			alert := agent.ProbeAlert{ID: aId}
+			err = alert.Acknowledge(r.DB, t.ID)
+			if err != nil {
+				ctx.StatusCode(http.StatusConflict)
+				return nil
+			}
+			r.Notifier.Dispatch(notifications.EventType_ALERT_ACKNOWLEDGED, &alert)
+
+			return ctx.JSON(alert)
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Resolve Alert",
+		Path: "/alerts/{alertid}/resolve",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			aId, err := primitive.ObjectIDFromHex(params.Get("alertid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			alert := agent.ProbeAlert{ID: aId}
+			err = alert.Resolve(r.DB, t.ID)
+			if err != nil {
+				ctx.StatusCode(http.StatusConflict)
+				return nil
+			}
+			r.Ingest.Engine.Flaps.Release(alert.ID)
+			r.Notifier.Dispatch(notifications.EventType_ALERT_RESOLVED, &alert)
+
+			return ctx.JSON(alert)
+		},
+		Type: RouteType_POST,
+	})
+
+	return tempRoutes
+}
+
+// readAlertFilter builds the alert filter from the url params (?status=FIRING,ACKNOWLEDGED&probe=&limit=)
+func readAlertFilter(ctx iris.Context) (agent.AlertFilter, error) {
+	filter := agent.AlertFilter{}
+
+	if status := ctx.URLParam("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			filter.Status = append(filter.Status, agent.AlertStatus(strings.ToUpper(strings.TrimSpace(s))))
+		}
+	}
+
+	if probe := ctx.URLParam("probe"); probe != "" {
+		pId, err := primitive.ObjectIDFromHex(probe)
+		if err != nil {
+			return filter, err
+		}
+		filter.Probe = pId
+	}
+
+	filter.Limit = ctx.URLParamInt64Default("limit", 0)
+
+	return filter, nil
+}
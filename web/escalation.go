@@ -0,0 +1,161 @@
+package web
+
+import (
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"nw-guardian/internal/notifications"
+)
+
+func addRouteEscalation(r *Router) []*Route {
+	var tempRoutes []*Route
+
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "New Escalation Policy",
+		Path: "/escalation/new/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			policy := notifications.EscalationPolicy{}
+			err = ctx.ReadJSON(&policy)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			policy.Site = sId
+
+			err = policy.Create(r.DB)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			return ctx.JSON(policy)
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Escalation Policies for Workspace",
+		Path: "/escalation/site/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			policies, err := notifications.GetEscalationPoliciesForSite(r.DB, sId)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(policies)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Update Escalation Policy",
+		Path: "/escalation/update/{policyid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			pId, err := primitive.ObjectIDFromHex(params.Get("policyid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			policy := notifications.EscalationPolicy{}
+			err = ctx.ReadJSON(&policy)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			policy.ID = pId
+
+			err = policy.Update(r.DB)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			ctx.StatusCode(http.StatusOK)
+			return nil
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Delete Escalation Policy",
+		Path: "/escalation/delete/{policyid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			pId, err := primitive.ObjectIDFromHex(params.Get("policyid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			policy := notifications.EscalationPolicy{ID: pId}
+			err = policy.Delete(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			ctx.StatusCode(http.StatusOK)
+			return nil
+		},
+		Type: RouteType_GET,
+	})
+
+	return tempRoutes
+}
@@ -0,0 +1,112 @@
+package web
+
+import (
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"nw-guardian/internal/agent"
+	"strings"
+	"time"
+)
+
+func addRouteExport(r *Router) []*Route {
+	var tempRoutes []*Route
+
+	// the scopes of the exports, the id of the path param is set on the export
+	scopes := []struct {
+		name  string
+		param string
+		set   func(e *agent.ProbeDataExport, id primitive.ObjectID)
+	}{
+		{"probe", "probeid", func(e *agent.ProbeDataExport, id primitive.ObjectID) { e.Probe = id }},
+		{"agent", "agentid", func(e *agent.ProbeDataExport, id primitive.ObjectID) { e.Agent = id }},
+		{"site", "siteid", func(e *agent.ProbeDataExport, id primitive.ObjectID) { e.Site = id }},
+	}
+
+	for _, s := range scopes {
+		s := s
+		tempRoutes = append(tempRoutes, &Route{
+			Name: "Export Probe Data by " + s.name,
+			Path: "/export/" + s.name + "/{" + s.param + "}",
+			JWT:  true,
+			Func: func(ctx iris.Context) error {
+				t := GetClaims(ctx)
+				_, err := t.FromID(r.DB)
+				if err != nil {
+					ctx.StatusCode(http.StatusInternalServerError)
+					return nil
+				}
+
+				params := ctx.Params()
+
+				id, err := primitive.ObjectIDFromHex(params.Get(s.param))
+				if err != nil {
+					ctx.StatusCode(http.StatusInternalServerError)
+					return nil
+				}
+
+				export, err := readExportRequest(ctx)
+				if err != nil {
+					ctx.StatusCode(http.StatusBadRequest)
+					return nil
+				}
+				s.set(&export, id)
+
+				if err = export.Validate(); err != nil {
+					ctx.StatusCode(http.StatusBadRequest)
+					return ctx.JSON(iris.Map{"error": err.Error()})
+				}
+
+				filename := "probe_data_" + s.name + "_" + id.Hex() + "." + string(export.Format)
+				if export.Format == agent.ExportFormat_CSV {
+					ctx.ContentType("text/csv")
+				} else {
+					ctx.ContentType("application/x-ndjson")
+				}
+				ctx.Header("Content-Disposition", "attachment; filename=\""+filename+"\"")
+
+				// errors past this point can't change the status anymore, the export is already streaming
+				err = export.Write(r.DB, ctx.ResponseWriter())
+				if err != nil {
+					log.Error(err)
+				}
+				return nil
+			},
+			Type: RouteType_GET,
+		})
+	}
+
+	return tempRoutes
+}
+
+// readExportRequest builds the export from the url params (?from=&to=&types=PING,MTR&format=csv), times are
+// RFC3339, from defaults to the last 24 hours and the format to ndjson
+func readExportRequest(ctx iris.Context) (agent.ProbeDataExport, error) {
+	export := agent.ProbeDataExport{
+		From:   time.Now().Add(-24 * time.Hour),
+		Format: agent.ExportFormat(strings.ToLower(ctx.URLParamDefault("format", string(agent.ExportFormat_NDJSON)))),
+	}
+
+	var err error
+	if from := ctx.URLParam("from"); from != "" {
+		export.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return export, err
+		}
+	}
+	if to := ctx.URLParam("to"); to != "" {
+		export.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return export, err
+		}
+	}
+
+	if types := ctx.URLParam("types"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			export.Types = append(export.Types, agent.ProbeType(strings.ToUpper(strings.TrimSpace(t))))
+		}
+	}
+
+	return export, nil
+}
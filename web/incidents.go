@@ -0,0 +1,181 @@
+package web
+
+import (
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"nw-guardian/internal/agent"
+	"nw-guardian/internal/notifications"
+)
+
+// incidentDetails is an incident along with its alerts
+type incidentDetails struct {
+	notifications.Incident
+	AlertList []agent.ProbeAlert `json:"alertList"`
+}
+
+func addRouteIncidents(r *Router) []*Route {
+	var tempRoutes []*Route
+
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Incidents for Workspace",
+		Path: "/incidents/site/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			// ?status=OPEN&limit=
+			incidents, err := notifications.GetIncidentsForSite(r.DB, sId, notifications.IncidentStatus(ctx.URLParam("status")), ctx.URLParamInt64Default("limit", 100))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(incidents)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Incident",
+		Path: "/incidents/{incidentid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			iId, err := primitive.ObjectIDFromHex(params.Get("incidentid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			incident := notifications.Incident{ID: iId}
+			err = incident.Get(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusNotFound)
+				return nil
+			}
+
+			alerts, err := agent.GetIncidentAlerts(r.DB, iId, false)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(incidentDetails{Incident: incident, AlertList: alerts})
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Acknowledge Incident",
+		Path: "/incidents/{incidentid}/acknowledge",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			iId, err := primitive.ObjectIDFromHex(params.Get("incidentid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			incident := notifications.Incident{ID: iId}
+			err = incident.Get(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusNotFound)
+				return nil
+			}
+
+			if incident.Status != notifications.IncidentStatus_OPEN {
+				ctx.StatusCode(http.StatusConflict)
+				return nil
+			}
+
+			err = r.Notifier.AcknowledgeIncident(&incident, t.ID)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(incident)
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Resolve Incident",
+		Path: "/incidents/{incidentid}/resolve",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			iId, err := primitive.ObjectIDFromHex(params.Get("incidentid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			incident := notifications.Incident{ID: iId}
+			err = incident.Get(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusNotFound)
+				return nil
+			}
+
+			if incident.Status == notifications.IncidentStatus_RESOLVED {
+				ctx.StatusCode(http.StatusConflict)
+				return nil
+			}
+
+			err = r.Notifier.ResolveIncident(&incident, t.ID)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(incident)
+		},
+		Type: RouteType_POST,
+	})
+
+	return tempRoutes
+}
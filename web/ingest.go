@@ -0,0 +1,30 @@
+package web
+
+import (
+	"github.com/kataras/iris/v12"
+	"net/http"
+)
+
+func addRouteIngest(r *Router) []*Route {
+	var tempRoutes []*Route
+
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Ingest Stats",
+		Path: "/ingest/stats",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(r.Ingest.Stats())
+		},
+		Type: RouteType_GET,
+	})
+
+	return tempRoutes
+}
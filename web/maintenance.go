@@ -0,0 +1,193 @@
+package web
+
+import (
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"nw-guardian/internal/handlers"
+	"time"
+)
+
+func addRouteMaintenance(r *Router) []*Route {
+	var tempRoutes []*Route
+
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "New Maintenance Window",
+		Path: "/maintenance/new/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			window := handlers.MaintenanceWindow{}
+			err = ctx.ReadJSON(&window)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			window.Site = sId
+
+			err = window.Create(r.DB)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			return ctx.JSON(window)
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Maintenance Windows for Workspace",
+		Path: "/maintenance/site/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			windows, err := handlers.GetMaintenanceWindowsForSite(r.DB, sId)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(windows)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Active Maintenance Windows for Workspace",
+		Path: "/maintenance/site/{siteid}/active",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			windows, err := handlers.GetActiveMaintenanceWindows(r.DB, sId, time.Now())
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(windows)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Update Maintenance Window",
+		Path: "/maintenance/update/{windowid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			wId, err := primitive.ObjectIDFromHex(params.Get("windowid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			window := handlers.MaintenanceWindow{}
+			err = ctx.ReadJSON(&window)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			window.ID = wId
+
+			err = window.Update(r.DB)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			ctx.StatusCode(http.StatusOK)
+			return nil
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Delete Maintenance Window",
+		Path: "/maintenance/delete/{windowid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			wId, err := primitive.ObjectIDFromHex(params.Get("windowid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			window := handlers.MaintenanceWindow{ID: wId}
+			err = window.Delete(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			ctx.StatusCode(http.StatusOK)
+			return nil
+		},
+		Type: RouteType_GET,
+	})
+
+	return tempRoutes
+}
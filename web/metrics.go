@@ -0,0 +1,48 @@
+package web
+
+import (
+	"crypto/subtle"
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+)
+
+func addRouteMetrics(r *Router) []*Route {
+	var tempRoutes []*Route
+
+	// scrapers can't log in, the endpoint is protected by METRICS_TOKEN instead of a session. It is disabled
+	// without a token unless METRICS_PUBLIC=true, the gauges expose the agents & targets of every workspace
+	token := os.Getenv("METRICS_TOKEN")
+	public := os.Getenv("METRICS_PUBLIC") == "true"
+	if token == "" && public {
+		log.Warn("METRICS_TOKEN is not set and METRICS_PUBLIC is true, /metrics is public")
+	} else if token == "" {
+		log.Warn("METRICS_TOKEN is not set, /metrics is disabled")
+	}
+
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Prometheus Metrics",
+		Path: "/metrics",
+		JWT:  false,
+		Func: func(ctx iris.Context) error {
+			if token == "" && !public {
+				ctx.StatusCode(http.StatusNotFound)
+				return nil
+			}
+			if token != "" {
+				auth := ctx.GetHeader("Authorization")
+				if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+					ctx.StatusCode(http.StatusUnauthorized)
+					return nil
+				}
+			}
+
+			ctx.ContentType("text/plain; version=0.0.4")
+			return r.Ingest.Metrics.Write(ctx.ResponseWriter())
+		},
+		Type: RouteType_GET,
+	})
+
+	return tempRoutes
+}
@@ -0,0 +1,283 @@
+package web
+
+import (
+	"github.com/kataras/iris/v12"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"nw-guardian/internal/notifications"
+)
+
+func addRouteNotifications(r *Router) []*Route {
+	var tempRoutes []*Route
+
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "New Notification Channel",
+		Path: "/notifications/channels/new/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			ch := notifications.Channel{}
+			err = ctx.ReadJSON(&ch)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			ch.Site = sId
+			generated := ch.Secret == ""
+
+			err = ch.Create(r.DB)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			// secrets & keys are write only, a generated secret is shown once as it is needed to verify the
+			// webhook signatures & inbound updates
+			if !generated {
+				ch.Secret = ""
+			}
+			ch.Key = ""
+			return ctx.JSON(ch)
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Notification Channels for Workspace",
+		Path: "/notifications/channels/site/{siteid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			sId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			channels, err := notifications.GetChannelsForSite(r.DB, sId, false)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			// secrets & keys are write only
+			for i := range channels {
+				channels[i].Secret = ""
+				channels[i].Key = ""
+			}
+
+			return ctx.JSON(channels)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Update Notification Channel",
+		Path: "/notifications/channels/update/{channelid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			cId, err := primitive.ObjectIDFromHex(params.Get("channelid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			ch := notifications.Channel{}
+			err = ctx.ReadJSON(&ch)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+			ch.ID = cId
+
+			err = ch.Update(r.DB)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			ctx.StatusCode(http.StatusOK)
+			return nil
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Delete Notification Channel",
+		Path: "/notifications/channels/delete/{channelid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			cId, err := primitive.ObjectIDFromHex(params.Get("channelid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			ch := notifications.Channel{ID: cId}
+			err = ch.Delete(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			ctx.StatusCode(http.StatusOK)
+			return nil
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Test Notification Channel",
+		Path: "/notifications/channels/{channelid}/test",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			cId, err := primitive.ObjectIDFromHex(params.Get("channelid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			ch := notifications.Channel{ID: cId}
+			err = ch.Get(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusNotFound)
+				return nil
+			}
+
+			delivery, err := r.Notifier.Test(&ch)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(delivery)
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Inbound Incident Update",
+		Path: "/notifications/channels/{channelid}/inbound",
+		JWT:  false,
+		Func: func(ctx iris.Context) error {
+			// called by pagerduty / opsgenie webhooks, authenticated with ?token=<channel secret>
+			ctx.ContentType("application/json") // "Application/json"
+			params := ctx.Params()
+
+			cId, err := primitive.ObjectIDFromHex(params.Get("channelid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			ch := notifications.Channel{ID: cId}
+			err = ch.Get(r.DB)
+			if err != nil || !ch.VerifyInbound(ctx.URLParam("token")) {
+				ctx.StatusCode(http.StatusUnauthorized)
+				return nil
+			}
+
+			body, err := ctx.GetBody()
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			alerts, err := r.Notifier.SyncIncident(&ch, body)
+			if err != nil {
+				log.Warn(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			return ctx.JSON(alerts)
+		},
+		Type: RouteType_POST,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Notification Deliveries",
+		Path: "/notifications/channels/{channelid}/deliveries",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			cId, err := primitive.ObjectIDFromHex(params.Get("channelid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			deliveries, err := notifications.GetDeliveries(r.DB, cId, ctx.URLParamInt64Default("limit", 100))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(deliveries)
+		},
+		Type: RouteType_GET,
+	})
+
+	return tempRoutes
+}
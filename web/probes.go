@@ -8,6 +8,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"nw-guardian/internal/agent"
+	"strings"
+	"time"
 )
 
 func addRouteProbes(r *Router) []*Route {
@@ -442,22 +444,30 @@ func addRouteProbes(r *Router) []*Route {
 				// Check format parameter
 				format := ctx.URLParam("format")
 
+				// the cursor applies to the query, every format pages the same way and returns the
+				// cursor of the next page along with the data when paginate is set
 				switch format {
 				case "flat":
 					// Return flat array format
-					data, err := pp[0].GetAgentProbeDataFlat(&req, r.DB)
+					data, err := pp[0].GetAgentProbeDataGrouped(&req, r.DB)
 					if err != nil {
 						return err
 					}
-					return ctx.JSON(data)
+					if req.Paginate {
+						return ctx.JSON(agent.AgentProbeDataFlatPage{Data: data.Flat(), NextCursor: data.NextCursor})
+					}
+					return ctx.JSON(data.Flat())
 
 				case "simple":
 					// Return simple map format (type -> data)
-					data, err := pp[0].GetAgentProbeData(&req, r.DB)
+					data, err := pp[0].GetAgentProbeDataGrouped(&req, r.DB)
 					if err != nil {
 						return err
 					}
-					return ctx.JSON(data)
+					if req.Paginate {
+						return ctx.JSON(agent.AgentProbeDataSimplePage{Data: data.ByType(), NextCursor: data.NextCursor})
+					}
+					return ctx.JSON(data.ByType())
 
 				default:
 					// Return full grouped format (default for AGENT probes)
@@ -469,6 +479,16 @@ func addRouteProbes(r *Router) []*Route {
 				}
 			}
 
+			// the page is returned with the cursor of the next one, the data alone otherwise
+			if req.Paginate {
+				page, err := pp[0].GetDataPage(&req, r.DB)
+				if err != nil {
+					ctx.StatusCode(http.StatusBadRequest)
+					return nil
+				}
+				return ctx.JSON(page)
+			}
+
 			// Original behavior for non-AGENT probes
 			get, err := pp[0].GetData(&req, r.DB)
 			if err != nil {
@@ -584,5 +604,170 @@ func addRouteProbes(r *Router) []*Route {
 		},
 		Type: RouteType_POST,
 	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get MTR Route Versions",
+		Path: "/probes/routes/{probeid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			pId, err := primitive.ObjectIDFromHex(params.Get("probeid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			versions, err := agent.GetRouteVersions(r.DB, pId, ctx.URLParam("target"), ctx.URLParamInt64Default("limit", 50))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(versions)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get MTR Route Changes",
+		Path: "/probes/routes/{probeid}/changes",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			pId, err := primitive.ObjectIDFromHex(params.Get("probeid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			changes, err := agent.GetRouteChanges(r.DB, pId, ctx.URLParam("target"), ctx.URLParamInt64Default("limit", 50))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(changes)
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Probe Rollups",
+		Path: "/probes/rollups/{probeid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			pId, err := primitive.ObjectIDFromHex(params.Get("probeid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			req, err := readRollupRequest(ctx)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			rollups, resolution, err := agent.GetRollups(r.DB, pId, req)
+			if err != nil {
+				log.Error(err)
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			return ctx.JSON(struct {
+				Resolution agent.RollupResolution `json:"resolution"`
+				Rollups    []agent.Rollup         `json:"rollups"`
+			}{resolution, rollups})
+		},
+		Type: RouteType_GET,
+	})
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Get Quarantined Probe Data",
+		Path: "/probes/quarantine/{probeid}",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+			ctx.ContentType("application/json") // "Application/json"
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+
+			pId, err := primitive.ObjectIDFromHex(params.Get("probeid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			quarantined, err := agent.GetQuarantinedProbeData(r.DB, pId, ctx.URLParamInt64Default("limit", 50))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			return ctx.JSON(quarantined)
+		},
+		Type: RouteType_GET,
+	})
 	return tempRoutes
 }
+
+// readRollupRequest builds the rollup request from the url params
+// (?from=&to=&resolution=auto&target=&metrics=PingResult.AvgRtt,PingResult.PacketLoss), times are RFC3339
+func readRollupRequest(ctx iris.Context) (agent.RollupRequest, error) {
+	req := agent.RollupRequest{
+		Resolution: agent.RollupResolution(ctx.URLParam("resolution")),
+		Target:     ctx.URLParam("target"),
+	}
+
+	var err error
+	if from := ctx.URLParam("from"); from != "" {
+		req.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return req, err
+		}
+	}
+	if to := ctx.URLParam("to"); to != "" {
+		req.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return req, err
+		}
+	}
+
+	if metrics := ctx.URLParam("metrics"); metrics != "" {
+		for _, m := range strings.Split(metrics, ",") {
+			req.Metrics = append(req.Metrics, strings.TrimSpace(m))
+		}
+	}
+
+	return req, nil
+}
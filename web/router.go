@@ -6,7 +6,8 @@ import (
 	"github.com/kataras/neffos"
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/mongo"
-	"nw-guardian/internal/agent"
+	"nw-guardian/internal/handlers"
+	"nw-guardian/internal/notifications"
 )
 
 type Router struct {
@@ -14,7 +15,8 @@ type Router struct {
 	DB              *mongo.Database
 	Routes          []*Route
 	WebSocketServer *neffos.Server
-	ProbeDataChan   chan agent.ProbeData
+	Ingest          *handlers.ProbeDataPipeline
+	Notifier        *notifications.Dispatcher
 }
 
 func NewRouter(mongoDB *mongo.Database) *Router {
@@ -36,12 +38,23 @@ func (r *Router) Init() {
 	log.Info("Loading Agent Websocket Route...")
 
 	r.App.Use(ProxyIPMiddleware)
+	r.App.Use(TracingMiddleware)
 
 	r.Routes = append(r.Routes, addRouteAuth(r)...)
 	r.Routes = append(r.Routes, addRouteAgents(r)...)
 	r.Routes = append(r.Routes, addRouteSites(r)...)
 	r.Routes = append(r.Routes, addRouteAgentAPI(r)...)
 	r.Routes = append(r.Routes, addRouteProbes(r)...)
+	r.Routes = append(r.Routes, addRouteAlerts(r)...)
+	r.Routes = append(r.Routes, addRouteNotifications(r)...)
+	r.Routes = append(r.Routes, addRouteMaintenance(r)...)
+	r.Routes = append(r.Routes, addRouteEscalation(r)...)
+	r.Routes = append(r.Routes, addRouteIncidents(r)...)
+	r.Routes = append(r.Routes, addRouteRetention(r)...)
+	r.Routes = append(r.Routes, addRouteIngest(r)...)
+	r.Routes = append(r.Routes, addRouteExport(r)...)
+	r.Routes = append(r.Routes, addRouteMetrics(r)...)
+	r.Routes = append(r.Routes, addRouteSinks(r)...)
 
 	log.Info("Loading all routes...")
 	log.Infof("Found %d route(s).", len(r.Routes))
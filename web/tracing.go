@@ -0,0 +1,64 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/websocket"
+	"net/http"
+	"nw-guardian/internal/telemetry"
+)
+
+// TracingMiddleware traces the requests as server spans, joining the trace of the caller when it sent a traceparent
+func TracingMiddleware(ctx iris.Context) {
+	route := ctx.Path()
+	if current := ctx.GetCurrentRoute(); current != nil {
+		// the template keeps the ids out of the span names
+		route = current.Path()
+	}
+
+	parent := telemetry.ContextWithTraceParent(ctx.Request().Context(), ctx.GetHeader("traceparent"))
+	spanCtx, span := telemetry.Start(parent, ctx.Method()+" "+route, telemetry.SpanKind_SERVER)
+	if span == nil {
+		ctx.Next()
+		return
+	}
+	defer span.End()
+
+	span.SetAttribute("http.request.method", ctx.Method())
+	span.SetAttribute("http.route", route)
+	span.SetAttribute("url.path", ctx.Path())
+	span.SetAttribute("client.address", ctx.Values().GetString("client_ip"))
+	span.SetAttribute("user_agent.original", ctx.GetHeader("User-Agent"))
+
+	ctx.ResetRequest(ctx.Request().WithContext(spanCtx))
+	ctx.Next()
+
+	status := ctx.GetStatusCode()
+	span.SetAttribute("http.response.status_code", status)
+	if status >= http.StatusInternalServerError {
+		span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+	}
+}
+
+// tracedEventHandler is a websocket event handler given the context of the span of the event
+type tracedEventHandler func(ctx context.Context, nsConn *websocket.NSConn, msg websocket.Message) error
+
+// tracedEvent traces the websocket event handler as a server span, the queries the handler runs with ctx are part of it
+func tracedEvent(event string, handler tracedEventHandler) websocket.MessageHandlerFunc {
+	return func(nsConn *websocket.NSConn, msg websocket.Message) error {
+		ctx, span := telemetry.Start(context.Background(), "ws "+event, telemetry.SpanKind_SERVER)
+		if span == nil {
+			return handler(ctx, nsConn, msg)
+		}
+		defer span.End()
+
+		span.SetAttribute("guardian.ws.event", event)
+		span.SetAttribute("guardian.ws.connection", nsConn.String())
+		span.SetAttribute("guardian.ws.body.size", len(msg.Body))
+
+		err := handler(ctx, nsConn, msg)
+		span.SetError(err)
+		return err
+	}
+}
@@ -249,6 +249,56 @@ func addRouteSites(r *Router) []*Route {
 		Type: RouteType_POST, // POST is used for updating data
 	})
 
+	tempRoutes = append(tempRoutes, &Route{
+		Name: "Update Alert Email Opt Out",
+		Path: "/sites/{siteid}/alert_emails",
+		JWT:  true,
+		Func: func(ctx iris.Context) error {
+
+			t := GetClaims(ctx)
+			_, err := t.FromID(r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			params := ctx.Params()
+			siteId, err := primitive.ObjectIDFromHex(params.Get("siteid"))
+			if err != nil {
+				ctx.StatusCode(http.StatusInternalServerError)
+				return nil
+			}
+
+			req := struct {
+				OptOut bool `json:"optOut"`
+			}{}
+
+			err = ctx.ReadJSON(&req)
+			if err != nil {
+				ctx.StatusCode(http.StatusBadRequest)
+				return nil
+			}
+
+			s := workspace.Workspace{ID: siteId}
+			err = s.Get(r.DB)
+			if err != nil {
+				return err
+			}
+
+			// members can only change their own preference
+			err = s.SetAlertOptOut(t.ID, req.OptOut, r.DB)
+			if err != nil {
+				ctx.StatusCode(http.StatusNotFound)
+				return nil
+			}
+
+			ctx.StatusCode(http.StatusOK)
+
+			return nil
+		},
+		Type: RouteType_POST,
+	})
+
 	tempRoutes = append(tempRoutes, &Route{
 		Name: "Add Member",
 		Path: "/sites/{siteid}/invite",
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/golang-jwt/jwt/v5"
@@ -85,26 +86,27 @@ func getWebsocketEvents(r *Router) websocket.Namespaces {
 				return nil
 			},
 			websocket.OnNamespaceDisconnect: func(nsConn *websocket.NSConn, msg websocket.Message) error {
-				// todo update agent status to be offline??
+				// agents are marked offline by the watchdog once the heart beat lapses, a disconnect
+				// on its own is usually just the agent reconnecting
 				log.Infof("[%s] disconnected from namespace [%s]", nsConn, msg.Namespace)
 				return nil
 			},
-			"probe_get": func(nsConn *websocket.NSConn, msg websocket.Message) error {
+			"probe_get": tracedEvent("probe_get", func(ctx context.Context, nsConn *websocket.NSConn, msg websocket.Message) error {
 				// room.String() returns -> NSConn.String() returns -> Conn.String() returns -> Conn.ID()
 				// log.Printf("[%s] sent: %s", nsConn, string(msg.Body))
 
-				session, err := auth.GetSessionFromWSConn(nsConn.String(), r.DB)
+				session, err := auth.GetSessionFromWSConn(ctx, nsConn.String(), r.DB)
 				if err != nil {
 					return err
 				}
 
 				a := agent.Agent{ID: session.ID}
-				err = a.Get(r.DB)
+				err = a.GetContext(ctx, r.DB)
 				if err != nil {
 					return err
 				}
 
-				err = a.UpdateTimestamp(r.DB)
+				err = a.UpdateTimestamp(ctx, r.DB)
 				if err != nil {
 					log.Error(err)
 				}
@@ -112,7 +114,7 @@ func getWebsocketEvents(r *Router) websocket.Namespaces {
 				probe := agent.Probe{Agent: session.ID}
 				// todo change this to build based on if the probe is an agent/group type probe
 				// todo add group type probes ?? or just use agent type probes for groups??
-				probes, err := probe.GetAllProbesForAgent(r.DB)
+				probes, err := probe.GetAllProbesForAgent(ctx, r.DB)
 				if err != nil {
 					log.Errorf(err.Error())
 				}
@@ -129,18 +131,18 @@ func getWebsocketEvents(r *Router) websocket.Namespaces {
 				// Write message to all except this client with:
 				//nsConn.Conn.Server().Broadcast(nsConn, msg)
 				return nil
-			},
-			"probe_post": func(nsConn *websocket.NSConn, msg websocket.Message) error {
+			}),
+			"probe_post": tracedEvent("probe_post", func(ctx context.Context, nsConn *websocket.NSConn, msg websocket.Message) error {
 				// room.String() returns -> NSConn.String() returns -> Conn.String() returns -> Conn.ID()
 				// log.Printf("[%s] sent: %s", nsConn, string(msg.Body))
 
-				session, err := auth.GetSessionFromWSConn(nsConn.String(), r.DB)
+				session, err := auth.GetSessionFromWSConn(ctx, nsConn.String(), r.DB)
 				if err != nil {
 					return err
 				}
 
 				a := agent.Agent{ID: session.ID}
-				err = a.Get(r.DB)
+				err = a.GetContext(ctx, r.DB)
 				if err != nil {
 					return err
 				}
@@ -153,7 +155,19 @@ func getWebsocketEvents(r *Router) websocket.Namespaces {
 					return err
 				}
 
-				r.ProbeDataChan <- data
+				err = r.Ingest.Enqueue(data, a.ID)
+				if reason, ok := err.(*agent.ProbeDataError); ok {
+					// the agent is told why the data was rejected instead of the connection erroring
+					reply, err := json.Marshal(reason)
+					if err != nil {
+						return err
+					}
+					nsConn.Emit("probe_error", reply)
+					return nil
+				}
+				if err != nil {
+					return err
+				}
 
 				/*probe := agent.Probe{Agent: session.ID}
 				probes, _ := probe.GetAll(r.DB)
@@ -165,7 +179,7 @@ func getWebsocketEvents(r *Router) websocket.Namespaces {
 				// Write message to all except this client with:
 				//nsConn.Conn.Server().Broadcast(nsConn, msg)
 				return nil
-			},
+			}),
 		},
 	}
 
@@ -0,0 +1,28 @@
+package workers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"nw-guardian/internal/handlers"
+	"time"
+)
+
+// CreateAgentWatchdogWorker checks the agent heart beats a few times per offline window
+func CreateAgentWatchdogWorker(watchdog *handlers.AgentWatchdog) {
+	interval := watchdog.Window / 4
+	if interval < 10*time.Second {
+		interval = 10 * time.Second
+	}
+
+	go func(w *handlers.AgentWatchdog) {
+		log.Infof("Starting agent watchdog worker, offline after %s...", w.Window)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := w.Check()
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}(watchdog)
+}
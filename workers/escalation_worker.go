@@ -0,0 +1,23 @@
+package workers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"nw-guardian/internal/notifications"
+	"time"
+)
+
+// CreateEscalationWorker periodically notifies the escalation steps of unacknowledged alerts once they are due
+func CreateEscalationWorker(d *notifications.Dispatcher) {
+	go func(dispatcher *notifications.Dispatcher) {
+		log.Info("Starting alert escalation worker...")
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			err := dispatcher.Escalate()
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}(d)
+}
@@ -2,105 +2,53 @@ package workers
 
 import (
 	log "github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/mongo"
 	"nw-guardian/internal/agent"
+	"nw-guardian/internal/handlers"
+	"time"
 )
 
-/*
-func Push2Loki(cd *agent.Data, db *mongo.Database) error {
-	// List of default labels which would be attached to every log message
-	agent := agent.Agent{ID: cd.AgentID}
-	err := agent.Get(db)
-	if err != nil {
-		return err
-	}
-
-	if agent.LokiDataPath == "" {
-		return errors.New("agent does not have loki data path set")
-	}
-
-	site2 := site.Site{ID: agent.Site}
-	err = site2.Get(db)
-	if err != nil {
-		return err
-	}
-
-	identifiers := map[string]string{
-		"agentName":   agent.Name,
-		"agentID":     agent.ID.Hex(),
-		"siteID":      agent.Site.Hex(),
-		"siteName":    site2.Name,
-		"checkType":   string(cd.Type),
-		"checkTarget": cd.Target,
-	}
-
-	promtailClient, err := promtail.NewJSONv1Client(agent.LokiDataPath, identifiers)
-	if err != nil {
-		return err
-	}
-	defer promtailClient.Close()
-
-	marshal, err := json.Marshal(cd)
-	if err != nil {
-		return err
-	}
-	str := strings.Replace(string(marshal), "%", "", -1)
-
-	promtailClient.LogfWithLabels(promtail.Info, identifiers, str)
-
-	return nil
-
-	/*customLabels := map[string]string{
-		"somethingSpecial": "right-here",
-	}
-		promtailClient.LogfWithLabels(promtail.Info, customLabels, "Still here")*/
-//}*/
-
-func CreateProbeDataWorker(c chan agent.ProbeData, db *mongo.Database) {
-	go func(cc chan agent.ProbeData) {
-		for {
-			data := <-cc
+// CreateProbeDataWorker starts the workers of the pipeline, each inserts its queue in batches of BatchSize,
+// flushing partial batches every FlushInterval
+func CreateProbeDataWorker(p *handlers.ProbeDataPipeline) {
+	log.Infof("Starting %d probe data workers...", p.Workers)
+
+	for i := 0; i < p.Workers; i++ {
+		go func(queue <-chan agent.ProbeData) {
+			ticker := time.NewTicker(p.FlushInterval)
+			defer ticker.Stop()
+
+			batch := make([]agent.ProbeData, 0, p.BatchSize)
+			for {
+				select {
+				case data := <-queue:
+					batch = append(batch, data)
+					if len(batch) < p.BatchSize {
+						continue
+					}
+				case <-ticker.C:
+					if len(batch) == 0 {
+						continue
+					}
+				}
 
-			err := data.Create(db)
-			if err != nil {
-				log.Error(err)
+				p.ProcessBatch(batch)
+				batch = make([]agent.ProbeData, 0, p.BatchSize)
 			}
-		}
-	}(c)
-}
+		}(p.Queue(i))
+	}
 
-/*func CreateCheckWorker(c chan agent.Data, db *mongo.Database) {
-	go func(cl chan agent.Data) {
-		log.Info("Starting check data creation worker...")
+	go func() {
 		for {
-			data := <-cl
-
-			// TODO send data directly to loki data path, and also add it to it's own DB :)
-
-			err := data.Create(db)
-			if err != nil {
+			time.Sleep(5 * time.Minute)
+			p.Probes.Prune()
+			p.Maintenance.Prune()
+			p.Agents.Prune()
+			if err := p.Engine.Prune(); err != nil {
 				log.Error(err)
 			}
-
-			if data.Type == agent.CtSpeedTest {
-				agentC := agent.Check{ID: data.CheckID}
-				_, err := agentC.Get(db)
-				if err != nil {
-					log.Error(err)
-					return
-				}
-				agentC.Pending = false
-				err = agentC.Update(db)
-				if err != nil {
-					log.Error(err)
-					return
-				}
-			}
-
-			err = Push2Loki(&data, db)
-			if err != nil {
+			if err := p.Metrics.Prune(p.DB); err != nil {
 				log.Error(err)
 			}
 		}
-	}(c)
-}*/
+	}()
+}
@@ -0,0 +1,35 @@
+package workers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"nw-guardian/internal/agent"
+	"time"
+)
+
+// CreateRetentionWorker prunes the probe data past the retention policies of the workspaces, the
+// expired rollups and the old quarantined probe data, every hour
+func CreateRetentionWorker(db *mongo.Database) {
+	go func(db *mongo.Database) {
+		log.Info("Starting probe data retention worker...")
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for ; true; <-ticker.C {
+			err := agent.PruneProbeData(db)
+			if err != nil {
+				log.Error(err)
+			}
+
+			err = agent.PruneRollups(db)
+			if err != nil {
+				log.Error(err)
+			}
+
+			err = agent.PruneQuarantine(db)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}(db)
+}